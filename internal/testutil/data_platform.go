@@ -0,0 +1,90 @@
+package testutil
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	SaveCustomerPath             = "/utility-project/ysCustomer/save"
+	queryUseTimeAndValidTimePath = "/utility-project/ysCustomer/queryUseTimeAndValidTime"
+)
+
+// DataPlatform answers every data platform call with success and records
+// the calls by path. It keeps the end of the memberships saved.
+type DataPlatform struct {
+	*httptest.Server
+	mu         sync.Mutex
+	calls      map[string][]string
+	validTimes map[string]string
+}
+
+func NewDataPlatform(t testing.TB) *DataPlatform {
+	p := &DataPlatform{calls: make(map[string][]string), validTimes: make(map[string]string)}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.calls[r.URL.Path] = append(p.calls[r.URL.Path], string(body))
+		switch r.URL.Path {
+		case SaveCustomerPath:
+			var customer struct {
+				UserName  string `json:"username"`
+				ValidTime string `json:"validTime"`
+			}
+			json.Unmarshal(body, &customer)
+			if len(customer.ValidTime) != 0 {
+				p.validTimes[customer.UserName] = customer.ValidTime
+			}
+		case queryUseTimeAndValidTimePath:
+			data, _ := json.Marshal(map[string]any{"code": 200, "data": map[string]any{"validTime": p.validTimes[r.URL.Query().Get("username")]}})
+			w.Write(data)
+			return
+		}
+		w.Write([]byte(`{"code":200}`))
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// Endpoint is the host:port the services are configured with.
+func (p *DataPlatform) Endpoint() string {
+	return strings.TrimPrefix(p.URL, "http://")
+}
+
+// Bodies returns the bodies of the calls of path so far.
+func (p *DataPlatform) Bodies(path string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.calls[path]...)
+}
+
+// SetValidTime sets the end of the membership of openid, as the platform
+// answers it.
+func (p *DataPlatform) SetValidTime(openid, validTime string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.validTimes[openid] = validTime
+}
+
+// WaitFor polls until the platform received a call of path whose body
+// contains want.
+func (p *DataPlatform) WaitFor(t testing.TB, path string, want string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, body := range p.Bodies(path) {
+			if strings.Contains(body, want) {
+				return
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no %s call with %s, got %v", path, want, p.Bodies(path))
+}
@@ -0,0 +1,80 @@
+// Package testutil holds the fixtures shared by the tests of several
+// packages. It is only imported by tests.
+package testutil
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// ER_LOCK_NOWAIT, a row read FOR UPDATE NOWAIT is locked by another transaction
+const mysqlErrLockNowait = 3572
+
+// DB creates a database of its own on the mysql server named by
+// GATEWAY_TEST_MYSQL_DSN, tests are skipped without one.
+func DB(t testing.TB) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("GATEWAY_TEST_MYSQL_DSN")
+	if len(dsn) == 0 {
+		t.Skip("GATEWAY_TEST_MYSQL_DSN not set")
+	}
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("parse GATEWAY_TEST_MYSQL_DSN: %v", err)
+	}
+	admin, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	name := fmt.Sprintf("gateway_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatalf("create database: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP DATABASE " + name) })
+	config.DBName = name
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// RequireRowLocks skips tests of concurrent transactions when the server of
+// db does not lock the rows read FOR UPDATE, as some in-memory stand-ins for
+// mysql do not.
+func RequireRowLocks(t testing.TB, db *sql.DB) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS gateway_test_lock (id INT NOT NULL PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT IGNORE INTO gateway_test_lock (id) VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	var id int
+	holder, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Rollback()
+	if err := holder.QueryRowContext(ctx, "SELECT id FROM gateway_test_lock WHERE id = 1 FOR UPDATE").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Rollback()
+	err = other.QueryRowContext(ctx, "SELECT id FROM gateway_test_lock WHERE id = 1 FOR UPDATE NOWAIT").Scan(&id)
+	if mysqlErr, ok := err.(*mysql.MySQLError); !ok || mysqlErr.Number != mysqlErrLockNowait {
+		t.Skipf("the test database does not lock rows read FOR UPDATE: %v", err)
+	}
+}
@@ -2,9 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
-	"fmt"
 	"net/http"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
@@ -17,11 +15,13 @@ import (
 	auth_service "github.com/pkusunjy/grpc-gateway/service/auth"
 	"github.com/pkusunjy/grpc-gateway/service/doubao"
 	exercise_pool_service "github.com/pkusunjy/grpc-gateway/service/exercise_pool"
+	"github.com/pkusunjy/grpc-gateway/service/metering"
 	"github.com/pkusunjy/grpc-gateway/service/platform"
+	"github.com/pkusunjy/grpc-gateway/service/rate_limit"
 	"github.com/pkusunjy/grpc-gateway/service/report"
+	"github.com/pkusunjy/grpc-gateway/service/router"
 	wx_payment_service "github.com/pkusunjy/grpc-gateway/service/wx_payment"
 	auth_pb "github.com/pkusunjy/openai-server-proto/auth"
-	"github.com/pkusunjy/openai-server-proto/chat_completion"
 	chat_pb "github.com/pkusunjy/openai-server-proto/chat_completion"
 	exercise_pool_pb "github.com/pkusunjy/openai-server-proto/exercise_pool"
 	wx_payment_pb "github.com/pkusunjy/openai-server-proto/wx_payment"
@@ -97,17 +97,15 @@ func run() error {
 	// Generated routes end
 
 	// Custom routes begin
-	// 微信回调接口
-	notifyServer, err := wx_payment_service.NotifyServiceInitialize(&ctx)
+	customRouter, err := router.RouterInitialize(&ctx, mux)
 	if err != nil {
-		grpclog.Fatal("WxPaymentNotifyServiceInitialize failed error:", err)
+		grpclog.Fatal("RouterInitialize failed error:", err)
 		return err
 	}
-	err = mux.HandlePath("POST", "/wx_payment_notify/jsapi_notify_url", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		notifyServer.NotifyWxPayment(&ctx, w, r)
-	})
-	if err != nil {
-		grpclog.Fatal("WxPaymentNotifyService HandlePath failed error:", err)
+
+	// 登录
+	if err := customRouter.Register(authService.Routes(customRouter)...); err != nil {
+		grpclog.Fatalf("AuthService Register failed error:%+v", err)
 		return err
 	}
 
@@ -117,119 +115,34 @@ func run() error {
 		grpclog.Fatal("PlatformServiceInitialize failed error:", err)
 		return err
 	}
-
-	if err := mux.HandlePath("POST", "/platform/whitelist_insert", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		var data platform.WhitelistUserData
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
-		grpclog.Infof("Received request:%+v", data)
-		res, err := platformServer.WhitelistMySqlInsert(&ctx, &data)
-		if err != nil {
-			grpclog.Warningf("platform insert failed err:%+v", err)
-		}
-		resp := fmt.Sprintf("{\"res\":%v}", res)
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(resp))
-	}); err != nil {
-		grpclog.Fatalf("PlatformService insert HandlePath failed error:%+v", err)
+	if err := customRouter.Register(platformServer.Routes()...); err != nil {
+		grpclog.Fatalf("PlatformService Register failed error:%+v", err)
 		return err
 	}
 
-	if err := mux.HandlePath("POST", "/platform/whitelist_update", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		var data platform.WhitelistUserData
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
-		grpclog.Infof("Received request:%+v", data)
-		res, err := platformServer.WhitelistMySqlUpdate(&ctx, &data)
-		if err != nil {
-			grpclog.Warningf("platform update failed err:%+v", err)
-		}
-		resp := fmt.Sprintf("{\"res\":%v}", res)
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(resp))
-	}); err != nil {
-		grpclog.Fatalf("PlatformService update HandlePath failed error:%+v", err)
+	// 微信支付
+	wxPaymentServer, err := wx_payment_service.WxPaymentServiceInitialize(&ctx, platformServer)
+	if err != nil {
+		grpclog.Fatal("WxPaymentServiceInitialize failed error:", err)
 		return err
 	}
-
-	if err := mux.HandlePath("POST", "/platform/whitelist_query", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		var data platform.WhitelistUserData
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
-		grpclog.Infof("Received request:%+v", data)
-		res, err := platformServer.WhitelistMySqlQuery(&ctx, &data)
-		if err != nil {
-			grpclog.Warningf("platform query failed err:%+v", err)
-		}
-		whitelistJsonObj, _ := json.Marshal(res)
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(whitelistJsonObj)
-	}); err != nil {
-		grpclog.Fatalf("PlatformService query HandlePath failed error:%+v", err)
+	err = wx_payment_pb.RegisterWxPaymentServiceHandlerServer(ctx, mux, wxPaymentServer)
+	if err != nil {
 		return err
 	}
-
-	if err := mux.HandlePath("POST", "/platform/whitelist_delete", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		var data platform.WhitelistUserData
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
-		grpclog.Infof("Received request:%+v", data)
-		res, err := platformServer.WhitelistMySqlDelete(&ctx, &data)
-		if err != nil {
-			grpclog.Warningf("platform delete failed err:%+v", err)
-		}
-		resp := fmt.Sprintf("{\"res\":%v}", res)
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(resp))
-	}); err != nil {
-		grpclog.Fatalf("PlatformService delete HandlePath failed error:%+v", err)
+	if err := customRouter.Register(wxPaymentServer.Routes()...); err != nil {
+		grpclog.Fatalf("WxPaymentService Register failed error:%+v", err)
 		return err
 	}
 
-	if err := mux.HandlePath("POST", "/platform/sadd", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		platformServer.RedisSAdd(&ctx, w, r)
-	}); err != nil {
-		grpclog.Fatalf("PlatformService RedisSAdd HandlePath failed error:%+v", err)
-		return err
-	}
-	if err := mux.HandlePath("GET", "/platform/sadd", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		platformServer.RedisSAddGet(&ctx, w, r)
-	}); err != nil {
-		grpclog.Fatalf("PlatformService RedisSAdd HandlePath failed error:%+v", err)
-		return err
-	}
-	if err := mux.HandlePath("POST", "/platform/smembers", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		platformServer.RedisSMembers(&ctx, w, r)
-	}); err != nil {
-		grpclog.Fatalf("PlatformService RedisSMembers HandlePath failed error:%+v", err)
-		return err
-	}
-	if err := mux.HandlePath("POST", "/platform/srem", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		platformServer.RedisSRem(&ctx, w, r)
-	}); err != nil {
-		grpclog.Fatalf("PlatformService RedisSRem HandlePath failed error:%+v", err)
-		return err
-	}
-	// 微信支付
-	wxPaymentServer, err := wx_payment_service.WxPaymentServiceInitialize(&ctx, platformServer)
+	// 微信回调接口
+	notifyServer, err := wx_payment_service.NotifyServiceInitialize(&ctx, wxPaymentServer)
 	if err != nil {
-		grpclog.Fatal("WxPaymentServiceInitialize failed error:", err)
+		grpclog.Fatal("WxPaymentNotifyServiceInitialize failed error:", err)
 		return err
 	}
-	err = wx_payment_pb.RegisterWxPaymentServiceHandlerServer(ctx, mux, wxPaymentServer)
-	if err != nil {
+	if err := customRouter.Register(notifyServer.Routes()...); err != nil {
+		grpclog.Fatalf("WxPaymentNotifyService Register failed error:%+v", err)
 		return err
 	}
 
@@ -239,23 +152,8 @@ func run() error {
 		grpclog.Fatal("TTSServiceInitialize failed error:", err)
 		return err
 	}
-	if err := mux.HandlePath("POST", "/chat_completion.ChatService/text_to_speech", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		var data chat_completion.ChatMessage
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
-		grpclog.Infof("Received request:%+v", &data)
-		res, err := ttsServer.TTS(ctx, &data)
-		if err != nil {
-			grpclog.Warningf("TTS failed err:%+v", err)
-		}
-		ttsResJsonObj, _ := json.Marshal(res)
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ttsResJsonObj)
-	}); err != nil {
-		grpclog.Fatalf("TTSService text_to_speech_doubao HandlePath failed error:%+v", err)
+	if err := customRouter.Register(ttsServer.Routes()...); err != nil {
+		grpclog.Fatalf("TTSService Register failed error:%+v", err)
 		return err
 	}
 
@@ -265,23 +163,8 @@ func run() error {
 		grpclog.Fatal("AsrServiceInitialize failed error:", err)
 		return err
 	}
-	if err := mux.HandlePath("POST", "/chat_completion.ChatService/transcribe_judge_doubao", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-		var data chat_completion.ChatMessage
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
-		grpclog.Infof("Received request:%+v", &data)
-		res, err := asrServer.Whisper(ctx, &data)
-		if err != nil {
-			grpclog.Warningf("ASR failed err:%+v", err)
-		}
-		asrResJsonObj, _ := json.Marshal(res)
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(asrResJsonObj)
-	}); err != nil {
-		grpclog.Fatalf("AsrService speech_to_text HandlePath failed error:%+v", err)
+	if err := customRouter.Register(asrServer.Routes()...); err != nil {
+		grpclog.Fatalf("AsrService Register failed error:%+v", err)
 		return err
 	}
 
@@ -291,22 +174,33 @@ func run() error {
 		grpclog.Fatal("ForwardServiceInitialize failed error:", err)
 		return err
 	}
-	for path, meth := range platform.ForwardPathMethMap {
-		err = mux.HandlePath(meth, path, func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
-			forwardServer.Forward(&ctx, w, r)
-		})
-		if err != nil {
-			grpclog.Fatalf("ForwardServer HandlePath %v failed err:%v", path, err)
-			return err
-		}
+	if err := customRouter.Register(forwardServer.Routes()...); err != nil {
+		grpclog.Fatalf("ForwardServer Register failed err:%v", err)
+		return err
 	}
 	// Custom routes end
 
+	// 计量
+	meter, err := metering.MeteringServiceInitialize(&ctx)
+	if err != nil {
+		grpclog.Fatal("MeteringServiceInitialize failed error:", err)
+		return err
+	}
+	// 限流
+	rateLimiter, err := rate_limit.RateLimitServiceInitialize(&ctx)
+	if err != nil {
+		grpclog.Fatal("RateLimitServiceInitialize failed error:", err)
+		return err
+	}
+	rateLimiter.SetTierResolver(meter)
+	// the router resolves the caller that limits and meters apply to
+	handler := customRouter.Middleware(rateLimiter.Middleware(meter.Middleware(mux)))
+
 	// Start HTTP server (and proxy calls to gRPC server endpoint)
 	if *offlineModeLocal {
-		return http.ListenAndServe(":8124", mux)
+		return http.ListenAndServe(":8124", handler)
 	} else {
-		return http.ListenAndServeTLS(":8124", *certChain, *privKey, mux)
+		return http.ListenAndServeTLS(":8124", *certChain, *privKey, handler)
 	}
 }
 
@@ -8,6 +8,7 @@ import (
 	"os"
 
 	"github.com/pkusunjy/openai-server-proto/auth"
+	"github.com/redis/go-redis/v9"
 	"google.golang.org/grpc/grpclog"
 	"gopkg.in/yaml.v3"
 )
@@ -18,6 +19,9 @@ type AuthServiceImpl struct {
 	AliyunOssAccessKeySecret string `yaml:"oss_access_key_secret"`
 	WxAppID                  string `yaml:"wx_appid"`
 	WxSecret                 string `yaml:"wx_secret"`
+	RedisAddr                string `yaml:"redis_addr"`
+	WebTicketTTLSec          int64  `yaml:"web_ticket_ttl_sec"`
+	redisClient              *redis.Client
 	auth.UnimplementedAuthServiceServer
 }
 
@@ -45,6 +49,22 @@ func AuthServiceInitialize(ctx *context.Context) (*AuthServiceImpl, error) {
 		grpclog.Fatal(err)
 		return nil, err
 	}
+	// load auth conf
+	content, err = os.ReadFile(authFile)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	err = yaml.Unmarshal(content, &server)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	server.redisClient = redis.NewClient(&redis.Options{
+		Addr:     server.RedisAddr,
+		Password: "",
+		DB:       0,
+	})
 	grpclog.Infof("initialized auth: %v", server)
 	return &server, nil
 }
@@ -1,7 +1,10 @@
 package auth
 
 const (
+	authFile        = "./conf/auth.yaml"
 	aliyunOssFile   = "./conf/aliyun_oss.yaml"
 	wxPaymentFile   = "./conf/wx_payment.yaml"
 	code2SessionUrl = "https://api.weixin.qq.com/sns/jscode2session?appid=%s&secret=%s&js_code=%s&grant_type=authorization_code"
+	// web login tickets, see web_ticket.go
+	webTicketKeyPrefix = "auth:web_ticket"
 )
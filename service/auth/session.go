@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/pkusunjy/grpc-gateway/service/router"
+	"github.com/pkusunjy/grpc-gateway/service/validation"
+	"google.golang.org/grpc/grpclog"
+)
+
+// SessionIssuer signs the session token of an openid wechat vouched for.
+type SessionIssuer interface {
+	IssueSession(openid string, now time.Time) (string, time.Time)
+}
+
+type SessionRequest struct {
+	// code from wx.login
+	Code string `json:"code"`
+}
+
+// SessionResponse carries the token the mini program sends in the
+// X-Session-Token header of later requests.
+type SessionResponse struct {
+	OpenID       string `json:"openid"`
+	SessionToken string `json:"session_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+var sessionRules = validation.Rules{
+	"code": "required,max=128",
+}
+
+// code2SessionResp is the part of the jscode2session reply the gateway needs,
+// the session_key is left with wechat.
+type code2SessionResp struct {
+	OpenID  string `json:"openid"`
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (server AuthServiceImpl) Routes(sessions SessionIssuer) []router.Route {
+	return []router.Route{
+		router.JSON(http.MethodPost, "/auth/session", router.AuthNone, sessionRules,
+			func(ctx context.Context, req *SessionRequest) (*SessionResponse, error) {
+				return server.Session(ctx, req, sessions)
+			}),
+		router.JSON(http.MethodPost, "/auth/web_ticket", router.AuthNone, nil, server.CreateWebTicket),
+		router.JSON(http.MethodPost, "/auth/web_ticket/confirm", router.AuthUser, webTicketConfirmRules, server.ConfirmWebTicket),
+		router.JSON(http.MethodPost, "/auth/web_ticket/session", router.AuthNone, webTicketSessionRules,
+			func(ctx context.Context, req *WebTicketSessionRequest) (*WebTicketSessionResponse, error) {
+				return server.WebTicketSession(ctx, req, sessions)
+			}),
+	}
+}
+
+// Session exchanges a wx.login code for a session token. The openid comes
+// from wechat, so the token proves who the caller is.
+func (server AuthServiceImpl) Session(ctx context.Context, req *SessionRequest, sessions SessionIssuer) (*SessionResponse, error) {
+	sessionUrl := fmt.Sprintf(code2SessionUrl, url.QueryEscape(server.WxAppID), url.QueryEscape(server.WxSecret), url.QueryEscape(req.Code))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, sessionUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		grpclog.Errorf("code2session get fail, err:%v", err)
+		return nil, common.NewHTTPError(http.StatusBadGateway, "code2session failed")
+	}
+	defer httpResp.Body.Close()
+	var resp code2SessionResp
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		grpclog.Errorf("code2session json decode fail, err:%v", err)
+		return nil, common.NewHTTPError(http.StatusBadGateway, "code2session failed")
+	}
+	if resp.ErrCode != 0 || len(resp.OpenID) == 0 {
+		grpclog.Warningf("code2session rejected code errcode:%v errmsg:%v", resp.ErrCode, resp.ErrMsg)
+		return nil, common.NewHTTPError(http.StatusUnauthorized, "code rejected by wechat")
+	}
+	token, expiresAt := sessions.IssueSession(resp.OpenID, time.Now())
+	return &SessionResponse{OpenID: resp.OpenID, SessionToken: token, ExpiresAt: expiresAt.Unix()}, nil
+}
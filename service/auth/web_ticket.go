@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/pkusunjy/grpc-gateway/service/validation"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/grpclog"
+)
+
+// Web pages, such as the Native and H5 payment pages, cannot call wx.login.
+// They log in with a ticket the mini program confirms: the page creates a
+// ticket and shows it as a QR code, or opens the mini program with it, the
+// mini program confirms it with its own session and the page then exchanges
+// the ticket for a session of the same openid. Only the page knows the poll
+// token, so whoever sees the QR code cannot take the session.
+
+type WebTicketRequest struct{}
+
+// WebTicketResponse is a new ticket, PollToken must stay with the page.
+type WebTicketResponse struct {
+	Ticket    string `json:"ticket"`
+	PollToken string `json:"poll_token"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type WebTicketConfirmRequest struct {
+	Ticket string `json:"ticket"`
+}
+
+type WebTicketConfirmResponse struct{}
+
+type WebTicketSessionRequest struct {
+	Ticket    string `json:"ticket"`
+	PollToken string `json:"poll_token"`
+}
+
+// WebTicketSessionResponse has Confirmed false and no token while the mini
+// program has not confirmed the ticket yet.
+type WebTicketSessionResponse struct {
+	Confirmed bool `json:"confirmed"`
+	SessionResponse
+}
+
+var webTicketConfirmRules = validation.Rules{
+	"ticket": "required,max=64",
+}
+
+var webTicketSessionRules = validation.Rules{
+	"ticket":     "required,max=64",
+	"poll_token": "required,max=64",
+}
+
+// KEYS[1] ticket
+// ARGV[1] openid confirming it
+// returns 1 when confirmed, 0 when confirmed before, -1 when unknown
+var confirmTicketScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+if redis.call('HSETNX', KEYS[1], 'openid', ARGV[1]) == 0 then
+	return 0
+end
+return 1
+`)
+
+// KEYS[1] ticket
+// ARGV[1] digest of the poll token
+// returns the openid and deletes the ticket once confirmed, an empty string
+// while pending, false when unknown
+var takeTicketScript = redis.NewScript(`
+local ticket = redis.call('HMGET', KEYS[1], 'poll', 'openid')
+if ticket[1] ~= ARGV[1] then
+	return false
+end
+if not ticket[2] then
+	return ''
+end
+redis.call('DEL', KEYS[1])
+return ticket[2]
+`)
+
+// CreateWebTicket starts a web login.
+func (server AuthServiceImpl) CreateWebTicket(ctx context.Context, req *WebTicketRequest) (*WebTicketResponse, error) {
+	ticket, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	pollToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	ttl := server.webTicketTTL()
+	key := webTicketKey(ticket)
+	_, err = server.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "poll", pollDigest(pollToken))
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		grpclog.Errorf("create web ticket failed err:%v", err)
+		return nil, common.NewHTTPError(http.StatusServiceUnavailable, "web login unavailable")
+	}
+	return &WebTicketResponse{Ticket: ticket, PollToken: pollToken, ExpiresAt: time.Now().Add(ttl).Unix()}, nil
+}
+
+// ConfirmWebTicket lets the page holding the ticket log in as the caller.
+func (server AuthServiceImpl) ConfirmWebTicket(ctx context.Context, req *WebTicketConfirmRequest) (*WebTicketConfirmResponse, error) {
+	caller := common.CallerFromContext(ctx)
+	// a session must not be minted from an openid nobody verified
+	if caller.Unverified {
+		return nil, common.NewHTTPError(http.StatusUnauthorized, "session token required")
+	}
+	res, err := confirmTicketScript.Run(ctx, server.redisClient, []string{webTicketKey(req.Ticket)}, caller.OpenID).Int64()
+	if err != nil {
+		grpclog.Errorf("confirm web ticket failed openid:%v err:%v", caller.OpenID, err)
+		return nil, common.NewHTTPError(http.StatusServiceUnavailable, "web login unavailable")
+	}
+	switch res {
+	case -1:
+		return nil, common.NewHTTPError(http.StatusNotFound, "ticket not found or expired")
+	case 0:
+		return nil, common.NewHTTPError(http.StatusConflict, "ticket already confirmed")
+	}
+	grpclog.Infof("web ticket confirmed openid:%v", caller.OpenID)
+	return &WebTicketConfirmResponse{}, nil
+}
+
+// WebTicketSession is polled by the page until the ticket is confirmed, it
+// then returns the session once.
+func (server AuthServiceImpl) WebTicketSession(ctx context.Context, req *WebTicketSessionRequest, sessions SessionIssuer) (*WebTicketSessionResponse, error) {
+	openid, err := takeTicketScript.Run(ctx, server.redisClient, []string{webTicketKey(req.Ticket)}, pollDigest(req.PollToken)).Text()
+	if err == redis.Nil {
+		return nil, common.NewHTTPError(http.StatusNotFound, "ticket not found or expired")
+	}
+	if err != nil {
+		grpclog.Errorf("take web ticket failed err:%v", err)
+		return nil, common.NewHTTPError(http.StatusServiceUnavailable, "web login unavailable")
+	}
+	if len(openid) == 0 {
+		return &WebTicketSessionResponse{}, nil
+	}
+	token, expiresAt := sessions.IssueSession(openid, time.Now())
+	return &WebTicketSessionResponse{
+		Confirmed:       true,
+		SessionResponse: SessionResponse{OpenID: openid, SessionToken: token, ExpiresAt: expiresAt.Unix()},
+	}, nil
+}
+
+func (server AuthServiceImpl) webTicketTTL() time.Duration {
+	if server.WebTicketTTLSec <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(server.WebTicketTTLSec) * time.Second
+}
+
+func webTicketKey(ticket string) string {
+	return fmt.Sprintf("%s:%s", webTicketKeyPrefix, ticket)
+}
+
+func pollDigest(pollToken string) string {
+	sum := sha256.Sum256([]byte(pollToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/redis/go-redis/v9"
+)
+
+type testSessions struct{}
+
+func (testSessions) IssueSession(openid string, now time.Time) (string, time.Time) {
+	return "token-of-" + openid, now.Add(time.Hour)
+}
+
+func httpStatus(err error) int {
+	var httpErr *common.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Status
+	}
+	return 0
+}
+
+func TestWebTicket(t *testing.T) {
+	mr := miniredis.RunT(t)
+	server := AuthServiceImpl{redisClient: redis.NewClient(&redis.Options{Addr: mr.Addr()})}
+	ctx := context.Background()
+	as := func(caller common.Caller) context.Context {
+		return common.ContextWithCaller(ctx, caller)
+	}
+
+	ticket, err := server.CreateWebTicket(ctx, &WebTicketRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll := &WebTicketSessionRequest{Ticket: ticket.Ticket, PollToken: ticket.PollToken}
+	if resp, err := server.WebTicketSession(ctx, poll, testSessions{}); err != nil || resp.Confirmed {
+		t.Fatalf("pending ticket = %+v %v", resp, err)
+	}
+
+	// only a verified caller confirms, and only once
+	confirm := &WebTicketConfirmRequest{Ticket: ticket.Ticket}
+	if _, err := server.ConfirmWebTicket(as(common.Caller{OpenID: "oOther", Unverified: true}), confirm); httpStatus(err) != http.StatusUnauthorized {
+		t.Fatalf("unverified confirm = %v", err)
+	}
+	if _, err := server.ConfirmWebTicket(as(common.Caller{OpenID: "oUser"}), confirm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ConfirmWebTicket(as(common.Caller{OpenID: "oOther"}), confirm); httpStatus(err) != http.StatusConflict {
+		t.Fatalf("second confirm = %v", err)
+	}
+
+	// the ticket alone does not give the session
+	stolen := &WebTicketSessionRequest{Ticket: ticket.Ticket, PollToken: "guess"}
+	if _, err := server.WebTicketSession(ctx, stolen, testSessions{}); httpStatus(err) != http.StatusNotFound {
+		t.Fatalf("session without poll token = %v", err)
+	}
+	resp, err := server.WebTicketSession(ctx, poll, testSessions{})
+	if err != nil || !resp.Confirmed || resp.OpenID != "oUser" || resp.SessionToken != "token-of-oUser" {
+		t.Fatalf("confirmed ticket = %+v %v", resp, err)
+	}
+	if _, err := server.WebTicketSession(ctx, poll, testSessions{}); httpStatus(err) != http.StatusNotFound {
+		t.Fatalf("ticket used twice = %v", err)
+	}
+
+	// tickets expire
+	ticket, _ = server.CreateWebTicket(ctx, &WebTicketRequest{})
+	mr.FastForward(server.webTicketTTL())
+	if _, err := server.ConfirmWebTicket(as(common.Caller{OpenID: "oUser"}), &WebTicketConfirmRequest{Ticket: ticket.Ticket}); httpStatus(err) != http.StatusNotFound {
+		t.Fatalf("confirm expired ticket = %v", err)
+	}
+}
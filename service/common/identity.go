@@ -0,0 +1,218 @@
+package common
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// OpenIDHeader is injected by the WeChat cloud gateway. It is only
+	// believed on requests arriving from a trusted proxy, which must strip
+	// any copy sent by the client.
+	OpenIDHeader = "X-WX-OPENID"
+	// SessionTokenHeader carries the token issued by IssueSession.
+	SessionTokenHeader = "X-Session-Token"
+	// shorter secrets are refused so that a placeholder left in the config
+	// never signs sessions
+	minSessionSecretSize = 32
+)
+
+type callerKey struct{}
+
+// Caller identifies who sent a request, custom routes find it in their
+// context. OpenID is only set when the gateway could verify it.
+type Caller struct {
+	OpenID string
+	IP     string
+	// Unverified is set when OpenID was only believed because of
+	// Identity.LegacyOpenIDHeader
+	Unverified bool
+}
+
+func ContextWithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext returns the caller stored by ContextWithCaller, or the
+// zero Caller.
+func CallerFromContext(ctx context.Context) Caller {
+	caller, _ := ctx.Value(callerKey{}).(Caller)
+	return caller
+}
+
+// LookupCaller is CallerFromContext telling whether a caller was stored.
+func LookupCaller(ctx context.Context) (Caller, bool) {
+	caller, ok := ctx.Value(callerKey{}).(Caller)
+	return caller, ok
+}
+
+// Identity tells who sent a request from what the gateway can verify: a
+// session token it signed, or the openid header of a trusted proxy. Openids
+// in the query string or the body are never believed.
+type Identity struct {
+	// LegacyOpenIDHeader believes the openid header from any peer when no
+	// session token is sent, as the gateway did before sessions. It keeps
+	// clients that do not send X-Session-Token yet working and must be
+	// turned off once they all do.
+	LegacyOpenIDHeader bool
+	secret             []byte
+	ttl                time.Duration
+	proxies            []netip.Prefix
+}
+
+// NewIdentity signs sessions valid for ttl with secret. trustedProxies are
+// addresses or CIDR prefixes of the proxies in front of the gateway.
+func NewIdentity(secret string, ttl time.Duration, trustedProxies []string) (*Identity, error) {
+	if len(secret) < minSessionSecretSize {
+		return nil, fmt.Errorf("session secret must be at least %d bytes", minSessionSecretSize)
+	}
+	if ttl <= 0 {
+		return nil, errors.New("session ttl must be positive")
+	}
+	id := &Identity{secret: []byte(secret), ttl: ttl}
+	for _, proxy := range trustedProxies {
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", proxy, err)
+		}
+		id.proxies = append(id.proxies, prefix)
+	}
+	return id, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Caller returns the verified caller of r.
+func (id *Identity) Caller(r *http.Request) Caller {
+	caller := Caller{IP: id.clientIP(r)}
+	if token := r.Header.Get(SessionTokenHeader); len(token) != 0 {
+		caller.OpenID, _ = id.verifySession(token, time.Now())
+	} else if id.trusted(remoteAddr(r)) {
+		caller.OpenID = r.Header.Get(OpenIDHeader)
+	} else if id.LegacyOpenIDHeader {
+		caller.OpenID = r.Header.Get(OpenIDHeader)
+		caller.Unverified = len(caller.OpenID) != 0
+	}
+	return caller
+}
+
+// Middleware stores the verified caller in the request context for the
+// handlers and middlewares behind it.
+func (id *Identity) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(ContextWithCaller(r.Context(), id.Caller(r))))
+	})
+}
+
+// IssueSession returns a token proving the caller is openid, to be sent in
+// the X-Session-Token header, and when it expires.
+func (id *Identity) IssueSession(openid string, now time.Time) (string, time.Time) {
+	expiresAt := now.Add(id.ttl)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(openid)) + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "." + id.sign(payload), expiresAt
+}
+
+func (id *Identity) verifySession(token string, now time.Time) (string, bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", false
+	}
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(id.sign(payload))) {
+		return "", false
+	}
+	encoded, expires, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", false
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() >= expiresAt {
+		return "", false
+	}
+	openid, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(openid) == 0 {
+		return "", false
+	}
+	return string(openid), true
+}
+
+func (id *Identity) sign(payload string) string {
+	mac := hmac.New(sha256.New, id.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (id *Identity) trusted(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	for _, prefix := range id.proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr is the peer of the connection, the invalid address if unknown.
+func remoteAddr(r *http.Request) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err == nil {
+		return addrPort.Addr().Unmap()
+	}
+	addr, _ := netip.ParseAddr(r.RemoteAddr)
+	return addr.Unmap()
+}
+
+// clientIP returns the address of the caller. Forwarding headers are only
+// believed from trusted proxies, X-Forwarded-For is walked from the right
+// and the first hop that is not a trusted proxy is the caller, since every
+// hop left of it may have been written by the client.
+func (id *Identity) clientIP(r *http.Request) string {
+	peer := remoteAddr(r)
+	if !id.trusted(peer) {
+		if peer.IsValid() {
+			return peer.String()
+		}
+		return r.RemoteAddr
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) != 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				// a hop nobody can vouch for ends the walk
+				break
+			}
+			peer = hop.Unmap()
+			if !id.trusted(peer) {
+				break
+			}
+		}
+		return peer.String()
+	}
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap().String()
+	}
+	return peer.String()
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func newTestIdentity(t *testing.T, proxies ...string) *Identity {
+	t.Helper()
+	id, err := NewIdentity(testSecret, time.Hour, proxies)
+	if err != nil {
+		t.Fatalf("NewIdentity: %v", err)
+	}
+	return id
+}
+
+func TestNewIdentityRejectsShortSecret(t *testing.T) {
+	if _, err := NewIdentity("GATEWAY_SESSION_SECRET", time.Hour, nil); err == nil {
+		t.Fatal("placeholder secret accepted")
+	}
+	if _, err := NewIdentity(testSecret, time.Hour, []string{"not an address"}); err == nil {
+		t.Fatal("invalid trusted proxy accepted")
+	}
+}
+
+func TestSessionToken(t *testing.T) {
+	id := newTestIdentity(t)
+	now := time.Now()
+	token, expiresAt := id.IssueSession("oUser-1_a", now)
+	if !expiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expires at %v", expiresAt)
+	}
+	if openid, ok := id.verifySession(token, now); !ok || openid != "oUser-1_a" {
+		t.Fatalf("verify = %q %v", openid, ok)
+	}
+	if _, ok := id.verifySession(token, expiresAt); ok {
+		t.Fatal("expired token verified")
+	}
+	other, _ := id.IssueSession("oOther", now)
+	forged := other[:strings.LastIndexByte(other, '.')] + token[strings.LastIndexByte(token, '.'):]
+	if _, ok := id.verifySession(forged, now); ok {
+		t.Fatal("token with another signature verified")
+	}
+	stranger, _ := NewIdentity(strings.Repeat("x", 32), time.Hour, nil)
+	if _, ok := stranger.verifySession(token, now); ok {
+		t.Fatal("token verified with another secret")
+	}
+}
+
+func TestCaller(t *testing.T) {
+	id := newTestIdentity(t, "10.0.0.0/8", "192.168.1.1")
+	token, _ := id.IssueSession("oSigned", time.Now())
+	cases := []struct {
+		name   string
+		remote string
+		header map[string]string
+		target string
+		want   string
+	}{
+		{"session token", "1.2.3.4:5", map[string]string{SessionTokenHeader: token}, "/", "oSigned"},
+		{"bad session token", "10.1.2.3:5", map[string]string{SessionTokenHeader: token + "x", OpenIDHeader: "oHeader"}, "/", ""},
+		{"header from trusted prefix", "10.1.2.3:5", map[string]string{OpenIDHeader: "oHeader"}, "/", "oHeader"},
+		{"header from trusted address", "192.168.1.1:5", map[string]string{OpenIDHeader: "oHeader"}, "/", "oHeader"},
+		{"header from client", "1.2.3.4:5", map[string]string{OpenIDHeader: "oHeader"}, "/", ""},
+		{"query string", "1.2.3.4:5", nil, "/?openid=oQuery", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", c.target, strings.NewReader(`{"openid":"oBody","userid":"oBody"}`))
+		r.RemoteAddr = c.remote
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		if got := id.Caller(r).OpenID; got != c.want {
+			t.Errorf("%s: openid = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	id := newTestIdentity(t, "10.0.0.0/8")
+	cases := []struct {
+		name      string
+		remote    string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{"direct", "1.2.3.4:5", "", "", "1.2.3.4"},
+		{"spoofed from client", "1.2.3.4:5", "9.9.9.9", "8.8.8.8", "1.2.3.4"},
+		{"one proxy", "10.0.0.1:5", "1.2.3.4", "", "1.2.3.4"},
+		{"client prepends", "10.0.0.1:5", "9.9.9.9, 1.2.3.4", "", "1.2.3.4"},
+		{"proxy chain", "10.0.0.1:5", "9.9.9.9, 1.2.3.4, 10.0.0.2", "", "1.2.3.4"},
+		{"garbage hop", "10.0.0.1:5", "1.2.3.4, junk, 10.0.0.2", "", "10.0.0.2"},
+		{"real ip from proxy", "10.0.0.1:5", "", "1.2.3.4", "1.2.3.4"},
+		{"ipv6", "[2001:db8::1]:5", "", "", "2001:db8::1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if len(c.forwarded) != 0 {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if len(c.realIP) != 0 {
+			r.Header.Set("X-Real-IP", c.realIP)
+		}
+		if got := id.Caller(r).IP; got != c.want {
+			t.Errorf("%s: ip = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCallerLegacyOpenIDHeader(t *testing.T) {
+	id := newTestIdentity(t)
+	id.LegacyOpenIDHeader = true
+	token, _ := id.IssueSession("oSigned", time.Now())
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "1.2.3.4:5"
+	r.Header.Set(OpenIDHeader, "oHeader")
+	if got := id.Caller(r); got.OpenID != "oHeader" || !got.Unverified {
+		t.Fatalf("legacy header from client: caller = %+v", got)
+	}
+	// a session token still wins over the header
+	r.Header.Set(SessionTokenHeader, token)
+	if got := id.Caller(r).OpenID; got != "oSigned" {
+		t.Fatalf("legacy header with session: openid = %q", got)
+	}
+	r.Header.Set(SessionTokenHeader, token+"x")
+	if got := id.Caller(r).OpenID; got != "" {
+		t.Fatalf("legacy header with bad session: openid = %q", got)
+	}
+}
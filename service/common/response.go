@@ -0,0 +1,86 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorResponse is the envelope returned by custom routes when a request is
+// rejected or fails, mirroring the err_no/err_msg pair used by the grpc services.
+type ErrorResponse struct {
+	ErrNo  int32        `json:"err_no"`
+	ErrMsg string       `json:"err_msg"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError reports why a single request field was rejected.
+type FieldError struct {
+	Field string `json:"field"`
+	Msg   string `json:"msg"`
+}
+
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		grpclog.Errorf("json marshal response failed err:%v", err)
+		http.Error(w, "json marshal failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func WriteError(w http.ResponseWriter, status int, msg string) {
+	WriteJSON(w, status, ErrorResponse{ErrNo: int32(status), ErrMsg: msg})
+}
+
+func WriteFieldErrors(w http.ResponseWriter, fields []FieldError) {
+	WriteJSON(w, http.StatusBadRequest, ErrorResponse{
+		ErrNo:  http.StatusBadRequest,
+		ErrMsg: "invalid request",
+		Fields: fields,
+	})
+}
+
+// HTTPError carries the status a handler wants returned to the client.
+type HTTPError struct {
+	Status int
+	Msg    string
+	Fields []FieldError
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, e.Msg)
+}
+
+func NewHTTPError(status int, format string, args ...any) *HTTPError {
+	return &HTTPError{Status: status, Msg: fmt.Sprintf(format, args...)}
+}
+
+// WriteErr maps err to the error envelope: HTTPError keeps its status, grpc
+// status errors are translated the way grpc-gateway does, anything else is
+// an internal error.
+func WriteErr(w http.ResponseWriter, err error) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		WriteJSON(w, httpErr.Status, ErrorResponse{
+			ErrNo:  int32(httpErr.Status),
+			ErrMsg: httpErr.Msg,
+			Fields: httpErr.Fields,
+		})
+		return
+	}
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		WriteError(w, runtime.HTTPStatusFromCode(st.Code()), st.Message())
+		return
+	}
+	WriteError(w, http.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,213 @@
+package doubao
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/grpclog"
+)
+
+var (
+	flagReloadInterval = flag.Duration("doubao_reload_interval", time.Minute, "how often doubao accounts are reloaded from doubao_file")
+)
+
+// ErrNoAccount is returned when every account was tried.
+var ErrNoAccount = errors.New("no doubao account left")
+
+// Account is an app of doubao with its resource ids. Weight is its share
+// of the sessions.
+type Account struct {
+	Name          string `yaml:"name"`
+	AppID         string `yaml:"app_id"`
+	AccessToken   string `yaml:"access_token"`
+	TTSResourceID string `yaml:"tts_resource_id"`
+	ASRResourceID string `yaml:"asr_resource_id"`
+	Weight        int    `yaml:"weight"`
+}
+
+// AccountsConfig is the doubao_accounts part of conf/doubao.yaml.
+type AccountsConfig struct {
+	// doubao error codes after which an account rests for CooldownSeconds
+	FailoverCodes   []uint32  `yaml:"failover_codes"`
+	CooldownSeconds int       `yaml:"cooldown_seconds"`
+	Accounts        []Account `yaml:"accounts"`
+}
+
+// StatusError is an http status of doubao that rejects the account, such
+// as a failed websocket handshake.
+type StatusError struct {
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("doubao answered http status %d", e.Status)
+}
+
+// Accounts picks the account of each session. An account that ran out of
+// quota or was rejected rests for a while, sessions move on to the others.
+// The accounts are reloaded from doubao_file, so that tokens are rotated
+// without a restart.
+type Accounts struct {
+	path string
+
+	mu     sync.RWMutex
+	config AccountsConfig
+	// until when an account rests, by name
+	resting map[string]time.Time
+}
+
+func NewAccounts(path string) (*Accounts, error) {
+	a := &Accounts{path: path, resting: make(map[string]time.Time)}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Run reloads the accounts every -doubao_reload_interval until ctx is done.
+func (a *Accounts) Run(ctx context.Context) {
+	ticker := time.NewTicker(*flagReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.Reload(); err != nil {
+				grpclog.Errorf("doubao accounts reload failed, keeping the loaded ones error: %v", err)
+			}
+		}
+	}
+}
+
+// Reload reads the accounts from doubao_file. The loaded accounts are kept
+// if the file is unusable.
+func (a *Accounts) Reload() error {
+	doubao, err := loadDoubaoConfig(a.path)
+	if err != nil {
+		return err
+	}
+	config := doubao.Accounts
+	if len(config.Accounts) == 0 {
+		return errors.New("no doubao accounts")
+	}
+	if config.CooldownSeconds <= 0 {
+		config.CooldownSeconds = 300
+	}
+	for i := range config.Accounts {
+		account := &config.Accounts[i]
+		if len(account.AppID) == 0 || len(account.AccessToken) == 0 {
+			return fmt.Errorf("doubao account %d has no app_id or access_token", i)
+		}
+		if len(account.Name) == 0 {
+			account.Name = account.AppID
+		}
+		if len(account.TTSResourceID) == 0 {
+			account.TTSResourceID = "volc.service_type.10029"
+		}
+		if len(account.ASRResourceID) == 0 {
+			account.ASRResourceID = "volc.bigasr.auc"
+		}
+		if account.Weight <= 0 {
+			account.Weight = 1
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if slices.Equal(a.config.Accounts, config.Accounts) && slices.Equal(a.config.FailoverCodes, config.FailoverCodes) &&
+		a.config.CooldownSeconds == config.CooldownSeconds {
+		return nil
+	}
+	// a rotated account gets a fresh start
+	for name := range a.resting {
+		i := slices.IndexFunc(config.Accounts, func(account Account) bool { return account.Name == name })
+		if i < 0 || !slices.Contains(a.config.Accounts, config.Accounts[i]) {
+			delete(a.resting, name)
+		}
+	}
+	a.config = config
+	grpclog.Infof("doubao accounts loaded count:%d", len(config.Accounts))
+	return nil
+}
+
+// Pick chooses an account not in tried by weight. Resting accounts are only
+// chosen when all others rest, the one back first then.
+func (a *Accounts) Pick(tried []string) (Account, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	now := time.Now()
+	var ready []Account
+	var back *Account
+	total := 0
+	for i, account := range a.config.Accounts {
+		if slices.Contains(tried, account.Name) {
+			continue
+		}
+		if until, ok := a.resting[account.Name]; ok && now.Before(until) {
+			if back == nil || until.Before(a.resting[back.Name]) {
+				back = &a.config.Accounts[i]
+			}
+			continue
+		}
+		ready = append(ready, account)
+		total += account.Weight
+	}
+	if len(ready) == 0 {
+		if back == nil {
+			return Account{}, ErrNoAccount
+		}
+		return *back, nil
+	}
+	n := rand.IntN(total)
+	for _, account := range ready {
+		if n < account.Weight {
+			return account, nil
+		}
+		n -= account.Weight
+	}
+	return ready[len(ready)-1], nil
+}
+
+// Fail rests account when err means it is out of quota or rejected, and
+// tells whether another account should be tried.
+func (a *Accounts) Fail(account Account, err error) bool {
+	var serverErr *ServerError
+	var statusErr *StatusError
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case errors.As(err, &serverErr) && slices.Contains(a.config.FailoverCodes, serverErr.Code):
+	case errors.As(err, &statusErr):
+	default:
+		return false
+	}
+	cooldown := time.Duration(a.config.CooldownSeconds) * time.Second
+	a.resting[account.Name] = time.Now().Add(cooldown)
+	grpclog.Warningf("doubao account %v rests for %v err:%v", account.Name, cooldown, err)
+	return true
+}
+
+// Current tells whether account is still loaded as it is, connections of a
+// rotated account are not reused.
+func (a *Accounts) Current(account Account) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return slices.Contains(a.config.Accounts, account)
+}
+
+// statusError keeps the statuses that reject the account.
+func statusError(status int) error {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return &StatusError{Status: status}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package doubao
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestAccounts(t *testing.T, accounts string) *Accounts {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "doubao.yaml")
+	config := "doubao_accounts:\n  failover_codes: [45000292]\n  cooldown_seconds: 300\n  accounts:\n" + accounts
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAccountsPickByWeight(t *testing.T) {
+	a := newTestAccounts(t, `
+    - {name: heavy, app_id: "1", access_token: a, weight: 3}
+    - {name: light, app_id: "2", access_token: b, weight: 1}
+`)
+	picks := map[string]int{}
+	for range 4000 {
+		account, err := a.Pick(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[account.Name]++
+	}
+	if picks["heavy"] < 2700 || picks["heavy"] > 3300 {
+		t.Fatalf("picks by weight %v", picks)
+	}
+
+	if account, err := a.Pick([]string{"heavy"}); err != nil || account.Name != "light" {
+		t.Fatalf("pick after heavy was tried = %v %v", account.Name, err)
+	}
+	if _, err := a.Pick([]string{"heavy", "light"}); !errors.Is(err, ErrNoAccount) {
+		t.Fatalf("pick after all were tried = %v", err)
+	}
+}
+
+func TestAccountsFail(t *testing.T) {
+	a := newTestAccounts(t, `
+    - {name: first, app_id: "1", access_token: a}
+    - {name: second, app_id: "2", access_token: b}
+`)
+	first := Account{Name: "first"}
+	second := Account{Name: "second"}
+
+	// errors that are not about the account do not fail over
+	if a.Fail(first, &ServerError{Code: 45000001}) || a.Fail(first, errors.New("broken pipe")) {
+		t.Fatal("failed over on an error of the session")
+	}
+	for range 100 {
+		if _, err := a.Pick(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// out of quota, first rests and second takes every session
+	if !a.Fail(first, &ServerError{Code: 45000292}) {
+		t.Fatal("no failover on quota exceeded")
+	}
+	for range 100 {
+		if account, _ := a.Pick(nil); account.Name != "second" {
+			t.Fatalf("picked resting %v", account.Name)
+		}
+	}
+
+	// when all rest, the one back first is picked
+	if !a.Fail(second, statusError(http.StatusUnauthorized)) {
+		t.Fatal("no failover on a rejected account")
+	}
+	if account, err := a.Pick(nil); err != nil || account.Name != "first" {
+		t.Fatalf("pick when all rest = %v %v", account.Name, err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
 	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/credentials"
+	"github.com/pkusunjy/grpc-gateway/service/validation"
 	"github.com/pkusunjy/openai-server-proto/chat_completion"
 	"google.golang.org/grpc/grpclog"
 )
@@ -16,9 +17,16 @@ var (
 	asrUrl = flag.String("url", "https://openspeech.bytedance.com/api/v3/auc/bigmodel", "url")
 )
 
+// AsrRules expects the oss key of the uploaded audio in content.
+var AsrRules = validation.Rules{
+	"userid":  "max=64",
+	"content": "required,max=512",
+}
+
 type AsrService struct {
 	loc       *time.Location
 	ossClient *oss.Client
+	accounts  *Accounts
 }
 
 func AsrServiceInitialize(ctx *context.Context) (*AsrService, error) {
@@ -29,7 +37,14 @@ func AsrServiceInitialize(ctx *context.Context) (*AsrService, error) {
 		WithCredentialsProvider(credentials.NewEnvironmentVariableCredentialsProvider()).
 		WithRegion(region)
 
-	return &AsrService{loc: loc, ossClient: oss.NewClient(cfg)}, nil
+	accounts, err := NewAccounts(*flagConfFile)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	go accounts.Run(*ctx)
+
+	return &AsrService{loc: loc, ossClient: oss.NewClient(cfg), accounts: accounts}, nil
 }
 
 func (s *AsrService) Whisper(ctx context.Context, req *chat_completion.ChatMessage) (*chat_completion.ChatMessage, error) {
@@ -48,7 +63,7 @@ func (s *AsrService) Whisper(ctx context.Context, req *chat_completion.ChatMessa
 	audioUrl := getObjResult.URL
 	grpclog.Infof("presigned url for object %s, url: %s", fileName, audioUrl)
 	// 2. call asr api
-	c := NewAsrHttpClient(*asrUrl)
+	c := NewAsrHttpClient(*asrUrl, s.accounts)
 	asrRes, err := c.Excute(ctx, audioUrl)
 	if err != nil {
 		grpclog.Warningf("failed to excute: %v", err)
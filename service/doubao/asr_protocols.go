@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/bytedance/sonic"
@@ -94,18 +95,26 @@ func DefaultPayload(fileURL string) *AsrRequestPayload {
 }
 
 type AsrHttpClient struct {
-	url string
+	url      string
+	accounts *Accounts
 }
 
-func NewAsrHttpClient(url string) *AsrHttpClient {
+func NewAsrHttpClient(url string, accounts *Accounts) *AsrHttpClient {
 	return &AsrHttpClient{
-		url: url,
+		url:      url,
+		accounts: accounts,
 	}
 }
 
-func (c *AsrHttpClient) submit(ctx context.Context, reqID string, fileUrl string) (string, error) {
+// asrStatusError keeps the account in X-Api-Status-Code for failover.
+func asrStatusError(code string, message string) error {
+	parsed, _ := strconv.ParseUint(code, 10, 32)
+	return fmt.Errorf("response failed: %w", &ServerError{Code: uint32(parsed), Msg: message})
+}
+
+func (c *AsrHttpClient) submit(ctx context.Context, account Account, reqID string, fileUrl string) (string, error) {
 	submitUrl := c.url + "/submit"
-	header := NewAuthHeader(reqID, "volc.bigasr.auc")
+	header := NewAuthHeader(account, reqID, account.ASRResourceID)
 	payload := DefaultPayload(fileUrl)
 
 	payloadData, err := sonic.Marshal(payload)
@@ -128,21 +137,24 @@ func (c *AsrHttpClient) submit(ctx context.Context, reqID string, fileUrl string
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		if statusErr := statusError(resp.StatusCode); statusErr != nil {
+			return "", fmt.Errorf("response failed: %w", statusErr)
+		}
 		return "", fmt.Errorf("response failed, status code: %d", resp.StatusCode)
 	}
 	statusCode := resp.Header.Get("X-Api-Status-Code")
 	message := resp.Header.Get("X-Api-Message")
 	logID := resp.Header.Get("X-Tt-Logid")
 	if statusCode != "20000000" {
-		return "", fmt.Errorf("response failed, status code: %s, message: %s", statusCode, message)
+		return "", asrStatusError(statusCode, message)
 	}
 
 	return logID, nil
 }
 
-func (c *AsrHttpClient) doQuery(ctx context.Context, reqID string) ([]byte, http.Header, error) {
+func (c *AsrHttpClient) doQuery(ctx context.Context, account Account, reqID string) ([]byte, http.Header, error) {
 	queryUrl := c.url + "/query"
-	header := NewAuthHeader(reqID, "volc.bigasr.auc")
+	header := NewAuthHeader(account, reqID, account.ASRResourceID)
 	queryRequest, err := http.NewRequest(http.MethodPost, queryUrl, bytes.NewBuffer([]byte("{}")))
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create query request: %w", err)
@@ -168,9 +180,9 @@ func (c *AsrHttpClient) doQuery(ctx context.Context, reqID string) ([]byte, http
 	return body, resp.Header, nil
 }
 
-func (c *AsrHttpClient) query(ctx context.Context, reqID string) (*AsrResponse, error) {
+func (c *AsrHttpClient) query(ctx context.Context, account Account, reqID string) (*AsrResponse, error) {
 	for {
-		body, header, err := c.doQuery(ctx, reqID)
+		body, header, err := c.doQuery(ctx, account, reqID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to do query: %w", err)
 		}
@@ -184,7 +196,7 @@ func (c *AsrHttpClient) query(ctx context.Context, reqID string) (*AsrResponse,
 			return &resp, nil
 		}
 		if code != "20000001" && code != "20000002" {
-			return nil, fmt.Errorf("response failed, status code: %s, message: %s", code, message)
+			return nil, asrStatusError(code, message)
 		}
 		time.Sleep(time.Second * 3)
 	}
@@ -197,14 +209,30 @@ func (c *AsrHttpClient) Excute(ctx context.Context, fileURL string) (*AsrRespons
 	// reqID 代表一个任务
 	reqID := uuid.New().String()
 	// submit，logID 代表一个请求
-	logID, err := c.submit(ctx, reqID, fileURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to submit request: %w", err)
+	// 账号额度用尽或鉴权失败时换下一个账号
+	var tried []string
+	var account Account
+	var logID string
+	for {
+		picked, err := c.accounts.Pick(tried)
+		if err != nil {
+			return nil, fmt.Errorf("failed to submit request: %w", err)
+		}
+		logID, err = c.submit(ctx, picked, reqID, fileURL)
+		if err == nil {
+			account = picked
+			break
+		}
+		if !c.accounts.Fail(picked, err) {
+			return nil, fmt.Errorf("failed to submit request: %w", err)
+		}
+		tried = append(tried, picked.Name)
 	}
-	grpclog.Infof("task submitted, logID: %s", logID)
-	// for loop do query
-	resp, err := c.query(ctx, reqID)
+	grpclog.Infof("task submitted, logID: %s account: %s", logID, account.Name)
+	// for loop do query, 任务属于提交它的账号
+	resp, err := c.query(ctx, account, reqID)
 	if err != nil {
+		c.accounts.Fail(account, err)
 		return nil, fmt.Errorf("task failed: %w", err)
 	}
 
@@ -1,6 +0,0 @@
-package doubao
-
-const (
-	AppID       = "3609485977"
-	AccessToken = "5cqoxvmi8jYN8-K78LdxYxL72q8m3qu5"
-)
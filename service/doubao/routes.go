@@ -0,0 +1,21 @@
+package doubao
+
+import (
+	"net/http"
+
+	"github.com/pkusunjy/grpc-gateway/service/router"
+)
+
+func (s *TTSService) Routes() []router.Route {
+	return []router.Route{
+		router.JSON(http.MethodPost, "/chat_completion.ChatService/text_to_speech", router.AuthUser, TTSRules, s.TTS),
+		router.Raw(http.MethodPost, "/chat_completion.ChatService/text_to_speech_stream", router.AuthUser, s.TTSStream),
+		router.JSON(http.MethodGet, "/chat_completion.ChatService/tts_cache_stats", router.AuthAdmin, nil, s.TTSCacheStats),
+	}
+}
+
+func (s *AsrService) Routes() []router.Route {
+	return []router.Route{
+		router.JSON(http.MethodPost, "/chat_completion.ChatService/transcribe_judge_doubao", router.AuthNone, AsrRules, s.Whisper),
+	}
+}
@@ -1,20 +1,17 @@
 package doubao
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
 	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/credentials"
-	"github.com/golang/glog"
-	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
-	"github.com/pkusunjy/openai-server-proto/chat_completion"
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/pkusunjy/grpc-gateway/service/validation"
 	"google.golang.org/grpc/grpclog"
 )
 
@@ -22,11 +19,34 @@ var (
 	flagVoiceType = flag.String("voice_type", "zh_female_shuangkuaisisi_moon_bigtts", "voice_type")
 	flagEncoding  = flag.String("encoding", "mp3", "encoding")
 	flagEndpoint  = flag.String("endpoint", "wss://openspeech.bytedance.com/api/v3/tts/bidirection", "endpoint")
+	flagTimeout   = flag.Duration("tts_timeout", time.Minute, "how long a tts session may take")
+	flagConfFile  = flag.String("doubao_file", "./conf/doubao.yaml", "doubao_file")
 )
 
+// ttsCacheControl lets clients keep audio and subtitles, their keys are
+// never reused.
+const ttsCacheControl = "max-age=31536000, immutable"
+
+// TTSRequest is the ChatMessage the route used to take plus TTSOptions,
+// which are checked against conf/doubao.yaml rather than rules. The userid
+// clients still send is ignored, audio is kept below the verified caller.
+type TTSRequest struct {
+	Content string `json:"content"`
+	TTSOptions
+}
+
+// TTSRules bounds the text sent for synthesis, each rune costs doubao quota.
+var TTSRules = validation.Rules{
+	"content": "required,max=1000",
+}
+
 type TTSService struct {
 	loc       *time.Location
 	ossClient *oss.Client
+	conf      TTSConfig
+	client    *TTSClient
+	// nil unless tts_cache is enabled
+	cache *TTSCache
 }
 
 func TTSServiceInitialize(ctx *context.Context) (*TTSService, error) {
@@ -37,31 +57,96 @@ func TTSServiceInitialize(ctx *context.Context) (*TTSService, error) {
 		WithCredentialsProvider(credentials.NewEnvironmentVariableCredentialsProvider()).
 		WithRegion(region)
 
-	return &TTSService{loc: loc, ossClient: oss.NewClient(cfg)}, nil
+	config, err := loadDoubaoConfig(*flagConfFile)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+
+	config.TTS = config.TTS.withDefaults()
+
+	accounts, err := NewAccounts(*flagConfFile)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	go accounts.Run(*ctx)
+
+	server := TTSService{loc: loc, ossClient: oss.NewClient(cfg), conf: config.TTS, client: NewTTSClient(config.TTSClient, accounts)}
+	go server.client.Run(*ctx)
+	if config.TTSCache.Enabled {
+		server.cache = NewTTSCache(config.TTSCache, server.ossClient)
+		go server.cache.Run(*ctx)
+	}
+	return &server, nil
+}
+
+// TTSResponse keeps content, the audio url of the ChatMessage the route
+// used to answer. The subtitle urls are empty when doubao sent no timing.
+type TTSResponse struct {
+	Content   string     `json:"content"`
+	Sentences []Sentence `json:"sentences,omitempty"`
+	VttUrl    string     `json:"vtt_url,omitempty"`
+	SrtUrl    string     `json:"srt_url,omitempty"`
 }
 
-func (s *TTSService) TTS(ctx context.Context, req *chat_completion.ChatMessage) (*chat_completion.ChatMessage, error) {
-	uid := req.GetUserid()
-	text := req.GetContent()
-	// 1. call api & save local audio file
-	uniqId := fmt.Sprintf("%s_%d", uid, time.Now().UnixMilli())
-	fileName, err := s.TTSImpl(uniqId, text)
+func (s *TTSService) TTS(ctx context.Context, req *TTSRequest) (*TTSResponse, error) {
+	uid := common.CallerFromContext(ctx).OpenID
+	text := req.Content
+	params, err := req.TTSOptions.resolve(s.conf)
 	if err != nil {
 		return nil, err
 	}
-	// 2. upload oss
-	cur := time.Now().In(s.loc)
-	pattern := cur.Format("2006/1/2")
-	remoteFileName := fmt.Sprintf("%s/%s", pattern, fileName)
-	_, err = s.ossClient.PutObjectFromFile(ctx, &oss.PutObjectRequest{
-		Bucket: oss.Ptr("mikiai"),
-		Key:    oss.Ptr(remoteFileName),
-	}, fileName)
+	var digest string
+	if s.cache != nil {
+		digest = ttsDigest(text, params)
+		if entry, ok := s.cache.Lookup(ctx, digest); ok {
+			resp, err := s.response(ctx, entry.Key, entry.subtitles(), entry.sentences())
+			if err == nil {
+				grpclog.Infof("tts cache hit userid:%v object:%v", uid, entry.Key)
+				return resp, nil
+			}
+		}
+	}
+	// 1. call api
+	audio, sentences, err := s.TTSImpl(ctx, text, params)
 	if err != nil {
-		grpclog.Warningf("failed to put object %v err: %v", fileName, err)
+		grpclog.Warningf("tts failed userid:%v err:%v", uid, err)
+		return nil, ttsHTTPError(err)
+	}
+	// 2. upload oss
+	remoteFileName := s.objectKey(uid, params.Format)
+	if s.cache != nil {
+		remoteFileName = s.cache.ObjectKey(digest, params.Format)
+	}
+	if err := s.putObject(ctx, remoteFileName, audioContentType(params.Format), audio); err != nil {
 		return nil, err
 	}
+	subs := s.putSubtitles(ctx, remoteFileName, sentences)
+	if s.cache != nil {
+		s.cache.Store(ctx, digest, newTTSCacheEntry(remoteFileName, audioContentType(params.Format), subs, sentences))
+	}
 	// 3. generate presigned url
+	return s.response(ctx, remoteFileName, subs, sentences)
+}
+
+// response presigns the urls of the audio and its subtitles.
+func (s *TTSService) response(ctx context.Context, remoteFileName string, subs subtitles, sentences []Sentence) (*TTSResponse, error) {
+	url, err := s.presign(ctx, remoteFileName)
+	if err != nil {
+		return nil, err
+	}
+	resp := TTSResponse{Content: url, Sentences: sentences}
+	if len(subs.VttKey) != 0 {
+		resp.VttUrl, _ = s.presign(ctx, subs.VttKey)
+	}
+	if len(subs.SrtKey) != 0 {
+		resp.SrtUrl, _ = s.presign(ctx, subs.SrtKey)
+	}
+	return &resp, nil
+}
+
+func (s *TTSService) presign(ctx context.Context, remoteFileName string) (string, error) {
 	getObjRequest := &oss.GetObjectRequest{
 		Bucket: oss.Ptr("mikiai"),
 		Key:    oss.Ptr(remoteFileName),
@@ -69,146 +154,63 @@ func (s *TTSService) TTS(ctx context.Context, req *chat_completion.ChatMessage)
 	getObjResult, err := s.ossClient.Presign(ctx, getObjRequest)
 	if err != nil {
 		grpclog.Warningf("failed to get object presign %v", err)
-		return nil, err
+		return "", err
 	}
 	grpclog.Infof("presigned url for object %s, url: %s", remoteFileName, getObjResult.URL)
-	// 4. delete local audio file
-	err = os.Remove(fileName)
-	if err != nil {
-		grpclog.Warningf("failed to remove local file %v err: %v", fileName, err)
-	}
-	return &chat_completion.ChatMessage{Content: getObjResult.URL}, nil
+	return getObjResult.URL, nil
 }
 
-func (s *TTSService) TTSImpl(uniqId string, text string) (string, error) {
-	sessionId := uuid.New().String()
-	header := NewAuthHeader(sessionId, "volc.service_type.10029")
+// objectKey is where new audio of userid is kept in oss, below a prefix
+// per user and day so that lifecycle rules and deleting a user work on
+// prefixes.
+func (s *TTSService) objectKey(userid string, format string) string {
+	cur := time.Now().In(s.loc)
+	return fmt.Sprintf("%s%s/%s/%d.%s", s.conf.ObjectPrefix, objectKeyPart(userid), cur.Format("2006-01-02"), cur.UnixMilli(), audioExtension(format))
+}
 
-	conn, r, err := websocket.DefaultDialer.DialContext(context.Background(), *flagEndpoint, header)
-	if err != nil {
-		glog.Exit(r, err)
-	}
-	defer func() {
-		err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-		if err != nil {
-			glog.Exit(err)
-		}
-		conn.Close()
-	}()
-	glog.Info("Connection established, Logid: ", r.Header.Get("x-tt-logid"))
-	if err := StartConnection(conn); err != nil {
-		glog.Exit(err)
-	}
-	msg, err := WaitForEvent(conn, MsgTypeFullServerResponse, EventType_ConnectionStarted)
-	if err != nil {
-		glog.Exit(msg, err)
-	}
-	defer func() {
-		// ----------------finish connection----------------
-		if err := FinishConnection(conn); err != nil {
-			glog.Exit(err)
-		}
-		// ----------------wait connection finished----------------
-		msg, err := WaitForEvent(conn, MsgTypeFullServerResponse, EventType_ConnectionFinished)
-		if err != nil {
-			glog.Exit(msg, err)
+// objectKeyPart keeps userid from adding directories to a key.
+func objectKeyPart(userid string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
 		}
-	}()
-
-	request := map[string]any{
-		"user": map[string]any{
-			"uid": sessionId,
-		},
-		"namespace": "BidirectionalTTS",
-		"req_params": map[string]any{
-			"speaker": *flagVoiceType,
-			"audio_params": map[string]any{
-				"format":           *flagEncoding,
-				"sample_rate":      24000,
-				"enable_timestamp": true,
-			},
-			"additions": func() string {
-				str, _ := json.Marshal(map[string]any{
-					"disable_markdown_filter": false,
-				})
-				return string(str)
-			}(),
-		},
-	}
-
-	startReq := map[string]any{
-		"user":       request["user"],
-		"event":      int(EventType_StartSession),
-		"namespace":  request["namespace"],
-		"req_params": request["req_params"],
-	}
-	payload, err := json.Marshal(&startReq)
+	}, userid)
+}
+
+// putObject uploads content from memory. Objects are never overwritten
+// with other content, a key names one audio, so they may be cached for
+// good.
+func (s *TTSService) putObject(ctx context.Context, key string, contentType string, content []byte) error {
+	_, err := s.ossClient.PutObject(ctx, &oss.PutObjectRequest{
+		Bucket:        oss.Ptr("mikiai"),
+		Key:           oss.Ptr(key),
+		ContentType:   oss.Ptr(contentType),
+		CacheControl:  oss.Ptr(ttsCacheControl),
+		ContentLength: oss.Ptr(int64(len(content))),
+		Body:          bytes.NewReader(content),
+	})
 	if err != nil {
-		glog.Exit(err)
-	}
-	// ----------------start session----------------
-	if err := StartSession(conn, payload, sessionId); err != nil {
-		glog.Exit(err)
+		grpclog.Warningf("failed to put object %v err: %v", key, err)
 	}
-	msg, err = WaitForEvent(conn, MsgTypeFullServerResponse, EventType_SessionStarted)
-	if err != nil {
-		glog.Exit(msg, err)
-	}
-	go func() {
-		t := time.NewTicker(5 * time.Millisecond)
-		defer t.Stop()
-		for _, char := range text {
-			request["req_params"].(map[string]any)["text"] = string(char)
-			ttsReq := map[string]any{
-				"user":       request["user"],
-				"event":      int(EventType_TaskRequest),
-				"namespace":  request["namespace"],
-				"req_params": request["req_params"],
-			}
-			payload, err := json.Marshal(&ttsReq)
-			if err != nil {
-				glog.Exit(err)
-			}
-			// ----------------send task request----------------
-			if err := TaskRequest(conn, payload, sessionId); err != nil {
-				glog.Exit(err)
-			}
-			<-t.C
-		}
-		if err := FinishSession(conn, sessionId); err != nil {
-			glog.Exit(err)
-		}
-	}()
+	return err
+}
 
+// TTSImpl synthesizes text into memory.
+func (s *TTSService) TTSImpl(ctx context.Context, text string, params audioParams) ([]byte, []Sentence, error) {
 	var audio []byte
-	var fileName string
-	for {
-		msg, err := ReceiveMessage(conn)
-		if err != nil {
-			glog.Exit(msg, err)
-		}
-		switch msg.MsgType {
-		case MsgTypeFullServerResponse:
-		case MsgTypeAudioOnlyServer:
-			audio = append(audio, msg.Payload...)
-		default:
-			glog.Exit(msg)
-		}
-		if msg.EventType == EventType_SessionFinished {
-			break
-		}
-		if len(audio) == 0 {
-			continue
-		}
-		fileName = "text_to_speech_" + uniqId + "." + string(*flagEncoding)
-		if err := os.WriteFile(fileName, audio, 0644); err != nil {
-			glog.Exit(err)
-		}
-		glog.Infof("audio received: %d, saved to %s", len(audio), fileName)
+	sentences, err := s.client.Synthesize(ctx, text, params, func(chunk []byte) error {
+		audio = append(audio, chunk...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-
-	if len(fileName) == 0 {
-		return "", errors.New("no audio received")
+	if len(audio) == 0 {
+		return nil, nil, ErrNoAudio
 	}
-	return fileName, nil
+	grpclog.Infof("audio received: %d", len(audio))
+	return audio, sentences, nil
 }
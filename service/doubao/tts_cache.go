@@ -0,0 +1,334 @@
+package doubao
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	ttsCacheRedisPrefix = "doubao:tts_cache"
+	ttsCacheEvictBatch  = 100
+)
+
+// TTSCacheConfig is the tts_cache part of conf/doubao.yaml.
+type TTSCacheConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	RedisAddr    string `yaml:"redis_addr"`
+	ObjectPrefix string `yaml:"object_prefix"`
+	MaxIdleDays  int    `yaml:"max_idle_days"`
+	EvictHours   int    `yaml:"evict_hours"`
+}
+
+// TTSCache maps the text and audio params of a synthesis to the oss object
+// holding its audio, so that prompts read aloud again and again are only
+// synthesized once. Entries unused for MaxIdleDays are evicted together
+// with their object.
+//
+// Redis keeps an entry hash per digest, an index sorted by last use, the
+// hit and miss counters and the objects eviction has yet to delete.
+type TTSCache struct {
+	TTSCacheConfig
+	redisClient *redis.Client
+	ossClient   *oss.Client
+}
+
+type ttsCacheEntry struct {
+	Key         string `redis:"key"`
+	ContentType string `redis:"content_type"`
+	VttKey      string `redis:"vtt_key"`
+	SrtKey      string `redis:"srt_key"`
+	// json of the []Sentence
+	Sentences string `redis:"sentences"`
+	CreatedAt int64  `redis:"created_at"`
+}
+
+func newTTSCacheEntry(key string, contentType string, subs subtitles, sentences []Sentence) ttsCacheEntry {
+	entry := ttsCacheEntry{
+		Key:         key,
+		ContentType: contentType,
+		VttKey:      subs.VttKey,
+		SrtKey:      subs.SrtKey,
+		CreatedAt:   time.Now().Unix(),
+	}
+	if len(sentences) != 0 {
+		content, _ := json.Marshal(sentences)
+		entry.Sentences = string(content)
+	}
+	return entry
+}
+
+func (e *ttsCacheEntry) subtitles() subtitles {
+	return subtitles{VttKey: e.VttKey, SrtKey: e.SrtKey}
+}
+
+func (e *ttsCacheEntry) sentences() []Sentence {
+	var sentences []Sentence
+	if len(e.Sentences) != 0 {
+		json.Unmarshal([]byte(e.Sentences), &sentences)
+	}
+	return sentences
+}
+
+func NewTTSCache(config TTSCacheConfig, ossClient *oss.Client) *TTSCache {
+	if config.MaxIdleDays <= 0 {
+		config.MaxIdleDays = 30
+	}
+	if config.EvictHours <= 0 {
+		config.EvictHours = 6
+	}
+	if len(config.ObjectPrefix) == 0 {
+		config.ObjectPrefix = "tts_cache/"
+	}
+	return &TTSCache{
+		TTSCacheConfig: config,
+		redisClient: redis.NewClient(&redis.Options{
+			Addr:     config.RedisAddr,
+			Password: "",
+			DB:       0,
+		}),
+		ossClient: ossClient,
+	}
+}
+
+// ttsDigest identifies what a session synthesizes, every audio param
+// changes the audio.
+func ttsDigest(text string, params audioParams) string {
+	content, _ := json.Marshal(struct {
+		Text   string      `json:"text"`
+		Params audioParams `json:"params"`
+	}{text, params})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// ObjectKey spreads the objects over 256 prefixes below ObjectPrefix.
+func (c *TTSCache) ObjectKey(digest string, format string) string {
+	return c.ObjectPrefix + digest[:2] + "/" + digest + "." + audioExtension(format)
+}
+
+func (c *TTSCache) entryKey(digest string) string {
+	return ttsCacheRedisPrefix + ":entry:" + digest
+}
+
+func (c *TTSCache) indexKey() string {
+	return ttsCacheRedisPrefix + ":index"
+}
+
+func (c *TTSCache) statsKey() string {
+	return ttsCacheRedisPrefix + ":stats"
+}
+
+// orphansKey holds the object keys of evicted entries by digest until they
+// are deleted.
+func (c *TTSCache) orphansKey() string {
+	return ttsCacheRedisPrefix + ":orphans"
+}
+
+// Lookup counts a hit or a miss, a hit also renews the entry. Redis errors
+// are misses that are not counted.
+func (c *TTSCache) Lookup(ctx context.Context, digest string) (*ttsCacheEntry, bool) {
+	var entry ttsCacheEntry
+	if err := c.redisClient.HGetAll(ctx, c.entryKey(digest)).Scan(&entry); err != nil {
+		grpclog.Warningf("tts cache lookup failed digest:%v err:%v", digest, err)
+		return nil, false
+	}
+	if len(entry.Key) == 0 {
+		c.redisClient.HIncrBy(ctx, c.statsKey(), "misses", 1)
+		return nil, false
+	}
+	pipe := c.redisClient.TxPipeline()
+	pipe.ZAdd(ctx, c.indexKey(), redis.Z{Score: float64(time.Now().Unix()), Member: digest})
+	pipe.HIncrBy(ctx, c.statsKey(), "hits", 1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		grpclog.Warningf("tts cache touch failed digest:%v err:%v", digest, err)
+	}
+	return &entry, true
+}
+
+// Store records an uploaded object.
+func (c *TTSCache) Store(ctx context.Context, digest string, entry ttsCacheEntry) {
+	pipe := c.redisClient.TxPipeline()
+	pipe.HSet(ctx, c.entryKey(digest), entry)
+	pipe.ZAdd(ctx, c.indexKey(), redis.Z{Score: float64(entry.CreatedAt), Member: digest})
+	if _, err := pipe.Exec(ctx); err != nil {
+		grpclog.Warningf("tts cache store failed digest:%v err:%v", digest, err)
+	}
+}
+
+// Run evicts idle entries every EvictHours until ctx is done.
+func (c *TTSCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(c.EvictHours) * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			evicted, err := c.Evict(ctx)
+			if err != nil {
+				grpclog.Errorf("tts cache evict failed error: %v", err)
+			}
+			grpclog.Infof("tts cache evicted %d entries", evicted)
+		}
+	}
+}
+
+// ttsCacheClaimScript removes the entry of digest ARGV[1] from index
+// KEYS[1] and entry hash KEYS[2] if it was last used by ARGV[2]. The check
+// is atomic with the removal, so a Lookup renewing the entry in between
+// keeps it. It answers the object keys of the removed entry.
+var ttsCacheClaimScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) > tonumber(ARGV[2]) then
+	return false
+end
+local keys = redis.call('HMGET', KEYS[2], 'key', 'vtt_key', 'srt_key')
+redis.call('DEL', KEYS[2])
+redis.call('ZREM', KEYS[1], ARGV[1])
+return keys
+`)
+
+// Evict removes the entries unused for MaxIdleDays and deletes their audio
+// and subtitles. Entries leave redis before their objects are deleted, so
+// that no request is answered with an object about to go. Objects that
+// cannot be deleted are recorded and retried by the next run.
+func (c *TTSCache) Evict(ctx context.Context) (int, error) {
+	c.retryOrphans(ctx)
+	before := time.Now().AddDate(0, 0, -c.MaxIdleDays).Unix()
+	evicted := 0
+	for {
+		digests, err := c.redisClient.ZRangeByScore(ctx, c.indexKey(), &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(before, 10),
+			Count: ttsCacheEvictBatch,
+		}).Result()
+		if err != nil {
+			return evicted, err
+		}
+		claimed := 0
+		for _, digest := range digests {
+			keys, ok, err := c.claim(ctx, digest, before)
+			if err != nil {
+				return evicted, err
+			}
+			if !ok {
+				continue
+			}
+			claimed++
+			c.deleteEvicted(ctx, digest, keys)
+		}
+		evicted += claimed
+		if len(digests) < ttsCacheEvictBatch || claimed == 0 {
+			return evicted, nil
+		}
+	}
+}
+
+// claim runs ttsCacheClaimScript, it is false if the entry was used after
+// before or is gone.
+func (c *TTSCache) claim(ctx context.Context, digest string, before int64) ([]string, bool, error) {
+	result, err := ttsCacheClaimScript.Run(ctx, c.redisClient, []string{c.indexKey(), c.entryKey(digest)}, digest, before).Slice()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var keys []string
+	for _, key := range result {
+		if key, ok := key.(string); ok && len(key) != 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys, true, nil
+}
+
+// deleteEvicted deletes the objects of an evicted entry. They are left
+// alone if digest was cached again meanwhile, the new entry has the same
+// object keys.
+func (c *TTSCache) deleteEvicted(ctx context.Context, digest string, keys []string) bool {
+	cached, err := c.redisClient.Exists(ctx, c.entryKey(digest)).Result()
+	if err == nil && cached != 0 {
+		return true
+	}
+	if err == nil && c.deleteObjects(ctx, keys...) {
+		return true
+	}
+	content, _ := json.Marshal(keys)
+	if err := c.redisClient.HSet(ctx, c.orphansKey(), digest, content).Err(); err != nil {
+		grpclog.Errorf("tts cache record orphans failed digest:%v keys:%v err:%v", digest, keys, err)
+	}
+	return false
+}
+
+// retryOrphans deletes the objects earlier runs failed to delete.
+func (c *TTSCache) retryOrphans(ctx context.Context) {
+	orphans, err := c.redisClient.HGetAll(ctx, c.orphansKey()).Result()
+	if err != nil {
+		grpclog.Warningf("tts cache list orphans failed err:%v", err)
+		return
+	}
+	for digest, content := range orphans {
+		var keys []string
+		json.Unmarshal([]byte(content), &keys)
+		if c.deleteEvicted(ctx, digest, keys) {
+			c.redisClient.HDel(ctx, c.orphansKey(), digest)
+		}
+	}
+}
+
+func (c *TTSCache) deleteObjects(ctx context.Context, keys ...string) bool {
+	for _, key := range keys {
+		_, err := c.ossClient.DeleteObject(ctx, &oss.DeleteObjectRequest{
+			Bucket: oss.Ptr("mikiai"),
+			Key:    oss.Ptr(key),
+		})
+		if err != nil {
+			grpclog.Warningf("tts cache delete object %v failed err:%v", key, err)
+			return false
+		}
+	}
+	return true
+}
+
+type TTSCacheStatsRequest struct{}
+
+type TTSCacheStatsResponse struct {
+	Hits    int64   `json:"hits" redis:"hits"`
+	Misses  int64   `json:"misses" redis:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	Entries int64   `json:"entries"`
+}
+
+func (c *TTSCache) Stats(ctx context.Context) (*TTSCacheStatsResponse, error) {
+	var resp TTSCacheStatsResponse
+	if err := c.redisClient.HGetAll(ctx, c.statsKey()).Scan(&resp); err != nil {
+		return nil, err
+	}
+	entries, err := c.redisClient.ZCard(ctx, c.indexKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	resp.Entries = entries
+	if total := resp.Hits + resp.Misses; total != 0 {
+		resp.HitRate = float64(resp.Hits) / float64(total)
+	}
+	return &resp, nil
+}
+
+func (s *TTSService) TTSCacheStats(ctx context.Context, req *TTSCacheStatsRequest) (*TTSCacheStatsResponse, error) {
+	if s.cache == nil {
+		return nil, common.NewHTTPError(http.StatusNotFound, "tts cache disabled")
+	}
+	return s.cache.Stats(ctx)
+}
@@ -0,0 +1,139 @@
+package doubao
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss/credentials"
+)
+
+// fakeOSS records the deleted keys, deletes fail while failing is set.
+type fakeOSS struct {
+	mu      sync.Mutex
+	failing bool
+	deleted []string
+}
+
+func (f *fakeOSS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Method != http.MethodDelete {
+		http.NotFound(w, r)
+		return
+	}
+	if f.failing {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>InternalError</Code><Message>test</Message></Error>`))
+		return
+	}
+	f.deleted = append(f.deleted, strings.TrimPrefix(r.URL.Path, "/mikiai/"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeOSS) setFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func (f *fakeOSS) takeDeleted() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deleted := f.deleted
+	f.deleted = nil
+	slices.Sort(deleted)
+	return deleted
+}
+
+func newTestTTSCache(t *testing.T) (*TTSCache, *fakeOSS) {
+	t.Helper()
+	store := &fakeOSS{}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+	cfg := oss.LoadDefaultConfig().
+		WithCredentialsProvider(credentials.NewStaticCredentialsProvider("ak", "sk")).
+		WithRegion("cn-hangzhou").
+		WithEndpoint(server.URL).
+		WithUsePathStyle(true).
+		WithRetryMaxAttempts(1)
+	cache := NewTTSCache(TTSCacheConfig{Enabled: true, RedisAddr: miniredis.RunT(t).Addr(), MaxIdleDays: 1}, oss.NewClient(cfg))
+	return cache, store
+}
+
+// storeIdle caches digest as last used days ago.
+func storeIdle(t *testing.T, cache *TTSCache, digest string, days int) {
+	t.Helper()
+	entry := newTTSCacheEntry(cache.ObjectKey(digest, "mp3"), "audio/mpeg", subtitles{}, nil)
+	entry.CreatedAt = time.Now().AddDate(0, 0, -days).Unix()
+	cache.Store(context.Background(), digest, entry)
+}
+
+func TestTTSCacheEvict(t *testing.T) {
+	cache, store := newTestTTSCache(t)
+	ctx := context.Background()
+	storeIdle(t, cache, "aaaa", 2)
+	storeIdle(t, cache, "bbbb", 2)
+	storeIdle(t, cache, "cccc", 0)
+
+	// a lookup between listing and claiming keeps the entry
+	cache.Lookup(ctx, "bbbb")
+	if _, ok, err := cache.claim(ctx, "bbbb", time.Now().Add(-time.Hour).Unix()); ok || err != nil {
+		t.Fatalf("claimed an entry used since %v", err)
+	}
+
+	evicted, err := cache.Evict(ctx)
+	if err != nil || evicted != 1 {
+		t.Fatalf("evict = %d %v", evicted, err)
+	}
+	if deleted := store.takeDeleted(); !slices.Equal(deleted, []string{"tts_cache/aa/aaaa.mp3"}) {
+		t.Fatalf("deleted %v", deleted)
+	}
+	for digest, cached := range map[string]bool{"aaaa": false, "bbbb": true, "cccc": true} {
+		if _, ok := cache.Lookup(ctx, digest); ok != cached {
+			t.Fatalf("lookup %s after evict = %v", digest, ok)
+		}
+	}
+}
+
+func TestTTSCacheEvictFailingDeletes(t *testing.T) {
+	cache, store := newTestTTSCache(t)
+	ctx := context.Background()
+	for _, digest := range []string{"aaaa", "bbbb", "cccc"} {
+		storeIdle(t, cache, digest, 2)
+	}
+
+	// the entries go even though their objects stay
+	store.setFailing(true)
+	evicted, err := cache.Evict(ctx)
+	if err != nil || evicted != 3 {
+		t.Fatalf("evict with failing deletes = %d %v", evicted, err)
+	}
+	if stats, _ := cache.Stats(ctx); stats.Entries != 0 {
+		t.Fatalf("entries after evict %d", stats.Entries)
+	}
+
+	// the next run deletes them, except the one that was cached again
+	storeIdle(t, cache, "cccc", 0)
+	store.setFailing(false)
+	if evicted, err = cache.Evict(ctx); err != nil || evicted != 0 {
+		t.Fatalf("second evict = %d %v", evicted, err)
+	}
+	if deleted := store.takeDeleted(); !slices.Equal(deleted, []string{"tts_cache/aa/aaaa.mp3", "tts_cache/bb/bbbb.mp3"}) {
+		t.Fatalf("deleted %v", deleted)
+	}
+	if orphans, _ := cache.redisClient.HLen(ctx, cache.orphansKey()).Result(); orphans != 0 {
+		t.Fatalf("orphans left %d", orphans)
+	}
+	if _, err := cache.Evict(ctx); err != nil || len(store.takeDeleted()) != 0 {
+		t.Fatalf("third evict deleted again %v", err)
+	}
+}
@@ -0,0 +1,702 @@
+package doubao
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	// a write to a healthy connection never takes this long
+	ttsWriteTimeout = 10 * time.Second
+	// how often idle connections are closed and warm ones dialed
+	ttsPoolInterval = 10 * time.Second
+	// messages of a session waiting for it, a session that lets it fill up
+	// fails rather than hold up the other sessions of its connection
+	ttsSessionBuffer = 64
+	// where text is cut into task requests
+	ttsSentenceEnds = "。！？；!?;\n"
+)
+
+// ErrTTSBusy is returned when max_queue sessions are already waiting.
+var ErrTTSBusy = errors.New("too many tts sessions")
+
+var errTTSConnClosed = errors.New("tts connection closed")
+
+var errTTSSessionBehind = errors.New("tts session fell behind")
+
+// TTSClientConfig is the tts_client part of conf/doubao.yaml.
+type TTSClientConfig struct {
+	MaxSessions     int `yaml:"max_sessions"`
+	MaxQueue        int `yaml:"max_queue"`
+	SessionsPerConn int `yaml:"sessions_per_conn"`
+	WarmConns       int `yaml:"warm_conns"`
+	IdleSeconds     int `yaml:"idle_seconds"`
+	ChunkRunes      int `yaml:"chunk_runes"`
+}
+
+// TTSClient runs tts sessions on a pool of doubao websocket connections.
+// Connections are kept open between sessions, which tell their messages
+// apart by session id, so that a session only costs a StartSession round
+// trip. At most MaxSessions sessions run at once, up to MaxQueue more wait
+// for one of them to finish. Each connection belongs to one of accounts.
+type TTSClient struct {
+	TTSClientConfig
+	accounts *Accounts
+	slots    chan struct{}
+	queued   atomic.Int64
+
+	mu    sync.Mutex
+	conns []*ttsConn
+}
+
+// ttsConn is a pooled connection. A reader goroutine hands each message to
+// the session it belongs to, writes are serialized by writeMu.
+type ttsConn struct {
+	ws      *websocket.Conn
+	account Account
+	writeMu sync.Mutex
+	// closed with err set once the connection is unusable
+	done     chan struct{}
+	failOnce sync.Once
+
+	mu       sync.Mutex
+	err      error
+	sessions map[string]*ttsSession
+
+	// guarded by TTSClient.mu
+	active    int
+	idleSince time.Time
+	// no new sessions, closed once active drops to 0
+	retired bool
+}
+
+type ttsSession struct {
+	id       string
+	conn     *ttsConn
+	messages chan *Message
+	// closed when the session stops reading
+	done chan struct{}
+	// closed with err set when the connection gave up on the session
+	failed   chan struct{}
+	failOnce sync.Once
+	err      error
+}
+
+func NewTTSClient(config TTSClientConfig, accounts *Accounts) *TTSClient {
+	if config.MaxSessions <= 0 {
+		config.MaxSessions = 10
+	}
+	if config.MaxQueue <= 0 {
+		config.MaxQueue = 50
+	}
+	if config.SessionsPerConn <= 0 {
+		config.SessionsPerConn = 1
+	}
+	if config.WarmConns < 0 {
+		config.WarmConns = 0
+	}
+	if config.IdleSeconds <= 0 {
+		config.IdleSeconds = 60
+	}
+	if config.ChunkRunes <= 0 {
+		config.ChunkRunes = 100
+	}
+	return &TTSClient{
+		TTSClientConfig: config,
+		accounts:        accounts,
+		slots:           make(chan struct{}, config.MaxSessions),
+	}
+}
+
+// Run keeps WarmConns connections open and closes the idle ones beyond
+// them until ctx is done, then closes every connection.
+func (c *TTSClient) Run(ctx context.Context) {
+	ticker := time.NewTicker(ttsPoolInterval)
+	defer ticker.Stop()
+	for {
+		c.maintain(ctx)
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			conns := c.conns
+			c.conns = nil
+			c.mu.Unlock()
+			for _, conn := range conns {
+				conn.close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *TTSClient) maintain(ctx context.Context) {
+	idleTimeout := time.Duration(c.IdleSeconds) * time.Second
+	c.mu.Lock()
+	live := 0
+	for _, conn := range c.conns {
+		if !c.accounts.Current(conn.account) {
+			conn.retired = true
+		}
+		if !conn.retired && !conn.broken() {
+			live++
+		}
+	}
+	var keep, closing []*ttsConn
+	for _, conn := range c.conns {
+		switch {
+		case conn.active != 0:
+			keep = append(keep, conn)
+		case conn.retired || conn.broken():
+			closing = append(closing, conn)
+		case live > c.WarmConns && time.Since(conn.idleSince) > idleTimeout:
+			live--
+			closing = append(closing, conn)
+		default:
+			keep = append(keep, conn)
+		}
+	}
+	c.conns = keep
+	c.mu.Unlock()
+	for _, conn := range closing {
+		conn.close()
+	}
+
+	for ; live < c.WarmConns && ctx.Err() == nil; live++ {
+		dialCtx, cancel := context.WithTimeout(ctx, ttsWriteTimeout)
+		conn, err := c.dialAny(dialCtx, nil)
+		cancel()
+		if err != nil {
+			grpclog.Warningf("tts warm connection failed err:%v", err)
+			return
+		}
+		c.mu.Lock()
+		c.conns = append(c.conns, conn)
+		c.mu.Unlock()
+	}
+}
+
+// Synthesize runs a doubao tts session for text and hands the audio to
+// onAudio chunk by chunk, as soon as each chunk arrives. An error of onAudio
+// aborts the session. The session is bounded by ctx and -tts_timeout,
+// including the wait for a free slot. It returns the timing of the
+// sentences doubao sent.
+func (c *TTSClient) Synthesize(ctx context.Context, text string, params audioParams, onAudio func(chunk []byte) error) ([]Sentence, error) {
+	ctx, cancel := context.WithTimeout(ctx, *flagTimeout)
+	defer cancel()
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	sessionId := uuid.New().String()
+	request := map[string]any{
+		"user": map[string]any{
+			"uid": sessionId,
+		},
+		"namespace":  "BidirectionalTTS",
+		"req_params": params.requestParams(),
+	}
+	startReq := map[string]any{
+		"user":       request["user"],
+		"event":      int(EventType_StartSession),
+		"namespace":  request["namespace"],
+		"req_params": request["req_params"],
+	}
+	payload, err := json.Marshal(&startReq)
+	if err != nil {
+		return nil, sessionError(ctx, ttsStageStartSession, err)
+	}
+
+	// a session rejected by an account moves on to the next account, and a
+	// pooled connection closed by doubao while it was idle gets one more try
+	// on a new connection
+	var session *ttsSession
+	var tried []string
+	retried := false
+	for {
+		conn, fresh, err := c.conn(ctx, tried)
+		if err != nil {
+			return nil, err
+		}
+		session, err = conn.startSession(ctx, sessionId, payload)
+		if err == nil {
+			break
+		}
+		c.put(conn, false)
+		if ctx.Err() != nil {
+			return nil, sessionError(ctx, ttsStageStartSession, err)
+		}
+		if c.accounts.Fail(conn.account, err) {
+			c.retire(conn.account)
+			tried = append(tried, conn.account.Name)
+			if _, pickErr := c.accounts.Pick(tried); pickErr != nil {
+				return nil, sessionError(ctx, ttsStageStartSession, err)
+			}
+			continue
+		}
+		var serverErr *ServerError
+		if fresh || retried || errors.As(err, &serverErr) {
+			return nil, sessionError(ctx, ttsStageStartSession, err)
+		}
+		retried = true
+		grpclog.Warningf("tts pooled connection failed session:%v err:%v", sessionId, err)
+	}
+
+	// the sender owns the session's writes until it is done
+	sendCtx, cancelSend := context.WithCancel(ctx)
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- session.sendText(sendCtx, request, textChunks(text, c.ChunkRunes))
+	}()
+	var t timeline
+	err = session.receiveAudio(ctx, onAudio, &t)
+	cancelSend()
+	senderErr := <-sendErr
+	c.endSession(session, err == nil && senderErr == nil)
+	if err != nil && c.accounts.Fail(session.conn.account, err) {
+		c.retire(session.conn.account)
+	}
+
+	if senderErr != nil && !errors.Is(senderErr, context.Canceled) {
+		// a failed send usually makes the receive fail as well, report the cause
+		return nil, sessionError(ctx, ttsStageSend, senderErr)
+	}
+	var outputErr *TTSError
+	if errors.As(err, &outputErr) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, sessionError(ctx, ttsStageReceive, err)
+	}
+	return t.result(), nil
+}
+
+// acquire waits for one of the MaxSessions slots.
+func (c *TTSClient) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-c.slots }
+	select {
+	case c.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if c.queued.Add(1) > int64(c.MaxQueue) {
+		c.queued.Add(-1)
+		return nil, &TTSError{Stage: ttsStageQueue, Err: ErrTTSBusy}
+	}
+	defer c.queued.Add(-1)
+	select {
+	case c.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, sessionError(ctx, ttsStageQueue, ctx.Err())
+	}
+}
+
+// conn picks the least busy connection with room for a session of an
+// account not in tried, or dials one. fresh tells whether it was dialed for
+// this session.
+func (c *TTSClient) conn(ctx context.Context, tried []string) (conn *ttsConn, fresh bool, err error) {
+	c.mu.Lock()
+	var best *ttsConn
+	for _, conn := range c.conns {
+		if !c.accounts.Current(conn.account) {
+			conn.retired = true
+		}
+		if conn.retired || conn.broken() || conn.active >= c.SessionsPerConn || slices.Contains(tried, conn.account.Name) {
+			continue
+		}
+		if best == nil || conn.active < best.active {
+			best = conn
+		}
+	}
+	if best != nil {
+		best.active++
+		c.mu.Unlock()
+		return best, false, nil
+	}
+	c.mu.Unlock()
+
+	conn, err = c.dialAny(ctx, tried)
+	if err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	conn.active++
+	c.conns = append(c.conns, conn)
+	c.mu.Unlock()
+	return conn, true, nil
+}
+
+// put hands a connection back. One whose session did not finish may still
+// get its messages, it is retired instead of reused.
+func (c *TTSClient) put(conn *ttsConn, finished bool) {
+	c.mu.Lock()
+	conn.active--
+	conn.idleSince = time.Now()
+	if !finished {
+		conn.retired = true
+	}
+	closing := conn.active == 0 && (conn.retired || conn.broken())
+	if closing {
+		for i, pooled := range c.conns {
+			if pooled == conn {
+				c.conns = append(c.conns[:i], c.conns[i+1:]...)
+				break
+			}
+		}
+	}
+	c.mu.Unlock()
+	if closing {
+		conn.close()
+	}
+}
+
+// endSession stops routing messages to session, an unfinished session is
+// cancelled in case its connection is shared.
+func (c *TTSClient) endSession(session *ttsSession, finished bool) {
+	session.conn.unregister(session)
+	if !finished && !session.conn.broken() && !session.broken() {
+		err := session.conn.write(func(ws *websocket.Conn) error {
+			return CancelSession(ws, session.id)
+		})
+		if err != nil {
+			grpclog.Warningf("tts cancel session failed session:%v err:%v", session.id, err)
+		}
+	}
+	c.put(session.conn, finished)
+}
+
+// retire keeps new sessions off the connections of account.
+func (c *TTSClient) retire(account Account) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.conns {
+		if conn.account.Name == account.Name {
+			conn.retired = true
+		}
+	}
+}
+
+// dialAny dials with an account not in tried, moving on to the next account
+// when one is rejected.
+func (c *TTSClient) dialAny(ctx context.Context, tried []string) (*ttsConn, error) {
+	var lastErr error
+	for {
+		account, err := c.accounts.Pick(tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, sessionError(ctx, ttsStageDial, err)
+		}
+		conn, err := c.dial(ctx, account)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil || !c.accounts.Fail(account, err) {
+			return nil, err
+		}
+		tried = append(tried, account.Name)
+		lastErr = err
+	}
+}
+
+func (c *TTSClient) dial(ctx context.Context, account Account) (*ttsConn, error) {
+	header := NewAuthHeader(account, uuid.New().String(), account.TTSResourceID)
+	ws, r, err := websocket.DefaultDialer.DialContext(ctx, *flagEndpoint, header)
+	if err != nil {
+		if r != nil {
+			if statusErr := statusError(r.StatusCode); statusErr != nil {
+				err = statusErr
+			}
+		}
+		return nil, sessionError(ctx, ttsStageDial, err)
+	}
+	grpclog.Infof("tts connection established logid:%v", r.Header.Get("x-tt-logid"))
+	// a blocked handshake returns once ctx is done
+	stop := context.AfterFunc(ctx, func() { ws.Close() })
+	defer stop()
+	if err := StartConnection(ws); err != nil {
+		ws.Close()
+		return nil, sessionError(ctx, ttsStageStartConnection, err)
+	}
+	if _, err := WaitForEvent(ws, MsgTypeFullServerResponse, EventType_ConnectionStarted); err != nil {
+		ws.Close()
+		return nil, sessionError(ctx, ttsStageStartConnection, err)
+	}
+	if !stop() {
+		return nil, sessionError(ctx, ttsStageStartConnection, errTTSConnClosed)
+	}
+	conn := &ttsConn{
+		ws:        ws,
+		account:   account,
+		done:      make(chan struct{}),
+		sessions:  make(map[string]*ttsSession),
+		idleSince: time.Now(),
+	}
+	go conn.read()
+	return conn, nil
+}
+
+// read routes messages to their sessions until the connection fails. An
+// error without a session fails every session of the connection, a session
+// whose messages pile up fails alone.
+func (c *ttsConn) read() {
+	for {
+		msg, err := ReceiveMessage(c.ws)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if msg.MsgType == MsgTypeError && len(msg.SessionID) == 0 {
+			c.fail(&ServerError{Code: msg.ErrorCode, Msg: string(msg.Payload)})
+			return
+		}
+		c.mu.Lock()
+		session, ok := c.sessions[msg.SessionID]
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case session.messages <- msg:
+		case <-session.done:
+		default:
+			c.failSession(session, errTTSSessionBehind)
+		}
+	}
+}
+
+// failSession stops routing messages to session and finishes it at doubao,
+// the session gets err once it read what was routed to it.
+func (c *ttsConn) failSession(session *ttsSession, err error) {
+	session.failOnce.Do(func() {
+		session.err = err
+		close(session.failed)
+		c.mu.Lock()
+		delete(c.sessions, session.id)
+		c.mu.Unlock()
+		grpclog.Warningf("tts session failed session:%v err:%v", session.id, err)
+		// the reader must not wait for a write
+		go func() {
+			err := c.write(func(ws *websocket.Conn) error {
+				return FinishSession(ws, session.id)
+			})
+			if err != nil {
+				grpclog.Warningf("tts finish session failed session:%v err:%v", session.id, err)
+			}
+		}()
+	})
+}
+
+func (c *ttsConn) fail(err error) {
+	c.failOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+		c.ws.Close()
+	})
+}
+
+func (c *ttsConn) broken() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *ttsConn) connErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// close says goodbye to doubao, failures do not matter anymore.
+func (c *ttsConn) close() {
+	if !c.broken() {
+		c.write(func(ws *websocket.Conn) error {
+			if err := FinishConnection(ws); err != nil {
+				return err
+			}
+			return ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		})
+	}
+	c.fail(errTTSConnClosed)
+}
+
+func (c *ttsConn) write(send func(ws *websocket.Conn) error) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(ttsWriteTimeout))
+	return send(c.ws)
+}
+
+func (c *ttsConn) unregister(session *ttsSession) {
+	c.mu.Lock()
+	delete(c.sessions, session.id)
+	c.mu.Unlock()
+	close(session.done)
+}
+
+// startSession starts a session and waits until doubao accepted it.
+func (c *ttsConn) startSession(ctx context.Context, sessionId string, payload []byte) (*ttsSession, error) {
+	session := &ttsSession{
+		id:       sessionId,
+		conn:     c,
+		messages: make(chan *Message, ttsSessionBuffer),
+		done:     make(chan struct{}),
+		failed:   make(chan struct{}),
+	}
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.sessions[sessionId] = session
+	c.mu.Unlock()
+
+	err := c.write(func(ws *websocket.Conn) error {
+		return StartSession(ws, payload, sessionId)
+	})
+	if err == nil {
+		var msg *Message
+		msg, err = session.receive(ctx)
+		if err == nil && (msg.MsgType != MsgTypeFullServerResponse || msg.EventType != EventType_SessionStarted) {
+			err = fmt.Errorf("unexpected message: %s", msg)
+		}
+	}
+	if err != nil {
+		c.unregister(session)
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *ttsSession) receive(ctx context.Context) (*Message, error) {
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-s.conn.done:
+		// messages that arrived before the connection failed come first
+		select {
+		case msg := <-s.messages:
+			return msg, nil
+		default:
+			return nil, s.conn.connErr()
+		}
+	case <-s.failed:
+		select {
+		case msg := <-s.messages:
+			return msg, nil
+		default:
+			return nil, s.err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *ttsSession) broken() bool {
+	select {
+	case <-s.failed:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendText sends text chunk by chunk and finishes the session.
+func (s *ttsSession) sendText(ctx context.Context, request map[string]any, chunks []string) error {
+	for _, chunk := range chunks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		request["req_params"].(map[string]any)["text"] = chunk
+		ttsReq := map[string]any{
+			"user":       request["user"],
+			"event":      int(EventType_TaskRequest),
+			"namespace":  request["namespace"],
+			"req_params": request["req_params"],
+		}
+		payload, err := json.Marshal(&ttsReq)
+		if err != nil {
+			return err
+		}
+		// ----------------send task request----------------
+		err = s.conn.write(func(ws *websocket.Conn) error {
+			return TaskRequest(ws, payload, s.id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.conn.write(func(ws *websocket.Conn) error {
+		return FinishSession(ws, s.id)
+	})
+}
+
+// receiveAudio reads the session until it finished, sentence events go to
+// the timeline.
+func (s *ttsSession) receiveAudio(ctx context.Context, onAudio func(chunk []byte) error, t *timeline) error {
+	for {
+		msg, err := s.receive(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg.MsgType {
+		case MsgTypeFullServerResponse:
+			if msg.EventType == EventType_SessionFailed {
+				return &ServerError{Code: msg.ErrorCode, Msg: string(msg.Payload)}
+			}
+			t.event(msg)
+		case MsgTypeAudioOnlyServer:
+			if len(msg.Payload) == 0 {
+				break
+			}
+			if err := onAudio(msg.Payload); err != nil {
+				return &TTSError{Stage: ttsStageOutput, Err: err}
+			}
+		case MsgTypeError:
+			return &ServerError{Code: msg.ErrorCode, Msg: string(msg.Payload)}
+		default:
+			return fmt.Errorf("unexpected message: %s", msg)
+		}
+		if msg.EventType == EventType_SessionFinished {
+			return nil
+		}
+	}
+}
+
+// textChunks cuts text after each sentence, sentences longer than max runes
+// are cut every max runes.
+func textChunks(text string, max int) []string {
+	var chunks []string
+	var chunk []rune
+	for _, r := range text {
+		chunk = append(chunk, r)
+		if strings.ContainsRune(ttsSentenceEnds, r) || len(chunk) >= max {
+			chunks = append(chunks, string(chunk))
+			chunk = chunk[:0]
+		}
+	}
+	if len(chunk) != 0 {
+		chunks = append(chunks, string(chunk))
+	}
+	return chunks
+}
@@ -0,0 +1,218 @@
+package doubao
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeSessionFailed is the code of sessions failed by a task with "boom".
+const fakeSessionFailed = 45000001
+
+// fakeDoubao speaks the bidirectional tts protocol. Each task request is
+// answered with the chunks audio makes of its text, a task whose text has
+// "boom" fails its session.
+type fakeDoubao struct {
+	*httptest.Server
+	audio func(text string) [][]byte
+
+	mu       sync.Mutex
+	conns    int
+	finished []string
+}
+
+func newFakeDoubao(t *testing.T, audio func(text string) [][]byte) *fakeDoubao {
+	t.Helper()
+	f := &fakeDoubao{audio: audio}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	endpoint := *flagEndpoint
+	*flagEndpoint = "ws" + strings.TrimPrefix(f.URL, "http")
+	t.Cleanup(func() { *flagEndpoint = endpoint })
+	return f
+}
+
+func (f *fakeDoubao) serve(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	f.mu.Lock()
+	f.conns++
+	f.mu.Unlock()
+	send := func(msgType MsgType, event EventType, sessionID string, payload []byte) error {
+		return ws.WriteMessage(websocket.BinaryMessage, serverFrame(msgType, event, sessionID, payload))
+	}
+	for {
+		msg, err := ReceiveMessage(ws)
+		if err != nil {
+			return
+		}
+		switch msg.EventType {
+		case EventType_StartConnection:
+			err = send(MsgTypeFullServerResponse, EventType_ConnectionStarted, "", []byte("{}"))
+		case EventType_StartSession:
+			err = send(MsgTypeFullServerResponse, EventType_SessionStarted, msg.SessionID, []byte("{}"))
+		case EventType_TaskRequest:
+			var req struct {
+				ReqParams struct {
+					Text string `json:"text"`
+				} `json:"req_params"`
+			}
+			json.Unmarshal(msg.Payload, &req)
+			if strings.Contains(req.ReqParams.Text, "boom") {
+				err = send(MsgTypeError, EventType_SessionFailed, msg.SessionID, []byte("boom"))
+				break
+			}
+			for _, chunk := range f.audio(req.ReqParams.Text) {
+				if err = send(MsgTypeAudioOnlyServer, EventType_TTSResponse, msg.SessionID, chunk); err != nil {
+					break
+				}
+			}
+		case EventType_FinishSession:
+			f.mu.Lock()
+			f.finished = append(f.finished, msg.SessionID)
+			f.mu.Unlock()
+			err = send(MsgTypeFullServerResponse, EventType_SessionFinished, msg.SessionID, []byte("{}"))
+		case EventType_FinishConnection:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serverFrame encodes a message the way doubao does, which Message.Marshal
+// does not: error codes come before the event and ConnectionStarted has a
+// connect id.
+func serverFrame(msgType MsgType, event EventType, sessionID string, payload []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{byte(Version1)<<4 | byte(HeaderSize4), byte(msgType)<<4 | byte(MsgTypeFlagWithEvent), byte(SerializationJSON) << 4, 0})
+	if msgType == MsgTypeError {
+		binary.Write(buf, binary.BigEndian, uint32(fakeSessionFailed))
+	}
+	binary.Write(buf, binary.BigEndian, event)
+	binary.Write(buf, binary.BigEndian, uint32(len(sessionID)))
+	buf.WriteString(sessionID)
+	binary.Write(buf, binary.BigEndian, uint32(len(payload)))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// newTestTTSClient runs a client against a fake doubao answering with audio.
+func newTestTTSClient(t *testing.T, config TTSClientConfig, audio func(text string) [][]byte) (*TTSClient, *fakeDoubao) {
+	t.Helper()
+	fake := newFakeDoubao(t, audio)
+	client := NewTTSClient(config, newTestAccounts(t, "    - {name: default, app_id: \"1\", access_token: a}\n"))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go client.Run(ctx)
+	return client, fake
+}
+
+// echoAudio answers each text with itself, "silent" texts with nothing.
+func echoAudio(text string) [][]byte {
+	if strings.Contains(text, "silent") {
+		return nil
+	}
+	return [][]byte{[]byte(text)}
+}
+
+func TestTextChunks(t *testing.T) {
+	cases := []struct {
+		text string
+		max  int
+		want []string
+	}{
+		{"", 10, nil},
+		{"你好。今天天气不错！走吧", 10, []string{"你好。", "今天天气不错！", "走吧"}},
+		{"one; two\nthree", 100, []string{"one;", " two\n", "three"}},
+		// long sentences are cut by runes, not bytes
+		{"一二三四五六七", 3, []string{"一二三", "四五六", "七"}},
+		{"ab。", 2, []string{"ab", "。"}},
+	}
+	for _, c := range cases {
+		got := textChunks(c.text, c.max)
+		if !slices.Equal(got, c.want) {
+			t.Errorf("textChunks(%q, %d) = %q, want %q", c.text, c.max, got, c.want)
+		}
+		if strings.Join(got, "") != c.text {
+			t.Errorf("textChunks(%q, %d) lost text", c.text, c.max)
+		}
+	}
+}
+
+func TestTTSClientStalledSession(t *testing.T) {
+	client, fake := newTestTTSClient(t, TTSClientConfig{SessionsPerConn: 2}, func(text string) [][]byte {
+		if text == "slow" {
+			return slices.Repeat([][]byte{[]byte("a")}, 2*ttsSessionBuffer)
+		}
+		return echoAudio(text)
+	})
+	params, _ := TTSOptions{}.resolve(testTTSConfig)
+
+	// the slow session stops reading at its first chunk, doubao keeps sending
+	stalled := make(chan struct{})
+	release := make(chan struct{})
+	slowErr := make(chan error, 1)
+	go func() {
+		first := true
+		_, err := client.Synthesize(context.Background(), "slow", params, func(chunk []byte) error {
+			if first {
+				first = false
+				close(stalled)
+				<-release
+			}
+			return nil
+		})
+		slowErr <- err
+	}()
+	<-stalled
+
+	// the other session of the connection is not held up
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var audio []byte
+	_, err := client.Synthesize(ctx, "quick", params, func(chunk []byte) error {
+		audio = append(audio, chunk...)
+		return nil
+	})
+	close(release)
+	if err != nil || string(audio) != "quick" {
+		t.Fatalf("session next to a stalled one = %q %v", audio, err)
+	}
+	if err := <-slowErr; !errors.Is(err, errTTSSessionBehind) {
+		t.Fatalf("stalled session = %v", err)
+	}
+
+	// doubao is told to finish the stalled session besides the sender doing so
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		fake.mu.Lock()
+		conns, finished := fake.conns, slices.Clone(fake.finished)
+		fake.mu.Unlock()
+		if conns != 1 {
+			t.Fatalf("sessions ran on %d connections", conns)
+		}
+		slices.Sort(finished)
+		if len(slices.Compact(finished)) < len(finished) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("finished sessions %v", finished)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package doubao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+)
+
+const (
+	// waiting for one of the tts_client max_sessions
+	ttsStageQueue           = "queue"
+	ttsStageDial            = "dial"
+	ttsStageStartConnection = "start_connection"
+	ttsStageStartSession    = "start_session"
+	ttsStageSend            = "send"
+	ttsStageReceive         = "receive"
+	// the audio could not be handed on, not doubao's fault
+	ttsStageOutput = "output"
+
+	// nginx's status for clients that went away, only seen in logs and meters
+	statusClientClosedRequest = 499
+)
+
+// ErrNoAudio is returned by sessions that finished without audio.
+var ErrNoAudio = errors.New("no audio received")
+
+// TTSError is a tts session that failed at Stage.
+type TTSError struct {
+	Stage string
+	Err   error
+}
+
+func (e *TTSError) Error() string {
+	return fmt.Sprintf("tts %s failed: %v", e.Stage, e.Err)
+}
+
+func (e *TTSError) Unwrap() error {
+	return e.Err
+}
+
+// ServerError is an error message sent by doubao.
+type ServerError struct {
+	Code uint32
+	Msg  string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("doubao error code:%d msg:%s", e.Code, e.Msg)
+}
+
+// sessionError blames ctx when it is done, a closed connection is then only
+// how the session was stopped.
+func sessionError(ctx context.Context, stage string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	return &TTSError{Stage: stage, Err: err}
+}
+
+// ttsHTTPError maps a failed session to what the caller is told.
+func ttsHTTPError(err error) *common.HTTPError {
+	var ttsErr *TTSError
+	var serverErr *ServerError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return common.NewHTTPError(http.StatusGatewayTimeout, "text to speech timed out")
+	case errors.Is(err, context.Canceled):
+		return common.NewHTTPError(statusClientClosedRequest, "request cancelled")
+	case errors.Is(err, ErrTTSBusy):
+		return common.NewHTTPError(http.StatusServiceUnavailable, "text to speech busy")
+	case errors.Is(err, ErrNoAudio):
+		return common.NewHTTPError(http.StatusBadGateway, "no audio received")
+	case errors.As(err, &serverErr):
+		return common.NewHTTPError(http.StatusBadGateway, "text to speech failed code:%d", serverErr.Code)
+	case errors.As(err, &ttsErr) && ttsErr.Stage == ttsStageOutput:
+		return common.NewHTTPError(http.StatusInternalServerError, "text to speech failed")
+	case errors.As(err, &ttsErr) && ttsErr.Stage == ttsStageDial:
+		return common.NewHTTPError(http.StatusServiceUnavailable, "text to speech unavailable")
+	case errors.As(err, &ttsErr):
+		return common.NewHTTPError(http.StatusBadGateway, "text to speech failed")
+	default:
+		return common.NewHTTPError(http.StatusInternalServerError, "text to speech failed")
+	}
+}
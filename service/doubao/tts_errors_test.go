@@ -0,0 +1,40 @@
+package doubao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestTTSHTTPError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		msg    string
+	}{
+		{sessionError(context.Background(), ttsStageReceive, context.DeadlineExceeded), http.StatusGatewayTimeout, "text to speech timed out"},
+		{&TTSError{Stage: ttsStageQueue, Err: context.Canceled}, statusClientClosedRequest, "request cancelled"},
+		{&TTSError{Stage: ttsStageQueue, Err: ErrTTSBusy}, http.StatusServiceUnavailable, "text to speech busy"},
+		{ErrNoAudio, http.StatusBadGateway, "no audio received"},
+		{&TTSError{Stage: ttsStageReceive, Err: &ServerError{Code: 45000001}}, http.StatusBadGateway, "text to speech failed code:45000001"},
+		{&TTSError{Stage: ttsStageOutput, Err: errors.New("broken pipe")}, http.StatusInternalServerError, "text to speech failed"},
+		{&TTSError{Stage: ttsStageDial, Err: errors.New("connection refused")}, http.StatusServiceUnavailable, "text to speech unavailable"},
+		{&TTSError{Stage: ttsStageSend, Err: errors.New("broken pipe")}, http.StatusBadGateway, "text to speech failed"},
+		{fmt.Errorf("wrapped: %w", errors.New("bug")), http.StatusInternalServerError, "text to speech failed"},
+	}
+	for _, c := range cases {
+		httpErr := ttsHTTPError(c.err)
+		if httpErr.Status != c.status || httpErr.Msg != c.msg {
+			t.Errorf("ttsHTTPError(%v) = %d %q, want %d %q", c.err, httpErr.Status, httpErr.Msg, c.status, c.msg)
+		}
+	}
+
+	// a cancelled session is the client's doing, whatever it failed with
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if httpErr := ttsHTTPError(sessionError(ctx, ttsStageReceive, errTTSConnClosed)); httpErr.Status != statusClientClosedRequest {
+		t.Errorf("cancelled session = %d", httpErr.Status)
+	}
+}
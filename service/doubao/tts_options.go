@@ -0,0 +1,191 @@
+package doubao
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"gopkg.in/yaml.v3"
+)
+
+// TTSConfig lists the audio choices a request may make and what a request
+// gets when it makes none. The defaults come from the -voice_type and
+// -encoding flags and 24000Hz unless set here. ObjectPrefix is where the
+// audio of each user is kept in oss.
+type TTSConfig struct {
+	Voices            []string  `yaml:"voices"`
+	Formats           []string  `yaml:"formats"`
+	SampleRates       []int     `yaml:"sample_rates"`
+	Emotions          []string  `yaml:"emotions"`
+	SpeechRate        RateRange `yaml:"speech_rate"`
+	LoudnessRate      RateRange `yaml:"loudness_rate"`
+	DefaultVoice      string    `yaml:"default_voice"`
+	DefaultFormat     string    `yaml:"default_format"`
+	DefaultSampleRate int       `yaml:"default_sample_rate"`
+	ObjectPrefix      string    `yaml:"object_prefix"`
+}
+
+// RateRange bounds a rate a request may ask for, doubao takes -50 (half)
+// to 100 (double).
+type RateRange struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+}
+
+func (r RateRange) contains(rate int) bool {
+	return rate >= r.Min && rate <= r.Max
+}
+
+// withDefaults fills in what conf/doubao.yaml leaves out.
+func (c TTSConfig) withDefaults() TTSConfig {
+	if len(c.DefaultVoice) == 0 {
+		c.DefaultVoice = *flagVoiceType
+	}
+	if len(c.DefaultFormat) == 0 {
+		c.DefaultFormat = *flagEncoding
+	}
+	if c.DefaultSampleRate == 0 {
+		c.DefaultSampleRate = 24000
+	}
+	if c.SpeechRate == (RateRange{}) {
+		c.SpeechRate = RateRange{Min: -50, Max: 100}
+	}
+	if c.LoudnessRate == (RateRange{}) {
+		c.LoudnessRate = RateRange{Min: -50, Max: 100}
+	}
+	if len(c.ObjectPrefix) == 0 {
+		c.ObjectPrefix = "tts/"
+	}
+	return c
+}
+
+type doubaoConfig struct {
+	TTS       TTSConfig       `yaml:"tts"`
+	TTSCache  TTSCacheConfig  `yaml:"tts_cache"`
+	TTSClient TTSClientConfig `yaml:"tts_client"`
+	Accounts  AccountsConfig  `yaml:"doubao_accounts"`
+}
+
+func loadDoubaoConfig(path string) (*doubaoConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config doubaoConfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// TTSOptions are the audio choices of a tts request, zero values keep the
+// defaults. Rates must be within the ranges of TTSConfig.
+type TTSOptions struct {
+	Voice        string `json:"voice"`
+	Format       string `json:"format"`
+	SampleRate   int    `json:"sample_rate"`
+	SpeechRate   int    `json:"speech_rate"`
+	LoudnessRate int    `json:"loudness_rate"`
+	Emotion      string `json:"emotion"`
+}
+
+// audioParams is what a session synthesizes with.
+type audioParams struct {
+	Voice        string
+	Format       string
+	SampleRate   int
+	SpeechRate   int
+	LoudnessRate int
+	Emotion      string
+}
+
+// resolve checks o against the allow-lists and fills in the defaults.
+func (o TTSOptions) resolve(config TTSConfig) (audioParams, error) {
+	params := audioParams{
+		Voice:        config.DefaultVoice,
+		Format:       config.DefaultFormat,
+		SampleRate:   config.DefaultSampleRate,
+		SpeechRate:   o.SpeechRate,
+		LoudnessRate: o.LoudnessRate,
+		Emotion:      o.Emotion,
+	}
+	var errs []common.FieldError
+	allow := func(field string, value string, allowed []string, target *string) {
+		if len(value) == 0 {
+			return
+		}
+		if !slices.Contains(allowed, value) {
+			errs = append(errs, common.FieldError{Field: field, Msg: fmt.Sprintf("%s is not allowed", value)})
+			return
+		}
+		*target = value
+	}
+	allow("voice", o.Voice, config.Voices, &params.Voice)
+	allow("format", o.Format, config.Formats, &params.Format)
+	allow("emotion", o.Emotion, config.Emotions, &params.Emotion)
+	if o.SampleRate != 0 {
+		if slices.Contains(config.SampleRates, o.SampleRate) {
+			params.SampleRate = o.SampleRate
+		} else {
+			errs = append(errs, common.FieldError{Field: "sample_rate", Msg: strconv.Itoa(o.SampleRate) + " is not allowed"})
+		}
+	}
+	if !config.SpeechRate.contains(o.SpeechRate) {
+		errs = append(errs, common.FieldError{Field: "speech_rate", Msg: fmt.Sprintf("must be between %d and %d", config.SpeechRate.Min, config.SpeechRate.Max)})
+	}
+	if !config.LoudnessRate.contains(o.LoudnessRate) {
+		errs = append(errs, common.FieldError{Field: "loudness_rate", Msg: fmt.Sprintf("must be between %d and %d", config.LoudnessRate.Min, config.LoudnessRate.Max)})
+	}
+	if len(errs) != 0 {
+		return params, &common.HTTPError{Status: http.StatusBadRequest, Msg: "invalid request", Fields: errs}
+	}
+	return params, nil
+}
+
+// requestParams is the req_params of a StartSession request.
+func (p audioParams) requestParams() map[string]any {
+	audio := map[string]any{
+		"format":           p.Format,
+		"sample_rate":      p.SampleRate,
+		"speech_rate":      p.SpeechRate,
+		"loudness_rate":    p.LoudnessRate,
+		"enable_timestamp": true,
+	}
+	if len(p.Emotion) != 0 {
+		audio["emotion"] = p.Emotion
+	}
+	additions, _ := json.Marshal(map[string]any{
+		"disable_markdown_filter": false,
+	})
+	return map[string]any{
+		"speaker":      p.Voice,
+		"audio_params": audio,
+		"additions":    string(additions),
+	}
+}
+
+func audioContentType(format string) string {
+	switch format {
+	case "mp3":
+		return "audio/mpeg"
+	case "ogg_opus":
+		return "audio/ogg"
+	case "wav":
+		return "audio/wav"
+	case "pcm":
+		return "audio/L16"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func audioExtension(format string) string {
+	if format == "ogg_opus" {
+		return "ogg"
+	}
+	return format
+}
@@ -0,0 +1,62 @@
+package doubao
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+)
+
+var testTTSConfig = TTSConfig{
+	Voices:       []string{"zh_female_shuangkuaisisi_moon_bigtts", "en_male_adam_mars_bigtts"},
+	Formats:      []string{"mp3", "pcm"},
+	SampleRates:  []int{16000, 24000},
+	Emotions:     []string{"happy"},
+	SpeechRate:   RateRange{Min: -20, Max: 50},
+	DefaultVoice: "zh_female_shuangkuaisisi_moon_bigtts",
+}.withDefaults()
+
+func TestTTSOptionsResolve(t *testing.T) {
+	params, err := TTSOptions{}.resolve(testTTSConfig)
+	want := audioParams{Voice: "zh_female_shuangkuaisisi_moon_bigtts", Format: *flagEncoding, SampleRate: 24000}
+	if err != nil || params != want {
+		t.Fatalf("defaults = %+v %v", params, err)
+	}
+
+	options := TTSOptions{Voice: "en_male_adam_mars_bigtts", Format: "pcm", SampleRate: 16000, SpeechRate: 50, LoudnessRate: -50, Emotion: "happy"}
+	params, err = options.resolve(testTTSConfig)
+	want = audioParams{Voice: "en_male_adam_mars_bigtts", Format: "pcm", SampleRate: 16000, SpeechRate: 50, LoudnessRate: -50, Emotion: "happy"}
+	if err != nil || params != want {
+		t.Fatalf("allowed options = %+v %v", params, err)
+	}
+
+	cases := []struct {
+		options TTSOptions
+		fields  []string
+	}{
+		{TTSOptions{Voice: "zh_male_unknown"}, []string{"voice"}},
+		{TTSOptions{Format: "flac", SampleRate: 44100}, []string{"format", "sample_rate"}},
+		{TTSOptions{Emotion: "bored"}, []string{"emotion"}},
+		// the speech rate is bounded by the config, loudness by the default
+		{TTSOptions{SpeechRate: 51}, []string{"speech_rate"}},
+		{TTSOptions{SpeechRate: -21, LoudnessRate: 100}, []string{"speech_rate"}},
+		{TTSOptions{LoudnessRate: 101}, []string{"loudness_rate"}},
+		{TTSOptions{LoudnessRate: -51}, []string{"loudness_rate"}},
+	}
+	for _, c := range cases {
+		_, err := c.options.resolve(testTTSConfig)
+		var httpErr *common.HTTPError
+		if !errors.As(err, &httpErr) || httpErr.Status != http.StatusBadRequest {
+			t.Fatalf("resolve %+v = %v", c.options, err)
+		}
+		var fields []string
+		for _, field := range httpErr.Fields {
+			fields = append(fields, field.Field)
+		}
+		if !slices.Equal(fields, c.fields) {
+			t.Fatalf("resolve %+v rejected %v, want %v", c.options, fields, c.fields)
+		}
+	}
+}
@@ -584,6 +584,9 @@ func WaitForEvent(conn *websocket.Conn, msgType MsgType, eventType EventType) (*
 		if err != nil {
 			return nil, err
 		}
+		if msg.MsgType == MsgTypeError {
+			return nil, &ServerError{Code: msg.ErrorCode, Msg: string(msg.Payload)}
+		}
 		if msg.MsgType != msgType || msg.EventType != eventType {
 			return nil, fmt.Errorf("unexpected message: %s", msg)
 		}
@@ -0,0 +1,180 @@
+package doubao
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aliyun/alibabacloud-oss-go-sdk-v2/oss"
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/pkusunjy/grpc-gateway/service/validation"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	// archiveUrlHeader carries the presigned url of the archived audio, it
+	// answers 404 until the archive upload finished.
+	archiveUrlHeader = "X-Audio-Url"
+	// ttsErrorTrailer tells why a stream ended early, the audio until then
+	// was already sent with status 200.
+	ttsErrorTrailer = "X-Tts-Error"
+)
+
+// TTSStreamRequest is the ChatMessage of text_to_speech, Archive keeps the
+// audio in oss like text_to_speech does.
+type TTSStreamRequest struct {
+	Content string `json:"content"`
+	Archive bool   `json:"archive"`
+	TTSOptions
+}
+
+var TTSStreamRules = validation.Rules{
+	"content": "required,max=1000",
+}
+
+// TTSStream writes the audio as a chunked response while doubao synthesizes
+// it, so that clients can start playing before the session finished.
+func (s *TTSService) TTSStream(w http.ResponseWriter, r *http.Request) {
+	var req TTSStreamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		common.WriteError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if errs := validation.Check(&req, TTSStreamRules); len(errs) != 0 {
+		common.WriteFieldErrors(w, errs)
+		return
+	}
+	params, err := req.TTSOptions.resolve(s.conf)
+	if err != nil {
+		common.WriteErr(w, err)
+		return
+	}
+	uid := common.CallerFromContext(r.Context()).OpenID
+
+	var digest string
+	if s.cache != nil {
+		digest = ttsDigest(req.Content, params)
+		if entry, ok := s.cache.Lookup(r.Context(), digest); ok && s.streamCached(w, r, req.Archive, entry) {
+			return
+		}
+	}
+
+	// cached audio is kept like archived audio, but only archiving outlives
+	// the client
+	keep := req.Archive || s.cache != nil
+	var remoteFileName string
+	if s.cache != nil {
+		remoteFileName = s.cache.ObjectKey(digest, params.Format)
+	} else if req.Archive {
+		remoteFileName = s.objectKey(uid, params.Format)
+	}
+	if req.Archive {
+		// the url is presigned up front, headers are gone once audio streams
+		url, err := s.presign(r.Context(), remoteFileName)
+		if err != nil {
+			common.WriteError(w, http.StatusInternalServerError, "presign failed")
+			return
+		}
+		w.Header().Set(archiveUrlHeader, url)
+	}
+	w.Header().Set("Content-Type", audioContentType(params.Format))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// failures after the first chunk can only be told in the trailer
+	w.Header().Set("Trailer", ttsErrorTrailer)
+
+	// an archived session outlives the client, it asked for the audio
+	ctx := r.Context()
+	if req.Archive {
+		ctx = context.WithoutCancel(ctx)
+	}
+	rc := http.NewResponseController(w)
+	var audio []byte
+	var streamed int
+	clientGone := false
+	sentences, err := s.client.Synthesize(ctx, req.Content, params, func(chunk []byte) error {
+		if keep {
+			audio = append(audio, chunk...)
+		}
+		if clientGone {
+			return nil
+		}
+		if _, err := w.Write(chunk); err != nil {
+			grpclog.Warningf("tts stream client gone userid:%v err:%v", uid, err)
+			clientGone = true
+			if req.Archive {
+				return nil
+			}
+			return err
+		}
+		streamed += len(chunk)
+		if err := rc.Flush(); err != nil {
+			grpclog.Warningf("tts stream flush failed userid:%v err:%v", uid, err)
+		}
+		return nil
+	})
+	if err == nil && len(audio) == 0 && streamed == 0 {
+		err = ErrNoAudio
+	}
+	if err != nil {
+		grpclog.Warningf("tts stream failed userid:%v streamed:%d err:%v", uid, streamed, err)
+		if streamed == 0 && !clientGone {
+			w.Header().Del(archiveUrlHeader)
+			w.Header().Del("Trailer")
+			common.WriteErr(w, ttsHTTPError(err))
+			return
+		}
+		w.Header().Set(ttsErrorTrailer, ttsHTTPError(err).Msg)
+		return
+	}
+	grpclog.Infof("tts stream userid:%v streamed:%d", uid, streamed)
+	if keep {
+		go s.archive(remoteFileName, audioContentType(params.Format), audio, sentences, digest)
+	}
+}
+
+// streamCached copies cached audio to the client. It is false if nothing
+// was written, so that the audio can still be synthesized.
+func (s *TTSService) streamCached(w http.ResponseWriter, r *http.Request, archive bool, entry *ttsCacheEntry) bool {
+	result, err := s.ossClient.GetObject(r.Context(), &oss.GetObjectRequest{
+		Bucket: oss.Ptr("mikiai"),
+		Key:    oss.Ptr(entry.Key),
+	})
+	if err != nil {
+		grpclog.Warningf("tts cache get object %v failed err:%v", entry.Key, err)
+		return false
+	}
+	defer result.Body.Close()
+	if archive {
+		url, err := s.presign(r.Context(), entry.Key)
+		if err != nil {
+			return false
+		}
+		w.Header().Set(archiveUrlHeader, url)
+	}
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	written, err := io.Copy(w, result.Body)
+	if err != nil {
+		grpclog.Warningf("tts cache stream %v failed written:%d err:%v", entry.Key, written, err)
+	}
+	grpclog.Infof("tts cache hit stream object:%v written:%d", entry.Key, written)
+	return true
+}
+
+// archive uploads streamed audio with its subtitles and caches it under
+// digest unless that is empty, it outlives the request.
+func (s *TTSService) archive(remoteFileName string, contentType string, audio []byte, sentences []Sentence, digest string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := s.putObject(ctx, remoteFileName, contentType, audio); err != nil {
+		return
+	}
+	grpclog.Infof("tts stream archived %s size:%d", remoteFileName, len(audio))
+	subs := s.putSubtitles(ctx, remoteFileName, sentences)
+	if s.cache != nil && len(digest) != 0 {
+		s.cache.Store(ctx, digest, newTTSCacheEntry(remoteFileName, contentType, subs, sentences))
+	}
+}
@@ -0,0 +1,83 @@
+package doubao
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+)
+
+// stream posts body to TTSStream of a service without cache and oss.
+func stream(t *testing.T, s *TTSService, body string) *http.Response {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/chat_completion.ChatService/text_to_speech_stream", strings.NewReader(body))
+	r = r.WithContext(common.ContextWithCaller(r.Context(), common.Caller{OpenID: "oUser"}))
+	w := httptest.NewRecorder()
+	s.TTSStream(w, r)
+	return w.Result()
+}
+
+func TestTTSStream(t *testing.T) {
+	client, _ := newTestTTSClient(t, TTSClientConfig{}, echoAudio)
+	s := &TTSService{conf: testTTSConfig, client: client}
+
+	resp := stream(t, s, `{"content":"你好。今天。"}`)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || body != "你好。今天。" || resp.Header.Get("Content-Type") != "audio/mpeg" {
+		t.Fatalf("stream = %d %q %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	if msg := resp.Trailer.Get(ttsErrorTrailer); len(msg) != 0 {
+		t.Fatalf("stream failed in the trailer %q", msg)
+	}
+}
+
+func TestTTSStreamErrors(t *testing.T) {
+	client, _ := newTestTTSClient(t, TTSClientConfig{}, echoAudio)
+	s := &TTSService{conf: testTTSConfig, client: client}
+
+	// failures before the first chunk get an error response
+	cases := []struct {
+		body   string
+		status int
+		msg    string
+	}{
+		{`{"content":"boom"}`, http.StatusBadGateway, "text to speech failed code:45000001"},
+		{`{"content":"silent"}`, http.StatusBadGateway, "no audio received"},
+		{`{"content":"你好","speech_rate":500}`, http.StatusBadRequest, "invalid request"},
+		{`{"content":""}`, http.StatusBadRequest, "invalid request"},
+		{`{"content":`, http.StatusBadRequest, "invalid json"},
+	}
+	for _, c := range cases {
+		resp := stream(t, s, c.body)
+		var errResp common.ErrorResponse
+		if err := json.Unmarshal([]byte(readBody(t, resp)), &errResp); err != nil {
+			t.Fatalf("%s answered %v", c.body, err)
+		}
+		if resp.StatusCode != c.status || errResp.ErrMsg != c.msg || len(resp.Trailer) != 0 {
+			t.Fatalf("%s = %d %q trailer %v", c.body, resp.StatusCode, errResp.ErrMsg, resp.Trailer)
+		}
+	}
+
+	// later ones keep the audio sent and are told in the trailer
+	resp := stream(t, s, `{"content":"你好。boom"}`)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || body != "你好。" {
+		t.Fatalf("stream failing late = %d %q", resp.StatusCode, body)
+	}
+	if msg := resp.Trailer.Get(ttsErrorTrailer); msg != "text to speech failed code:45000001" {
+		t.Fatalf("trailer of a stream failing late %q", msg)
+	}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
@@ -0,0 +1,162 @@
+package doubao
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"strings"
+)
+
+// Sentence is a synthesized sentence and when it is spoken, in
+// milliseconds from the start of the audio.
+type Sentence struct {
+	Text    string `json:"text"`
+	StartMs int64  `json:"start_ms"`
+	EndMs   int64  `json:"end_ms"`
+	Words   []Word `json:"words,omitempty"`
+}
+
+type Word struct {
+	Word    string `json:"word"`
+	StartMs int64  `json:"start_ms"`
+	EndMs   int64  `json:"end_ms"`
+}
+
+// timestampPayload is the part of the TTSSentenceStart, TTSSentenceEnd and
+// TTSResponse json payloads with timing, doubao sends word times in seconds
+// from the start of the session audio when enable_timestamp is set.
+type timestampPayload struct {
+	Text  string `json:"text"`
+	Words []struct {
+		Word      string  `json:"word"`
+		StartTime float64 `json:"startTime"`
+		EndTime   float64 `json:"endTime"`
+	} `json:"words"`
+}
+
+// timeline collects the sentences of a session from its events.
+type timeline struct {
+	sentences []Sentence
+	// the sentence between TTSSentenceStart and TTSSentenceEnd
+	current *Sentence
+}
+
+func (t *timeline) event(msg *Message) {
+	switch msg.EventType {
+	case EventType_TTSSentenceStart, EventType_TTSSentenceEnd, EventType_TTSResponse:
+	default:
+		return
+	}
+	var payload timestampPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		// timing is a bonus, the audio is what was asked for
+		return
+	}
+	if msg.EventType == EventType_TTSSentenceStart || t.current == nil {
+		t.finish()
+		t.current = &Sentence{Text: payload.Text}
+	}
+	if len(t.current.Text) == 0 {
+		t.current.Text = payload.Text
+	}
+	for _, word := range payload.Words {
+		t.current.Words = append(t.current.Words, Word{
+			Word:    word.Word,
+			StartMs: secondsToMs(word.StartTime),
+			EndMs:   secondsToMs(word.EndTime),
+		})
+	}
+	if msg.EventType == EventType_TTSSentenceEnd {
+		t.finish()
+	}
+}
+
+// finish closes the current sentence, one without words is placed at the
+// end of the previous one.
+func (t *timeline) finish() {
+	if t.current == nil {
+		return
+	}
+	sentence := *t.current
+	t.current = nil
+	if len(sentence.Words) != 0 {
+		sentence.StartMs = sentence.Words[0].StartMs
+		sentence.EndMs = sentence.Words[len(sentence.Words)-1].EndMs
+	} else if len(t.sentences) != 0 {
+		sentence.StartMs = t.sentences[len(t.sentences)-1].EndMs
+		sentence.EndMs = sentence.StartMs
+	}
+	if len(strings.TrimSpace(sentence.Text)) == 0 && len(sentence.Words) == 0 {
+		return
+	}
+	t.sentences = append(t.sentences, sentence)
+}
+
+func (t *timeline) result() []Sentence {
+	t.finish()
+	return t.sentences
+}
+
+func secondsToMs(seconds float64) int64 {
+	return int64(math.Round(seconds * 1000))
+}
+
+// subtitles are the oss keys of the subtitle files of an audio.
+type subtitles struct {
+	VttKey string
+	SrtKey string
+}
+
+// putSubtitles uploads subtitle files next to the audio. Subtitles that
+// failed to upload are left out, the audio is still usable.
+func (s *TTSService) putSubtitles(ctx context.Context, remoteFileName string, sentences []Sentence) subtitles {
+	var subs subtitles
+	if len(sentences) == 0 {
+		return subs
+	}
+	base := strings.TrimSuffix(remoteFileName, path.Ext(remoteFileName))
+	put := func(key string, contentType string, content string) bool {
+		return s.putObject(ctx, key, contentType, []byte(content)) == nil
+	}
+	if put(base+".vtt", "text/vtt; charset=utf-8", webVTT(sentences)) {
+		subs.VttKey = base + ".vtt"
+	}
+	if put(base+".srt", "application/x-subrip; charset=utf-8", srt(sentences)) {
+		subs.SrtKey = base + ".srt"
+	}
+	return subs
+}
+
+// webVTT renders sentences as a WebVTT subtitle file.
+func webVTT(sentences []Sentence) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for _, sentence := range sentences {
+		fmt.Fprintf(&b, "\n%s --> %s\n%s\n", cueTime(sentence.StartMs, "."), cueTime(sentence.EndMs, "."), cueText(sentence.Text))
+	}
+	return b.String()
+}
+
+// srt renders sentences as a SubRip subtitle file.
+func srt(sentences []Sentence) string {
+	var b strings.Builder
+	for i, sentence := range sentences {
+		if i != 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n", i+1, cueTime(sentence.StartMs, ","), cueTime(sentence.EndMs, ","), cueText(sentence.Text))
+	}
+	return b.String()
+}
+
+// cueTime formats ms as hh:mm:ss.mmm, SubRip separates ms with a comma.
+func cueTime(ms int64, separator string) string {
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
+
+// cueText keeps a cue on one line, a blank line would end it.
+func cueText(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
@@ -0,0 +1,55 @@
+package doubao
+
+import (
+	"slices"
+	"testing"
+)
+
+func timestampEvent(eventType EventType, payload string) *Message {
+	return &Message{EventType: eventType, Payload: []byte(payload)}
+}
+
+func TestTimeline(t *testing.T) {
+	var tl timeline
+	events := []*Message{
+		timestampEvent(EventType_TTSSentenceStart, `{"text":"你好。"}`),
+		timestampEvent(EventType_TTSResponse, `not json`),
+		timestampEvent(EventType_TTSSentenceEnd, `{"text":"你好。","words":[{"word":"你","startTime":0.1,"endTime":0.3},{"word":"好","startTime":0.3,"endTime":0.6}]}`),
+		// a sentence without timing is placed after the previous one
+		timestampEvent(EventType_TTSSentenceStart, `{"text":"嗯"}`),
+		timestampEvent(EventType_TTSSentenceEnd, `{}`),
+		timestampEvent(EventType_TTSSentenceStart, `{"text":" "}`),
+		timestampEvent(EventType_TTSSentenceEnd, `{}`),
+		// a response without a sentence start still opens a sentence
+		timestampEvent(EventType_TTSResponse, `{"text":"再见","words":[{"word":"再见","startTime":1.2345,"endTime":2}]}`),
+	}
+	for _, event := range events {
+		tl.event(event)
+	}
+	want := []Sentence{
+		{Text: "你好。", StartMs: 100, EndMs: 600, Words: []Word{{"你", 100, 300}, {"好", 300, 600}}},
+		{Text: "嗯", StartMs: 600, EndMs: 600},
+		{Text: "再见", StartMs: 1235, EndMs: 2000, Words: []Word{{"再见", 1235, 2000}}},
+	}
+	got := tl.result()
+	if !slices.EqualFunc(got, want, func(a, b Sentence) bool {
+		return a.Text == b.Text && a.StartMs == b.StartMs && a.EndMs == b.EndMs && slices.Equal(a.Words, b.Words)
+	}) {
+		t.Fatalf("sentences %+v, want %+v", got, want)
+	}
+}
+
+func TestSubtitles(t *testing.T) {
+	sentences := []Sentence{
+		{Text: "first\nline", StartMs: 100, EndMs: 600},
+		{Text: "second", StartMs: 3723456, EndMs: 3724000},
+	}
+	wantVTT := "WEBVTT\n\n00:00:00.100 --> 00:00:00.600\nfirst line\n\n01:02:03.456 --> 01:02:04.000\nsecond\n"
+	if got := webVTT(sentences); got != wantVTT {
+		t.Errorf("webVTT = %q, want %q", got, wantVTT)
+	}
+	wantSRT := "1\n00:00:00,100 --> 00:00:00,600\nfirst line\n\n2\n01:02:03,456 --> 01:02:04,000\nsecond\n"
+	if got := srt(sentences); got != wantSRT {
+		t.Errorf("srt = %q, want %q", got, wantSRT)
+	}
+}
@@ -2,11 +2,11 @@ package doubao
 
 import "net/http"
 
-func NewAuthHeader(reqID string, resourceID string) http.Header {
+func NewAuthHeader(account Account, reqID string, resourceID string) http.Header {
 	header := http.Header{}
 	header.Add("X-Api-Resource-Id", resourceID)
 	header.Add("X-Api-Request-Id", reqID)
-	header.Add("X-Api-Access-Key", AccessToken)
-	header.Add("X-Api-App-Key", AppID)
+	header.Add("X-Api-Access-Key", account.AccessToken)
+	header.Add("X-Api-App-Key", account.AppID)
 	return header
 }
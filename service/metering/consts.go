@@ -0,0 +1,14 @@
+package metering
+
+const (
+	meteringFile      = "./conf/metering.yaml"
+	dataPlatformFile  = "./conf/data_platform.yaml"
+	whitelistRedisKey = "mikiai_whitelist_user"
+	redisKeyPrefix    = "metering"
+	yyyymmdd          = "20060102"
+	datetimeLayout    = "2006-01-02 15:04:05"
+
+	TierDefault   = "default"
+	TierMember    = "member"
+	TierWhitelist = "whitelist"
+)
@@ -0,0 +1,359 @@
+package metering
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/pkusunjy/grpc-gateway/service/platform"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/grpclog"
+	"gopkg.in/yaml.v3"
+)
+
+// Feature is a paid capability guarded by the meter. Members and whitelisted
+// users are unmetered, everyone else gets DailyFree uses per day, and no
+// more than DailyFreeTotal across features.
+type Feature struct {
+	Routes    []string `yaml:"routes"`
+	DailyFree int64    `yaml:"daily_free"`
+}
+
+type MeteringService struct {
+	DataPlatformEndpoint string             `yaml:"endpoint"`
+	RedisAddr            string             `yaml:"redis_addr"`
+	AllowAnonymous       bool               `yaml:"allow_anonymous"`
+	DailyFreeTotal       int64              `yaml:"daily_free_total"`
+	MemberCacheSec       int64              `yaml:"member_cache_sec"`
+	ReconcileIntervalSec int64              `yaml:"reconcile_interval_sec"`
+	Features             map[string]Feature `yaml:"features"`
+	loc                  *time.Location
+	redisClient          *redis.Client
+	routeFeature         map[string]string
+}
+
+// useTimeAndValidTimeResp is the subset of ysCustomer/queryUseTimeAndValidTime
+// needed to decide membership.
+type useTimeAndValidTimeResp struct {
+	Code int `json:"code"`
+	Data *struct {
+		MemberType any `json:"memberType"`
+		ValidTime  any `json:"validTime"`
+	} `json:"data"`
+}
+
+// KEYS[1] daily usage counter of the feature
+// KEYS[2] daily usage counter across features, counted by the data platform
+// KEYS[3] pending reconciliation hash
+// ARGV[1] daily allowance of the feature
+// ARGV[2] daily allowance across features
+// ARGV[3] pending hash field
+// ARGV[4] counter ttl in seconds
+// ARGV[5] uses the data platform counted today, negative if not fetched
+// returns 1 when consumed, 0 when exhausted, -1 when ARGV[5] is needed
+var consumeScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 0 then
+	if tonumber(ARGV[5]) < 0 then
+		return -1
+	end
+	redis.call('SET', KEYS[2], ARGV[5], 'EX', ARGV[4])
+end
+local used = redis.call('INCR', KEYS[1])
+if used == 1 then
+	redis.call('EXPIRE', KEYS[1], ARGV[4])
+end
+local total = redis.call('INCR', KEYS[2])
+if used > tonumber(ARGV[1]) or total > tonumber(ARGV[2]) then
+	redis.call('DECR', KEYS[1])
+	redis.call('DECR', KEYS[2])
+	return 0
+end
+redis.call('HINCRBY', KEYS[3], ARGV[3], 1)
+redis.call('EXPIRE', KEYS[3], ARGV[4])
+return 1
+`)
+
+// KEYS[1] daily usage counter of the feature
+// KEYS[2] daily usage counter across features
+// KEYS[3] pending reconciliation hash
+// ARGV[1] pending hash field
+var releaseScript = redis.NewScript(`
+if tonumber(redis.call('GET', KEYS[1]) or '0') > 0 then
+	redis.call('DECR', KEYS[1])
+	redis.call('DECR', KEYS[2])
+	redis.call('HINCRBY', KEYS[3], ARGV[1], -1)
+end
+return 1
+`)
+
+func MeteringServiceInitialize(ctx *context.Context) (*MeteringService, error) {
+	server := MeteringService{}
+	// load metering file
+	content, err := os.ReadFile(meteringFile)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	err = yaml.Unmarshal(content, &server)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	// load data_platform file
+	content, err = os.ReadFile(dataPlatformFile)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	err = yaml.Unmarshal(content, &server)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	server.loc, _ = time.LoadLocation("Asia/Shanghai")
+	server.redisClient = redis.NewClient(&redis.Options{
+		Addr:     server.RedisAddr,
+		Password: "",
+		DB:       0,
+	})
+	server.routeFeature = make(map[string]string)
+	var dailyFree int64
+	for name, feature := range server.Features {
+		for _, route := range feature.Routes {
+			server.routeFeature[route] = name
+		}
+		dailyFree += feature.DailyFree
+	}
+	if server.DailyFreeTotal <= 0 {
+		server.DailyFreeTotal = dailyFree
+	}
+	go server.reconcileLoop(*ctx)
+	grpclog.Infof("initialized metering features:%v", server.Features)
+	return &server, nil
+}
+
+// Middleware checks the entitlement of the caller before a paid route runs.
+// Free uses are consumed up front and handed back if the route fails. Only
+// callers verified by the router middleware are metered as users.
+func (s *MeteringService) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		feature, ok := s.routeFeature[r.URL.Path]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		openid := common.CallerFromContext(ctx).OpenID
+		if len(openid) == 0 {
+			if s.AllowAnonymous {
+				next.ServeHTTP(w, r)
+				return
+			}
+			common.WriteError(w, http.StatusUnauthorized, "session token required")
+			return
+		}
+		tier := s.Tier(ctx, openid)
+		if tier != TierDefault {
+			next.ServeHTTP(w, r)
+			return
+		}
+		day := time.Now().In(s.loc).Format(yyyymmdd)
+		consumed, err := s.consume(ctx, feature, openid, day)
+		if err != nil {
+			// free uses that cannot be counted are not given away
+			grpclog.Errorf("metering consume failed feature:%v openid:%v err:%v", feature, openid, err)
+			common.WriteError(w, http.StatusServiceUnavailable, "metering unavailable")
+			return
+		}
+		if !consumed {
+			grpclog.Infof("metering daily free exhausted feature:%v openid:%v", feature, openid)
+			common.WriteError(w, http.StatusPaymentRequired, fmt.Sprintf("daily free %s usage exhausted", feature))
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if recorder.status >= http.StatusBadRequest {
+			s.release(ctx, feature, openid, day)
+		}
+	})
+}
+
+// Tier returns the membership tier of openid, it also serves as the
+// rate limiter tier resolver.
+func (s *MeteringService) Tier(ctx context.Context, openid string) string {
+	isWhitelisted, err := s.redisClient.SIsMember(ctx, whitelistRedisKey, openid).Result()
+	if err != nil {
+		grpclog.Warningf("metering whitelist lookup failed openid:%v err:%v", openid, err)
+	}
+	if isWhitelisted {
+		return TierWhitelist
+	}
+	if s.isMember(ctx, openid) {
+		return TierMember
+	}
+	return TierDefault
+}
+
+// isMember asks the data platform whether openid has a valid membership,
+// caching the expiration in redis.
+func (s *MeteringService) isMember(ctx context.Context, openid string) bool {
+	cacheKey := fmt.Sprintf("%s:member:%s", redisKeyPrefix, openid)
+	now := time.Now()
+	if cached, err := s.redisClient.Get(ctx, cacheKey).Int64(); err == nil {
+		return cached > now.Unix()
+	}
+	queryUrl := fmt.Sprintf("http://%s/utility-project/ysCustomer/queryUseTimeAndValidTime?username=%s",
+		s.DataPlatformEndpoint, url.QueryEscape(openid))
+	respBody, err := platform.DoHttpGet(queryUrl)
+	if err != nil {
+		grpclog.Errorf("metering query valid time failed url:%v err:%v", queryUrl, err)
+		return false
+	}
+	var resp useTimeAndValidTimeResp
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		grpclog.Errorf("metering unmarshal valid time failed body:%v err:%v", string(respBody), err)
+		return false
+	}
+	if resp.Code != platform.CodeOK {
+		grpclog.Errorf("metering query valid time failed url:%v body:%v", queryUrl, string(respBody))
+		return false
+	}
+	var validUntil int64
+	if resp.Data != nil {
+		validUntil = s.parseValidTime(resp.Data.ValidTime)
+	}
+	cacheSec := s.MemberCacheSec
+	if cacheSec <= 0 {
+		cacheSec = 300
+	}
+	s.redisClient.Set(ctx, cacheKey, validUntil, time.Duration(cacheSec)*time.Second)
+	return validUntil > now.Unix()
+}
+
+// parseValidTime accepts the unix seconds/milliseconds or datetime string
+// forms the data platform uses, returning unix seconds.
+func (s *MeteringService) parseValidTime(v any) int64 {
+	var ts int64
+	switch t := v.(type) {
+	case float64:
+		ts = int64(t)
+	case string:
+		if n, err := strconv.ParseInt(t, 10, 64); err == nil {
+			ts = n
+		} else if parsed, err := time.ParseInLocation(datetimeLayout, t, s.loc); err == nil {
+			return parsed.Unix()
+		}
+	}
+	// milliseconds
+	if ts > 1e12 {
+		ts /= 1000
+	}
+	return ts
+}
+
+// consume takes a free use of feature. The count across features starts
+// each day from what the data platform counted, so that uses it saw from
+// elsewhere are not given out again.
+func (s *MeteringService) consume(ctx context.Context, feature, openid, day string) (bool, error) {
+	allowance := s.Features[feature].DailyFree
+	if allowance <= 0 {
+		return false, nil
+	}
+	keys := []string{dailyKey(feature, openid, day), dailyTotalKey(openid, day), pendingKey(day)}
+	platformUsed := int64(-1)
+	for {
+		res, err := consumeScript.Run(ctx, s.redisClient, keys,
+			allowance, s.DailyFreeTotal, pendingField(feature, openid), 2*86400, platformUsed).Int64()
+		if err != nil {
+			return false, err
+		}
+		if res != -1 || platformUsed >= 0 {
+			return res == 1, nil
+		}
+		platformUsed, err = s.queryDailyFreeUse(openid)
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// dailyFreeUseResp is ysCustomer/queryDailyFreeUse, data is the number of
+// free uses of the day.
+type dailyFreeUseResp struct {
+	Code int `json:"code"`
+	Data any `json:"data"`
+}
+
+func (s *MeteringService) queryDailyFreeUse(openid string) (int64, error) {
+	queryUrl := fmt.Sprintf("http://%s/utility-project/ysCustomer/queryDailyFreeUse?username=%s",
+		s.DataPlatformEndpoint, url.QueryEscape(openid))
+	respBody, err := platform.DoHttpGet(queryUrl)
+	if err != nil {
+		return 0, err
+	}
+	var resp dailyFreeUseResp
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return 0, fmt.Errorf("unmarshal daily free use %s: %w", string(respBody), err)
+	}
+	if resp.Code != platform.CodeOK {
+		return 0, fmt.Errorf("daily free use code %d body %s", resp.Code, string(respBody))
+	}
+	switch data := resp.Data.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return int64(data), nil
+	case string:
+		if used, err := strconv.ParseInt(data, 10, 64); err == nil {
+			return used, nil
+		}
+	}
+	return 0, fmt.Errorf("unexpected daily free use %s", string(respBody))
+}
+
+func (s *MeteringService) release(ctx context.Context, feature, openid, day string) {
+	err := releaseScript.Run(ctx, s.redisClient,
+		[]string{dailyKey(feature, openid, day), dailyTotalKey(openid, day), pendingKey(day)},
+		pendingField(feature, openid)).Err()
+	if err != nil {
+		grpclog.Errorf("metering release failed feature:%v openid:%v err:%v", feature, openid, err)
+	}
+}
+
+func dailyKey(feature, openid, day string) string {
+	return fmt.Sprintf("%s:daily:%s:%s:%s", redisKeyPrefix, feature, day, openid)
+}
+
+func dailyTotalKey(openid, day string) string {
+	return fmt.Sprintf("%s:daily_total:%s:%s", redisKeyPrefix, day, openid)
+}
+
+func pendingKey(day string) string {
+	return fmt.Sprintf("%s:pending:%s", redisKeyPrefix, day)
+}
+
+func pendingField(feature, openid string) string {
+	return feature + ":" + openid
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,149 @@
+package metering
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/redis/go-redis/v9"
+)
+
+const ttsRoute = "/chat_completion.ChatService/text_to_speech"
+
+// newTestMeter meters one tts route against miniredis and a data platform
+// that counted platformUsed free uses today and knows no members.
+func newTestMeter(t *testing.T, platformUsed string) (*MeteringService, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	platform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/queryDailyFreeUse"):
+			w.Write([]byte(`{"code":200,"data":` + platformUsed + `}`))
+		default:
+			w.Write([]byte(`{"code":200,"data":{"memberType":"0","validTime":0}}`))
+		}
+	}))
+	t.Cleanup(platform.Close)
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	s := &MeteringService{
+		DataPlatformEndpoint: strings.TrimPrefix(platform.URL, "http://"),
+		DailyFreeTotal:       3,
+		Features:             map[string]Feature{"tts": {Routes: []string{ttsRoute}, DailyFree: 2}},
+		loc:                  loc,
+		redisClient:          redis.NewClient(&redis.Options{Addr: mr.Addr()}),
+		routeFeature:         map[string]string{ttsRoute: "tts"},
+	}
+	return s, mr
+}
+
+func serve(s *MeteringService, openid string, status int) int {
+	handler := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	r := httptest.NewRequest(http.MethodPost, ttsRoute, nil)
+	if len(openid) != 0 {
+		r = r.WithContext(common.ContextWithCaller(context.Background(), common.Caller{OpenID: openid}))
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestMeteringDailyAllowance(t *testing.T) {
+	s, _ := newTestMeter(t, "0")
+	if code := serve(s, "", http.StatusOK); code != http.StatusUnauthorized {
+		t.Fatalf("unverified caller got %d", code)
+	}
+	// failed calls hand their use back
+	if code := serve(s, "oUser", http.StatusInternalServerError); code != http.StatusInternalServerError {
+		t.Fatalf("failing route got %d", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := serve(s, "oUser", http.StatusOK); code != http.StatusOK {
+			t.Fatalf("use %d got %d", i, code)
+		}
+	}
+	if code := serve(s, "oUser", http.StatusOK); code != http.StatusPaymentRequired {
+		t.Fatalf("use beyond daily_free got %d", code)
+	}
+}
+
+func TestMeteringStartsFromPlatformCount(t *testing.T) {
+	s, _ := newTestMeter(t, "2")
+	if code := serve(s, "oUser", http.StatusOK); code != http.StatusOK {
+		t.Fatalf("first use got %d", code)
+	}
+	// the platform already counted 2 of the 3 free uses of the day
+	if code := serve(s, "oUser", http.StatusOK); code != http.StatusPaymentRequired {
+		t.Fatalf("use beyond daily_free_total got %d", code)
+	}
+}
+
+func TestMeteringFailsClosed(t *testing.T) {
+	s, mr := newTestMeter(t, "0")
+	mr.Close()
+	if code := serve(s, "oUser", http.StatusOK); code != http.StatusServiceUnavailable {
+		t.Fatalf("redis down got %d", code)
+	}
+	s, _ = newTestMeter(t, `"garbage"`)
+	if code := serve(s, "oUser", http.StatusOK); code != http.StatusServiceUnavailable {
+		t.Fatalf("unreadable platform count got %d", code)
+	}
+}
+
+func TestMeteringReconcile(t *testing.T) {
+	s, mr := newTestMeter(t, "0")
+	var mu sync.Mutex
+	// the platform refuses the use following the refuseAfter-th one
+	reported, refuseAfter := 0, -1
+	platform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if reported == refuseAfter {
+			refuseAfter = -1
+			w.Write([]byte(`{"code":500,"msg":"busy"}`))
+			return
+		}
+		reported++
+		w.Write([]byte(`{"code":200}`))
+	}))
+	t.Cleanup(platform.Close)
+	s.DataPlatformEndpoint = strings.TrimPrefix(platform.URL, "http://")
+	ctx := context.Background()
+	key := pendingKey("20240101")
+	field := pendingField("tts", "oUser")
+
+	// a use the platform refuses stays pending with the ones after it
+	mr.HSet(key, field, "3")
+	refuseAfter = 1
+	s.reconcile(ctx, "20240101")
+	if reported != 1 || mr.HGet(key, field) != "2" {
+		t.Fatalf("reported %d pending %q after a refusal", reported, mr.HGet(key, field))
+	}
+	s.reconcile(ctx, "20240101")
+	if reported != 3 || mr.HGet(key, field) != "0" {
+		t.Fatalf("reported %d pending %q", reported, mr.HGet(key, field))
+	}
+
+	// nodes reconciling together report each use once
+	reported = 0
+	mr.HSet(key, field, "20")
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.reconcile(ctx, "20240101")
+		}()
+	}
+	wg.Wait()
+	if reported != 20 || mr.HGet(key, field) != "0" {
+		t.Fatalf("concurrent reconcile reported %d pending %q", reported, mr.HGet(key, field))
+	}
+}
@@ -0,0 +1,112 @@
+package metering
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/platform"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/grpclog"
+)
+
+type dailyFreeUseParam struct {
+	UserName string `json:"username,omitempty"`
+}
+
+func (s *MeteringService) reconcileLoop(ctx context.Context) {
+	interval := time.Duration(s.ReconcileIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			// yesterday is included so that uses right before midnight are not lost
+			local := now.In(s.loc)
+			s.reconcile(ctx, local.AddDate(0, 0, -1).Format(yyyymmdd))
+			s.reconcile(ctx, local.Format(yyyymmdd))
+		}
+	}
+}
+
+// KEYS[1] pending reconciliation hash
+// ARGV[1] pending hash field
+// returns the uses taken out of the hash, the caller reports them and puts
+// back what it could not
+var claimScript = redis.NewScript(`
+local pending = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+if pending <= 0 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], ARGV[1], -pending)
+return pending
+`)
+
+// abtainDailyFreeUserResp is the subset of ysCustomer/abtainDailyFreeUser
+// needed to tell whether the use was counted.
+type abtainDailyFreeUserResp struct {
+	Code int `json:"code"`
+}
+
+// reconcile reports the free uses metered locally since the last run to the
+// data platform, one abtainDailyFreeUser call per use. Uses are claimed out
+// of the pending hash before they are reported, so that nodes reconciling at
+// the same time never report the same use twice.
+func (s *MeteringService) reconcile(ctx context.Context, day string) {
+	key := pendingKey(day)
+	fields, err := s.redisClient.HKeys(ctx, key).Result()
+	if err != nil {
+		grpclog.Errorf("metering reconcile hkeys failed key:%v err:%v", key, err)
+		return
+	}
+	abtainUrl := fmt.Sprintf("http://%s/utility-project/ysCustomer/abtainDailyFreeUser", s.DataPlatformEndpoint)
+	for _, field := range fields {
+		count, err := claimScript.Run(ctx, s.redisClient, []string{key}, field).Int64()
+		if err != nil {
+			grpclog.Errorf("metering reconcile claim failed key:%v field:%v err:%v", key, field, err)
+			continue
+		}
+		if count <= 0 {
+			continue
+		}
+		openid := field[strings.Index(field, ":")+1:]
+		reqBody, _ := json.Marshal(dailyFreeUseParam{UserName: openid})
+		var reported int64
+		for ; reported < count; reported++ {
+			if err := postDailyFreeUse(abtainUrl, reqBody); err != nil {
+				grpclog.Errorf("metering reconcile post failed url:%v reqBody:%v err:%v", abtainUrl, string(reqBody), err)
+				break
+			}
+		}
+		grpclog.Infof("metering reconcile openid:%v reported:%v of:%v", openid, reported, count)
+		if reported == count {
+			continue
+		}
+		// the rest is put back for the next run
+		if err := s.redisClient.HIncrBy(ctx, key, field, count-reported).Err(); err != nil {
+			grpclog.Errorf("metering reconcile restore failed key:%v field:%v uses:%v err:%v", key, field, count-reported, err)
+		}
+	}
+}
+
+func postDailyFreeUse(abtainUrl string, reqBody []byte) error {
+	respBody, err := platform.DoHttpPost(abtainUrl, reqBody)
+	if err != nil {
+		return err
+	}
+	var resp abtainDailyFreeUserResp
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return fmt.Errorf("unmarshal abtain daily free user %s: %w", string(respBody), err)
+	}
+	if resp.Code != platform.CodeOK {
+		return fmt.Errorf("abtain daily free user code %d body %s", resp.Code, string(respBody))
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"time"
 
 	"google.golang.org/grpc/grpclog"
 	"gopkg.in/yaml.v3"
@@ -15,6 +16,16 @@ import (
 
 type ForwardService struct {
 	DataPlatformEndpoint string `yaml:"endpoint"`
+	// ShadowEndpoint is a candidate data platform that receives a mirrored copy
+	// of the requests on ShadowRoutes. Its responses are compared, never returned.
+	ShadowEndpoint string `yaml:"shadow_endpoint"`
+	// ShadowRoutes maps a forwarded path to its sampling rate in [0, 1].
+	ShadowRoutes    map[string]float64 `yaml:"shadow_routes"`
+	ShadowTimeoutMs int64              `yaml:"shadow_timeout_ms"`
+	// ShadowMaxInflight bounds the mirrors running at once, more are dropped.
+	ShadowMaxInflight int `yaml:"shadow_max_inflight"`
+
+	shadowSlots chan struct{}
 }
 
 func ForwardServiceInitialize(ctx *context.Context) (*ForwardService, error) {
@@ -31,6 +42,10 @@ func ForwardServiceInitialize(ctx *context.Context) (*ForwardService, error) {
 		grpclog.Fatal(err)
 		return nil, err
 	}
+	if server.ShadowMaxInflight <= 0 {
+		server.ShadowMaxInflight = defaultShadowMaxInflight
+	}
+	server.shadowSlots = make(chan struct{}, server.ShadowMaxInflight)
 
 	return &server, nil
 }
@@ -41,6 +56,7 @@ func (s ForwardService) Forward(ctx *context.Context, w http.ResponseWriter, r *
 		errmsg := fmt.Sprintf("Forward failed to parse url err:%v", err)
 		grpclog.Error(errmsg)
 		http.Error(w, errmsg, http.StatusInternalServerError)
+		return
 	}
 
 	forwardURL := fmt.Sprintf("http://%s%s", s.DataPlatformEndpoint, parsedURL.Path)
@@ -53,6 +69,7 @@ func (s ForwardService) Forward(ctx *context.Context, w http.ResponseWriter, r *
 		errmsg := fmt.Sprintf("Forward failed to parse body err:%v", err)
 		grpclog.Error(errmsg)
 		http.Error(w, errmsg, http.StatusInternalServerError)
+		return
 	}
 	grpclog.Infof("Forward recv request:%v", string(bodyBytes))
 
@@ -63,16 +80,28 @@ func (s ForwardService) Forward(ctx *context.Context, w http.ResponseWriter, r *
 			forwardRequest.Header.Add(key, value)
 		}
 	}
+	start := time.Now()
 	forwardResponse, err := http.DefaultClient.Do(forwardRequest)
 	if err != nil {
 		errmsg := fmt.Sprintf("Forward failed to request backend err:%+v", err)
 		grpclog.Error(errmsg)
 		http.Error(w, errmsg, http.StatusInternalServerError)
+		return
 	}
 	defer forwardResponse.Body.Close()
 
 	grpclog.Infof("Forward response:%+v", forwardResponse)
 
+	// the primary body is buffered so that it can be compared with the shadow one
+	respBody, err := io.ReadAll(forwardResponse.Body)
+	latency := time.Since(start)
+	if err != nil {
+		errmsg := fmt.Sprintf("Forward failed to read backend body err:%+v", err)
+		grpclog.Error(errmsg)
+		http.Error(w, errmsg, http.StatusInternalServerError)
+		return
+	}
+
 	// deep copy response
 	for key, values := range forwardResponse.Header {
 		for _, value := range values {
@@ -80,10 +109,21 @@ func (s ForwardService) Forward(ctx *context.Context, w http.ResponseWriter, r *
 		}
 	}
 	w.WriteHeader(forwardResponse.StatusCode)
-	_, err = io.Copy(w, forwardResponse.Body)
+	_, err = w.Write(respBody)
 	if err != nil {
-		errmsg := fmt.Sprintf("Forward copy body faile rr:%+v", err)
-		grpclog.Error(errmsg)
-		http.Error(w, errmsg, http.StatusInternalServerError)
+		grpclog.Errorf("Forward copy body faile rr:%+v", err)
+	}
+
+	if s.shouldMirror(parsedURL.Path) {
+		s.startMirror(&shadowSample{
+			Method:         r.Method,
+			Path:           parsedURL.Path,
+			RawQuery:       parsedURL.RawQuery,
+			Header:         shadowHeader(r.Header),
+			Body:           bodyBytes,
+			PrimaryStatus:  forwardResponse.StatusCode,
+			PrimaryBody:    respBody,
+			PrimaryLatency: latency,
+		})
 	}
 }
@@ -3,14 +3,13 @@ package platform
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
 	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/pkusunjy/grpc-gateway/service/validation"
 	"github.com/redis/go-redis/v9"
 	"google.golang.org/grpc/grpclog"
 	"gopkg.in/yaml.v3"
@@ -39,6 +38,47 @@ type WhitelistUserData struct {
 	Status         *int8   `json:"status,omitempty"`
 }
 
+type RedisData struct {
+	Key    string   `json:"key,omitempty"`
+	Values []string `json:"values,omitempty"`
+}
+
+type RedisOpenIDData struct {
+	OpenID string `json:"openid,omitempty"`
+}
+
+// ResResponse is the {"res": ...} body returned by the platform routes.
+type ResResponse struct {
+	Res any `json:"res"`
+}
+
+var (
+	// insert and update derive expiration_date from added_time
+	WhitelistWriteRules = validation.Rules{
+		"openid":     "required,openid",
+		"name":       "max=64",
+		"added_time": "required",
+		"added_by":   "max=64",
+		"status":     "oneof=0 1",
+	}
+	WhitelistQueryRules = validation.Rules{
+		"openid": "openid",
+	}
+	WhitelistDeleteRules = validation.Rules{
+		"openid": "required,openid",
+	}
+	redisSetRules = validation.Rules{
+		"key":    "max=128",
+		"values": "required,max=1000",
+	}
+	redisQueryRules = validation.Rules{
+		"key": "max=128",
+	}
+	redisOpenIDRules = validation.Rules{
+		"openid": "required,openid",
+	}
+)
+
 func PlatformServiceInitialize(ctx *context.Context) (*PlatformService, error) {
 	// load keys
 	content, err := os.ReadFile(mysqlConf)
@@ -82,6 +122,11 @@ func PlatformServiceInitialize(ctx *context.Context) (*PlatformService, error) {
 	return &server, nil
 }
 
+// DB exposes the gateway database to services that keep their own tables.
+func (server PlatformService) DB() *sql.DB {
+	return server.db
+}
+
 func (server PlatformService) Destroy() error {
 	return server.db.Close()
 }
@@ -214,111 +259,51 @@ func (server PlatformService) WhitelistMySqlDelete(ctx *context.Context, data *W
 	return rowsAffected, nil
 }
 
-func (server PlatformService) RedisSAdd(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
-
-	type RedisData struct {
-		Key    string   `json:"key,omitempty"`
-		Values []string `json:"values,omitempty"`
-	}
-
-	var data RedisData
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
-	}
-
-	grpclog.Infof("Received request:%+v", data)
+func (server PlatformService) RedisSAdd(ctx context.Context, data *RedisData) (*ResResponse, error) {
 	key := "mikiai_whitelist_user"
 	if len(data.Key) != 0 {
 		key = data.Key
 	}
-	ret := server.redisClient.SAdd(*ctx, key, data.Values)
-	if ret == nil {
-		grpclog.Errorf("redis sadd failed")
-		http.Error(w, "redis sadd failed", http.StatusBadRequest)
-		return
+	ret, err := server.redisClient.SAdd(ctx, key, data.Values).Result()
+	if err != nil {
+		grpclog.Errorf("redis sadd failed err:%v", err)
+		return nil, err
 	}
-	resp := fmt.Sprintf("{\"res\":%v}", ret.Val())
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(resp))
+	return &ResResponse{Res: ret}, nil
 }
 
-func (server PlatformService) RedisSAddGet(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
-	openid := query.Get("openid")
-
-	grpclog.Infof("Received openid:%+v", openid)
+func (server PlatformService) RedisSAddGet(ctx context.Context, data *RedisOpenIDData) (*ResResponse, error) {
 	key := "mikiai_whitelist_user"
-	ret := server.redisClient.SAdd(*ctx, key, []string{openid})
-	if ret == nil {
-		grpclog.Errorf("redis sadd failed")
-		http.Error(w, "redis sadd failed", http.StatusBadRequest)
-		return
-	}
-	resp := fmt.Sprintf("{\"res\":%v}", ret.Val())
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(resp))
-}
-
-func (server PlatformService) RedisSMembers(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
-
-	type RedisData struct {
-		Key    string   `json:"key,omitempty"`
-		Values []string `json:"values,omitempty"`
-	}
-
-	var data RedisData
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	ret, err := server.redisClient.SAdd(ctx, key, []string{data.OpenID}).Result()
+	if err != nil {
+		grpclog.Errorf("redis sadd failed err:%v", err)
+		return nil, err
 	}
+	return &ResResponse{Res: ret}, nil
+}
 
-	grpclog.Infof("Received request:%+v", data)
+func (server PlatformService) RedisSMembers(ctx context.Context, data *RedisData) (*ResResponse, error) {
 	key := "mikiai_whitelist_user"
 	if len(data.Key) != 0 {
 		key = data.Key
 	}
-	whitelist := server.redisClient.SMembers(*ctx, key)
-	if whitelist == nil {
-		grpclog.Errorf("error exec smembers cmd")
-		return
+	whitelist, err := server.redisClient.SMembers(ctx, key).Result()
+	if err != nil {
+		grpclog.Errorf("error exec smembers cmd err:%v", err)
+		return nil, err
 	}
-
-	whitelistJsonObj, _ := json.Marshal(whitelist.Val())
-	resp := fmt.Sprintf("{\"res\":%v}", string(whitelistJsonObj))
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(resp))
+	return &ResResponse{Res: whitelist}, nil
 }
 
-func (server PlatformService) RedisSRem(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
-
-	type RedisData struct {
-		Key    string   `json:"key,omitempty"`
-		Values []string `json:"values,omitempty"`
-	}
-
-	var data RedisData
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
-	}
-
-	grpclog.Infof("Received request:%+v", data)
+func (server PlatformService) RedisSRem(ctx context.Context, data *RedisData) (*ResResponse, error) {
 	key := "mikiai_whitelist_user"
 	if len(data.Key) != 0 {
 		key = data.Key
 	}
-	ret := server.redisClient.SRem(*ctx, key, data.Values)
-	if ret == nil {
-		grpclog.Errorf("error exec srem cmd")
-		return
+	ret, err := server.redisClient.SRem(ctx, key, data.Values).Result()
+	if err != nil {
+		grpclog.Errorf("error exec srem cmd err:%v", err)
+		return nil, err
 	}
-
-	resp := fmt.Sprintf("{\"res\":%v}", ret.Val())
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(resp))
+	return &ResResponse{Res: ret}, nil
 }
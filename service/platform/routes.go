@@ -0,0 +1,69 @@
+package platform
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkusunjy/grpc-gateway/service/router"
+)
+
+func (server PlatformService) Routes() []router.Route {
+	return []router.Route{
+		router.JSON(http.MethodPost, "/platform/whitelist_insert", router.AuthAdmin, WhitelistWriteRules, server.whitelistInsert),
+		router.JSON(http.MethodPost, "/platform/whitelist_update", router.AuthAdmin, WhitelistWriteRules, server.whitelistUpdate),
+		router.JSON(http.MethodPost, "/platform/whitelist_query", router.AuthAdmin, WhitelistQueryRules, server.whitelistQuery),
+		router.JSON(http.MethodPost, "/platform/whitelist_delete", router.AuthAdmin, WhitelistDeleteRules, server.whitelistDelete),
+		router.JSON(http.MethodPost, "/platform/sadd", router.AuthAdmin, redisSetRules, server.RedisSAdd),
+		router.JSON(http.MethodGet, "/platform/sadd", router.AuthAdmin, redisOpenIDRules, server.RedisSAddGet),
+		router.JSON(http.MethodPost, "/platform/smembers", router.AuthAdmin, redisQueryRules, server.RedisSMembers),
+		router.JSON(http.MethodPost, "/platform/srem", router.AuthAdmin, redisSetRules, server.RedisSRem),
+	}
+}
+
+func (server PlatformService) whitelistInsert(ctx context.Context, data *WhitelistUserData) (*ResResponse, error) {
+	res, err := server.WhitelistMySqlInsert(&ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	return &ResResponse{Res: res}, nil
+}
+
+func (server PlatformService) whitelistUpdate(ctx context.Context, data *WhitelistUserData) (*ResResponse, error) {
+	res, err := server.WhitelistMySqlUpdate(&ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	return &ResResponse{Res: res}, nil
+}
+
+func (server PlatformService) whitelistQuery(ctx context.Context, data *WhitelistUserData) (*[]WhitelistUserData, error) {
+	res, err := server.WhitelistMySqlQuery(&ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (server PlatformService) whitelistDelete(ctx context.Context, data *WhitelistUserData) (*ResResponse, error) {
+	res, err := server.WhitelistMySqlDelete(&ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	return &ResResponse{Res: res}, nil
+}
+
+func (s ForwardService) Routes() []router.Route {
+	routes := make([]router.Route, 0, len(ForwardPathMethMap)+len(AdminForwardPathMethMap))
+	for path, meth := range ForwardPathMethMap {
+		routes = append(routes, router.Raw(meth, path, router.AuthNone, s.forwardHandler))
+	}
+	for path, meth := range AdminForwardPathMethMap {
+		routes = append(routes, router.Raw(meth, path, router.AuthAdmin, s.forwardHandler))
+	}
+	return routes
+}
+
+func (s ForwardService) forwardHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	s.Forward(&ctx, w, r)
+}
@@ -0,0 +1,27 @@
+package platform
+
+import (
+	"testing"
+
+	"github.com/pkusunjy/grpc-gateway/service/router"
+)
+
+func TestForwardRoutesAuth(t *testing.T) {
+	want := map[string]router.AuthPolicy{
+		"/utility-project/ysPaper/queryPaperList":  router.AuthNone,
+		"/utility-project/ysCustomer/save":         router.AuthAdmin,
+		"/utility-project/ysOrder/editOrderStatus": router.AuthAdmin,
+	}
+	routes := ForwardService{}.Routes()
+	if len(routes) != len(ForwardPathMethMap)+len(AdminForwardPathMethMap) {
+		t.Fatalf("%d forward routes", len(routes))
+	}
+	for _, route := range routes {
+		if auth, ok := want[route.Path]; ok && route.Auth != auth {
+			t.Errorf("%s auth %v, want %v", route.Path, route.Auth, auth)
+		}
+		if _, public := ForwardPathMethMap[route.Path]; public && route.Auth != router.AuthNone {
+			t.Errorf("%s auth %v", route.Path, route.Auth)
+		}
+	}
+}
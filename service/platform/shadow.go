@@ -0,0 +1,188 @@
+package platform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	defaultShadowTimeout = 5 * time.Second
+	// mirrors running at once unless shadow_max_inflight is set
+	defaultShadowMaxInflight = 16
+	// at most this many differing json paths are logged per request
+	maxShadowDiffs = 10
+)
+
+// shadowStrippedHeaders authenticate the client to the gateway, the shadow
+// has no business seeing them.
+var shadowStrippedHeaders = []string{
+	common.SessionTokenHeader,
+	"X-Admin-Token",
+	"Authorization",
+	"Cookie",
+}
+
+// shadowSample holds everything needed to replay a forwarded request against
+// the shadow endpoint and compare the outcome with the primary one.
+type shadowSample struct {
+	Method         string
+	Path           string
+	RawQuery       string
+	Header         http.Header
+	Body           []byte
+	PrimaryStatus  int
+	PrimaryBody    []byte
+	PrimaryLatency time.Duration
+}
+
+func (s ForwardService) shouldMirror(path string) bool {
+	if len(s.ShadowEndpoint) == 0 {
+		return false
+	}
+	rate, ok := s.ShadowRoutes[path]
+	if !ok || rate <= 0 {
+		return false
+	}
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// startMirror mirrors the sample in the background unless
+// shadow_max_inflight mirrors are running already, then it is dropped so that
+// a slow shadow cannot pile up goroutines and connections.
+func (s ForwardService) startMirror(sample *shadowSample) {
+	select {
+	case s.shadowSlots <- struct{}{}:
+	default:
+		grpclog.Warningf("Shadow path:%v dropped, %d mirrors in flight", sample.Path, cap(s.shadowSlots))
+		return
+	}
+	go func() {
+		defer func() { <-s.shadowSlots }()
+		s.mirror(sample)
+	}()
+}
+
+// shadowHeader copies the client header without its credentials.
+func shadowHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, key := range shadowStrippedHeaders {
+		header.Del(key)
+	}
+	return header
+}
+
+// mirror sends the sample to the shadow endpoint and logs latency, status and
+// body differences. The shadow response is discarded.
+func (s ForwardService) mirror(sample *shadowSample) {
+	timeout := defaultShadowTimeout
+	if s.ShadowTimeoutMs > 0 {
+		timeout = time.Duration(s.ShadowTimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	shadowURL := fmt.Sprintf("http://%s%s", s.ShadowEndpoint, sample.Path)
+	if sample.RawQuery != "" {
+		shadowURL = fmt.Sprintf("%s?%s", shadowURL, sample.RawQuery)
+	}
+	shadowRequest, err := http.NewRequestWithContext(ctx, sample.Method, shadowURL, bytes.NewReader(sample.Body))
+	if err != nil {
+		grpclog.Errorf("Shadow failed to build request url:%v err:%v", shadowURL, err)
+		return
+	}
+	shadowRequest.Header = sample.Header
+
+	start := time.Now()
+	shadowResponse, err := http.DefaultClient.Do(shadowRequest)
+	if err != nil {
+		grpclog.Warningf("Shadow path:%v primary_status:%v primary_latency:%v shadow_latency:%v shadow_err:%v",
+			sample.Path, sample.PrimaryStatus, sample.PrimaryLatency, time.Since(start), err)
+		return
+	}
+	defer shadowResponse.Body.Close()
+	shadowBody, err := io.ReadAll(shadowResponse.Body)
+	latency := time.Since(start)
+	if err != nil {
+		grpclog.Warningf("Shadow path:%v failed to read body err:%v", sample.Path, err)
+		return
+	}
+
+	diffs := diffBody(sample.PrimaryBody, shadowBody)
+	if sample.PrimaryStatus == shadowResponse.StatusCode && len(diffs) == 0 {
+		grpclog.Infof("Shadow path:%v status:%v primary_latency:%v shadow_latency:%v body_match:true",
+			sample.Path, sample.PrimaryStatus, sample.PrimaryLatency, latency)
+		return
+	}
+	grpclog.Warningf("Shadow path:%v query:%v primary_status:%v shadow_status:%v primary_latency:%v shadow_latency:%v body_match:false diffs:%v",
+		sample.Path, sample.RawQuery, sample.PrimaryStatus, shadowResponse.StatusCode, sample.PrimaryLatency, latency, diffs)
+}
+
+// diffBody compares two response bodies. JSON bodies are compared
+// structurally and the differing paths are returned, anything else is
+// compared byte by byte.
+func diffBody(primary, shadow []byte) []string {
+	var primaryObj, shadowObj any
+	if json.Unmarshal(primary, &primaryObj) != nil || json.Unmarshal(shadow, &shadowObj) != nil {
+		if bytes.Equal(primary, shadow) {
+			return nil
+		}
+		return []string{fmt.Sprintf("raw body differs primary_len:%d shadow_len:%d", len(primary), len(shadow))}
+	}
+	var diffs []string
+	diffJSON("$", primaryObj, shadowObj, &diffs)
+	return diffs
+}
+
+func diffJSON(path string, primary, shadow any, diffs *[]string) {
+	if len(*diffs) >= maxShadowDiffs {
+		return
+	}
+	switch p := primary.(type) {
+	case map[string]any:
+		s, ok := shadow.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(p)+len(s))
+		for k := range p {
+			keys = append(keys, k)
+		}
+		for k := range s {
+			if _, ok := p[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffJSON(path+"."+k, p[k], s[k], diffs)
+		}
+		return
+	case []any:
+		s, ok := shadow.([]any)
+		if !ok {
+			break
+		}
+		if len(p) != len(s) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: len %d != %d", path, len(p), len(s)))
+			return
+		}
+		for i := range p {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), p[i], s[i], diffs)
+		}
+		return
+	}
+	if !reflect.DeepEqual(primary, shadow) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: %v != %v", path, primary, shadow))
+	}
+}
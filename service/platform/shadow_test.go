@@ -0,0 +1,86 @@
+package platform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+)
+
+func TestDiffBody(t *testing.T) {
+	cases := []struct {
+		primary, shadow string
+		want            []string
+	}{
+		{`{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1}`, nil},
+		{`{"a":1,"b":{"c":"x"}}`, `{"a":2,"b":{"c":"y"},"d":true}`, []string{"$.a: 1 != 2", "$.b.c: x != y", "$.d: <nil> != true"}},
+		{`{"list":[1,2]}`, `{"list":[1]}`, []string{"$.list: len 2 != 1"}},
+		{`{"list":[{"id":1}]}`, `{"list":[{"id":2}]}`, []string{"$.list[0].id: 1 != 2"}},
+		{`{"a":{"b":1}}`, `{"a":[1]}`, []string{"$.a: map[b:1] != [1]"}},
+		{`ok`, `ok`, nil},
+		{`ok`, `{}`, []string{"raw body differs primary_len:2 shadow_len:2"}},
+	}
+	for _, c := range cases {
+		if got := diffBody([]byte(c.primary), []byte(c.shadow)); !slices.Equal(got, c.want) {
+			t.Errorf("diffBody(%s, %s) = %q, want %q", c.primary, c.shadow, got, c.want)
+		}
+	}
+
+	// the diffs logged per request are capped
+	primary, shadow := []string{}, []string{}
+	for i := range 2 * maxShadowDiffs {
+		primary = append(primary, "1")
+		shadow = append(shadow, string(rune('2'+i%7)))
+	}
+	diffs := diffBody([]byte("["+strings.Join(primary, ",")+"]"), []byte("["+strings.Join(shadow, ",")+"]"))
+	if len(diffs) != maxShadowDiffs {
+		t.Fatalf("diffs not capped %d", len(diffs))
+	}
+}
+
+func TestMirror(t *testing.T) {
+	received := make(chan http.Header, 1)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		<-release
+		w.Write([]byte(`{}`))
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	s := ForwardService{
+		ShadowEndpoint: strings.TrimPrefix(shadow.URL, "http://"),
+		shadowSlots:    make(chan struct{}, 1),
+	}
+	header := http.Header{}
+	header.Set(common.SessionTokenHeader, "secret")
+	header.Set("Cookie", "sid=secret")
+	header.Set(common.OpenIDHeader, "oUser")
+	sample := &shadowSample{Method: http.MethodGet, Path: "/utility-project/ysExam/queryById", Header: shadowHeader(header), PrimaryStatus: 200, PrimaryBody: []byte(`{}`)}
+
+	s.startMirror(sample)
+	select {
+	case got := <-received:
+		if len(got.Get(common.SessionTokenHeader)) != 0 || len(got.Get("Cookie")) != 0 || got.Get(common.OpenIDHeader) != "oUser" {
+			t.Fatalf("shadow got header %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mirror")
+	}
+
+	// the only slot is busy until the shadow answers, the sample is dropped
+	s.startMirror(sample)
+	select {
+	case <-received:
+		t.Fatal("mirrored beyond shadow_max_inflight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(s.shadowSlots) != 1 {
+		t.Fatalf("slots in use %d", len(s.shadowSlots))
+	}
+}
@@ -10,6 +10,9 @@ import (
 
 const (
 	dataPlatformFile = "./conf/data_platform.yaml"
+	// CodeOK is the code of a data platform response that succeeded, other
+	// codes come with http status 200 as well
+	CodeOK = 200
 )
 
 var (
@@ -21,7 +24,6 @@ var (
 		"/utility-project/ysCustomer/queryByUsername":          "GET",
 		"/utility-project/ysCustomer/queryDailyFreeUse":        "GET",
 		"/utility-project/ysCustomer/queryUseTimeAndValidTime": "GET",
-		"/utility-project/ysCustomer/save":                     "POST",
 		"/utility-project/ysExam/queryById":                    "GET",
 		"/utility-project/ysExam/queryExamByPaperId":           "POST",
 		"/utility-project/ysExamAnswer/queryExamAnswerList":    "POST",
@@ -30,7 +32,6 @@ var (
 		"/utility-project/ysExperienceRecord/queryById":        "GET",
 		"/utility-project/ysExperienceRecord/save":             "POST",
 		"/utility-project/ysMemberConfig/queryById":            "GET",
-		"/utility-project/ysOrder/editOrderStatus":             "POST",
 		"/utility-project/ysOrder/queryById":                   "GET",
 		"/utility-project/ysOrder/queryByUsername":             "GET",
 		"/utility-project/ysOrder/save":                        "POST",
@@ -38,6 +39,12 @@ var (
 		"/utility-project/ysPaper/queryPaperList":              "POST",
 		"/utility-project/ysPaper/queryExamByPaperType":        "GET",
 	}
+	// AdminForwardPathMethMap are forwarded for admins only, they change
+	// memberships and order states the gateway is otherwise in charge of
+	AdminForwardPathMethMap = map[string]string{
+		"/utility-project/ysCustomer/save":         "POST",
+		"/utility-project/ysOrder/editOrderStatus": "POST",
+	}
 )
 
 func DoHttpPost(url string, reqBody []byte) ([]byte, error) {
@@ -56,3 +63,18 @@ func DoHttpPost(url string, reqBody []byte) ([]byte, error) {
 	}
 	return respBody, nil
 }
+
+func DoHttpGet(url string) ([]byte, error) {
+	resp, err := http.DefaultClient.Get(url)
+	if err != nil {
+		grpclog.Errorf("Error sending request:%v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		grpclog.Errorf("Error read resp:%v", err)
+		return nil, err
+	}
+	return respBody, nil
+}
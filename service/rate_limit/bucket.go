@@ -0,0 +1,120 @@
+package rate_limit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Limit describes a token bucket refilled at PerMinute tokens per minute and
+// holding at most Burst tokens.
+type Limit struct {
+	PerMinute float64 `yaml:"per_minute"`
+	Burst     int     `yaml:"burst"`
+}
+
+func (l Limit) valid() bool {
+	return l.PerMinute > 0 && l.Burst > 0
+}
+
+// tokensPerMs is the refill speed of the bucket.
+func (l Limit) tokensPerMs() float64 {
+	return l.PerMinute / 60000
+}
+
+type bucketStore interface {
+	// take consumes one token from the bucket identified by key, returning
+	// how long the caller should wait when the bucket is empty.
+	take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error)
+}
+
+// KEYS[1] bucket key
+// ARGV[1] refill rate in tokens per millisecond
+// ARGV[2] burst
+// ARGV[3] now in unix milliseconds
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate) + 1000)
+return {allowed, wait}
+`)
+
+type redisBucketStore struct {
+	client *redis.Client
+}
+
+func (s *redisBucketStore) take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	res, err := tokenBucketScript.Run(ctx, s.client, []string{key},
+		limit.tokensPerMs(), limit.Burst, now.UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+type memoryBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+// memoryBucketStore keeps buckets in process, it is used in single-node/dev
+// mode and whenever redis is unreachable.
+type memoryBucketStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func newMemoryBucketStore() *memoryBucketStore {
+	return &memoryBucketStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *memoryBucketStore) take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(limit.Burst), ts: now}
+		s.buckets[key] = b
+	}
+	elapsed := float64(now.Sub(b.ts).Milliseconds())
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+math.Max(0, elapsed)*limit.tokensPerMs())
+	b.ts = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	wait := math.Ceil((1 - b.tokens) / limit.tokensPerMs())
+	return false, time.Duration(wait) * time.Millisecond, nil
+}
+
+// sweep drops buckets that have been idle long enough to be full again.
+func (s *memoryBucketStore) sweep(now time.Time, idle time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, b := range s.buckets {
+		if now.Sub(b.ts) > idle {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package rate_limit
+
+const (
+	rateLimitFile     = "./conf/rate_limit.yaml"
+	whitelistRedisKey = "mikiai_whitelist_user"
+	defaultTier       = "default"
+	whitelistTier     = "whitelist"
+	redisKeyPrefix    = "rate_limit"
+)
@@ -0,0 +1,172 @@
+package rate_limit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc/grpclog"
+	"gopkg.in/yaml.v3"
+)
+
+// RouteLimit holds the limits of one route. IP applies to every caller, User
+// applies per openid and is picked by the membership tier of the caller.
+type RouteLimit struct {
+	IP   Limit            `yaml:"ip"`
+	User map[string]Limit `yaml:"user"`
+}
+
+// TierResolver returns the membership tier of an openid, used to select the
+// per-user limit of a route.
+type TierResolver interface {
+	Tier(ctx context.Context, openid string) string
+}
+
+type RateLimiter struct {
+	// Mode is either "redis" or "local"
+	Mode      string                `yaml:"mode"`
+	RedisAddr string                `yaml:"redis_addr"`
+	Routes    map[string]RouteLimit `yaml:"routes"`
+	redis     *redisBucketStore
+	local     *memoryBucketStore
+	tiers     TierResolver
+}
+
+func RateLimitServiceInitialize(ctx *context.Context) (*RateLimiter, error) {
+	content, err := os.ReadFile(rateLimitFile)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	server := RateLimiter{}
+	err = yaml.Unmarshal(content, &server)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	server.local = newMemoryBucketStore()
+	if server.Mode != "local" && len(server.RedisAddr) != 0 {
+		client := redis.NewClient(&redis.Options{
+			Addr:     server.RedisAddr,
+			Password: "",
+			DB:       0,
+		})
+		if err := client.Ping(*ctx).Err(); err != nil {
+			grpclog.Warningf("rate limit redis %v unreachable, falling back to local buckets err:%v", server.RedisAddr, err)
+		}
+		server.redis = &redisBucketStore{client: client}
+		server.tiers = &whitelistTierResolver{client: client}
+	}
+	go server.sweepLocal(*ctx)
+	grpclog.Infof("initialized rate limit mode:%v routes:%v", server.Mode, len(server.Routes))
+	return &server, nil
+}
+
+// SetTierResolver replaces the default whitelist based tier lookup.
+func (l *RateLimiter) SetTierResolver(resolver TierResolver) {
+	l.tiers = resolver
+}
+
+// Middleware rejects requests exceeding the limits of their route with 429
+// and a Retry-After header. Routes without limits are passed through. The
+// caller is the one the router middleware put in the context.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := l.Routes[r.URL.Path]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		caller := common.CallerFromContext(ctx)
+		now := time.Now()
+		if route.IP.valid() {
+			ip := caller.IP
+			key := fmt.Sprintf("%s:%s:ip:%s", redisKeyPrefix, r.URL.Path, ip)
+			if allowed, wait := l.take(ctx, key, route.IP, now); !allowed {
+				grpclog.Warningf("rate limit exceeded path:%v ip:%v retry_after:%v", r.URL.Path, ip, wait)
+				reject(w, wait)
+				return
+			}
+		}
+		if len(route.User) != 0 {
+			if openid := caller.OpenID; len(openid) != 0 {
+				tier := l.tier(ctx, openid)
+				limit, ok := route.User[tier]
+				if !ok {
+					limit = route.User[defaultTier]
+				}
+				if limit.valid() {
+					key := fmt.Sprintf("%s:%s:user:%s", redisKeyPrefix, r.URL.Path, openid)
+					if allowed, wait := l.take(ctx, key, limit, now); !allowed {
+						grpclog.Warningf("rate limit exceeded path:%v openid:%v tier:%v retry_after:%v", r.URL.Path, openid, tier, wait)
+						reject(w, wait)
+						return
+					}
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *RateLimiter) take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration) {
+	if l.redis != nil {
+		allowed, wait, err := l.redis.take(ctx, key, limit, now)
+		if err == nil {
+			return allowed, wait
+		}
+		grpclog.Warningf("rate limit redis take failed, falling back to local bucket key:%v err:%v", key, err)
+	}
+	allowed, wait, _ := l.local.take(ctx, key, limit, now)
+	return allowed, wait
+}
+
+func (l *RateLimiter) tier(ctx context.Context, openid string) string {
+	if l.tiers == nil {
+		return defaultTier
+	}
+	return l.tiers.Tier(ctx, openid)
+}
+
+func (l *RateLimiter) sweepLocal(ctx context.Context) {
+	t := time.NewTicker(10 * time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			l.local.sweep(now, time.Hour)
+		}
+	}
+}
+
+func reject(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	common.WriteError(w, http.StatusTooManyRequests, "rate limit exceeded")
+}
+
+// whitelistTierResolver puts whitelisted users in their own tier and
+// everyone else in the default one.
+type whitelistTierResolver struct {
+	client *redis.Client
+}
+
+func (t *whitelistTierResolver) Tier(ctx context.Context, openid string) string {
+	isMember, err := t.client.SIsMember(ctx, whitelistRedisKey, openid).Result()
+	if err != nil {
+		grpclog.Warningf("rate limit whitelist lookup failed openid:%v err:%v", openid, err)
+		return defaultTier
+	}
+	if isMember {
+		return whitelistTier
+	}
+	return defaultTier
+}
@@ -0,0 +1,155 @@
+package rate_limit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/redis/go-redis/v9"
+)
+
+const ttsRoute = "/chat_completion.ChatService/text_to_speech"
+
+func TestBucketStores(t *testing.T) {
+	mr := miniredis.RunT(t)
+	stores := map[string]bucketStore{
+		"redis":  &redisBucketStore{client: redis.NewClient(&redis.Options{Addr: mr.Addr()})},
+		"memory": newMemoryBucketStore(),
+	}
+	// one token a second, two in the bucket
+	limit := Limit{PerMinute: 60, Burst: 2}
+	start := time.UnixMilli(1700000000000)
+	steps := []struct {
+		after   time.Duration
+		allowed bool
+		wait    time.Duration
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, time.Second},
+		{400 * time.Millisecond, false, 600 * time.Millisecond},
+		{time.Second, true, 0},
+		{time.Second, false, 1000 * time.Millisecond},
+		// refilled no further than the burst
+		{time.Minute, true, 0},
+		{time.Minute, true, 0},
+		{time.Minute, false, time.Second},
+	}
+	for name, store := range stores {
+		for i, step := range steps {
+			allowed, wait, err := store.take(context.Background(), "bucket", limit, start.Add(step.after))
+			if err != nil {
+				t.Fatalf("%s step %d: %v", name, i, err)
+			}
+			if allowed != step.allowed || wait != step.wait {
+				t.Fatalf("%s step %d = %v %v, want %v %v", name, i, allowed, wait, step.allowed, step.wait)
+			}
+		}
+	}
+	if ttl := mr.TTL("bucket"); ttl <= 0 || ttl > 3*time.Second {
+		t.Fatalf("bucket ttl %v", ttl)
+	}
+}
+
+func newTestLimiter(t *testing.T, route RouteLimit) (*RateLimiter, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	l := &RateLimiter{
+		Routes: map[string]RouteLimit{ttsRoute: route},
+		redis:  &redisBucketStore{client: client},
+		local:  newMemoryBucketStore(),
+		tiers:  &whitelistTierResolver{client: client},
+	}
+	return l, mr
+}
+
+// serve sends one request to the tts route as openid from ip.
+func serve(l *RateLimiter, openid, ip string) *httptest.ResponseRecorder {
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodPost, ttsRoute, nil)
+	r = r.WithContext(common.ContextWithCaller(r.Context(), common.Caller{OpenID: openid, IP: ip}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestMiddlewareRetryAfter(t *testing.T) {
+	l, _ := newTestLimiter(t, RouteLimit{IP: Limit{PerMinute: 6, Burst: 1}})
+	if w := serve(l, "", "1.2.3.4"); w.Code != http.StatusOK {
+		t.Fatalf("first request got %d", w.Code)
+	}
+	w := serve(l, "", "1.2.3.4")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+		t.Fatalf("second request got %d retry after %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// other addresses have buckets of their own
+	if w := serve(l, "", "5.6.7.8"); w.Code != http.StatusOK {
+		t.Fatalf("other ip got %d", w.Code)
+	}
+	// routes without limits pass
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/other", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unlimited route got %d", w.Code)
+	}
+}
+
+func TestMiddlewareTiers(t *testing.T) {
+	l, mr := newTestLimiter(t, RouteLimit{User: map[string]Limit{
+		defaultTier:   {PerMinute: 1, Burst: 1},
+		whitelistTier: {PerMinute: 1, Burst: 3},
+	}})
+	mr.SAdd(whitelistRedisKey, "oWhite")
+
+	if tier := l.tier(context.Background(), "oWhite"); tier != whitelistTier {
+		t.Fatalf("tier of whitelisted = %q", tier)
+	}
+	if tier := l.tier(context.Background(), "oPlain"); tier != defaultTier {
+		t.Fatalf("tier of plain = %q", tier)
+	}
+	for openid, allowed := range map[string]int{"oWhite": 3, "oPlain": 1} {
+		for i := range allowed {
+			if w := serve(l, openid, "1.2.3.4"); w.Code != http.StatusOK {
+				t.Fatalf("%s request %d got %d", openid, i, w.Code)
+			}
+		}
+		if w := serve(l, openid, "1.2.3.4"); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s over the limit got %d", openid, w.Code)
+		}
+	}
+	// callers without an openid only meet the ip limit
+	if w := serve(l, "", "1.2.3.4"); w.Code != http.StatusOK {
+		t.Fatalf("anonymous got %d", w.Code)
+	}
+
+	// everyone is in the default tier when the whitelist cannot be read
+	mr.SetError("whitelist down")
+	if tier := l.tier(context.Background(), "oWhite"); tier != defaultTier {
+		t.Fatalf("tier with redis down = %q", tier)
+	}
+}
+
+func TestMiddlewareLocalFallback(t *testing.T) {
+	l, mr := newTestLimiter(t, RouteLimit{IP: Limit{PerMinute: 1, Burst: 2}})
+	mr.Close()
+	for i := range 2 {
+		if w := serve(l, "", "1.2.3.4"); w.Code != http.StatusOK {
+			t.Fatalf("request %d with redis down got %d", i, w.Code)
+		}
+	}
+	if w := serve(l, "", "1.2.3.4"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over the limit with redis down got %d", w.Code)
+	}
+
+	// local mode never had redis
+	local := &RateLimiter{Routes: l.Routes, local: newMemoryBucketStore()}
+	if w := serve(local, "oUser", "1.2.3.4"); w.Code != http.StatusOK {
+		t.Fatalf("local mode got %d", w.Code)
+	}
+}
@@ -0,0 +1,83 @@
+package router
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+)
+
+// decodeQuery fills the fields of dst from query parameters named after
+// their json tags. Scalars, pointers to scalars and string slices are supported.
+func decodeQuery(values url.Values, dst any) error {
+	val := reflect.ValueOf(dst).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name := sf.Name
+		if tag, ok := sf.Tag.Lookup("json"); ok {
+			if tagName := strings.Split(tag, ",")[0]; len(tagName) != 0 {
+				name = tagName
+			}
+		}
+		raw, ok := values[name]
+		if !ok || len(raw) == 0 {
+			continue
+		}
+		field := val.Field(i)
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String {
+			field.Set(reflect.ValueOf(raw))
+			continue
+		}
+		if field.Kind() == reflect.Pointer {
+			field.Set(reflect.New(field.Type().Elem()))
+			field = field.Elem()
+		}
+		if err := setScalar(field, raw[0]); err != nil {
+			return &common.HTTPError{
+				Status: http.StatusBadRequest,
+				Msg:    "invalid query",
+				Fields: []common.FieldError{{Field: name, Msg: err.Error()}},
+			}
+		}
+	}
+	return nil
+}
+
+func setScalar(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	}
+	return nil
+}
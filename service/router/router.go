@@ -0,0 +1,234 @@
+package router
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/pkusunjy/grpc-gateway/service/validation"
+	"google.golang.org/grpc/grpclog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	routerFile       = "./conf/router.yaml"
+	adminTokenHeader = "X-Admin-Token"
+	// left in router.yaml when the deploy did not replace it
+	adminTokenPlaceholder = "GATEWAY_ADMIN_TOKEN"
+)
+
+// AuthPolicy decides who may call a route.
+type AuthPolicy int
+
+const (
+	// AuthNone lets anyone call the route
+	AuthNone AuthPolicy = iota
+	// AuthUser requires a caller whose openid the gateway verified
+	AuthUser
+	// AuthAdmin requires the admin token in the X-Admin-Token header
+	AuthAdmin
+)
+
+func (p AuthPolicy) String() string {
+	switch p {
+	case AuthNone:
+		return "none"
+	case AuthUser:
+		return "user"
+	case AuthAdmin:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+// Route describes a custom HTTP route, build one with JSON or Raw.
+type Route struct {
+	Method  string
+	Path    string
+	Auth    AuthPolicy
+	handler http.HandlerFunc
+}
+
+type Router struct {
+	AdminToken string `yaml:"admin_token"`
+	// signs the session tokens proving the openid of users
+	SessionSecret   string `yaml:"session_secret"`
+	SessionTTLHours int    `yaml:"session_ttl_hours"`
+	// proxies whose X-WX-OPENID and forwarding headers are believed, they must
+	// strip X-WX-OPENID from clients
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// believe X-WX-OPENID from any peer for clients without a session token
+	LegacyOpenIDHeader bool `yaml:"legacy_openid_header"`
+	identity           *common.Identity
+	mux                *runtime.ServeMux
+	// auth policies of the routes served by generated grpc-gateway handlers,
+	// keyed by method and path
+	guards map[string]AuthPolicy
+}
+
+func RouterInitialize(ctx *context.Context, mux *runtime.ServeMux) (*Router, error) {
+	content, err := os.ReadFile(routerFile)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	server := Router{mux: mux}
+	err = yaml.Unmarshal(content, &server)
+	if err != nil {
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	if server.SessionTTLHours <= 0 {
+		server.SessionTTLHours = 7 * 24
+	}
+	server.identity, err = common.NewIdentity(server.SessionSecret, time.Duration(server.SessionTTLHours)*time.Hour, server.TrustedProxies)
+	if err != nil {
+		grpclog.Fatal("router identity error: ", err)
+		return nil, err
+	}
+	if server.LegacyOpenIDHeader {
+		grpclog.Warning("router legacy_openid_header is on, X-WX-OPENID is believed from any peer without a session token")
+		server.identity.LegacyOpenIDHeader = true
+	}
+	// a missing secret leaves the token empty, which must not open the admin routes
+	if len(server.AdminToken) == 0 || server.AdminToken == adminTokenPlaceholder {
+		err = errors.New("router admin_token not configured")
+		grpclog.Fatal(err)
+		return nil, err
+	}
+	return &server, nil
+}
+
+// Middleware puts the verified caller in the request context, it must wrap
+// every middleware that looks at the caller. It also enforces the auth policy
+// of the routes registered with Guard.
+func (rt *Router) Middleware(next http.Handler) http.Handler {
+	return rt.identity.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth, ok := rt.guards[r.Method+" "+r.URL.Path]; ok {
+			if err := rt.authorize(auth, r, common.CallerFromContext(r.Context())); err != nil {
+				grpclog.Warningf("router reject %v %v auth:%v err:%v", r.Method, r.URL.Path, auth, err)
+				common.WriteErr(w, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// IssueSession signs a session token for openid, see common.Identity.
+func (rt *Router) IssueSession(openid string, now time.Time) (string, time.Time) {
+	return rt.identity.IssueSession(openid, now)
+}
+
+// Register adds routes to the mux, enforcing their auth policy. Handlers find
+// the caller in the request context.
+func (rt *Router) Register(routes ...Route) error {
+	for _, route := range routes {
+		route := route
+		if route.handler == nil {
+			if rt.guards == nil {
+				rt.guards = make(map[string]AuthPolicy)
+			}
+			rt.guards[route.Method+" "+route.Path] = route.Auth
+			grpclog.Infof("router guarded %v %v auth:%v", route.Method, route.Path, route.Auth)
+			continue
+		}
+		err := rt.mux.HandlePath(route.Method, route.Path, func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+			caller, ok := common.LookupCaller(r.Context())
+			if !ok {
+				caller = rt.identity.Caller(r)
+			}
+			if err := rt.authorize(route.Auth, r, caller); err != nil {
+				grpclog.Warningf("router reject %v %v auth:%v err:%v", route.Method, route.Path, route.Auth, err)
+				common.WriteErr(w, err)
+				return
+			}
+			route.handler(w, r.WithContext(common.ContextWithCaller(r.Context(), caller)))
+		})
+		if err != nil {
+			grpclog.Errorf("router HandlePath %v %v failed err:%v", route.Method, route.Path, err)
+			return err
+		}
+		grpclog.Infof("router registered %v %v auth:%v", route.Method, route.Path, route.Auth)
+	}
+	return nil
+}
+
+func (rt *Router) authorize(policy AuthPolicy, r *http.Request, caller common.Caller) error {
+	switch policy {
+	case AuthUser:
+		if len(caller.OpenID) == 0 {
+			return common.NewHTTPError(http.StatusUnauthorized, "session token required")
+		}
+	case AuthAdmin:
+		if len(rt.AdminToken) == 0 {
+			return common.NewHTTPError(http.StatusForbidden, "admin routes disabled")
+		}
+		token := r.Header.Get(adminTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(rt.AdminToken)) != 1 {
+			return common.NewHTTPError(http.StatusForbidden, "admin token invalid")
+		}
+	}
+	return nil
+}
+
+// JSON builds a route that decodes the request into Req (from the query
+// string for GET, from the json body otherwise), validates it against rules,
+// calls fn and encodes its result as json.
+func JSON[Req any, Resp any](method, path string, auth AuthPolicy, rules validation.Rules,
+	fn func(ctx context.Context, req *Req) (*Resp, error)) Route {
+	return Route{
+		Method: method,
+		Path:   path,
+		Auth:   auth,
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			var req Req
+			if method == http.MethodGet {
+				if err := decodeQuery(r.URL.Query(), &req); err != nil {
+					common.WriteErr(w, err)
+					return
+				}
+			} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				common.WriteError(w, http.StatusBadRequest, "invalid json")
+				return
+			}
+			grpclog.Infof("%v received request:%+v", path, &req)
+			if errs := validation.Check(&req, rules); len(errs) != 0 {
+				common.WriteFieldErrors(w, errs)
+				return
+			}
+			resp, err := fn(r.Context(), &req)
+			if err != nil {
+				grpclog.Warningf("%v failed err:%+v", path, err)
+				common.WriteErr(w, err)
+				return
+			}
+			common.WriteJSON(w, http.StatusOK, resp)
+		},
+	}
+}
+
+// Guard builds a route that keeps being served by the handler grpc-gateway
+// generated for it, only its auth policy is enforced. Such routes must be
+// served behind Middleware, handlers find the caller in the request context.
+func Guard(method, path string, auth AuthPolicy) Route {
+	return Route{Method: method, Path: path, Auth: auth}
+}
+
+// Raw builds a route around a handler that writes its own response, for
+// protocols that dictate the response format.
+func Raw(method, path string, auth AuthPolicy, fn http.HandlerFunc) Route {
+	return Route{
+		Method:  method,
+		Path:    path,
+		Auth:    auth,
+		handler: fn,
+	}
+}
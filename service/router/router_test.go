@@ -0,0 +1,111 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/pkusunjy/grpc-gateway/service/validation"
+)
+
+type echoRequest struct {
+	Text string `json:"text"`
+}
+
+type echoResponse struct {
+	OpenID string `json:"openid"`
+	Text   string `json:"text"`
+}
+
+func echo(ctx context.Context, req *echoRequest) (*echoResponse, error) {
+	return &echoResponse{OpenID: common.CallerFromContext(ctx).OpenID, Text: req.Text}, nil
+}
+
+func newTestRouter(t *testing.T, adminToken string) (*Router, http.Handler) {
+	t.Helper()
+	identity, err := common.NewIdentity(strings.Repeat("s", 32), time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := runtime.NewServeMux()
+	rt := &Router{AdminToken: adminToken, identity: identity, mux: mux}
+	rules := validation.Rules{"text": "required,max=5"}
+	err = rt.Register(
+		JSON(http.MethodPost, "/user", AuthUser, rules, echo),
+		JSON(http.MethodPost, "/admin", AuthAdmin, rules, echo),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt, rt.Middleware(mux)
+}
+
+func call(handler http.Handler, path string, body string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	_, handler := newTestRouter(t, "admin-secret")
+	if w := call(handler, "/admin", `{"text":"hi"}`, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("no token got %d", w.Code)
+	}
+	if w := call(handler, "/admin", `{"text":"hi"}`, map[string]string{adminTokenHeader: "wrong"}); w.Code != http.StatusForbidden {
+		t.Fatalf("wrong token got %d", w.Code)
+	}
+	if w := call(handler, "/admin", `{"text":"hi"}`, map[string]string{adminTokenHeader: "admin-secret"}); w.Code != http.StatusOK {
+		t.Fatalf("admin token got %d %s", w.Code, w.Body)
+	}
+
+	// without a configured token admin routes stay closed
+	_, handler = newTestRouter(t, "")
+	if w := call(handler, "/admin", `{"text":"hi"}`, map[string]string{adminTokenHeader: ""}); w.Code != http.StatusForbidden {
+		t.Fatalf("empty admin token got %d", w.Code)
+	}
+}
+
+func TestUserAuth(t *testing.T) {
+	rt, handler := newTestRouter(t, "admin-secret")
+	if w := call(handler, "/user", `{"text":"hi","openid":"oBody"}`, map[string]string{common.OpenIDHeader: "oHeader"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unverified openid got %d", w.Code)
+	}
+	token, _ := rt.IssueSession("oUser", time.Now())
+	w := call(handler, "/user", `{"text":"hi"}`, map[string]string{common.SessionTokenHeader: token})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"openid":"oUser"`) {
+		t.Fatalf("session token got %d %s", w.Code, w.Body)
+	}
+	w = call(handler, "/user", `{"text":"too long"}`, map[string]string{common.SessionTokenHeader: token})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"field":"text"`) {
+		t.Fatalf("invalid request got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	rt, handler := newTestRouter(t, "admin-secret")
+	err := rt.mux.HandlePath(http.MethodPost, "/generated", func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		w.Write([]byte(common.CallerFromContext(r.Context()).OpenID))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Register(Guard(http.MethodPost, "/generated", AuthUser)); err != nil {
+		t.Fatal(err)
+	}
+	if w := call(handler, "/generated", `{"openid":"oBody"}`, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("guarded route without session got %d", w.Code)
+	}
+	token, _ := rt.IssueSession("oUser", time.Now())
+	if w := call(handler, "/generated", `{}`, map[string]string{common.SessionTokenHeader: token}); w.Code != http.StatusOK || w.Body.String() != "oUser" {
+		t.Fatalf("guarded route with session got %d %s", w.Code, w.Body)
+	}
+}
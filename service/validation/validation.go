@@ -0,0 +1,167 @@
+package validation
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+)
+
+// Rules maps the json name of a request field to its comma separated rules:
+//
+//	required    field must be present and non-zero
+//	openid      string must look like a wechat openid
+//	min=N       minimum string length in runes, slice length or number value
+//	max=N       maximum string length in runes, slice length or number value
+//	oneof=A B   value must be one of the space separated options
+//
+// Rules other than required are skipped for absent fields.
+type Rules map[string]string
+
+var openidPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+// Check validates the struct pointed to by v against rules and returns one
+// FieldError per violated field, in field name order.
+func Check(v any, rules Rules) []common.FieldError {
+	val := reflect.Indirect(reflect.ValueOf(v))
+	if val.Kind() != reflect.Struct {
+		return []common.FieldError{{Field: "", Msg: "request body must be a json object"}}
+	}
+	fields := jsonFields(val)
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []common.FieldError
+	for _, name := range names {
+		field, ok := fields[name]
+		if !ok {
+			errs = append(errs, common.FieldError{Field: name, Msg: "unknown field"})
+			continue
+		}
+		if msg := checkField(field, rules[name]); len(msg) != 0 {
+			errs = append(errs, common.FieldError{Field: name, Msg: msg})
+		}
+	}
+	return errs
+}
+
+// jsonFields indexes the exported fields of a struct by their json name.
+func jsonFields(val reflect.Value) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name := sf.Name
+		if tag, ok := sf.Tag.Lookup("json"); ok {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			}
+			if len(tagName) != 0 {
+				name = tagName
+			}
+		}
+		fields[name] = val.Field(i)
+	}
+	return fields
+}
+
+func checkField(field reflect.Value, rules string) string {
+	for field.Kind() == reflect.Pointer || field.Kind() == reflect.Interface {
+		if field.IsNil() {
+			if hasRule(rules, "required") {
+				return "is required"
+			}
+			return ""
+		}
+		field = field.Elem()
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		var msg string
+		switch name {
+		case "":
+		case "required":
+			if field.IsZero() || (field.Kind() == reflect.Slice && field.Len() == 0) {
+				return "is required"
+			}
+		case "openid":
+			if field.Kind() == reflect.String && field.Len() != 0 && !openidPattern.MatchString(field.String()) {
+				msg = "is not a valid openid"
+			}
+		case "min", "max":
+			msg = checkBound(field, name, arg)
+		case "oneof":
+			if options := strings.Fields(arg); !contains(options, fmt.Sprint(field.Interface())) {
+				msg = fmt.Sprintf("must be one of [%s]", strings.Join(options, " "))
+			}
+		default:
+			msg = fmt.Sprintf("unknown rule %q", name)
+		}
+		if len(msg) != 0 {
+			return msg
+		}
+	}
+	return ""
+}
+
+func checkBound(field reflect.Value, name, arg string) string {
+	bound, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return fmt.Sprintf("bad %s rule %q", name, arg)
+	}
+	var size float64
+	unit := ""
+	switch field.Kind() {
+	case reflect.String:
+		size = float64(utf8.RuneCountInString(field.String()))
+		unit = " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		size = float64(field.Len())
+		unit = " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = float64(field.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size = float64(field.Uint())
+	case reflect.Float32, reflect.Float64:
+		size = field.Float()
+	default:
+		return ""
+	}
+	if name == "min" && size < bound {
+		return fmt.Sprintf("must be at least %s%s", arg, unit)
+	}
+	if name == "max" && size > bound {
+		return fmt.Sprintf("must be at most %s%s", arg, unit)
+	}
+	return ""
+}
+
+func hasRule(rules, name string) bool {
+	for _, rule := range strings.Split(rules, ",") {
+		if strings.TrimSpace(rule) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(options []string, value string) bool {
+	for _, option := range options {
+		if option == value {
+			return true
+		}
+	}
+	return false
+}
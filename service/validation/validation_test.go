@@ -0,0 +1,80 @@
+package validation
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+)
+
+type testRequest struct {
+	OpenID  string   `json:"openid"`
+	Content string   `json:"content"`
+	Limit   int32    `json:"limit"`
+	Scene   *string  `json:"scene"`
+	Tags    []string `json:"tags"`
+	Skipped string   `json:"-"`
+}
+
+var testRules = Rules{
+	"openid":  "required,openid",
+	"content": "max=3",
+	"limit":   "min=1,max=100",
+	"scene":   "oneof=Wap iOS",
+	"tags":    "max=2",
+}
+
+func TestCheck(t *testing.T) {
+	scene := "Wap"
+	valid := testRequest{OpenID: "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", Content: "你好吗", Limit: 1, Scene: &scene}
+	if errs := Check(&valid, testRules); len(errs) != 0 {
+		t.Fatalf("valid request %v", errs)
+	}
+
+	other := "Android"
+	cases := []struct {
+		req  testRequest
+		want []common.FieldError
+	}{
+		{
+			testRequest{Limit: 1},
+			[]common.FieldError{{Field: "openid", Msg: "is required"}},
+		},
+		{
+			testRequest{OpenID: "../../etc", Content: "四个字符", Limit: 101, Scene: &other, Tags: []string{"a", "b", "c"}},
+			[]common.FieldError{
+				{Field: "content", Msg: "must be at most 3 characters"},
+				{Field: "limit", Msg: "must be at most 100"},
+				{Field: "openid", Msg: "is not a valid openid"},
+				{Field: "scene", Msg: "must be one of [Wap iOS]"},
+				{Field: "tags", Msg: "must be at most 2 items"},
+			},
+		},
+		// a nil pointer is absent, a zero value is checked
+		{
+			testRequest{OpenID: valid.OpenID},
+			[]common.FieldError{{Field: "limit", Msg: "must be at least 1"}},
+		},
+	}
+	for _, c := range cases {
+		if errs := Check(&c.req, testRules); !slices.Equal(errs, c.want) {
+			t.Errorf("Check(%+v) = %v, want %v", c.req, errs, c.want)
+		}
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	req := testRequest{Limit: 5}
+	errs := Check(&req, Rules{"missing": "required", "-": "required", "limit": "max=x,between=1"})
+	want := []common.FieldError{
+		{Field: "-", Msg: "unknown field"},
+		{Field: "limit", Msg: `bad max rule "x"`},
+		{Field: "missing", Msg: "unknown field"},
+	}
+	if !slices.Equal(errs, want) {
+		t.Fatalf("Check with bad rules = %v, want %v", errs, want)
+	}
+	if errs := Check([]string{}, nil); len(errs) != 1 {
+		t.Fatalf("Check of a non object = %v", errs)
+	}
+}
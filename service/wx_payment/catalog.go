@@ -0,0 +1,194 @@
+package wx_payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/platform"
+	"google.golang.org/grpc/grpclog"
+	"gopkg.in/yaml.v3"
+)
+
+// Product is something a user can buy, the price is what the server charges
+// regardless of the amount the client sends.
+type Product struct {
+	OrderType      int32       `yaml:"order_type" json:"order_type"`
+	Name           string      `yaml:"name" json:"name"`
+	Description    string      `yaml:"description" json:"description"`
+	Price          int64       `yaml:"price" json:"price"`
+	DurationDays   int32       `yaml:"duration_days" json:"duration_days"`
+	MemberConfigID int64       `yaml:"member_config_id" json:"-"`
+	Promotions     []Promotion `yaml:"promotions" json:"-"`
+}
+
+// Promotion is a limited-time price within [Start, End), given as
+// "2006-01-02 15:04:05" in China standard time.
+type Promotion struct {
+	Price int64  `yaml:"price"`
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	start time.Time
+	end   time.Time
+}
+
+// PriceAt is the price charged at t, the lowest running promotion wins.
+func (p Product) PriceAt(t time.Time) int64 {
+	price := p.Price
+	for _, promotion := range p.Promotions {
+		if !t.Before(promotion.start) && t.Before(promotion.end) && promotion.Price < price {
+			price = promotion.Price
+		}
+	}
+	return price
+}
+
+type Catalog struct {
+	RefreshSec int64     `yaml:"refresh_sec"`
+	Products   []Product `yaml:"products"`
+	endpoint   string
+	mu         sync.RWMutex
+	byType     map[int32]Product
+}
+
+// memberConfigResp is the subset of ysMemberConfig/queryById that prices a
+// product, price is in yuan.
+type memberConfigResp struct {
+	Code int `json:"code"`
+	Data *struct {
+		Price      any    `json:"price"`
+		MemberName string `json:"memberName"`
+	} `json:"data"`
+}
+
+func NewCatalog(ctx context.Context, path string, dataPlatformEndpoint string) (*Catalog, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	catalog := Catalog{endpoint: dataPlatformEndpoint}
+	if err := yaml.Unmarshal(content, &catalog); err != nil {
+		return nil, err
+	}
+	byType := make(map[int32]Product, len(catalog.Products))
+	for _, product := range catalog.Products {
+		if product.Price <= 0 {
+			return nil, fmt.Errorf("product %d has no price", product.OrderType)
+		}
+		if _, ok := byType[product.OrderType]; ok {
+			return nil, fmt.Errorf("product %d listed twice", product.OrderType)
+		}
+		for i := range product.Promotions {
+			promotion := &product.Promotions[i]
+			promotion.start, err = time.ParseInLocation(datetimeLayout, promotion.Start, billLocation)
+			if err != nil {
+				return nil, fmt.Errorf("product %d promotion start: %w", product.OrderType, err)
+			}
+			promotion.end, err = time.ParseInLocation(datetimeLayout, promotion.End, billLocation)
+			if err != nil {
+				return nil, fmt.Errorf("product %d promotion end: %w", product.OrderType, err)
+			}
+			if promotion.Price <= 0 || !promotion.start.Before(promotion.end) {
+				return nil, fmt.Errorf("product %d has an invalid promotion %+v", product.OrderType, *promotion)
+			}
+		}
+		byType[product.OrderType] = product
+	}
+	catalog.byType = byType
+	if catalog.RefreshSec > 0 {
+		go catalog.refreshLoop(ctx)
+	}
+	grpclog.Infof("initialized product catalog:%+v", catalog.List())
+	return &catalog, nil
+}
+
+func (c *Catalog) Lookup(orderType int32) (Product, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	product, ok := c.byType[orderType]
+	return product, ok
+}
+
+// List returns the products ordered by order type.
+func (c *Catalog) List() []Product {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	products := make([]Product, 0, len(c.byType))
+	for _, product := range c.byType {
+		products = append(products, product)
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].OrderType < products[j].OrderType })
+	return products
+}
+
+func (c *Catalog) refreshLoop(ctx context.Context) {
+	t := time.NewTicker(time.Duration(c.RefreshSec) * time.Second)
+	defer t.Stop()
+	for {
+		c.refresh()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// refresh takes price and description from ysMemberConfig for products
+// that have a member_config_id. A product keeps its last known price when
+// the data platform cannot be reached.
+func (c *Catalog) refresh() {
+	c.mu.RLock()
+	products := make([]Product, 0, len(c.byType))
+	for _, product := range c.byType {
+		products = append(products, product)
+	}
+	c.mu.RUnlock()
+	for _, product := range products {
+		if product.MemberConfigID == 0 {
+			continue
+		}
+		queryUrl := fmt.Sprintf("http://%s/utility-project/ysMemberConfig/queryById?id=%d", c.endpoint, product.MemberConfigID)
+		respBody, err := platform.DoHttpGet(queryUrl)
+		if err != nil {
+			grpclog.Errorf("catalog query member config failed url:%v err:%v", queryUrl, err)
+			continue
+		}
+		var resp memberConfigResp
+		if err := json.Unmarshal(respBody, &resp); err != nil || resp.Code != platform.CodeOK || resp.Data == nil {
+			grpclog.Errorf("catalog unmarshal member config failed body:%v err:%v", string(respBody), err)
+			continue
+		}
+		price, err := parseYuan(resp.Data.Price)
+		if err != nil || price <= 0 {
+			grpclog.Errorf("catalog member config %v has invalid price %v err:%v", product.MemberConfigID, resp.Data.Price, err)
+			continue
+		}
+		if price != product.Price {
+			grpclog.Infof("catalog product %v price %v -> %v", product.OrderType, product.Price, price)
+		}
+		product.Price = price
+		if len(resp.Data.MemberName) != 0 {
+			product.Description = resp.Data.MemberName
+		}
+		c.mu.Lock()
+		c.byType[product.OrderType] = product
+		c.mu.Unlock()
+	}
+}
+
+func parseYuan(v any) (int64, error) {
+	switch price := v.(type) {
+	case string:
+		return yuanToFen(price)
+	case float64:
+		return yuanToFen(strconv.FormatFloat(price, 'f', -1, 64))
+	default:
+		return 0, fmt.Errorf("unexpected price %v", v)
+	}
+}
@@ -0,0 +1,414 @@
+package wx_payment
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/auth"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/auth/signers"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/auth/verifiers"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/consts"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/option"
+	"github.com/wechatpay-apiv3/wechatpay-go/utils"
+	"google.golang.org/grpc/grpclog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	certModeCertificate = "certificate"
+	certModePublicKey   = "public_key"
+
+	certificatesUrl = consts.WechatPayAPIServer + "/v3/certificates"
+)
+
+// merchantConfig is the part of the payment config CertManager reloads.
+// Merchants that switched to the wechat pay public key set the public key
+// fields, the others verify with the downloaded platform certificates.
+type merchantConfig struct {
+	WxSerialNo       string `yaml:"wx_serial_no"`
+	WxPrivateKeyPath string `yaml:"wx_private_key_path"`
+	WxPublicKeyID    string `yaml:"wx_public_key_id"`
+	WxPublicKeyPath  string `yaml:"wx_public_key_path"`
+}
+
+// CertManager holds the merchant key requests are signed with and what
+// responses and notifies are verified with. It is the auth.Signer and
+// auth.Verifier of the payment clients and the notify handler, so that Run
+// can rotate keys and certificates without rebuilding them.
+type CertManager struct {
+	mchID    string
+	apiV3Key string
+	opts     *options
+	// downloads certificates, their content is authenticated by the apiv3
+	// key so the response signature is not checked
+	downloadClient *core.Client
+
+	mu           sync.RWMutex
+	serialNo     string
+	key          *rsa.PrivateKey
+	publicKeyID  string
+	publicKey    *rsa.PublicKey
+	certificates map[string]*x509.Certificate
+	refreshedAt  time.Time
+	refreshErr   error
+}
+
+// NewCertManager loads the merchant key and the platform certificates or
+// public key, it fails if any of them cannot be loaded.
+func NewCertManager(ctx context.Context, mchID string, apiV3Key string, o *options) (*CertManager, error) {
+	m := &CertManager{
+		mchID:        mchID,
+		apiV3Key:     apiV3Key,
+		opts:         o,
+		certificates: make(map[string]*x509.Certificate),
+	}
+	for _, certificate := range o.certificates {
+		m.certificates[utils.GetCertificateSerialNumber(*certificate)] = certificate
+	}
+	downloadOpts := []core.ClientOption{option.WithSigner(m), option.WithoutValidator()}
+	if o.httpClient != nil {
+		downloadOpts = append(downloadOpts, option.WithHTTPClient(o.httpClient))
+	}
+	var err error
+	m.downloadClient, err = core.NewClient(ctx, downloadOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Run refreshes every -cert_refresh_interval until ctx is done. Failures
+// keep the current keys and certificates.
+func (m *CertManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(*certRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Refresh(ctx); err != nil {
+				grpclog.Errorf("refresh wechat pay certificates failed error: %v", err)
+			}
+		}
+	}
+}
+
+// Refresh reloads the merchant key and serial from the payment config and
+// downloads the platform certificates. Rotating the merchant key only needs
+// the new key file and wx_serial_no in place before the next refresh.
+// Merchants switching to the public key still get notifies signed with the
+// platform certificate for a while, so the certificates keep being
+// downloaded, failures only matter while they are all there is to verify.
+func (m *CertManager) Refresh(ctx context.Context) error {
+	err := m.reloadMerchant()
+	if err == nil && len(m.opts.certificates) == 0 {
+		if downloadErr := m.downloadCertificates(ctx); downloadErr != nil {
+			if m.mode() == certModeCertificate {
+				err = downloadErr
+			} else {
+				grpclog.Infof("platform certificates not refreshed in public key mode error: %v", downloadErr)
+			}
+		}
+	}
+	m.mu.Lock()
+	m.refreshedAt = time.Now()
+	m.refreshErr = err
+	m.mu.Unlock()
+	return err
+}
+
+func (m *CertManager) reloadMerchant() error {
+	content, err := os.ReadFile(m.opts.files.Payment)
+	if err != nil {
+		return err
+	}
+	var config merchantConfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return err
+	}
+	key := m.opts.merchantKey
+	if key == nil {
+		keyPath := config.WxPrivateKeyPath
+		if len(keyPath) == 0 {
+			keyPath = *apiClientKeyPath
+		}
+		key, err = utils.LoadPrivateKeyWithPath(keyPath)
+		if err != nil {
+			return fmt.Errorf("load merchant private key error: %w", err)
+		}
+	}
+	var publicKey *rsa.PublicKey
+	if len(config.WxPublicKeyID) != 0 {
+		publicKey, err = utils.LoadPublicKeyWithPath(config.WxPublicKeyPath)
+		if err != nil {
+			return fmt.Errorf("load wechat pay public key error: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.serialNo) != 0 && m.serialNo != config.WxSerialNo {
+		grpclog.Infof("merchant certificate serial rotated from %s to %s", m.serialNo, config.WxSerialNo)
+	}
+	if len(m.publicKeyID) != 0 && m.publicKeyID != config.WxPublicKeyID {
+		grpclog.Infof("wechat pay public key rotated from %s to %s", m.publicKeyID, config.WxPublicKeyID)
+	}
+	m.serialNo = config.WxSerialNo
+	m.key = key
+	m.publicKeyID = config.WxPublicKeyID
+	m.publicKey = publicKey
+	return nil
+}
+
+type encryptedCertificate struct {
+	Algorithm      string `json:"algorithm"`
+	Nonce          string `json:"nonce"`
+	AssociatedData string `json:"associated_data"`
+	Ciphertext     string `json:"ciphertext"`
+}
+
+type certificatesResponse struct {
+	Data []struct {
+		SerialNo           string               `json:"serial_no"`
+		EncryptCertificate encryptedCertificate `json:"encrypt_certificate"`
+	} `json:"data"`
+}
+
+// downloadCertificates replaces the platform certificates with the ones
+// wechat currently lists, which include the old certificate while wechat
+// rotates to a new one.
+func (m *CertManager) downloadCertificates(ctx context.Context) error {
+	result, err := m.downloadClient.Get(ctx, certificatesUrl)
+	if err != nil {
+		return fmt.Errorf("download platform certificates error: %w", err)
+	}
+	defer result.Response.Body.Close()
+	body, err := io.ReadAll(result.Response.Body)
+	if err != nil {
+		return err
+	}
+	var resp certificatesResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("unexpected platform certificates response %s", string(body))
+	}
+	certificates := make(map[string]*x509.Certificate, len(resp.Data))
+	for _, data := range resp.Data {
+		encrypted := data.EncryptCertificate
+		plaintext, err := utils.DecryptAES256GCM(m.apiV3Key, encrypted.AssociatedData, encrypted.Nonce, encrypted.Ciphertext)
+		if err != nil {
+			return fmt.Errorf("decrypt platform certificate %s error: %w", data.SerialNo, err)
+		}
+		certificate, err := utils.LoadCertificate(plaintext)
+		if err != nil {
+			return fmt.Errorf("load platform certificate %s error: %w", data.SerialNo, err)
+		}
+		certificates[data.SerialNo] = certificate
+	}
+	if len(certificates) == 0 {
+		return errors.New("wechat listed no platform certificates")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for serialNo := range certificates {
+		if _, ok := m.certificates[serialNo]; !ok {
+			grpclog.Infof("platform certificate %s loaded", serialNo)
+		}
+	}
+	m.certificates = certificates
+	return nil
+}
+
+func (m *CertManager) mode() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.publicKey != nil {
+		return certModePublicKey
+	}
+	return certModeCertificate
+}
+
+// Sign implements auth.Signer with the current merchant key.
+func (m *CertManager) Sign(ctx context.Context, message string) (*auth.SignatureResult, error) {
+	m.mu.RLock()
+	signer := signers.SHA256WithRSASigner{MchID: m.mchID, PrivateKey: m.key, CertificateSerialNo: m.serialNo}
+	m.mu.RUnlock()
+	return signer.Sign(ctx, message)
+}
+
+func (m *CertManager) Algorithm() string {
+	return (&signers.SHA256WithRSASigner{}).Algorithm()
+}
+
+// Verify implements auth.Verifier. Wechat signs with the public key once a
+// merchant switched to it, and with either during the switch.
+func (m *CertManager) Verify(ctx context.Context, serialNo string, message string, signature string) error {
+	m.mu.RLock()
+	var verifier auth.Verifier
+	if m.publicKey != nil && serialNo == m.publicKeyID {
+		verifier = verifiers.NewSHA256WithRSAPubkeyVerifier(m.publicKeyID, *m.publicKey)
+	} else {
+		certificates := make([]*x509.Certificate, 0, len(m.certificates))
+		for _, certificate := range m.certificates {
+			certificates = append(certificates, certificate)
+		}
+		verifier = verifiers.NewSHA256WithRSAVerifier(core.NewCertificateMapWithList(certificates))
+	}
+	m.mu.RUnlock()
+	return verifier.Verify(ctx, serialNo, message, signature)
+}
+
+// GetSerial returns the public key id or the serial of the newest platform
+// certificate.
+func (m *CertManager) GetSerial(ctx context.Context) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.publicKey != nil {
+		return m.publicKeyID, nil
+	}
+	var newest *x509.Certificate
+	var serialNo string
+	for s, certificate := range m.certificates {
+		if newest == nil || certificate.NotAfter.After(newest.NotAfter) {
+			newest, serialNo = certificate, s
+		}
+	}
+	if newest == nil {
+		return "", errors.New("no platform certificate loaded")
+	}
+	return serialNo, nil
+}
+
+// clientOptions are the options of the client calling the signed apis.
+func (m *CertManager) clientOptions() []core.ClientOption {
+	opts := []core.ClientOption{option.WithSigner(m), option.WithVerifier(m)}
+	if m.opts.httpClient != nil {
+		opts = append(opts, option.WithHTTPClient(m.opts.httpClient))
+	}
+	return opts
+}
+
+// billClientOptions are the options of the client downloading bills, which
+// wechat does not sign.
+func (m *CertManager) billClientOptions() []core.ClientOption {
+	opts := []core.ClientOption{option.WithSigner(m), option.WithoutValidator()}
+	if m.opts.httpClient != nil {
+		opts = append(opts, option.WithHTTPClient(m.opts.httpClient))
+	}
+	return opts
+}
+
+type CertificateHealth struct {
+	SerialNo  string `json:"serial_no"`
+	NotBefore int64  `json:"not_before"`
+	NotAfter  int64  `json:"not_after"`
+	DaysLeft  int64  `json:"days_left"`
+}
+
+type CertHealthResponse struct {
+	Healthy          bool                `json:"healthy"`
+	Mode             string              `json:"mode"`
+	MerchantSerialNo string              `json:"merchant_serial_no"`
+	PublicKeyID      string              `json:"public_key_id,omitempty"`
+	Certificates     []CertificateHealth `json:"certificates"`
+	RefreshedAt      int64               `json:"refreshed_at"`
+	RefreshError     string              `json:"refresh_error,omitempty"`
+	Warnings         []string            `json:"warnings,omitempty"`
+}
+
+// Health is unhealthy when nothing is left to verify wechat with, or when
+// the newest platform certificate expires within -cert_expiry_warning,
+// which means wechat has not rotated it or downloads keep failing. A failed
+// refresh alone is only a warning while the current certificates are valid.
+func (m *CertManager) Health() *CertHealthResponse {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	resp := CertHealthResponse{
+		Mode:             certModeCertificate,
+		MerchantSerialNo: m.serialNo,
+		PublicKeyID:      m.publicKeyID,
+		Certificates:     []CertificateHealth{},
+		RefreshedAt:      m.refreshedAt.Unix(),
+	}
+	if m.publicKey != nil {
+		resp.Mode = certModePublicKey
+	}
+	var newest time.Time
+	for serialNo, certificate := range m.certificates {
+		resp.Certificates = append(resp.Certificates, CertificateHealth{
+			SerialNo:  serialNo,
+			NotBefore: certificate.NotBefore.Unix(),
+			NotAfter:  certificate.NotAfter.Unix(),
+			DaysLeft:  int64(certificate.NotAfter.Sub(now).Hours() / 24),
+		})
+		if certificate.NotAfter.After(newest) {
+			newest = certificate.NotAfter
+		}
+	}
+	sort.Slice(resp.Certificates, func(i, j int) bool { return resp.Certificates[i].NotAfter > resp.Certificates[j].NotAfter })
+	if m.refreshErr != nil {
+		resp.RefreshError = m.refreshErr.Error()
+		resp.Warnings = append(resp.Warnings, "last refresh failed")
+	}
+
+	resp.Healthy = m.key != nil
+	if m.key == nil {
+		resp.Warnings = append(resp.Warnings, "merchant key not loaded")
+	}
+	switch {
+	case m.publicKey != nil:
+	case newest.Before(now):
+		resp.Healthy = false
+		resp.Warnings = append(resp.Warnings, "no valid platform certificate")
+	case newest.Before(now.Add(*certExpiryWarning)):
+		resp.Healthy = false
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("newest platform certificate expires at %s", newest.In(billLocation).Format(datetimeLayout)))
+	}
+	return &resp
+}
+
+// CertHealth answers 503 when unhealthy so that monitors need not parse the
+// body. It is public, the serials and warnings are left to CertStatus.
+func (server WxPaymentServiceImpl) CertHealth(w http.ResponseWriter, r *http.Request) {
+	healthy := server.Certs.Health().Healthy
+	code := http.StatusOK
+	if !healthy {
+		code = http.StatusServiceUnavailable
+	}
+	common.WriteJSON(w, code, map[string]bool{"healthy": healthy})
+}
+
+type CertStatusRequest struct{}
+
+// CertStatus answers the certificates and warnings behind CertHealth.
+func (server WxPaymentServiceImpl) CertStatus(ctx context.Context, req *CertStatusRequest) (*CertHealthResponse, error) {
+	return server.Certs.Health(), nil
+}
+
+type CertRefreshRequest struct{}
+
+// CertRefresh applies a rotated merchant key without waiting for Run.
+func (server WxPaymentServiceImpl) CertRefresh(ctx context.Context, req *CertRefreshRequest) (*CertHealthResponse, error) {
+	if err := server.Certs.Refresh(ctx); err != nil {
+		grpclog.Errorf("refresh wechat pay certificates failed error: %v", err)
+		return nil, err
+	}
+	return server.Certs.Health(), nil
+}
@@ -0,0 +1,128 @@
+package wx_payment
+
+import (
+	"context"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	"github.com/wechatpay-apiv3/wechatpay-go/services/payments/h5"
+	"github.com/wechatpay-apiv3/wechatpay-go/services/payments/native"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	ChannelJsapi  = "jsapi"
+	ChannelNative = "native"
+	ChannelH5     = "h5"
+)
+
+// PrepayRequest places an order from the web, the caller is identified by
+// the router. Web pages log in with a ticket the mini program confirms, see
+// /auth/web_ticket.
+type PrepayRequest struct {
+	OrderType  int32  `json:"order_type"`
+	Amount     int64  `json:"amount,omitempty"`
+	CouponCode string `json:"coupon_code,omitempty"`
+	// H5 only, one of iOS, Android and Wap, Wap when absent
+	SceneType *string `json:"scene_type,omitempty"`
+}
+
+// PrepayResponse carries what the client needs to pay, CodeUrl for Native
+// and H5Url for H5. Granted orders have neither and GrantedBy set.
+type PrepayResponse struct {
+	OutTradeNo string `json:"out_trade_no"`
+	Amount     int64  `json:"amount"`
+	CodeUrl    string `json:"code_url,omitempty"`
+	H5Url      string `json:"h5_url,omitempty"`
+	GrantedBy  string `json:"granted_by,omitempty"`
+}
+
+// NativePrepay returns a code_url to be shown as a QR code.
+func (server WxPaymentServiceImpl) NativePrepay(ctx context.Context, req *PrepayRequest) (*PrepayResponse, error) {
+	caller := common.CallerFromContext(ctx)
+	placed, err := server.placeOrder(ctx, ChannelNative, caller.OpenID, req.OrderType, req.Amount, req.CouponCode)
+	if err != nil {
+		return nil, err
+	}
+	if placed.GrantedBy != nil {
+		return grantedPrepayResponse(placed), nil
+	}
+	order := placed.Order
+	svc := native.NativeApiService{Client: server.WxClient}
+	prepayResp, _, err := svc.Prepay(ctx, native.PrepayRequest{
+		Appid:       core.String(server.WxAppID),
+		Mchid:       core.String(server.WxMchID),
+		Description: core.String(placed.Product.Description),
+		OutTradeNo:  core.String(order.OutTradeNo),
+		Attach:      core.String(jsapiAttach),
+		NotifyUrl:   core.String(*notifyUrl),
+		Amount: &native.Amount{
+			Total: core.Int64(order.Amount),
+		},
+	})
+	if err != nil {
+		grpclog.Errorf("native prepay order %v failed error:%v", order.OutTradeNo, err)
+		server.prepayFailed(ctx, order.OutTradeNo, err)
+		return nil, err
+	}
+	server.prepaidOrder(ctx, order.OutTradeNo, "native code_url")
+	return &PrepayResponse{
+		OutTradeNo: order.OutTradeNo,
+		Amount:     order.Amount,
+		CodeUrl:    stringValue(prepayResp.CodeUrl),
+	}, nil
+}
+
+// H5Prepay returns an h5_url for mobile browsers outside wechat.
+func (server WxPaymentServiceImpl) H5Prepay(ctx context.Context, req *PrepayRequest) (*PrepayResponse, error) {
+	caller := common.CallerFromContext(ctx)
+	placed, err := server.placeOrder(ctx, ChannelH5, caller.OpenID, req.OrderType, req.Amount, req.CouponCode)
+	if err != nil {
+		return nil, err
+	}
+	if placed.GrantedBy != nil {
+		return grantedPrepayResponse(placed), nil
+	}
+	order := placed.Order
+	sceneType := "Wap"
+	if req.SceneType != nil {
+		sceneType = *req.SceneType
+	}
+	svc := h5.H5ApiService{Client: server.WxClient}
+	prepayResp, _, err := svc.Prepay(ctx, h5.PrepayRequest{
+		Appid:       core.String(server.WxAppID),
+		Mchid:       core.String(server.WxMchID),
+		Description: core.String(placed.Product.Description),
+		OutTradeNo:  core.String(order.OutTradeNo),
+		Attach:      core.String(jsapiAttach),
+		NotifyUrl:   core.String(*notifyUrl),
+		Amount: &h5.Amount{
+			Total: core.Int64(order.Amount),
+		},
+		SceneInfo: &h5.SceneInfo{
+			// wechat checks the payer opens h5_url from this address
+			PayerClientIp: core.String(caller.IP),
+			H5Info: &h5.H5Info{
+				Type: core.String(sceneType),
+			},
+		},
+	})
+	if err != nil {
+		grpclog.Errorf("h5 prepay order %v failed error:%v", order.OutTradeNo, err)
+		server.prepayFailed(ctx, order.OutTradeNo, err)
+		return nil, err
+	}
+	server.prepaidOrder(ctx, order.OutTradeNo, "h5 h5_url")
+	return &PrepayResponse{
+		OutTradeNo: order.OutTradeNo,
+		Amount:     order.Amount,
+		H5Url:      stringValue(prepayResp.H5Url),
+	}, nil
+}
+
+func grantedPrepayResponse(placed *placedOrder) *PrepayResponse {
+	return &PrepayResponse{
+		OutTradeNo: placed.Order.OutTradeNo,
+		GrantedBy:  placed.GrantedBy.Name(),
+	}
+}
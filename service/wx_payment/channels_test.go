@@ -0,0 +1,43 @@
+package wx_payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/pkusunjy/grpc-gateway/service/validation"
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+)
+
+func TestPrepayRules(t *testing.T) {
+	wap, bad := "Wap", "Desktop"
+	if errs := validation.Check(&PrepayRequest{OrderType: 1}, prepayRules); len(errs) != 0 {
+		t.Fatalf("native prepay %v", errs)
+	}
+	if errs := validation.Check(&PrepayRequest{OrderType: 1}, h5PrepayRules); len(errs) != 0 {
+		t.Fatalf("h5 prepay without scene_type %v", errs)
+	}
+	if errs := validation.Check(&PrepayRequest{OrderType: 1, SceneType: &wap}, h5PrepayRules); len(errs) != 0 {
+		t.Fatalf("h5 prepay %v", errs)
+	}
+	if errs := validation.Check(&PrepayRequest{OrderType: 1, SceneType: &bad}, h5PrepayRules); len(errs) != 1 || errs[0].Field != "scene_type" {
+		t.Fatalf("h5 prepay with bad scene_type %v", errs)
+	}
+}
+
+func TestPrepayFailedOnlyWhenRefused(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	createTestOrder(t, server, "T1", "oUser", 1)
+	createTestOrder(t, server, "T2", "oUser", 1)
+
+	server.prepayFailed(ctx, "T1", errors.New("context deadline exceeded"))
+	server.prepayFailed(ctx, "T2", &core.APIError{StatusCode: http.StatusBadRequest, Code: "PARAM_ERROR"})
+	if order, _ := server.Orders.Get(ctx, "T1"); order.State != OrderCreated {
+		t.Fatalf("order after timeout %v", order.State)
+	}
+	if order, _ := server.Orders.Get(ctx, "T2"); order.State != OrderFailed {
+		t.Fatalf("order after refused prepay %v", order.State)
+	}
+}
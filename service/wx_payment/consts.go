@@ -1,6 +1,8 @@
 package wx_payment
 
 const (
-	jsapiDescription = "MikiAi会员购买"
-	jsapiAttach      = "MikiAi会员购买"
+	jsapiAttach    = "MikiAi会员购买"
+	datetimeLayout = "2006-01-02 15:04:05"
+	// served by the handler grpc-gateway generated for WxPaymentService
+	jsapiPath = "/wx_payment.WxPaymentService/Jsapi"
 )
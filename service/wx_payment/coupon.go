@@ -0,0 +1,299 @@
+package wx_payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	CouponFixed   = "fixed"
+	CouponPercent = "percent"
+
+	RedemptionHeld     = "held"
+	RedemptionRedeemed = "redeemed"
+	RedemptionReleased = "released"
+
+	// sent by clients as the Grpc-Metadata-Coupon-Code header
+	couponCodeMetadataKey = "coupon-code"
+	// answered as the Grpc-Metadata-Charged-Amount header
+	chargedAmountMetadataKey = "charged-amount"
+)
+
+var ErrCouponNotFound = errors.New("coupon not found")
+
+// Coupon is a discount code. Kind fixed takes Value fen off the price, kind
+// percent takes Value percent off. Zero limits and an empty OrderTypes do
+// not restrict. Times are unix seconds.
+type Coupon struct {
+	Code         string  `json:"code"`
+	Kind         string  `json:"kind"`
+	Value        int64   `json:"value"`
+	OrderTypes   []int32 `json:"order_types,omitempty"`
+	StartsAt     int64   `json:"starts_at"`
+	EndsAt       int64   `json:"ends_at"`
+	MaxUses      int64   `json:"max_uses,omitempty"`
+	PerUserLimit int64   `json:"per_user_limit,omitempty"`
+	Used         int64   `json:"used"`
+	CreatedAt    int64   `json:"created_at"`
+}
+
+var couponTables = []string{
+	`CREATE TABLE IF NOT EXISTS gateway_coupon (
+		code VARCHAR(32) NOT NULL PRIMARY KEY,
+		kind VARCHAR(16) NOT NULL,
+		value BIGINT NOT NULL,
+		order_types VARCHAR(255) NOT NULL DEFAULT '',
+		starts_at BIGINT NOT NULL,
+		ends_at BIGINT NOT NULL,
+		max_uses BIGINT NOT NULL DEFAULT 0,
+		per_user_limit BIGINT NOT NULL DEFAULT 0,
+		used BIGINT NOT NULL DEFAULT 0,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS gateway_coupon_redemption (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		code VARCHAR(32) NOT NULL,
+		openid VARCHAR(64) NOT NULL,
+		out_trade_no VARCHAR(64) NOT NULL,
+		discount BIGINT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		UNIQUE KEY uk_out_trade_no (out_trade_no),
+		KEY idx_code_openid (code, openid)
+	)`,
+}
+
+type CouponStore struct {
+	db *sql.DB
+}
+
+// NewCouponStore creates the coupon tables and hooks into orders so that a
+// held coupon is redeemed when its order is paid and released when the order
+// is closed, fails or is refunded.
+func NewCouponStore(ctx context.Context, db *sql.DB, orders *OrderStore) (*CouponStore, error) {
+	for _, ddl := range couponTables {
+		if _, err := db.ExecContext(ctx, ddl); err != nil {
+			grpclog.Errorf("create coupon table failed error: %v", err)
+			return nil, err
+		}
+	}
+	store := &CouponStore{db: db}
+	orders.OnTransition(store.onOrderTransition)
+	return store, nil
+}
+
+// Save creates or replaces the definition of a coupon, keeping its usage.
+func (s *CouponStore) Save(ctx context.Context, coupon *Coupon) error {
+	coupon.CreatedAt = time.Now().Unix()
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO gateway_coupon (code, kind, value, order_types, starts_at, ends_at, max_uses, per_user_limit, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE kind = VALUES(kind), value = VALUES(value), order_types = VALUES(order_types), starts_at = VALUES(starts_at),
+		ends_at = VALUES(ends_at), max_uses = VALUES(max_uses), per_user_limit = VALUES(per_user_limit);`,
+		coupon.Code, coupon.Kind, coupon.Value, joinOrderTypes(coupon.OrderTypes), coupon.StartsAt, coupon.EndsAt,
+		coupon.MaxUses, coupon.PerUserLimit, coupon.CreatedAt)
+	if err != nil {
+		grpclog.Errorf("save coupon %v failed error: %v", coupon.Code, err)
+	}
+	return err
+}
+
+func (s *CouponStore) Get(ctx context.Context, code string) (*Coupon, error) {
+	return scanCoupon(s.db.QueryRowContext(ctx, selectCoupon+" WHERE code = ?;", code))
+}
+
+// HoldTx reserves the coupon for an order inside tx, which should also create
+// the order. It returns the discount, or an InvalidArgument status when the
+// coupon does not apply.
+func (s *CouponStore) HoldTx(ctx context.Context, tx *sql.Tx, code string, openid string, orderType int32, price int64, outTradeNo string) (int64, error) {
+	coupon, err := scanCoupon(tx.QueryRowContext(ctx, selectCoupon+" WHERE code = ? FOR UPDATE;", code))
+	if errors.Is(err, ErrCouponNotFound) {
+		return 0, status.Errorf(codes.InvalidArgument, "coupon %s not found", code)
+	}
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	if now < coupon.StartsAt || now >= coupon.EndsAt {
+		return 0, status.Errorf(codes.InvalidArgument, "coupon %s is not valid now", code)
+	}
+	if !coupon.AppliesTo(orderType) {
+		return 0, status.Errorf(codes.InvalidArgument, "coupon %s does not apply to order type %d", code, orderType)
+	}
+	if coupon.MaxUses > 0 && coupon.Used >= coupon.MaxUses {
+		return 0, status.Errorf(codes.InvalidArgument, "coupon %s has been used up", code)
+	}
+	if coupon.PerUserLimit > 0 {
+		var used int64
+		err := tx.QueryRowContext(ctx,
+			"SELECT COUNT(*) FROM gateway_coupon_redemption WHERE code = ? AND openid = ? AND status != ?;",
+			code, openid, RedemptionReleased).Scan(&used)
+		if err != nil {
+			grpclog.Errorf("count coupon %v redemptions of %v failed error: %v", code, openid, err)
+			return 0, err
+		}
+		if used >= coupon.PerUserLimit {
+			return 0, status.Errorf(codes.InvalidArgument, "coupon %s has been used %d times by this user", code, used)
+		}
+	}
+	discount := coupon.Discount(price)
+	if _, err := tx.ExecContext(ctx, "UPDATE gateway_coupon SET used = used + 1 WHERE code = ?;", code); err != nil {
+		grpclog.Errorf("update coupon %v usage failed error: %v", code, err)
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO gateway_coupon_redemption (code, openid, out_trade_no, discount, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?);",
+		code, openid, outTradeNo, discount, RedemptionHeld, now, now)
+	if err != nil {
+		grpclog.Errorf("insert coupon %v redemption of %v failed error: %v", code, outTradeNo, err)
+		return 0, err
+	}
+	return discount, nil
+}
+
+// ReleaseTx gives the coupon held for an order back, it does nothing if the
+// order has no coupon or the coupon is already released.
+func (s *CouponStore) ReleaseTx(ctx context.Context, tx *sql.Tx, outTradeNo string) error {
+	var code, from string
+	err := tx.QueryRowContext(ctx,
+		"SELECT code, status FROM gateway_coupon_redemption WHERE out_trade_no = ? AND status != ? FOR UPDATE;",
+		outTradeNo, RedemptionReleased).Scan(&code, &from)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		grpclog.Errorf("query coupon redemption of %v failed error: %v", outTradeNo, err)
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE gateway_coupon SET used = used - 1 WHERE code = ? AND used > 0;", code); err != nil {
+		grpclog.Errorf("update coupon %v usage failed error: %v", code, err)
+		return err
+	}
+	if err := s.setStatusTx(ctx, tx, outTradeNo, from, RedemptionReleased); err != nil {
+		return err
+	}
+	grpclog.Infof("coupon %v released by order %v", code, outTradeNo)
+	return nil
+}
+
+func (s *CouponStore) onOrderTransition(ctx context.Context, tx *sql.Tx, order *Order, from OrderState) error {
+	switch order.State {
+	case OrderPaid:
+		// a partial refund moving the order back to paid changes nothing
+		if from == OrderRefunding {
+			return nil
+		}
+		return s.setStatusTx(ctx, tx, order.OutTradeNo, RedemptionHeld, RedemptionRedeemed)
+	case OrderClosed, OrderFailed, OrderRefunded:
+		return s.ReleaseTx(ctx, tx, order.OutTradeNo)
+	}
+	return nil
+}
+
+func (s *CouponStore) setStatusTx(ctx context.Context, tx *sql.Tx, outTradeNo string, from string, to string) error {
+	_, err := tx.ExecContext(ctx,
+		"UPDATE gateway_coupon_redemption SET status = ?, updated_at = ? WHERE out_trade_no = ? AND status = ?;",
+		to, time.Now().Unix(), outTradeNo, from)
+	if err != nil {
+		grpclog.Errorf("update coupon redemption of %v failed error: %v", outTradeNo, err)
+	}
+	return err
+}
+
+func (c *Coupon) AppliesTo(orderType int32) bool {
+	if len(c.OrderTypes) == 0 {
+		return true
+	}
+	for _, t := range c.OrderTypes {
+		if t == orderType {
+			return true
+		}
+	}
+	return false
+}
+
+// Discount is what the coupon takes off price, leaving at least one fen to
+// pay since wechat does not accept zero amounts.
+func (c *Coupon) Discount(price int64) int64 {
+	var discount int64
+	switch c.Kind {
+	case CouponFixed:
+		discount = c.Value
+	case CouponPercent:
+		discount = price * c.Value / 100
+	}
+	if discount > price-1 {
+		discount = price - 1
+	}
+	if discount < 0 {
+		discount = 0
+	}
+	return discount
+}
+
+// couponCode reads the coupon code the client sent along with a grpc call.
+func couponCode(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(couponCodeMetadataKey)
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
+
+const selectCoupon = "SELECT code, kind, value, order_types, starts_at, ends_at, max_uses, per_user_limit, used, created_at FROM gateway_coupon"
+
+func scanCoupon(row *sql.Row) (*Coupon, error) {
+	var coupon Coupon
+	var orderTypes string
+	err := row.Scan(&coupon.Code, &coupon.Kind, &coupon.Value, &orderTypes, &coupon.StartsAt, &coupon.EndsAt,
+		&coupon.MaxUses, &coupon.PerUserLimit, &coupon.Used, &coupon.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCouponNotFound
+	}
+	if err != nil {
+		grpclog.Errorf("scan coupon failed error: %v", err)
+		return nil, err
+	}
+	coupon.OrderTypes, err = splitOrderTypes(orderTypes)
+	if err != nil {
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+func joinOrderTypes(orderTypes []int32) string {
+	parts := make([]string, len(orderTypes))
+	for i, t := range orderTypes {
+		parts[i] = strconv.Itoa(int(t))
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitOrderTypes(s string) ([]int32, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	var orderTypes []int32
+	for _, part := range strings.Split(s, ",") {
+		t, err := strconv.ParseInt(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid order types %q", s)
+		}
+		orderTypes = append(orderTypes, int32(t))
+	}
+	return orderTypes, nil
+}
@@ -0,0 +1,193 @@
+package wx_payment
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/internal/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCouponDiscount(t *testing.T) {
+	cases := []struct {
+		kind  string
+		value int64
+		price int64
+		want  int64
+	}{
+		{CouponFixed, 500, 2990, 500},
+		{CouponPercent, 20, 2990, 598},
+		// at least one fen is left to pay
+		{CouponFixed, 5000, 2990, 2989},
+		{CouponPercent, 100, 2990, 2989},
+		{CouponFixed, 1, 1, 0},
+		{CouponFixed, -100, 2990, 0},
+		{"unknown", 500, 2990, 0},
+	}
+	for _, c := range cases {
+		coupon := &Coupon{Kind: c.kind, Value: c.value}
+		if got := coupon.Discount(c.price); got != c.want {
+			t.Errorf("%s %d off %d = %d, want %d", c.kind, c.value, c.price, got, c.want)
+		}
+	}
+}
+
+// saveTestCoupon saves a fixed coupon of 500 fen valid for an hour, adjusted
+// by edit.
+func saveTestCoupon(t *testing.T, server *WxPaymentServiceImpl, code string, edit func(*Coupon)) {
+	t.Helper()
+	now := time.Now().Unix()
+	coupon := &Coupon{Code: code, Kind: CouponFixed, Value: 500, StartsAt: now - 60, EndsAt: now + 3600}
+	if edit != nil {
+		edit(coupon)
+	}
+	if err := server.Coupons.Save(context.Background(), coupon); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createCouponOrder places an order of product 1 with the coupon code.
+func createCouponOrder(server *WxPaymentServiceImpl, outTradeNo, openid, code string) (*Order, error) {
+	product := testProducts[1]
+	order := &Order{OutTradeNo: outTradeNo, OpenID: openid, OrderType: 1, Channel: ChannelJsapi}
+	return order, server.createOrder(context.Background(), order, &product, code, 0)
+}
+
+func TestCouponAppliedToAmount(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	saveTestCoupon(t, server, "FIXED", nil)
+	saveTestCoupon(t, server, "HALF", func(c *Coupon) { c.Kind, c.Value = CouponPercent, 50 })
+
+	for outTradeNo, code := range map[string]string{"T1": "FIXED", "T2": "HALF"} {
+		if _, err := createCouponOrder(server, outTradeNo, "oUser", code); err != nil {
+			t.Fatalf("order with %s: %v", code, err)
+		}
+	}
+	for outTradeNo, want := range map[string]int64{"T1": 2490, "T2": 1495} {
+		if order, err := server.Orders.Get(ctx, outTradeNo); err != nil || order.Amount != want {
+			t.Fatalf("order %s charged %+v %v, want %d", outTradeNo, order, err, want)
+		}
+	}
+
+	// the client may send what the coupon makes it pay
+	product := testProducts[1]
+	order := &Order{OutTradeNo: "T3", OpenID: "oUser", OrderType: 1, Channel: ChannelJsapi}
+	if err := server.createOrder(ctx, order, &product, "FIXED", 2490); err != nil || order.Amount != 2490 {
+		t.Fatalf("order sending the discounted amount = %d %v", order.Amount, err)
+	}
+}
+
+func TestCouponHoldRules(t *testing.T) {
+	server, _ := newTestPayment(t)
+	now := time.Now().Unix()
+	saveTestCoupon(t, server, "ONCE", func(c *Coupon) { c.MaxUses = 1 })
+	saveTestCoupon(t, server, "PERUSER", func(c *Coupon) { c.PerUserLimit = 1 })
+	saveTestCoupon(t, server, "LATER", func(c *Coupon) { c.StartsAt = now + 60 })
+	saveTestCoupon(t, server, "EXPIRED", func(c *Coupon) { c.StartsAt, c.EndsAt = now-7200, now-3600 })
+	saveTestCoupon(t, server, "REPORT", func(c *Coupon) { c.OrderTypes = []int32{9} })
+
+	steps := []struct {
+		openid string
+		code   string
+		ok     bool
+	}{
+		{"oA", "ONCE", true},
+		{"oB", "ONCE", false},
+		{"oA", "PERUSER", true},
+		{"oA", "PERUSER", false},
+		{"oB", "PERUSER", true},
+		{"oA", "LATER", false},
+		{"oA", "EXPIRED", false},
+		{"oA", "REPORT", false},
+		{"oA", "MISSING", false},
+	}
+	for i, step := range steps {
+		_, err := createCouponOrder(server, fmt.Sprintf("T%d", i), step.openid, step.code)
+		if step.ok && err != nil {
+			t.Fatalf("step %d %s by %s: %v", i, step.code, step.openid, err)
+		}
+		if !step.ok && status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("step %d %s by %s = %v", i, step.code, step.openid, err)
+		}
+	}
+}
+
+func TestCouponConcurrentHolds(t *testing.T) {
+	server, _ := newTestPayment(t)
+	testutil.RequireRowLocks(t, server.Coupons.db)
+	saveTestCoupon(t, server, "LAST", func(c *Coupon) { c.MaxUses = 1 })
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = createCouponOrder(server, fmt.Sprintf("T%d", i), fmt.Sprintf("o%d", i), "LAST")
+		}()
+	}
+	wg.Wait()
+	held := 0
+	for _, err := range errs {
+		if err == nil {
+			held++
+		}
+	}
+	if held != 1 {
+		t.Fatalf("%d holds of the last use, errs %v", held, errs)
+	}
+	if coupon, err := server.Coupons.Get(context.Background(), "LAST"); err != nil || coupon.Used != 1 {
+		t.Fatalf("coupon after concurrent holds %+v %v", coupon, err)
+	}
+}
+
+func TestCouponReleasedWithOrder(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	saveTestCoupon(t, server, "LAST", func(c *Coupon) { c.MaxUses = 1 })
+	used := func() int64 {
+		t.Helper()
+		coupon, err := server.Coupons.Get(ctx, "LAST")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return coupon.Used
+	}
+
+	// closed and failed orders give the use back
+	for i, to := range []OrderState{OrderClosed, OrderFailed} {
+		outTradeNo := fmt.Sprintf("T%d", i)
+		if _, err := createCouponOrder(server, outTradeNo, "oUser", "LAST"); err != nil {
+			t.Fatalf("hold before %s: %v", to, err)
+		}
+		if _, err := createCouponOrder(server, outTradeNo+"b", "oOther", "LAST"); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("hold of a held coupon = %v", err)
+		}
+		if _, err := server.Orders.Transition(ctx, outTradeNo, to, OrderChange{Reason: "test"}); err != nil {
+			t.Fatal(err)
+		}
+		if n := used(); n != 0 {
+			t.Fatalf("coupon used %d after order %s", n, to)
+		}
+	}
+
+	// a paid order keeps it
+	if _, err := createCouponOrder(server, "T2", "oUser", "LAST"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Orders.Transition(ctx, "T2", OrderPaid, OrderChange{Reason: "test", TransactionID: "W2"}); err != nil {
+		t.Fatal(err)
+	}
+	var redemption string
+	if err := server.Coupons.db.QueryRow("SELECT status FROM gateway_coupon_redemption WHERE out_trade_no = 'T2';").Scan(&redemption); err != nil {
+		t.Fatal(err)
+	}
+	if n := used(); n != 1 || redemption != RedemptionRedeemed {
+		t.Fatalf("coupon used %d redemption %s after payment", n, redemption)
+	}
+}
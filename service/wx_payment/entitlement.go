@@ -0,0 +1,235 @@
+package wx_payment
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/platform"
+	"google.golang.org/grpc/grpclog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PolicyWhitelist = "whitelist"
+	PolicyFreeTrial = "free_trial"
+	PolicyPromotion = "promotion"
+	PolicyStaff     = "staff"
+
+	// answered as the Grpc-Metadata-Granted-By header when an order is
+	// granted without payment
+	grantedByMetadataKey = "granted-by"
+)
+
+// EntitlementPolicy decides whether an order is granted without payment.
+// Policies are evaluated in order before prepay and the first grant wins.
+type EntitlementPolicy interface {
+	Name() string
+	Grants(ctx context.Context, order *Order) (bool, error)
+}
+
+// claimingPolicy is implemented by policies whose grants are limited.
+// ClaimTx takes a grant for order inside the transaction that grants it and
+// returns false when none is left, Grants alone cannot tell for orders
+// placed at the same time.
+type claimingPolicy interface {
+	ClaimTx(ctx context.Context, tx *sql.Tx, order *Order) (bool, error)
+}
+
+// PolicyConfig configures one policy of conf/entitlement.yaml. An empty
+// OrderTypes applies the policy to every order type.
+type PolicyConfig struct {
+	Name       string   `yaml:"name"`
+	Kind       string   `yaml:"kind"`
+	Enabled    bool     `yaml:"enabled"`
+	OrderTypes []int32  `yaml:"order_types"`
+	OpenIDs    []string `yaml:"openids"`
+	Start      string   `yaml:"start"`
+	End        string   `yaml:"end"`
+	MaxGrants  int64    `yaml:"max_grants"`
+}
+
+type entitlementConf struct {
+	Policies []PolicyConfig `yaml:"policies"`
+}
+
+// LoadEntitlementPolicies builds the enabled policies of the config file.
+func LoadEntitlementPolicies(path string, platform *platform.PlatformService, orders *OrderStore) ([]EntitlementPolicy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := entitlementConf{}
+	if err := yaml.Unmarshal(content, &conf); err != nil {
+		return nil, err
+	}
+	var policies []EntitlementPolicy
+	for _, c := range conf.Policies {
+		if !c.Enabled {
+			continue
+		}
+		base := basePolicy{name: c.Name, orderTypes: c.OrderTypes}
+		switch c.Kind {
+		case PolicyWhitelist:
+			policies = append(policies, &whitelistPolicy{basePolicy: base, platform: platform})
+		case PolicyFreeTrial:
+			policies = append(policies, &freeTrialPolicy{basePolicy: base, orders: orders})
+		case PolicyPromotion:
+			policy := &promotionPolicy{basePolicy: base, orders: orders, maxGrants: c.MaxGrants}
+			if policy.start, err = time.ParseInLocation(datetimeLayout, c.Start, billLocation); err != nil {
+				return nil, fmt.Errorf("policy %s start: %w", c.Name, err)
+			}
+			if policy.end, err = time.ParseInLocation(datetimeLayout, c.End, billLocation); err != nil {
+				return nil, fmt.Errorf("policy %s end: %w", c.Name, err)
+			}
+			policies = append(policies, policy)
+		case PolicyStaff:
+			policy := &staffPolicy{basePolicy: base, openids: make(map[string]bool, len(c.OpenIDs))}
+			for _, openid := range c.OpenIDs {
+				policy.openids[openid] = true
+			}
+			policies = append(policies, policy)
+		default:
+			return nil, fmt.Errorf("policy %s has unknown kind %q", c.Name, c.Kind)
+		}
+	}
+	return policies, nil
+}
+
+// grantingPolicy returns the first policy granting order, or nil when the
+// order has to be paid. A failing policy is skipped so that users can
+// still pay.
+func (server WxPaymentServiceImpl) grantingPolicy(ctx context.Context, order *Order) EntitlementPolicy {
+	for _, policy := range server.Policies {
+		granted, err := policy.Grants(ctx, order)
+		if err != nil {
+			grpclog.Errorf("entitlement policy %v failed order:%v error:%v", policy.Name(), order.OutTradeNo, err)
+			continue
+		}
+		if granted {
+			return policy
+		}
+	}
+	return nil
+}
+
+// grantReason is the order event reason of grants by the policy, it is also
+// how grants are counted.
+func grantReason(policy EntitlementPolicy) string {
+	return "grant:" + policy.Name()
+}
+
+type basePolicy struct {
+	name       string
+	orderTypes []int32
+}
+
+func (p *basePolicy) Name() string {
+	return p.name
+}
+
+func (p *basePolicy) appliesTo(orderType int32) bool {
+	if len(p.orderTypes) == 0 {
+		return true
+	}
+	for _, t := range p.orderTypes {
+		if t == orderType {
+			return true
+		}
+	}
+	return false
+}
+
+// whitelistPolicy grants users in the whitelist_user table whose entry is
+// active, unset status or times do not restrict.
+type whitelistPolicy struct {
+	basePolicy
+	platform *platform.PlatformService
+}
+
+func (p *whitelistPolicy) Grants(ctx context.Context, order *Order) (bool, error) {
+	if !p.appliesTo(order.OrderType) {
+		return false, nil
+	}
+	entries, err := p.platform.WhitelistMySqlQuery(&ctx, &platform.WhitelistUserData{OpenID: &order.OpenID})
+	if err != nil {
+		return false, err
+	}
+	return len(entries) > 0 && whitelistActive(&entries[0], time.Now()), nil
+}
+
+func whitelistActive(entry *platform.WhitelistUserData, now time.Time) bool {
+	if entry.Status != nil && *entry.Status != 1 {
+		return false
+	}
+	if entry.AddedTime != nil && entry.ExpirationTime != nil {
+		nowUnix := uint64(now.Unix())
+		return *entry.AddedTime < nowUnix && nowUnix < *entry.ExpirationTime
+	}
+	return true
+}
+
+// freeTrialPolicy grants the first order of a user, once.
+type freeTrialPolicy struct {
+	basePolicy
+	orders *OrderStore
+}
+
+func (p *freeTrialPolicy) Grants(ctx context.Context, order *Order) (bool, error) {
+	if !p.appliesTo(order.OrderType) {
+		return false, nil
+	}
+	paid, err := p.orders.CountPaid(ctx, order.OpenID)
+	if err != nil {
+		return false, err
+	}
+	return paid == 0, nil
+}
+
+func (p *freeTrialPolicy) ClaimTx(ctx context.Context, tx *sql.Tx, order *Order) (bool, error) {
+	return p.orders.ClaimGrantTx(ctx, tx, p.name, order.OpenID, order.OutTradeNo, 0)
+}
+
+// promotionPolicy grants orders placed within [start, end) until maxGrants
+// orders have been granted, zero does not cap. Each user is granted once.
+type promotionPolicy struct {
+	basePolicy
+	orders    *OrderStore
+	start     time.Time
+	end       time.Time
+	maxGrants int64
+}
+
+func (p *promotionPolicy) Grants(ctx context.Context, order *Order) (bool, error) {
+	now := time.Now()
+	if !p.appliesTo(order.OrderType) || now.Before(p.start) || !now.Before(p.end) {
+		return false, nil
+	}
+	granted, err := p.orders.CountGranted(ctx, grantReason(p), order.OpenID)
+	if err != nil || granted > 0 {
+		return false, err
+	}
+	if p.maxGrants > 0 {
+		total, err := p.orders.CountGranted(ctx, grantReason(p), "")
+		if err != nil || total >= p.maxGrants {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (p *promotionPolicy) ClaimTx(ctx context.Context, tx *sql.Tx, order *Order) (bool, error) {
+	return p.orders.ClaimGrantTx(ctx, tx, p.name, order.OpenID, order.OutTradeNo, p.maxGrants)
+}
+
+// staffPolicy grants staff accounts listed in the config.
+type staffPolicy struct {
+	basePolicy
+	openids map[string]bool
+}
+
+func (p *staffPolicy) Grants(ctx context.Context, order *Order) (bool, error) {
+	return p.appliesTo(order.OrderType) && p.openids[order.OpenID], nil
+}
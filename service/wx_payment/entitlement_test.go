@@ -0,0 +1,97 @@
+package wx_payment
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/platform"
+)
+
+func TestWhitelistActive(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	active, inactive := int8(1), int8(0)
+	before, after := uint64(now.Unix()-60), uint64(now.Unix()+60)
+	cases := []struct {
+		entry platform.WhitelistUserData
+		want  bool
+	}{
+		{platform.WhitelistUserData{}, true},
+		{platform.WhitelistUserData{Status: &inactive}, false},
+		{platform.WhitelistUserData{Status: &active, AddedTime: &before, ExpirationTime: &after}, true},
+		{platform.WhitelistUserData{Status: &active, AddedTime: &before, ExpirationTime: &before}, false},
+	}
+	for i, c := range cases {
+		if got := whitelistActive(&c.entry, now); got != c.want {
+			t.Errorf("case %d whitelistActive = %v", i, got)
+		}
+	}
+}
+
+func TestFreeTrialGrantedOnce(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	trial := &freeTrialPolicy{basePolicy: basePolicy{name: "trial", orderTypes: []int32{1}}, orders: server.Orders}
+	first := createTestOrder(t, server, "T1", "oUser", 1)
+	second := createTestOrder(t, server, "T2", "oUser", 1)
+	report := createTestOrder(t, server, "T3", "oUser", 9)
+
+	// both orders were placed before either got granted
+	for _, order := range []*Order{first, second} {
+		if granted, err := trial.Grants(ctx, order); err != nil || !granted {
+			t.Fatalf("first orders not offered the trial %v %v", granted, err)
+		}
+	}
+	if granted, _ := trial.Grants(ctx, report); granted {
+		t.Fatal("trial offered for another order type")
+	}
+	if granted, err := server.grantOrder(ctx, "T1", trial); err != nil || !granted {
+		t.Fatalf("grant T1 %v %v", granted, err)
+	}
+	if granted, err := server.grantOrder(ctx, "T2", trial); err != nil || granted {
+		t.Fatalf("second trial granted %v %v", granted, err)
+	}
+	if order, _ := server.Orders.Get(ctx, "T2"); order.State != OrderCreated {
+		t.Fatalf("order without trial is %v", order.State)
+	}
+	if granted, _ := trial.Grants(ctx, createTestOrder(t, server, "T4", "oUser", 1)); granted {
+		t.Fatal("trial offered after it was granted")
+	}
+}
+
+func TestPromotionMaxGrants(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	now := time.Now()
+	promotion := &promotionPolicy{
+		basePolicy: basePolicy{name: "launch"},
+		orders:     server.Orders,
+		start:      now.Add(-time.Hour),
+		end:        now.Add(time.Hour),
+		maxGrants:  2,
+	}
+	// all offered before any grant, only the quota decides
+	for i := 0; i < 3; i++ {
+		order := createTestOrder(t, server, fmt.Sprintf("T%d", i), fmt.Sprintf("oUser%d", i), 1)
+		if ok, err := promotion.Grants(ctx, order); err != nil || !ok {
+			t.Fatalf("order %d not offered the promotion %v %v", i, ok, err)
+		}
+	}
+	var granted int
+	for i := 0; i < 3; i++ {
+		ok, err := server.grantOrder(ctx, fmt.Sprintf("T%d", i), promotion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			granted++
+		}
+	}
+	if granted != 2 {
+		t.Fatalf("promotion granted %d orders", granted)
+	}
+	if count, _ := server.Orders.CountGranted(ctx, grantReason(promotion), ""); count != 2 {
+		t.Fatalf("counted %d grants", count)
+	}
+}
@@ -1,10 +1,26 @@
 package wx_payment
 
-import "flag"
+import (
+	"flag"
+	"time"
+)
 
 var (
 	apiClientKeyPath = flag.String("api_client_key_path", "/home/work/cert/apiclient_key.pem", "api_client_key_path")
 	authFile         = flag.String("auth_file", "./conf/wx_payment.yaml", "auth_file")
 	dataPlatformFile = flag.String("data_platform_file", "./conf/data_platform.yaml", "data_platform_file")
+	productsFile     = flag.String("products_file", "./conf/products.yaml", "products_file")
+	entitlementFile  = flag.String("entitlement_file", "./conf/entitlement.yaml", "entitlement_file")
+	subscriptionFile = flag.String("subscription_file", "./conf/subscription.yaml", "subscription_file")
 	notifyUrl        = flag.String("notify_url", "https://mikiai.tuyaedu.com:8124/wx_payment_notify/jsapi_notify_url", "notify_url")
+	refundNotifyUrl  = flag.String("refund_notify_url", "https://mikiai.tuyaedu.com:8124/wx_payment_notify/refund_notify_url", "refund_notify_url")
+
+	reconcileInterval = flag.Duration("reconcile_interval", 5*time.Minute, "how often unsettled orders are checked with wechat")
+	prepaidQueryAfter = flag.Duration("prepaid_query_after", 5*time.Minute, "age after which a prepaid order is queried")
+	orderExpireAfter  = flag.Duration("order_expire_after", 2*time.Hour, "age after which an unpaid order is closed")
+	tradeBillHour     = flag.Int("trade_bill_hour", 10, "hour of day after which the trade bill of yesterday is reconciled")
+
+	certRefreshInterval  = flag.Duration("cert_refresh_interval", time.Hour, "how often the merchant key is reloaded and platform certificates are downloaded")
+	certExpiryWarning    = flag.Duration("cert_expiry_warning", 7*24*time.Hour, "remaining validity of the newest platform certificate below which cert health fails")
+	subscriptionInterval = flag.Duration("subscription_interval", 10*time.Minute, "how often renewal reminders are sent and ended subscriptions lapse")
 )
@@ -0,0 +1,127 @@
+package wx_payment
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pkusunjy/grpc-gateway/internal/testutil"
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/option"
+)
+
+var testProducts = map[int32]Product{
+	1: {OrderType: 1, Name: "monthly", Description: "monthly", Price: 2990, DurationDays: 31},
+	9: {OrderType: 9, Name: "report", Description: "report", Price: 500},
+}
+
+// newTestPayment builds the payment service on a test database without
+// talking to wechat.
+func newTestPayment(t *testing.T) (*WxPaymentServiceImpl, *testutil.DataPlatform) {
+	t.Helper()
+	ctx := context.Background()
+	db := testutil.DB(t)
+	platform := testutil.NewDataPlatform(t)
+	server := &WxPaymentServiceImpl{
+		WxAppID:              "wxappid",
+		WxMchID:              "1900000001",
+		DataPlatformEndpoint: platform.Endpoint(),
+		Catalog:              &Catalog{byType: testProducts},
+	}
+	var err error
+	if server.Orders, err = NewOrderStore(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if server.Outbox, err = NewOutbox(ctx, db, server.DataPlatformEndpoint); err != nil {
+		t.Fatal(err)
+	}
+	if server.Refunds, err = NewRefundStore(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if server.Notifies, err = NewNotifyStore(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if server.Coupons, err = NewCouponStore(ctx, db, server.Orders); err != nil {
+		t.Fatal(err)
+	}
+	if server.Subscriptions, err = NewSubscriptionStore(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	return server, platform
+}
+
+// createTestOrder stores an order of openid for product orderType.
+func createTestOrder(t *testing.T, server *WxPaymentServiceImpl, outTradeNo, openid string, orderType int32) *Order {
+	t.Helper()
+	order := &Order{
+		OutTradeNo: outTradeNo,
+		OpenID:     openid,
+		OrderType:  orderType,
+		Channel:    ChannelNative,
+		Amount:     testProducts[orderType].Price,
+	}
+	if err := server.Orders.Create(context.Background(), order); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// pendingOutbox returns the paths of the messages waiting in the outbox.
+func pendingOutbox(t *testing.T, server *WxPaymentServiceImpl) []string {
+	t.Helper()
+	rows, err := server.Outbox.db.Query("SELECT path FROM gateway_outbox WHERE status = ? ORDER BY id;", OutboxPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var paths []string
+	for rows.Next() {
+		var path string
+		rows.Scan(&path)
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// newTestWxClient sends the wechat requests of the service to handler,
+// responses are not verified.
+func newTestWxClient(t *testing.T, handler http.HandlerFunc) *core.Client {
+	t.Helper()
+	wechat := httptest.NewServer(handler)
+	t.Cleanup(wechat.Close)
+	target, _ := url.Parse(wechat.URL)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := core.NewClient(context.Background(),
+		option.WithMerchantCredential("1900000001", "TESTSERIAL", key),
+		option.WithoutValidator(),
+		option.WithHTTPClient(&http.Client{Transport: testTransport{target}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+type testTransport struct {
+	target *url.URL
+}
+
+func (t testTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// deliverOutbox delivers every pending outbox message.
+func deliverOutbox(server *WxPaymentServiceImpl) {
+	for server.Outbox.deliverBatch(context.Background()) > 0 {
+	}
+}
@@ -2,88 +2,150 @@ package wx_payment
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 
-	"github.com/pkusunjy/grpc-gateway/service/platform"
-	"github.com/wechatpay-apiv3/wechatpay-go/core/auth/verifiers"
-	"github.com/wechatpay-apiv3/wechatpay-go/core/downloader"
 	"github.com/wechatpay-apiv3/wechatpay-go/core/notify"
 	"github.com/wechatpay-apiv3/wechatpay-go/services/payments"
 	"google.golang.org/grpc/grpclog"
-	"gopkg.in/yaml.v3"
 )
 
 type NotifyServiceImpl struct {
-	WxAppID              string `yaml:"wx_appid"`
-	WxMchID              string `yaml:"wx_mchid"`
-	WxMchAPIv3Key        string `yaml:"wx_mch_apiv3"`
-	WxSecret             string `yaml:"wx_secret"`
-	WxSerialNo           string `yaml:"wx_serial_no"`
-	DataPlatformEndpoint string `yaml:"endpoint"`
+	WxAppID              string
+	WxMchID              string
+	WxMchAPIv3Key        string
+	DataPlatformEndpoint string
 	NotifyHandler        *notify.Handler
+	Notifies             *NotifyStore
+	Payment              *WxPaymentServiceImpl
 }
 
-func NotifyServiceInitialize(ctx *context.Context) (*NotifyServiceImpl, error) {
-	server := NotifyServiceImpl{}
-	// load wx payment file
-	content, err := os.ReadFile(*authFile)
-	if err != nil {
-		grpclog.Fatal(err)
-		return nil, err
-	}
-	err = yaml.Unmarshal(content, &server)
-	if err != nil {
-		grpclog.Fatal(err)
-		return nil, err
-	}
-	// load data_platform file
-	content, err = os.ReadFile(*dataPlatformFile)
-	if err != nil {
-		grpclog.Fatal(err)
-		return nil, err
-	}
-	err = yaml.Unmarshal(content, &server)
-	if err != nil {
-		grpclog.Fatal(err)
-		return nil, err
+// NotifyServiceInitialize shares the config, stores and outbox of the
+// payment service so that only one outbox worker runs, and verifies
+// notifies with its certificates.
+func NotifyServiceInitialize(ctx *context.Context, payment *WxPaymentServiceImpl) (*NotifyServiceImpl, error) {
+	server := NotifyServiceImpl{
+		WxAppID:              payment.WxAppID,
+		WxMchID:              payment.WxMchID,
+		WxMchAPIv3Key:        payment.WxMchAPIv3Key,
+		DataPlatformEndpoint: payment.DataPlatformEndpoint,
 	}
-
-	certificateVisitor := downloader.MgrInstance().GetCertificateVisitor(server.WxMchID)
-	server.NotifyHandler = notify.NewNotifyHandler(
-		server.WxMchAPIv3Key,
-		verifiers.NewSHA256WithRSAVerifier(certificateVisitor),
-	)
+	server.NotifyHandler = notify.NewNotifyHandler(server.WxMchAPIv3Key, payment.Certs)
+	server.Payment = payment
+	server.Notifies = payment.Notifies
 	return &server, nil
 }
 
 func (server NotifyServiceImpl) NotifyWxPayment(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
-	defer func() {
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-	}()
+	attempt := server.processPaymentNotify(*ctx, r)
+	grpclog.Infof("notify attempt:%+v", attempt)
+	server.Notifies.Record(*ctx, attempt)
+	writeNotifyResponse(w, attempt)
+}
+
+func (server NotifyServiceImpl) processPaymentNotify(ctx context.Context, r *http.Request) *notifyAttempt {
+	attempt := &notifyAttempt{Kind: "payment"}
 	// parse notify request
 	content := payments.Transaction{}
-	notifyReq, err := server.NotifyHandler.ParseNotifyRequest(*ctx, r, &content)
+	notifyReq, err := server.NotifyHandler.ParseNotifyRequest(ctx, r, &content)
 	if err != nil {
 		grpclog.Errorf("ParseNotifyRequest failed error: %v", err)
-		return
+		attempt.Result, attempt.Reason = notifyResultInvalid, err.Error()
+		attempt.Retry, attempt.Status = true, http.StatusUnauthorized
+		return attempt
 	}
 	grpclog.Infof("notify summary: %v, content: %v", notifyReq.Summary, content)
-	if *content.TradeState != "SUCCESS" {
-		grpclog.Errorf("TradeState not SUCCESS:%v", *content.TradeState)
-		return
+	attempt.TransactionID = stringValue(content.TransactionId)
+	attempt.OutTradeNo = stringValue(content.OutTradeNo)
+	attempt.TradeState = stringValue(content.TradeState)
+	if content.Amount != nil {
+		attempt.Amount = int64Value(content.Amount.Total)
+	}
+	if attempt.TradeState != "SUCCESS" {
+		grpclog.Errorf("TradeState not SUCCESS:%v", attempt.TradeState)
+		attempt.Result, attempt.Reason = notifyResultIgnored, "trade state "+attempt.TradeState
+		return attempt
 	}
-	// edit backend order table
-	editOrderReqBody, _ := json.Marshal(OrderParam{
-		OrderCode: *content.OutTradeNo,
+	// a mismatch will not go away on retry, so it is acknowledged and left to operators
+	if mchid := stringValue(content.Mchid); mchid != server.WxMchID {
+		attempt.Result, attempt.Reason = notifyResultRejected, "mchid mismatch "+mchid
+		grpclog.Errorf("notify %v rejected: %v", attempt.OutTradeNo, attempt.Reason)
+		return attempt
+	}
+	if appid := stringValue(content.Appid); appid != server.WxAppID {
+		attempt.Result, attempt.Reason = notifyResultRejected, "appid mismatch "+appid
+		grpclog.Errorf("notify %v rejected: %v", attempt.OutTradeNo, attempt.Reason)
+		return attempt
+	}
+
+	attempt.Result, attempt.Reason, err = server.Payment.creditPayment(ctx, &paymentCredit{
+		TransactionID: attempt.TransactionID,
+		OutTradeNo:    attempt.OutTradeNo,
+		Amount:        attempt.Amount,
+		Source:        "notify",
+		SuccessTime:   parseSuccessTime(content.SuccessTime),
 	})
-	editOrderUrl := fmt.Sprintf("http://%s/utility-project/ysOrder/editOrderStatus", server.DataPlatformEndpoint)
-	editOrderRespBody, err := platform.DoHttpPost(editOrderUrl, editOrderReqBody)
 	if err != nil {
-		grpclog.Errorf("Error HttpPost, url:%v, reqBody:%v, error:%v", editOrderUrl, string(editOrderReqBody), err)
+		attempt.Result, attempt.Reason, attempt.Retry = notifyResultError, err.Error(), true
+	}
+	return attempt
+}
+
+// refundNotifyContent is the decrypted resource of a refund notify.
+type refundNotifyContent struct {
+	Mchid        *string `json:"mchid"`
+	OutTradeNo   *string `json:"out_trade_no"`
+	OutRefundNo  *string `json:"out_refund_no"`
+	RefundId     *string `json:"refund_id"`
+	RefundStatus *string `json:"refund_status"`
+	Amount       *struct {
+		Total  *int64 `json:"total"`
+		Refund *int64 `json:"refund"`
+	} `json:"amount"`
+}
+
+func (server NotifyServiceImpl) NotifyWxRefund(ctx *context.Context, w http.ResponseWriter, r *http.Request) {
+	attempt := server.processRefundNotify(*ctx, r)
+	grpclog.Infof("refund notify attempt:%+v", attempt)
+	server.Notifies.Record(*ctx, attempt)
+	writeNotifyResponse(w, attempt)
+}
+
+func (server NotifyServiceImpl) processRefundNotify(ctx context.Context, r *http.Request) *notifyAttempt {
+	attempt := &notifyAttempt{Kind: "refund"}
+	content := refundNotifyContent{}
+	notifyReq, err := server.NotifyHandler.ParseNotifyRequest(ctx, r, &content)
+	if err != nil {
+		grpclog.Errorf("ParseNotifyRequest failed error: %v", err)
+		attempt.Result, attempt.Reason = notifyResultInvalid, err.Error()
+		attempt.Retry, attempt.Status = true, http.StatusUnauthorized
+		return attempt
+	}
+	grpclog.Infof("refund notify summary: %v, content: %+v", notifyReq.Summary, content)
+	attempt.TransactionID = stringValue(content.RefundId)
+	attempt.OutTradeNo = stringValue(content.OutTradeNo)
+	attempt.TradeState = stringValue(content.RefundStatus)
+	if content.Amount != nil {
+		attempt.Amount = int64Value(content.Amount.Refund)
+	}
+	if mchid := stringValue(content.Mchid); mchid != server.WxMchID {
+		attempt.Result, attempt.Reason = notifyResultRejected, "mchid mismatch "+mchid
+		grpclog.Errorf("refund notify %v rejected: %v", attempt.OutTradeNo, attempt.Reason)
+		return attempt
+	}
+	outRefundNo := stringValue(content.OutRefundNo)
+	resp, err := server.Payment.applyRefundStatus(ctx, outRefundNo, attempt.TransactionID, RefundStatus(attempt.TradeState), "notify")
+	if errors.Is(err, ErrRefundNotFound) {
+		// refunds made from the merchant console are not tracked
+		attempt.Result, attempt.Reason = notifyResultIgnored, "refund not found "+outRefundNo
+		return attempt
+	}
+	if err != nil {
+		attempt.Result, attempt.Reason, attempt.Retry = notifyResultError, err.Error(), true
+		return attempt
 	}
-	grpclog.Infof("edit order received response:%v", string(editOrderRespBody))
+	attempt.Result = notifyResultProcessed
+	attempt.Reason = fmt.Sprintf("refund %s %s, order %s", outRefundNo, resp.Refund.Status, resp.Order.State)
+	return attempt
 }
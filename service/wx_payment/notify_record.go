@@ -0,0 +1,184 @@
+package wx_payment
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	notifyResultProcessed = "processed"
+	notifyResultDuplicate = "duplicate"
+	notifyResultIgnored   = "ignored"
+	notifyResultRejected  = "rejected"
+	notifyResultInvalid   = "invalid"
+	notifyResultError     = "error"
+
+	// mysql error number of a duplicate key
+	mysqlErrDuplicateEntry = 1062
+)
+
+// notifyAttempt is the outcome of one callback from wechat. Callbacks with
+// Retry set are answered with FAIL so that wechat delivers them again.
+type notifyAttempt struct {
+	Kind          string
+	TransactionID string
+	OutTradeNo    string
+	TradeState    string
+	Amount        int64
+	Result        string
+	Reason        string
+	Retry         bool
+	Status        int
+}
+
+type notifyResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+var notifyTables = []string{
+	`CREATE TABLE IF NOT EXISTS gateway_notify_processed (
+		transaction_id VARCHAR(64) NOT NULL PRIMARY KEY,
+		out_trade_no VARCHAR(64) NOT NULL,
+		processed_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS gateway_notify_attempt (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		kind VARCHAR(16) NOT NULL,
+		transaction_id VARCHAR(64) NOT NULL DEFAULT '',
+		out_trade_no VARCHAR(64) NOT NULL DEFAULT '',
+		trade_state VARCHAR(32) NOT NULL DEFAULT '',
+		amount BIGINT NOT NULL DEFAULT 0,
+		result VARCHAR(16) NOT NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		KEY idx_transaction_id (transaction_id),
+		KEY idx_out_trade_no (out_trade_no)
+	)`,
+	`CREATE TABLE IF NOT EXISTS gateway_rejected_credit (
+		transaction_id VARCHAR(64) NOT NULL PRIMARY KEY,
+		out_trade_no VARCHAR(64) NOT NULL,
+		amount BIGINT NOT NULL,
+		source VARCHAR(16) NOT NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		KEY idx_out_trade_no (out_trade_no)
+	)`,
+}
+
+// RejectedCredit is a successful wechat transaction that was not applied to
+// its order. The money has been taken, so operators refund it or grant the
+// order by hand.
+type RejectedCredit struct {
+	TransactionID string `json:"transaction_id"`
+	OutTradeNo    string `json:"out_trade_no"`
+	Amount        int64  `json:"amount"`
+	Source        string `json:"source"`
+	Reason        string `json:"reason"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+type NotifyStore struct {
+	db *sql.DB
+}
+
+func NewNotifyStore(ctx context.Context, db *sql.DB) (*NotifyStore, error) {
+	for _, ddl := range notifyTables {
+		if _, err := db.ExecContext(ctx, ddl); err != nil {
+			grpclog.Errorf("create notify table failed error: %v", err)
+			return nil, err
+		}
+	}
+	return &NotifyStore{db: db}, nil
+}
+
+// MarkProcessedTx claims transactionID inside tx, returning false if it has
+// already been processed.
+func (s *NotifyStore) MarkProcessedTx(ctx context.Context, tx *sql.Tx, transactionID, outTradeNo string) (bool, error) {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO gateway_notify_processed (transaction_id, out_trade_no, processed_at) VALUES (?, ?, ?);",
+		transactionID, outTradeNo, time.Now().Unix())
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlErrDuplicateEntry {
+		return false, nil
+	}
+	if err != nil {
+		grpclog.Errorf("insert notify processed %v failed error: %v", transactionID, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// RejectTx keeps a transaction that is not credited inside the tx that marks
+// it processed.
+func (s *NotifyStore) RejectTx(ctx context.Context, tx *sql.Tx, credit *paymentCredit, reason string) error {
+	if runes := []rune(reason); len(runes) > 255 {
+		reason = string(runes[:255])
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO gateway_rejected_credit (transaction_id, out_trade_no, amount, source, reason, created_at) VALUES (?, ?, ?, ?, ?, ?);",
+		credit.TransactionID, credit.OutTradeNo, credit.Amount, credit.Source, reason, time.Now().Unix())
+	if err != nil {
+		grpclog.Errorf("insert rejected credit %v failed error: %v", credit.TransactionID, err)
+	}
+	return err
+}
+
+// Rejected lists the latest rejected credits.
+func (s *NotifyStore) Rejected(ctx context.Context, limit int) ([]RejectedCredit, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT transaction_id, out_trade_no, amount, source, reason, created_at FROM gateway_rejected_credit ORDER BY created_at DESC LIMIT ?;",
+		limit)
+	if err != nil {
+		grpclog.Errorf("query rejected credits failed error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var credits []RejectedCredit
+	for rows.Next() {
+		var c RejectedCredit
+		if err := rows.Scan(&c.TransactionID, &c.OutTradeNo, &c.Amount, &c.Source, &c.Reason, &c.CreatedAt); err != nil {
+			grpclog.Errorf("rows scan failed error: %v", err)
+			return nil, err
+		}
+		credits = append(credits, c)
+	}
+	return credits, rows.Err()
+}
+
+// Record keeps every callback for auditing, failures are only logged.
+func (s *NotifyStore) Record(ctx context.Context, attempt *notifyAttempt) {
+	reason := attempt.Reason
+	if runes := []rune(reason); len(runes) > 255 {
+		reason = string(runes[:255])
+	}
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO gateway_notify_attempt (kind, transaction_id, out_trade_no, trade_state, amount, result, reason, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?);",
+		attempt.Kind, attempt.TransactionID, attempt.OutTradeNo, attempt.TradeState, attempt.Amount, attempt.Result, reason, time.Now().Unix())
+	if err != nil {
+		grpclog.Errorf("record notify attempt %+v failed error: %v", attempt, err)
+	}
+}
+
+// writeNotifyResponse answers wechat as its notify spec requires: 200 with
+// SUCCESS to acknowledge, an error status with FAIL to ask for a retry.
+func writeNotifyResponse(w http.ResponseWriter, attempt *notifyAttempt) {
+	status := http.StatusOK
+	resp := notifyResponse{Code: "SUCCESS", Message: "成功"}
+	if attempt.Retry {
+		status = attempt.Status
+		if status < http.StatusBadRequest {
+			status = http.StatusInternalServerError
+		}
+		resp = notifyResponse{Code: "FAIL", Message: attempt.Reason}
+	}
+	body, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
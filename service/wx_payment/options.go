@@ -0,0 +1,103 @@
+package wx_payment
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"net/http"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Option changes what the payment services depend on. Without options they
+// read the config files given by flags, keep their tables in the platform
+// database, use the local redis, sign with the key of the payment config,
+// download the platform certificates and talk to api.mch.weixin.qq.com.
+// The simulator package provides options to run offline.
+type Option func(*options)
+
+type options struct {
+	httpClient   *http.Client
+	merchantKey  *rsa.PrivateKey
+	certificates []*x509.Certificate
+	files        ConfigFiles
+	db           *sql.DB
+	redisClient  *redis.Client
+}
+
+// ConfigFiles names the config files of the payment services, empty names
+// keep the file given by the flag.
+type ConfigFiles struct {
+	Payment      string
+	DataPlatform string
+	Products     string
+	Entitlement  string
+	Subscription string
+}
+
+// WithHTTPClient sends every wechat request through client.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// WithMerchantKey signs requests with key instead of loading it from file,
+// the key is then kept on refresh.
+func WithMerchantKey(key *rsa.PrivateKey) Option {
+	return func(o *options) {
+		o.merchantKey = key
+	}
+}
+
+// WithPlatformCertificates verifies responses and notifies with certificates
+// instead of downloading them from wechat, refreshes keep them.
+func WithPlatformCertificates(certificates ...*x509.Certificate) Option {
+	return func(o *options) {
+		o.certificates = certificates
+	}
+}
+
+// WithConfigFiles reads the config from files instead of the flags.
+func WithConfigFiles(files ConfigFiles) Option {
+	return func(o *options) {
+		o.files = files
+	}
+}
+
+// WithDB keeps orders, refunds and the other payment tables in db instead
+// of the platform database.
+func WithDB(db *sql.DB) Option {
+	return func(o *options) {
+		o.db = db
+	}
+}
+
+// WithRedis uses client instead of the redis on localhost.
+func WithRedis(client *redis.Client) Option {
+	return func(o *options) {
+		o.redisClient = client
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	for _, f := range []struct {
+		name *string
+		flag string
+	}{
+		{&o.files.Payment, *authFile},
+		{&o.files.DataPlatform, *dataPlatformFile},
+		{&o.files.Products, *productsFile},
+		{&o.files.Entitlement, *entitlementFile},
+		{&o.files.Subscription, *subscriptionFile},
+	} {
+		if len(*f.name) == 0 {
+			*f.name = f.flag
+		}
+	}
+	return o
+}
@@ -0,0 +1,395 @@
+package wx_payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"google.golang.org/grpc/grpclog"
+)
+
+type OrderState string
+
+const (
+	OrderCreated   OrderState = "created"
+	OrderPrepaid   OrderState = "prepaid"
+	OrderPaid      OrderState = "paid"
+	OrderClosed    OrderState = "closed"
+	OrderRefunding OrderState = "refunding"
+	OrderRefunded  OrderState = "refunded"
+	OrderFailed    OrderState = "failed"
+)
+
+// orderTransitions lists the states each state may move to. Orders granted
+// without payment go from created to paid directly, a partial refund moves
+// a refunding order back to paid.
+var orderTransitions = map[OrderState][]OrderState{
+	OrderCreated:   {OrderPrepaid, OrderPaid, OrderClosed, OrderFailed},
+	OrderPrepaid:   {OrderPaid, OrderClosed, OrderFailed},
+	OrderPaid:      {OrderRefunding},
+	OrderRefunding: {OrderRefunded, OrderPaid},
+	OrderClosed:    {},
+	OrderRefunded:  {},
+	OrderFailed:    {},
+}
+
+var (
+	ErrOrderNotFound     = errors.New("order not found")
+	ErrInvalidTransition = errors.New("invalid order state transition")
+)
+
+func (s OrderState) CanTransitTo(to OrderState) bool {
+	for _, next := range orderTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Order is the gateway side record of a payment, amounts are in fen and
+// times in unix seconds.
+type Order struct {
+	OutTradeNo    string     `json:"out_trade_no"`
+	OpenID        string     `json:"openid"`
+	OrderType     int32      `json:"order_type"`
+	Channel       string     `json:"channel"`
+	Amount        int64      `json:"amount"`
+	State         OrderState `json:"state"`
+	TransactionID string     `json:"transaction_id,omitempty"`
+	CreatedAt     int64      `json:"created_at"`
+	UpdatedAt     int64      `json:"updated_at"`
+	PaidAt        int64      `json:"paid_at,omitempty"`
+	// when wechat took the payment, which decides the trade bill of the order
+	SuccessTime int64 `json:"success_time,omitempty"`
+}
+
+// OrderEvent records one state change of an order.
+type OrderEvent struct {
+	OutTradeNo string     `json:"out_trade_no"`
+	FromState  OrderState `json:"from_state"`
+	ToState    OrderState `json:"to_state"`
+	Reason     string     `json:"reason,omitempty"`
+	CreatedAt  int64      `json:"created_at"`
+}
+
+// OrderChange carries the fields updated along with a transition.
+type OrderChange struct {
+	Reason        string
+	TransactionID string
+	SuccessTime   int64
+}
+
+// TransitionHook runs inside the transaction of every order transition,
+// an error aborts the transition.
+type TransitionHook func(ctx context.Context, tx *sql.Tx, order *Order, from OrderState) error
+
+type OrderStore struct {
+	db    *sql.DB
+	hooks []TransitionHook
+}
+
+var orderTables = []string{
+	`CREATE TABLE IF NOT EXISTS gateway_order (
+		out_trade_no VARCHAR(64) NOT NULL PRIMARY KEY,
+		openid VARCHAR(64) NOT NULL,
+		order_type INT NOT NULL,
+		channel VARCHAR(16) NOT NULL,
+		amount BIGINT NOT NULL,
+		state VARCHAR(16) NOT NULL,
+		transaction_id VARCHAR(64) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		paid_at BIGINT NOT NULL DEFAULT 0,
+		success_time BIGINT NOT NULL DEFAULT 0,
+		KEY idx_openid (openid),
+		KEY idx_state_updated (state, updated_at),
+		KEY idx_success_time (success_time)
+	)`,
+	`CREATE TABLE IF NOT EXISTS gateway_order_event (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		out_trade_no VARCHAR(64) NOT NULL,
+		from_state VARCHAR(16) NOT NULL,
+		to_state VARCHAR(16) NOT NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		KEY idx_out_trade_no (out_trade_no)
+	)`,
+	`CREATE TABLE IF NOT EXISTS gateway_grant (
+		policy VARCHAR(64) NOT NULL,
+		openid VARCHAR(64) NOT NULL,
+		out_trade_no VARCHAR(64) NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (policy, openid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS gateway_grant_quota (
+		policy VARCHAR(64) NOT NULL PRIMARY KEY,
+		granted BIGINT NOT NULL DEFAULT 0
+	)`,
+}
+
+func NewOrderStore(ctx context.Context, db *sql.DB) (*OrderStore, error) {
+	for _, ddl := range orderTables {
+		if _, err := db.ExecContext(ctx, ddl); err != nil {
+			grpclog.Errorf("create order table failed error: %v", err)
+			return nil, err
+		}
+	}
+	return &OrderStore{db: db}, nil
+}
+
+// OnTransition registers a hook, it is not safe to call once orders change.
+func (s *OrderStore) OnTransition(hook TransitionHook) {
+	s.hooks = append(s.hooks, hook)
+}
+
+// Create stores a new order in the created state.
+func (s *OrderStore) Create(ctx context.Context, order *Order) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.CreateTx(ctx, tx, order); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *OrderStore) CreateTx(ctx context.Context, tx *sql.Tx, order *Order) error {
+	now := time.Now().Unix()
+	order.State = OrderCreated
+	order.CreatedAt = now
+	order.UpdatedAt = now
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO gateway_order (out_trade_no, openid, order_type, channel, amount, state, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?);",
+		order.OutTradeNo, order.OpenID, order.OrderType, order.Channel, order.Amount, order.State, now, now)
+	if err != nil {
+		grpclog.Errorf("insert order %v failed error: %v", order.OutTradeNo, err)
+		return err
+	}
+	return insertOrderEvent(ctx, tx, order.OutTradeNo, "", OrderCreated, "", now)
+}
+
+func (s *OrderStore) BeginTx(ctx context.Context) (*sql.Tx, error) {
+	return s.db.BeginTx(ctx, nil)
+}
+
+// LockTx reads an order and locks it until tx ends.
+func (s *OrderStore) LockTx(ctx context.Context, tx *sql.Tx, outTradeNo string) (*Order, error) {
+	return scanOrder(tx.QueryRowContext(ctx, selectOrder+" WHERE out_trade_no = ? FOR UPDATE;", outTradeNo))
+}
+
+// Transition moves an order to the given state, see TransitionTx.
+func (s *OrderStore) Transition(ctx context.Context, outTradeNo string, to OrderState, change OrderChange) (*Order, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	order, err := s.TransitionTx(ctx, tx, outTradeNo, to, change)
+	if err != nil {
+		return order, err
+	}
+	return order, tx.Commit()
+}
+
+// TransitionTx locks the order, validates the transition and records it
+// inside tx. ErrInvalidTransition is returned along with the current order
+// when the move is not allowed.
+func (s *OrderStore) TransitionTx(ctx context.Context, tx *sql.Tx, outTradeNo string, to OrderState, change OrderChange) (*Order, error) {
+	order, err := s.LockTx(ctx, tx, outTradeNo)
+	if err != nil {
+		return nil, err
+	}
+	from := order.State
+	if !from.CanTransitTo(to) {
+		return order, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+	now := time.Now().Unix()
+	order.State = to
+	order.UpdatedAt = now
+	if len(change.TransactionID) != 0 {
+		order.TransactionID = change.TransactionID
+	}
+	if change.SuccessTime != 0 {
+		order.SuccessTime = change.SuccessTime
+	}
+	if to == OrderPaid && order.PaidAt == 0 {
+		order.PaidAt = now
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE gateway_order SET state = ?, transaction_id = ?, updated_at = ?, paid_at = ?, success_time = ? WHERE out_trade_no = ?;",
+		order.State, order.TransactionID, order.UpdatedAt, order.PaidAt, order.SuccessTime, outTradeNo)
+	if err != nil {
+		grpclog.Errorf("update order %v failed error: %v", outTradeNo, err)
+		return nil, err
+	}
+	if err := insertOrderEvent(ctx, tx, outTradeNo, from, to, change.Reason, now); err != nil {
+		return nil, err
+	}
+	for _, hook := range s.hooks {
+		if err := hook(ctx, tx, order, from); err != nil {
+			return nil, err
+		}
+	}
+	grpclog.Infof("order %v transition %v -> %v reason:%v", outTradeNo, from, to, change.Reason)
+	return order, nil
+}
+
+func (s *OrderStore) Get(ctx context.Context, outTradeNo string) (*Order, error) {
+	return scanOrder(s.db.QueryRowContext(ctx, selectOrder+" WHERE out_trade_no = ?;", outTradeNo))
+}
+
+// CountPaid counts the orders of openid that have been paid or granted,
+// including those refunded since.
+func (s *OrderStore) CountPaid(ctx context.Context, openid string) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM gateway_order WHERE openid = ? AND paid_at != 0;", openid).Scan(&count)
+	if err != nil {
+		grpclog.Errorf("count paid orders of %v failed error: %v", openid, err)
+	}
+	return count, err
+}
+
+// ClaimGrantTx records inside tx that policy grants the order outTradeNo of
+// openid. It returns false when policy granted openid before, or when
+// maxGrants grants have been made, zero does not cap. The quota row stays
+// locked until tx ends, so concurrent grants cannot exceed it.
+func (s *OrderStore) ClaimGrantTx(ctx context.Context, tx *sql.Tx, policy, openid, outTradeNo string, maxGrants int64) (bool, error) {
+	if maxGrants > 0 {
+		// created outside tx, two transactions inserting it would deadlock
+		if _, err := s.db.ExecContext(ctx, "INSERT IGNORE INTO gateway_grant_quota (policy, granted) VALUES (?, 0);", policy); err != nil {
+			grpclog.Errorf("insert grant quota of %v failed error: %v", policy, err)
+			return false, err
+		}
+		var granted int64
+		err := tx.QueryRowContext(ctx, "SELECT granted FROM gateway_grant_quota WHERE policy = ? FOR UPDATE;", policy).Scan(&granted)
+		if err != nil {
+			grpclog.Errorf("lock grant quota of %v failed error: %v", policy, err)
+			return false, err
+		}
+		if granted >= maxGrants {
+			return false, nil
+		}
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO gateway_grant (policy, openid, out_trade_no, created_at) VALUES (?, ?, ?, ?);",
+		policy, openid, outTradeNo, time.Now().Unix())
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlErrDuplicateEntry {
+		return false, nil
+	}
+	if err != nil {
+		grpclog.Errorf("insert grant of %v by %v failed error: %v", outTradeNo, policy, err)
+		return false, err
+	}
+	if maxGrants > 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE gateway_grant_quota SET granted = granted + 1 WHERE policy = ?;", policy); err != nil {
+			grpclog.Errorf("update grant quota of %v failed error: %v", policy, err)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// CountGranted counts the orders moved to paid with reason, only those of
+// openid unless it is empty.
+func (s *OrderStore) CountGranted(ctx context.Context, reason string, openid string) (int64, error) {
+	query := "SELECT COUNT(*) FROM gateway_order_event e JOIN gateway_order o ON o.out_trade_no = e.out_trade_no WHERE e.to_state = ? AND e.reason = ?"
+	args := []any{OrderPaid, reason}
+	if len(openid) != 0 {
+		query += " AND o.openid = ?"
+		args = append(args, openid)
+	}
+	var count int64
+	if err := s.db.QueryRowContext(ctx, query+";", args...).Scan(&count); err != nil {
+		grpclog.Errorf("count orders granted by %v failed error: %v", reason, err)
+		return 0, err
+	}
+	return count, nil
+}
+
+// ListStale returns orders that have been in state since before updatedBefore.
+func (s *OrderStore) ListStale(ctx context.Context, state OrderState, updatedBefore int64, limit int) ([]Order, error) {
+	return s.list(ctx, selectOrder+" WHERE state = ? AND updated_at < ? ORDER BY updated_at LIMIT ?;", state, updatedBefore, limit)
+}
+
+// ListPaid returns orders paid through wechat within [from, to) by the
+// clock of wechat, like the trade bill.
+func (s *OrderStore) ListPaid(ctx context.Context, from, to int64) ([]Order, error) {
+	return s.list(ctx, selectOrder+" WHERE success_time >= ? AND success_time < ? AND transaction_id != '';", from, to)
+}
+
+func (s *OrderStore) list(ctx context.Context, query string, args ...any) ([]Order, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		grpclog.Errorf("query orders failed error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var orders []Order
+	for rows.Next() {
+		var order Order
+		if err := rows.Scan(&order.OutTradeNo, &order.OpenID, &order.OrderType, &order.Channel, &order.Amount,
+			&order.State, &order.TransactionID, &order.CreatedAt, &order.UpdatedAt, &order.PaidAt, &order.SuccessTime); err != nil {
+			grpclog.Errorf("rows scan failed error: %v", err)
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+func (s *OrderStore) History(ctx context.Context, outTradeNo string) ([]OrderEvent, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT out_trade_no, from_state, to_state, reason, created_at FROM gateway_order_event WHERE out_trade_no = ? ORDER BY id;",
+		outTradeNo)
+	if err != nil {
+		grpclog.Errorf("query order events %v failed error: %v", outTradeNo, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var events []OrderEvent
+	for rows.Next() {
+		var event OrderEvent
+		if err := rows.Scan(&event.OutTradeNo, &event.FromState, &event.ToState, &event.Reason, &event.CreatedAt); err != nil {
+			grpclog.Errorf("rows scan failed error: %v", err)
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+const selectOrder = "SELECT out_trade_no, openid, order_type, channel, amount, state, transaction_id, created_at, updated_at, paid_at, success_time FROM gateway_order"
+
+func scanOrder(row *sql.Row) (*Order, error) {
+	var order Order
+	err := row.Scan(&order.OutTradeNo, &order.OpenID, &order.OrderType, &order.Channel, &order.Amount,
+		&order.State, &order.TransactionID, &order.CreatedAt, &order.UpdatedAt, &order.PaidAt, &order.SuccessTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		grpclog.Errorf("scan order failed error: %v", err)
+		return nil, err
+	}
+	return &order, nil
+}
+
+func insertOrderEvent(ctx context.Context, tx *sql.Tx, outTradeNo string, from, to OrderState, reason string, now int64) error {
+	if runes := []rune(reason); len(runes) > 255 {
+		reason = string(runes[:255])
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO gateway_order_event (out_trade_no, from_state, to_state, reason, created_at) VALUES (?, ?, ?, ?, ?);",
+		outTradeNo, from, to, reason, now)
+	if err != nil {
+		grpclog.Errorf("insert order event %v failed error: %v", outTradeNo, err)
+	}
+	return err
+}
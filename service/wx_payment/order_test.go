@@ -0,0 +1,122 @@
+package wx_payment
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/internal/testutil"
+)
+
+func TestCanTransitTo(t *testing.T) {
+	allowed := map[[2]OrderState]bool{
+		{OrderCreated, OrderPrepaid}:    true,
+		{OrderCreated, OrderPaid}:       true,
+		{OrderCreated, OrderClosed}:     true,
+		{OrderCreated, OrderFailed}:     true,
+		{OrderPrepaid, OrderPaid}:       true,
+		{OrderPrepaid, OrderClosed}:     true,
+		{OrderPrepaid, OrderFailed}:     true,
+		{OrderPaid, OrderRefunding}:     true,
+		{OrderRefunding, OrderRefunded}: true,
+		{OrderRefunding, OrderPaid}:     true,
+	}
+	states := []OrderState{OrderCreated, OrderPrepaid, OrderPaid, OrderClosed, OrderRefunding, OrderRefunded, OrderFailed}
+	for _, from := range states {
+		for _, to := range states {
+			if got := from.CanTransitTo(to); got != allowed[[2]OrderState{from, to}] {
+				t.Errorf("%s -> %s allowed = %v", from, to, got)
+			}
+		}
+	}
+}
+
+func TestTransition(t *testing.T) {
+	ctx := context.Background()
+	orders, err := NewOrderStore(ctx, testutil.DB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := orders.Create(ctx, &Order{OutTradeNo: "T1", OpenID: "oUser", OrderType: 1, Channel: "jsapi", Amount: 2990}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		to     OrderState
+		change OrderChange
+	}{
+		{OrderPrepaid, OrderChange{Reason: "prepay"}},
+		{OrderPaid, OrderChange{Reason: "notify", TransactionID: "W1", SuccessTime: 1700000000}},
+		{OrderRefunding, OrderChange{Reason: "refund"}},
+		// a partial refund leaves the order paid
+		{OrderPaid, OrderChange{Reason: "partial refund"}},
+		{OrderRefunding, OrderChange{Reason: "refund"}},
+		{OrderRefunded, OrderChange{Reason: "refund notify"}},
+	}
+	var paidAt int64
+	for _, step := range steps {
+		order, err := orders.Transition(ctx, "T1", step.to, step.change)
+		if err != nil || order.State != step.to {
+			t.Fatalf("transition to %s = %+v %v", step.to, order, err)
+		}
+		if paidAt == 0 {
+			paidAt = order.PaidAt
+		} else if order.PaidAt != paidAt {
+			t.Fatalf("paid_at moved from %d to %d", paidAt, order.PaidAt)
+		}
+	}
+
+	// the final state is kept, the current order is returned with the error
+	order, err := orders.Transition(ctx, "T1", OrderPaid, OrderChange{Reason: "late notify", TransactionID: "W2"})
+	if !errors.Is(err, ErrInvalidTransition) || order == nil || order.State != OrderRefunded {
+		t.Fatalf("transition out of refunded = %+v %v", order, err)
+	}
+	if order, _ = orders.Get(ctx, "T1"); order.State != OrderRefunded || order.TransactionID != "W1" || order.SuccessTime != 1700000000 {
+		t.Fatalf("order after transitions %+v", order)
+	}
+	if _, err := orders.Transition(ctx, "T9", OrderPaid, OrderChange{}); !errors.Is(err, ErrOrderNotFound) {
+		t.Fatalf("transition of a missing order = %v", err)
+	}
+
+	events, err := orders.History(ctx, "T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var moves []string
+	for _, event := range events {
+		moves = append(moves, string(event.FromState)+">"+string(event.ToState)+" "+event.Reason)
+	}
+	want := []string{">created ", "created>prepaid prepay", "prepaid>paid notify", "paid>refunding refund",
+		"refunding>paid partial refund", "paid>refunding refund", "refunding>refunded refund notify"}
+	if !slices.Equal(moves, want) {
+		t.Fatalf("history %q", moves)
+	}
+}
+
+func TestListPaidBySuccessTime(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	createTestOrder(t, server, "T1", "oUser", 1)
+	// paid just before midnight, the notify only arrives the next day
+	yesterday := time.Now().In(billLocation).AddDate(0, 0, -1)
+	day := time.Date(yesterday.Year(), yesterday.Month(), yesterday.Day(), 0, 0, 0, 0, billLocation)
+	credit := &paymentCredit{
+		TransactionID: "W1",
+		OutTradeNo:    "T1",
+		Amount:        testProducts[1].Price,
+		Source:        "notify",
+		SuccessTime:   day.Add(24*time.Hour - time.Second).Unix(),
+	}
+	if _, _, err := server.creditPayment(ctx, credit); err != nil {
+		t.Fatal(err)
+	}
+	paid, err := server.Orders.ListPaid(ctx, day.Unix(), day.AddDate(0, 0, 1).Unix())
+	if err != nil || len(paid) != 1 || paid[0].SuccessTime != credit.SuccessTime {
+		t.Fatalf("paid on the day of success_time %+v %v", paid, err)
+	}
+	if paid, _ := server.Orders.ListPaid(ctx, day.AddDate(0, 0, 1).Unix(), day.AddDate(0, 0, 2).Unix()); len(paid) != 0 {
+		t.Fatalf("paid on the day of the notify %+v", paid)
+	}
+}
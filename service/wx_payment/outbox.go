@@ -0,0 +1,312 @@
+package wx_payment
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/platform"
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+	OutboxDead      = "dead"
+
+	outboxBatchSize   = 20
+	outboxMaxAttempts = 10
+	outboxBaseBackoff = 10 * time.Second
+	outboxMaxBackoff  = time.Hour
+	outboxPollPeriod  = 5 * time.Second
+	outboxTimeout     = 10 * time.Second
+	// a batch is delivered one message after another, a worker that is gone
+	// for longer leaves its claims to the others
+	outboxLease = outboxBatchSize*outboxTimeout + time.Minute
+
+	editOrderStatusPath = "/utility-project/ysOrder/editOrderStatus"
+)
+
+// OutboxMessage is a data platform call recorded in the same transaction as
+// the order change that caused it, so that it is delivered at least once.
+// Messages sharing a key are delivered one at a time in the order they were
+// queued.
+type OutboxMessage struct {
+	ID            int64  `json:"id"`
+	Key           string `json:"key"`
+	Path          string `json:"path"`
+	Payload       string `json:"payload"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	NextAttemptAt int64  `json:"next_attempt_at"`
+	ClaimedUntil  int64  `json:"claimed_until"`
+	LastError     string `json:"last_error,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+	UpdatedAt     int64  `json:"updated_at"`
+}
+
+type Outbox struct {
+	db       *sql.DB
+	endpoint string
+	client   *http.Client
+	kick     chan struct{}
+}
+
+var outboxTables = []string{
+	`CREATE TABLE IF NOT EXISTS gateway_outbox (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		message_key VARCHAR(64) NOT NULL DEFAULT '',
+		path VARCHAR(255) NOT NULL,
+		payload TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at BIGINT NOT NULL,
+		claimed_until BIGINT NOT NULL DEFAULT 0,
+		last_error VARCHAR(255) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		KEY idx_status_next (status, next_attempt_at),
+		KEY idx_key_status (message_key, status)
+	)`,
+}
+
+func NewOutbox(ctx context.Context, db *sql.DB, dataPlatformEndpoint string) (*Outbox, error) {
+	for _, ddl := range outboxTables {
+		if _, err := db.ExecContext(ctx, ddl); err != nil {
+			grpclog.Errorf("create outbox table failed error: %v", err)
+			return nil, err
+		}
+	}
+	return &Outbox{
+		db:       db,
+		endpoint: dataPlatformEndpoint,
+		client:   &http.Client{Timeout: outboxTimeout},
+		kick:     make(chan struct{}, 1),
+	}, nil
+}
+
+// EnqueueTx records a POST of payload to the data platform path inside tx,
+// delivered after the earlier messages of key. Call Kick after tx commits to
+// deliver it right away.
+func (o *Outbox) EnqueueTx(ctx context.Context, tx *sql.Tx, key string, path string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO gateway_outbox (message_key, path, payload, status, next_attempt_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?);",
+		key, path, string(body), OutboxPending, now, now, now)
+	if err != nil {
+		grpclog.Errorf("insert outbox %v %v failed error: %v", path, string(body), err)
+	}
+	return err
+}
+
+// EnqueueOrderPaidTx tells the data platform that the order has been paid,
+// which is what upgrades the user. It shares the key of the membership
+// updates of the user, so they arrive in the order they were made.
+func (o *Outbox) EnqueueOrderPaidTx(ctx context.Context, tx *sql.Tx, order *Order) error {
+	return o.EnqueueTx(ctx, tx, order.OpenID, editOrderStatusPath, OrderParam{OrderCode: order.OutTradeNo})
+}
+
+// Kick wakes the worker up without waiting for the next poll.
+func (o *Outbox) Kick() {
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers pending messages until ctx is done.
+func (o *Outbox) Run(ctx context.Context) {
+	t := time.NewTicker(outboxPollPeriod)
+	defer t.Stop()
+	for {
+		// delivering a message lets the next one of its key go
+		for o.deliverBatch(ctx) > 0 {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-o.kick:
+		}
+	}
+}
+
+// deliverBatch sends due messages and returns how many it handled. The
+// messages are claimed in a short transaction and delivered outside of it,
+// so several gateways can share the outbox without holding row locks across
+// http calls.
+func (o *Outbox) deliverBatch(ctx context.Context) int {
+	messages, err := o.claim(ctx)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range messages {
+		err := o.deliver(ctx, &msg)
+		now := time.Now()
+		msg.Attempts++
+		msg.UpdatedAt = now.Unix()
+		if err == nil {
+			msg.Status = OutboxDelivered
+			msg.LastError = ""
+			grpclog.Infof("outbox %v delivered %v after %v attempts", msg.ID, msg.Path, msg.Attempts)
+		} else {
+			msg.LastError = err.Error()
+			if runes := []rune(msg.LastError); len(runes) > 255 {
+				msg.LastError = string(runes[:255])
+			}
+			if msg.Attempts >= outboxMaxAttempts {
+				msg.Status = OutboxDead
+				grpclog.Errorf("outbox %v dead after %v attempts path:%v payload:%v error:%v", msg.ID, msg.Attempts, msg.Path, msg.Payload, err)
+			} else {
+				msg.NextAttemptAt = now.Add(outboxBackoff(msg.Attempts)).Unix()
+				grpclog.Warningf("outbox %v attempt %v failed path:%v error:%v", msg.ID, msg.Attempts, msg.Path, err)
+			}
+		}
+		// a claim that ran out may have been taken over, the new owner reports
+		rs, err := o.db.ExecContext(ctx,
+			"UPDATE gateway_outbox SET status = ?, attempts = ?, next_attempt_at = ?, claimed_until = 0, last_error = ?, updated_at = ? WHERE id = ? AND claimed_until = ?;",
+			msg.Status, msg.Attempts, msg.NextAttemptAt, msg.LastError, msg.UpdatedAt, msg.ID, msg.ClaimedUntil)
+		if err != nil {
+			grpclog.Errorf("outbox update %v failed error: %v", msg.ID, err)
+			return 0
+		}
+		if n, _ := rs.RowsAffected(); n == 0 {
+			grpclog.Warningf("outbox %v claim expired during delivery", msg.ID)
+		}
+	}
+	return len(messages)
+}
+
+// claim leases the due messages that no earlier message of their key is
+// waiting before. Dead messages do not hold their key up.
+func (o *Outbox) claim(ctx context.Context) ([]OutboxMessage, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		grpclog.Errorf("outbox begin tx failed error: %v", err)
+		return nil, err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	rows, err := tx.QueryContext(ctx,
+		selectOutbox+` o WHERE status = ? AND next_attempt_at <= ? AND claimed_until <= ?
+			AND (message_key = '' OR NOT EXISTS (SELECT 1 FROM gateway_outbox p WHERE p.message_key = o.message_key AND p.status = ? AND p.id < o.id))
+			ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED;`,
+		OutboxPending, now.Unix(), now.Unix(), OutboxPending, outboxBatchSize)
+	if err != nil {
+		grpclog.Errorf("outbox query failed error: %v", err)
+		return nil, err
+	}
+	messages, err := scanOutbox(rows)
+	if err != nil {
+		return nil, err
+	}
+	claimedUntil := now.Add(outboxLease).Unix()
+	for i := range messages {
+		_, err := tx.ExecContext(ctx, "UPDATE gateway_outbox SET claimed_until = ? WHERE id = ?;", claimedUntil, messages[i].ID)
+		if err != nil {
+			grpclog.Errorf("outbox claim %v failed error: %v", messages[i].ID, err)
+			return nil, err
+		}
+		messages[i].ClaimedUntil = claimedUntil
+	}
+	if err := tx.Commit(); err != nil {
+		grpclog.Errorf("outbox commit failed error: %v", err)
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (o *Outbox) deliver(ctx context.Context, msg *OutboxMessage) error {
+	url := fmt.Sprintf("http://%s%s", o.endpoint, msg.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader([]byte(msg.Payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d body %s", resp.StatusCode, string(respBody))
+	}
+	// the data platform answers 200 and reports failures in the body
+	var platformResp platformCodeResp
+	if err := json.Unmarshal(respBody, &platformResp); err != nil {
+		return fmt.Errorf("unexpected body %s", string(respBody))
+	}
+	if platformResp.Code != platform.CodeOK {
+		return fmt.Errorf("code %d body %s", platformResp.Code, string(respBody))
+	}
+	grpclog.Infof("outbox %v %v received response:%v", msg.ID, msg.Path, string(respBody))
+	return nil
+}
+
+// platformCodeResp is the envelope shared by the data platform responses.
+type platformCodeResp struct {
+	Code int `json:"code"`
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
+
+// DeadLetters lists the messages that ran out of attempts.
+func (o *Outbox) DeadLetters(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	rows, err := o.db.QueryContext(ctx, selectOutbox+" WHERE status = ? ORDER BY id DESC LIMIT ?;", OutboxDead, limit)
+	if err != nil {
+		grpclog.Errorf("outbox query dead letters failed error: %v", err)
+		return nil, err
+	}
+	return scanOutbox(rows)
+}
+
+// Replay puts a dead message back in the queue with a fresh attempt budget.
+func (o *Outbox) Replay(ctx context.Context, id int64) (int64, error) {
+	now := time.Now().Unix()
+	rs, err := o.db.ExecContext(ctx,
+		"UPDATE gateway_outbox SET status = ?, attempts = 0, next_attempt_at = ?, claimed_until = 0, updated_at = ? WHERE id = ? AND status = ?;",
+		OutboxPending, now, now, id, OutboxDead)
+	if err != nil {
+		grpclog.Errorf("outbox replay %v failed error: %v", id, err)
+		return 0, err
+	}
+	rowsAffected, err := rs.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	o.Kick()
+	return rowsAffected, nil
+}
+
+const selectOutbox = "SELECT id, message_key, path, payload, status, attempts, next_attempt_at, claimed_until, last_error, created_at, updated_at FROM gateway_outbox"
+
+func scanOutbox(rows *sql.Rows) ([]OutboxMessage, error) {
+	defer rows.Close()
+	var messages []OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		if err := rows.Scan(&msg.ID, &msg.Key, &msg.Path, &msg.Payload, &msg.Status, &msg.Attempts,
+			&msg.NextAttemptAt, &msg.ClaimedUntil, &msg.LastError, &msg.CreatedAt, &msg.UpdatedAt); err != nil {
+			grpclog.Errorf("rows scan failed error: %v", err)
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
@@ -0,0 +1,99 @@
+package wx_payment
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkusunjy/grpc-gateway/internal/testutil"
+)
+
+type outboxTestPayload struct {
+	N string `json:"n"`
+}
+
+func TestOutboxDeliversKeyInOrder(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu        sync.Mutex
+		delivered []string
+		failing   = true
+		outbox    *Outbox
+	)
+	platform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p outboxTestPayload
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &p)
+		// the message stays claimed while it is delivered
+		if claimed, err := outbox.claim(ctx); err != nil || len(claimed) != 0 {
+			t.Errorf("claimed %v during delivery %v", claimed, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if p.N == "a1" && failing {
+			w.Write([]byte(`{"code":500,"msg":"busy"}`))
+			return
+		}
+		delivered = append(delivered, p.N)
+		w.Write([]byte(`{"code":200}`))
+	}))
+	defer platform.Close()
+	var err error
+	outbox, err = NewOutbox(ctx, testutil.DB(t), strings.TrimPrefix(platform.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueue := func(key, n string) {
+		tx, err := outbox.db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if err := outbox.EnqueueTx(ctx, tx, key, "/test", outboxTestPayload{N: n}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enqueue("oA", "a1")
+	enqueue("oA", "a2")
+	enqueue("oB", "b1")
+
+	// a2 waits for a1, which fails and backs off
+	if n := outbox.deliverBatch(ctx); n != 2 {
+		t.Fatalf("first batch handled %d", n)
+	}
+	if n := outbox.deliverBatch(ctx); n != 0 {
+		t.Fatalf("batch behind a failed message handled %d", n)
+	}
+	if !slices.Equal(delivered, []string{"b1"}) {
+		t.Fatalf("delivered %v", delivered)
+	}
+	var attempts int
+	var lastError string
+	if err := outbox.db.QueryRow("SELECT attempts, last_error FROM gateway_outbox WHERE payload LIKE '%a1%';").Scan(&attempts, &lastError); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 || !strings.HasPrefix(lastError, "code 500") {
+		t.Fatalf("refused message attempts:%d last_error:%q", attempts, lastError)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if _, err := outbox.db.Exec("UPDATE gateway_outbox SET next_attempt_at = 0;"); err != nil {
+		t.Fatal(err)
+	}
+	for outbox.deliverBatch(ctx) > 0 {
+	}
+	if !slices.Equal(delivered, []string{"b1", "a1", "a2"}) {
+		t.Fatalf("delivered %v", delivered)
+	}
+}
@@ -0,0 +1,118 @@
+package wx_payment
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	"github.com/wechatpay-apiv3/wechatpay-go/services/payments/jsapi"
+	"google.golang.org/grpc/grpclog"
+)
+
+const reconcileBatchSize = 100
+
+// RunReconcile settles orders whose notify never arrived and reconciles the
+// trade bill once a day, until ctx is done.
+func (server WxPaymentServiceImpl) RunReconcile(ctx context.Context) {
+	t := time.NewTicker(*reconcileInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		server.reconcileOrders(ctx)
+		server.reconcileTradeBill(ctx, time.Now())
+	}
+}
+
+func (server WxPaymentServiceImpl) reconcileOrders(ctx context.Context) {
+	now := time.Now()
+	// a prepay that failed without an answer may still have reached wechat
+	created, err := server.Orders.ListStale(ctx, OrderCreated, now.Add(-*orderExpireAfter).Unix(), reconcileBatchSize)
+	if err != nil {
+		return
+	}
+	for _, order := range created {
+		server.reconcileOrder(ctx, &order, now)
+	}
+	prepaid, err := server.Orders.ListStale(ctx, OrderPrepaid, now.Add(-*prepaidQueryAfter).Unix(), reconcileBatchSize)
+	if err != nil {
+		return
+	}
+	for _, order := range prepaid {
+		server.reconcileOrder(ctx, &order, now)
+	}
+}
+
+// reconcileOrder asks wechat what became of a created or prepaid order,
+// crediting it if it was paid and closing it once it expires unpaid. The
+// jsapi query and close endpoints serve orders of every channel.
+func (server WxPaymentServiceImpl) reconcileOrder(ctx context.Context, order *Order, now time.Time) {
+	svc := jsapi.JsapiApiService{Client: server.WxClient}
+	transaction, _, err := svc.QueryOrderByOutTradeNo(ctx, jsapi.QueryOrderByOutTradeNoRequest{
+		OutTradeNo: core.String(order.OutTradeNo),
+		Mchid:      core.String(server.WxMchID),
+	})
+	if err != nil && !isOrderNotExist(err) {
+		grpclog.Errorf("reconcile query order %v failed error:%v", order.OutTradeNo, err)
+		return
+	}
+	tradeState := "NOTPAY"
+	if transaction != nil {
+		tradeState = stringValue(transaction.TradeState)
+	}
+	expired := order.CreatedAt < now.Add(-*orderExpireAfter).Unix()
+	switch tradeState {
+	case "SUCCESS":
+		var amount int64
+		if transaction.Amount != nil {
+			amount = int64Value(transaction.Amount.Total)
+		}
+		result, reason, err := server.creditPayment(ctx, &paymentCredit{
+			TransactionID: stringValue(transaction.TransactionId),
+			OutTradeNo:    order.OutTradeNo,
+			Amount:        amount,
+			Source:        "reconcile",
+			SuccessTime:   parseSuccessTime(transaction.SuccessTime),
+		})
+		if err != nil {
+			grpclog.Errorf("reconcile credit order %v failed error:%v", order.OutTradeNo, err)
+			return
+		}
+		grpclog.Infof("reconcile credited missed notify of order %v result:%v %v", order.OutTradeNo, result, reason)
+	case "CLOSED", "REVOKED", "PAYERROR":
+		server.closeOrderLocally(ctx, order.OutTradeNo, "wechat trade state "+tradeState)
+	case "NOTPAY", "USERPAYING":
+		if !expired {
+			return
+		}
+		if transaction != nil {
+			_, err := svc.CloseOrder(ctx, jsapi.CloseOrderRequest{
+				OutTradeNo: core.String(order.OutTradeNo),
+				Mchid:      core.String(server.WxMchID),
+			})
+			if err != nil {
+				grpclog.Errorf("reconcile close order %v failed error:%v", order.OutTradeNo, err)
+				return
+			}
+		}
+		server.closeOrderLocally(ctx, order.OutTradeNo, "expired unpaid")
+	default:
+		grpclog.Warningf("reconcile order %v left alone in trade state %v", order.OutTradeNo, tradeState)
+	}
+}
+
+func (server WxPaymentServiceImpl) closeOrderLocally(ctx context.Context, outTradeNo string, reason string) {
+	_, err := server.Orders.Transition(ctx, outTradeNo, OrderClosed, OrderChange{Reason: reason})
+	if err != nil {
+		grpclog.Errorf("order %v transition to closed failed error:%v", outTradeNo, err)
+	}
+}
+
+func isOrderNotExist(err error) bool {
+	var apiErr *core.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == "ORDER_NOT_EXIST"
+}
@@ -0,0 +1,39 @@
+package wx_payment
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcileStaleCreatedOrders(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	createTestOrder(t, server, "T1", "oUser", 1)
+	createTestOrder(t, server, "T2", "oUser", 1)
+	// T1 was taken by wechat although its prepay timed out, T2 never got there
+	server.WxClient = newTestWxClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/out-trade-no/T1") {
+			w.Write([]byte(`{"out_trade_no":"T1","transaction_id":"W1","trade_state":"SUCCESS",
+				"success_time":"2026-01-02T03:04:05+08:00","amount":{"total":2990}}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":"ORDER_NOT_EXIST","message":"order not exist"}`))
+	})
+	stale := time.Now().Add(-*orderExpireAfter - time.Minute).Unix()
+	if _, err := server.Orders.db.Exec("UPDATE gateway_order SET created_at = ?, updated_at = ?;", stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	server.reconcileOrders(ctx)
+	if order, _ := server.Orders.Get(ctx, "T1"); order.State != OrderPaid || order.TransactionID != "W1" {
+		t.Fatalf("order paid at wechat %+v", order)
+	}
+	if order, _ := server.Orders.Get(ctx, "T2"); order.State != OrderClosed {
+		t.Fatalf("order unknown to wechat %v", order.State)
+	}
+}
@@ -0,0 +1,354 @@
+package wx_payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	"github.com/wechatpay-apiv3/wechatpay-go/services/refunddomestic"
+	"google.golang.org/grpc/grpclog"
+)
+
+type RefundStatus string
+
+// refund statuses follow the ones wechat reports
+const (
+	RefundProcessing RefundStatus = "PROCESSING"
+	RefundSuccess    RefundStatus = "SUCCESS"
+	RefundClosed     RefundStatus = "CLOSED"
+	RefundAbnormal   RefundStatus = "ABNORMAL"
+
+	saveCustomerPath = "/utility-project/ysCustomer/save"
+)
+
+var ErrRefundNotFound = errors.New("refund not found")
+
+func (s RefundStatus) Terminal() bool {
+	return s == RefundSuccess || s == RefundClosed || s == RefundAbnormal
+}
+
+// Refund is the gateway side record of one refund of an order, amounts are
+// in fen and times in unix seconds.
+type Refund struct {
+	OutRefundNo string       `json:"out_refund_no"`
+	OutTradeNo  string       `json:"out_trade_no"`
+	RefundID    string       `json:"refund_id,omitempty"`
+	Amount      int64        `json:"amount"`
+	Status      RefundStatus `json:"status"`
+	Reason      string       `json:"reason,omitempty"`
+	CreatedAt   int64        `json:"created_at"`
+	UpdatedAt   int64        `json:"updated_at"`
+	SucceededAt int64        `json:"succeeded_at,omitempty"`
+}
+
+var refundTables = []string{
+	`CREATE TABLE IF NOT EXISTS gateway_refund (
+		out_refund_no VARCHAR(64) NOT NULL PRIMARY KEY,
+		out_trade_no VARCHAR(64) NOT NULL,
+		refund_id VARCHAR(64) NOT NULL DEFAULT '',
+		amount BIGINT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		reason VARCHAR(80) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		succeeded_at BIGINT NOT NULL DEFAULT 0,
+		KEY idx_out_trade_no (out_trade_no)
+	)`,
+}
+
+type RefundStore struct {
+	db *sql.DB
+}
+
+func NewRefundStore(ctx context.Context, db *sql.DB) (*RefundStore, error) {
+	for _, ddl := range refundTables {
+		if _, err := db.ExecContext(ctx, ddl); err != nil {
+			grpclog.Errorf("create refund table failed error: %v", err)
+			return nil, err
+		}
+	}
+	return &RefundStore{db: db}, nil
+}
+
+func (s *RefundStore) CreateTx(ctx context.Context, tx *sql.Tx, refund *Refund) error {
+	now := time.Now().Unix()
+	refund.Status = RefundProcessing
+	refund.CreatedAt = now
+	refund.UpdatedAt = now
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO gateway_refund (out_refund_no, out_trade_no, amount, status, reason, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?);",
+		refund.OutRefundNo, refund.OutTradeNo, refund.Amount, refund.Status, refund.Reason, now, now)
+	if err != nil {
+		grpclog.Errorf("insert refund %v failed error: %v", refund.OutRefundNo, err)
+	}
+	return err
+}
+
+func (s *RefundStore) LockTx(ctx context.Context, tx *sql.Tx, outRefundNo string) (*Refund, error) {
+	return scanRefund(tx.QueryRowContext(ctx, selectRefund+" WHERE out_refund_no = ? FOR UPDATE;", outRefundNo))
+}
+
+func (s *RefundStore) UpdateTx(ctx context.Context, tx *sql.Tx, refund *Refund) error {
+	refund.UpdatedAt = time.Now().Unix()
+	_, err := tx.ExecContext(ctx,
+		"UPDATE gateway_refund SET refund_id = ?, status = ?, updated_at = ?, succeeded_at = ? WHERE out_refund_no = ?;",
+		refund.RefundID, refund.Status, refund.UpdatedAt, refund.SucceededAt, refund.OutRefundNo)
+	if err != nil {
+		grpclog.Errorf("update refund %v failed error: %v", refund.OutRefundNo, err)
+	}
+	return err
+}
+
+// RefundedTx sums the refunds of an order that succeeded or may still
+// succeed, which is what can no longer be refunded.
+func (s *RefundStore) RefundedTx(ctx context.Context, tx *sql.Tx, outTradeNo string) (int64, error) {
+	var refunded int64
+	err := tx.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(amount), 0) FROM gateway_refund WHERE out_trade_no = ? AND status IN (?, ?);",
+		outTradeNo, RefundProcessing, RefundSuccess).Scan(&refunded)
+	if err != nil {
+		grpclog.Errorf("sum refunds of %v failed error: %v", outTradeNo, err)
+	}
+	return refunded, err
+}
+
+func (s *RefundStore) Get(ctx context.Context, outRefundNo string) (*Refund, error) {
+	return scanRefund(s.db.QueryRowContext(ctx, selectRefund+" WHERE out_refund_no = ?;", outRefundNo))
+}
+
+const selectRefund = "SELECT out_refund_no, out_trade_no, refund_id, amount, status, reason, created_at, updated_at, succeeded_at FROM gateway_refund"
+
+func scanRefund(row *sql.Row) (*Refund, error) {
+	var refund Refund
+	err := row.Scan(&refund.OutRefundNo, &refund.OutTradeNo, &refund.RefundID, &refund.Amount, &refund.Status,
+		&refund.Reason, &refund.CreatedAt, &refund.UpdatedAt, &refund.SucceededAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRefundNotFound
+	}
+	if err != nil {
+		grpclog.Errorf("scan refund failed error: %v", err)
+		return nil, err
+	}
+	return &refund, nil
+}
+
+type CreateRefundRequest struct {
+	OutTradeNo string `json:"out_trade_no,omitempty"`
+	// Amount in fen, zero refunds whatever is left of the order
+	Amount int64  `json:"amount,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type RefundResponse struct {
+	Refund *Refund `json:"refund"`
+	Order  *Order  `json:"order"`
+}
+
+// CreateRefund refunds an order fully or partially. The order stays in
+// refunding until wechat reports the outcome, so that only one refund of an
+// order is in flight at a time.
+func (server WxPaymentServiceImpl) CreateRefund(ctx context.Context, req *CreateRefundRequest) (*RefundResponse, error) {
+	outRefundNo, err := GenRandomStr()
+	if err != nil || outRefundNo == nil {
+		grpclog.Errorf("generate out_refund_no failed error:%v", err)
+		return nil, err
+	}
+	refund := &Refund{
+		OutRefundNo: *outRefundNo,
+		OutTradeNo:  req.OutTradeNo,
+		Amount:      req.Amount,
+		Reason:      req.Reason,
+	}
+	order, err := server.beginRefund(ctx, refund)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := refunddomestic.RefundsApiService{Client: server.WxClient}
+	createReq := refunddomestic.CreateRequest{
+		OutTradeNo:  core.String(order.OutTradeNo),
+		OutRefundNo: core.String(refund.OutRefundNo),
+		NotifyUrl:   core.String(*refundNotifyUrl),
+		Amount: &refunddomestic.AmountReq{
+			Refund:   core.Int64(refund.Amount),
+			Total:    core.Int64(order.Amount),
+			Currency: core.String("CNY"),
+		},
+	}
+	if len(refund.Reason) != 0 {
+		createReq.Reason = core.String(refund.Reason)
+	}
+	wxRefund, _, err := svc.Create(ctx, createReq)
+	var apiErr *core.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode/100 == 4 {
+		// wechat turned the refund down, nothing was refunded
+		grpclog.Errorf("refund %v of order %v refused error:%v", refund.OutRefundNo, order.OutTradeNo, err)
+		if _, applyErr := server.applyRefundStatus(ctx, refund.OutRefundNo, "", RefundClosed, "create refused"); applyErr != nil {
+			grpclog.Errorf("refund %v close failed error:%v", refund.OutRefundNo, applyErr)
+		}
+		return nil, common.NewHTTPError(http.StatusBadGateway, "create refund failed: %v", err)
+	}
+	if err != nil {
+		// wechat may have taken the refund, the notify or RefundQuery settles it
+		grpclog.Errorf("refund %v of order %v create failed error:%v", refund.OutRefundNo, order.OutTradeNo, err)
+		return nil, common.NewHTTPError(http.StatusBadGateway, "refund %s left processing, query it later: %v", refund.OutRefundNo, err)
+	}
+	return server.applyWxRefund(ctx, wxRefund, "create")
+}
+
+// beginRefund checks the refund against what is left of the order and
+// moves the order to refunding.
+func (server WxPaymentServiceImpl) beginRefund(ctx context.Context, refund *Refund) (*Order, error) {
+	tx, err := server.Orders.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	order, err := server.Orders.LockTx(ctx, tx, refund.OutTradeNo)
+	if errors.Is(err, ErrOrderNotFound) {
+		return nil, common.NewHTTPError(http.StatusNotFound, "order %s not found", refund.OutTradeNo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if order.State != OrderPaid {
+		return nil, common.NewHTTPError(http.StatusConflict, "order %s is %s", order.OutTradeNo, order.State)
+	}
+	if len(order.TransactionID) == 0 {
+		return nil, common.NewHTTPError(http.StatusConflict, "order %s was not paid through wechat", order.OutTradeNo)
+	}
+	refunded, err := server.Refunds.RefundedTx(ctx, tx, order.OutTradeNo)
+	if err != nil {
+		return nil, err
+	}
+	left := order.Amount - refunded
+	if refund.Amount == 0 {
+		refund.Amount = left
+	}
+	if refund.Amount <= 0 || refund.Amount > left {
+		return nil, common.NewHTTPError(http.StatusBadRequest, "refund amount %d exceeds %d left of order %s", refund.Amount, left, order.OutTradeNo)
+	}
+	if err := server.Refunds.CreateTx(ctx, tx, refund); err != nil {
+		return nil, err
+	}
+	order, err = server.Orders.TransitionTx(ctx, tx, order.OutTradeNo, OrderRefunding, OrderChange{Reason: "refund " + refund.OutRefundNo})
+	if err != nil {
+		return nil, err
+	}
+	return order, tx.Commit()
+}
+
+type RefundQueryRequest struct {
+	OutRefundNo string `json:"out_refund_no,omitempty"`
+}
+
+// RefundQuery asks wechat for the status of a refund, which also settles
+// refunds whose notify never arrived.
+func (server WxPaymentServiceImpl) RefundQuery(ctx context.Context, req *RefundQueryRequest) (*RefundResponse, error) {
+	refund, err := server.Refunds.Get(ctx, req.OutRefundNo)
+	if errors.Is(err, ErrRefundNotFound) {
+		return nil, common.NewHTTPError(http.StatusNotFound, "refund %s not found", req.OutRefundNo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if refund.Status.Terminal() {
+		order, err := server.Orders.Get(ctx, refund.OutTradeNo)
+		if err != nil {
+			return nil, err
+		}
+		return &RefundResponse{Refund: refund, Order: order}, nil
+	}
+	svc := refunddomestic.RefundsApiService{Client: server.WxClient}
+	wxRefund, _, err := svc.QueryByOutRefundNo(ctx, refunddomestic.QueryByOutRefundNoRequest{
+		OutRefundNo: core.String(req.OutRefundNo),
+	})
+	if isRefundNotExist(err) {
+		// the create request never reached wechat
+		return server.applyRefundStatus(ctx, req.OutRefundNo, "", RefundClosed, "query")
+	}
+	if err != nil {
+		grpclog.Errorf("refund %v query failed error:%v", req.OutRefundNo, err)
+		return nil, common.NewHTTPError(http.StatusBadGateway, "query refund failed: %v", err)
+	}
+	return server.applyWxRefund(ctx, wxRefund, "query")
+}
+
+func isRefundNotExist(err error) bool {
+	var apiErr *core.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == "RESOURCE_NOT_EXISTS"
+}
+
+func (server WxPaymentServiceImpl) applyWxRefund(ctx context.Context, wxRefund *refunddomestic.Refund, source string) (*RefundResponse, error) {
+	var status RefundStatus
+	if wxRefund.Status != nil {
+		status = RefundStatus(*wxRefund.Status)
+	}
+	return server.applyRefundStatus(ctx, stringValue(wxRefund.OutRefundNo), stringValue(wxRefund.RefundId), status, source)
+}
+
+// applyRefundStatus records the status wechat reports for a refund. Once the
+// refund is settled the order leaves refunding: a refund that completes the
+// order refunds it and revokes the membership, anything else puts it back
+// to paid. Settled refunds are left untouched so repeated reports are harmless.
+func (server WxPaymentServiceImpl) applyRefundStatus(ctx context.Context, outRefundNo string, refundID string, status RefundStatus, source string) (*RefundResponse, error) {
+	tx, err := server.Orders.BeginTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	refund, err := server.Refunds.LockTx(ctx, tx, outRefundNo)
+	if err != nil {
+		return nil, err
+	}
+	order, err := server.Orders.LockTx(ctx, tx, refund.OutTradeNo)
+	if err != nil {
+		return nil, err
+	}
+	if refund.Status.Terminal() || !status.Terminal() {
+		return &RefundResponse{Refund: refund, Order: order}, nil
+	}
+	refund.Status = status
+	if len(refundID) != 0 {
+		refund.RefundID = refundID
+	}
+	if status == RefundSuccess {
+		refund.SucceededAt = time.Now().Unix()
+	}
+	if err := server.Refunds.UpdateTx(ctx, tx, refund); err != nil {
+		return nil, err
+	}
+	to := OrderPaid
+	if status == RefundSuccess {
+		refunded, err := server.Refunds.RefundedTx(ctx, tx, order.OutTradeNo)
+		if err != nil {
+			return nil, err
+		}
+		if refunded >= order.Amount {
+			to = OrderRefunded
+		}
+	}
+	reason := fmt.Sprintf("refund %s %s by %s", refund.OutRefundNo, status, source)
+	order, err = server.Orders.TransitionTx(ctx, tx, order.OutTradeNo, to, OrderChange{Reason: reason})
+	if err != nil {
+		return nil, err
+	}
+	if to == OrderRefunded {
+		if err := server.revokeSubscriptionTx(ctx, tx, order); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if to == OrderRefunded {
+		server.Outbox.Kick()
+	}
+	grpclog.Infof("refund %v of order %v settled %v, order %v", refund.OutRefundNo, order.OutTradeNo, status, order.State)
+	return &RefundResponse{Refund: refund, Order: order}, nil
+}
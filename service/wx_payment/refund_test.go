@@ -0,0 +1,94 @@
+package wx_payment
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// paidTestOrder stores a monthly order of openid paid by transactionID.
+func paidTestOrder(t *testing.T, server *WxPaymentServiceImpl, outTradeNo, openid, transactionID string) {
+	t.Helper()
+	createTestOrder(t, server, outTradeNo, openid, 1)
+	credit := &paymentCredit{TransactionID: transactionID, OutTradeNo: outTradeNo, Amount: testProducts[1].Price, Source: "notify"}
+	if result, reason, err := server.creditPayment(context.Background(), credit); err != nil || result != notifyResultProcessed {
+		t.Fatalf("credit %v = %v %v %v", outTradeNo, result, reason, err)
+	}
+}
+
+// wechatRefundHandler answers refund creation with status and body, and
+// reports the out_refund_no asked for.
+func wechatRefundHandler(status int, body string, outRefundNo *string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			OutRefundNo string `json:"out_refund_no"`
+		}
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &req)
+		*outRefundNo = req.OutRefundNo
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if len(body) == 0 {
+			data, _ := json.Marshal(map[string]any{"out_refund_no": req.OutRefundNo, "refund_id": "R" + req.OutRefundNo, "status": "SUCCESS"})
+			body = string(data)
+		}
+		w.Write([]byte(body))
+	}
+}
+
+func TestCreateRefundClosesOnlyRefused(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	paidTestOrder(t, server, "T1", "oUser", "W1")
+
+	var outRefundNo string
+	server.WxClient = newTestWxClient(t, wechatRefundHandler(http.StatusBadRequest, `{"code":"PARAM_ERROR","message":"refused"}`, &outRefundNo))
+	if _, err := server.CreateRefund(ctx, &CreateRefundRequest{OutTradeNo: "T1"}); err == nil {
+		t.Fatal("refused refund succeeded")
+	}
+	if refund, _ := server.Refunds.Get(ctx, outRefundNo); refund == nil || refund.Status != RefundClosed {
+		t.Fatalf("refused refund %+v", refund)
+	}
+	if order, _ := server.Orders.Get(ctx, "T1"); order.State != OrderPaid {
+		t.Fatalf("order after refused refund %v", order.State)
+	}
+
+	// wechat may have refunded despite the error
+	server.WxClient = newTestWxClient(t, wechatRefundHandler(http.StatusInternalServerError, `{"code":"SYSTEM_ERROR","message":"busy"}`, &outRefundNo))
+	if _, err := server.CreateRefund(ctx, &CreateRefundRequest{OutTradeNo: "T1"}); err == nil {
+		t.Fatal("failed refund succeeded")
+	}
+	if refund, _ := server.Refunds.Get(ctx, outRefundNo); refund == nil || refund.Status != RefundProcessing {
+		t.Fatalf("failed refund %+v", refund)
+	}
+	if order, _ := server.Orders.Get(ctx, "T1"); order.State != OrderRefunding {
+		t.Fatalf("order after failed refund %v", order.State)
+	}
+}
+
+func TestRefundRevokesMembership(t *testing.T) {
+	server, platform := newTestPayment(t)
+	ctx := context.Background()
+	paidTestOrder(t, server, "T1", "oUser", "W1")
+	deliverOutbox(server)
+	if until := server.memberValidUntil("oUser"); until <= time.Now().Unix() {
+		t.Fatalf("paid member valid until %v", until)
+	}
+
+	var outRefundNo string
+	server.WxClient = newTestWxClient(t, wechatRefundHandler(http.StatusOK, "", &outRefundNo))
+	resp, err := server.CreateRefund(ctx, &CreateRefundRequest{OutTradeNo: "T1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Refund.Status != RefundSuccess || resp.Order.State != OrderRefunded {
+		t.Fatalf("refund %+v order %+v", resp.Refund, resp.Order)
+	}
+	deliverOutbox(server)
+	if until := server.memberValidUntil("oUser"); until > time.Now().Unix() {
+		t.Fatalf("refunded member still valid until %v, saved %v", until, platform.Bodies(saveCustomerPath))
+	}
+}
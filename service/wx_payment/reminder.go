@@ -0,0 +1,157 @@
+package wx_payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/platform"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	stableTokenUrl      = "https://api.weixin.qq.com/cgi-bin/stable_token"
+	subscribeSendUrl    = "https://api.weixin.qq.com/cgi-bin/message/subscribe/send?access_token="
+	accessTokenCacheKey = "wx_payment:access_token"
+
+	// the user has not accepted the template or used up the acceptance
+	errcodeSubscribeRefused = 43101
+	errcodeTokenInvalid     = 40001
+)
+
+// RenewalReminder sends renewal reminders as mini program subscribe
+// messages. Data maps the template fields to values in which {plan},
+// {period_end} and {days_left} are replaced.
+type RenewalReminder struct {
+	RemindDays       int               `yaml:"remind_days"`
+	TemplateID       string            `yaml:"template_id"`
+	Page             string            `yaml:"page"`
+	MiniprogramState string            `yaml:"miniprogram_state"`
+	Data             map[string]string `yaml:"data"`
+	appID            string
+	secret           string
+	redisClient      *redis.Client
+}
+
+// wxError is the error part of every api.weixin.qq.com response.
+type wxError struct {
+	Errcode int    `json:"errcode"`
+	Errmsg  string `json:"errmsg"`
+}
+
+func (e *wxError) Error() string {
+	return fmt.Sprintf("errcode:%d errmsg:%s", e.Errcode, e.Errmsg)
+}
+
+func NewRenewalReminder(path string, appID string, secret string, redisClient *redis.Client) (*RenewalReminder, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reminder := RenewalReminder{appID: appID, secret: secret, redisClient: redisClient}
+	if err := yaml.Unmarshal(content, &reminder); err != nil {
+		return nil, err
+	}
+	if reminder.RemindDays <= 0 {
+		reminder.RemindDays = 3
+	}
+	return &reminder, nil
+}
+
+// Enabled is false until a template is configured.
+func (r *RenewalReminder) Enabled() bool {
+	return len(r.TemplateID) != 0
+}
+
+// Ahead is how long before the end of a period users are reminded.
+func (r *RenewalReminder) Ahead() time.Duration {
+	return time.Duration(r.RemindDays) * 24 * time.Hour
+}
+
+func (r *RenewalReminder) Send(ctx context.Context, sub *Subscription, product Product) error {
+	periodEnd := time.Unix(sub.CurrentPeriodEnd, 0).In(billLocation)
+	daysLeft := int(time.Until(periodEnd).Hours()/24) + 1
+	replacer := strings.NewReplacer(
+		"{plan}", product.Description,
+		"{period_end}", periodEnd.Format(datetimeLayout),
+		"{days_left}", strconv.Itoa(daysLeft),
+	)
+	data := make(map[string]map[string]string, len(r.Data))
+	for field, value := range r.Data {
+		data[field] = map[string]string{"value": replacer.Replace(value)}
+	}
+	reqBody, _ := json.Marshal(map[string]any{
+		"touser":            sub.OpenID,
+		"template_id":       r.TemplateID,
+		"page":              r.Page,
+		"miniprogram_state": r.MiniprogramState,
+		"lang":              "zh_CN",
+		"data":              data,
+	})
+	token, err := r.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.post(subscribeSendUrl+url.QueryEscape(token), reqBody, nil)
+	var wxErr *wxError
+	if errors.As(err, &wxErr) && wxErr.Errcode == errcodeTokenInvalid {
+		// refreshed elsewhere, the next run fetches a new one
+		r.redisClient.Del(ctx, accessTokenCacheKey)
+	}
+	return err
+}
+
+// accessToken returns the cached access token, stable_token keeps tokens
+// fetched by other services of the app valid.
+func (r *RenewalReminder) accessToken(ctx context.Context) (string, error) {
+	if token, err := r.redisClient.Get(ctx, accessTokenCacheKey).Result(); err == nil && len(token) != 0 {
+		return token, nil
+	}
+	reqBody, _ := json.Marshal(map[string]string{
+		"grant_type": "client_credential",
+		"appid":      r.appID,
+		"secret":     r.secret,
+	})
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := r.post(stableTokenUrl, reqBody, &resp); err != nil {
+		return "", err
+	}
+	ttl := time.Duration(resp.ExpiresIn-300) * time.Second
+	if ttl > 0 {
+		r.redisClient.Set(ctx, accessTokenCacheKey, resp.AccessToken, ttl)
+	}
+	return resp.AccessToken, nil
+}
+
+func (r *RenewalReminder) post(postUrl string, reqBody []byte, v any) error {
+	respBody, err := platform.DoHttpPost(postUrl, reqBody)
+	if err != nil {
+		return err
+	}
+	var wxErr wxError
+	if err := json.Unmarshal(respBody, &wxErr); err != nil {
+		return fmt.Errorf("unexpected response %s", string(respBody))
+	}
+	if wxErr.Errcode != 0 {
+		return &wxErr
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, v)
+}
+
+func isReminderRefused(err error) bool {
+	var wxErr *wxError
+	return errors.As(err, &wxErr) && wxErr.Errcode == errcodeSubscribeRefused
+}
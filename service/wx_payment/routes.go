@@ -0,0 +1,100 @@
+package wx_payment
+
+import (
+	"net/http"
+
+	"github.com/pkusunjy/grpc-gateway/service/router"
+	"github.com/pkusunjy/grpc-gateway/service/validation"
+)
+
+var orderHistoryRules = validation.Rules{
+	"out_trade_no": "required,max=64",
+}
+
+var prepayRules = validation.Rules{
+	"order_type":  "required",
+	"amount":      "min=0",
+	"coupon_code": "max=32",
+}
+
+var h5PrepayRules = validation.Rules{
+	"order_type":  "required",
+	"amount":      "min=0",
+	"coupon_code": "max=32",
+	"scene_type":  "oneof=iOS Android Wap",
+}
+
+var createRefundRules = validation.Rules{
+	"out_trade_no": "required,max=64",
+	"amount":       "min=0",
+	"reason":       "max=80",
+}
+
+var refundQueryRules = validation.Rules{
+	"out_refund_no": "required,max=64",
+}
+
+var billMismatchesRules = validation.Rules{
+	"bill_date": "required,max=10",
+}
+
+var saveCouponRules = validation.Rules{
+	"code":      "required,max=32",
+	"kind":      "oneof=fixed percent",
+	"value":     "min=1",
+	"starts_at": "required",
+	"ends_at":   "required",
+}
+
+var couponRules = validation.Rules{
+	"code": "required,max=32",
+}
+
+var outboxDeadLettersRules = validation.Rules{
+	"limit": "min=0,max=500",
+}
+
+var rejectedCreditsRules = validation.Rules{
+	"limit": "min=0,max=500",
+}
+
+var outboxReplayRules = validation.Rules{
+	"id": "required,min=1",
+}
+
+func (server NotifyServiceImpl) Routes() []router.Route {
+	return []router.Route{
+		router.Raw(http.MethodPost, "/wx_payment_notify/jsapi_notify_url", router.AuthNone, func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			server.NotifyWxPayment(&ctx, w, r)
+		}),
+		router.Raw(http.MethodPost, "/wx_payment_notify/refund_notify_url", router.AuthNone, func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			server.NotifyWxRefund(&ctx, w, r)
+		}),
+	}
+}
+
+func (server WxPaymentServiceImpl) Routes() []router.Route {
+	return []router.Route{
+		router.Guard(http.MethodPost, jsapiPath, router.AuthUser),
+		router.JSON(http.MethodGet, "/wx_payment/products", router.AuthNone, nil, server.Products),
+		router.JSON(http.MethodPost, "/wx_payment/native_prepay", router.AuthUser, prepayRules, server.NativePrepay),
+		router.JSON(http.MethodPost, "/wx_payment/h5_prepay", router.AuthUser, h5PrepayRules, server.H5Prepay),
+		router.JSON(http.MethodGet, "/wx_payment/subscription", router.AuthUser, nil, server.GetSubscription),
+		router.JSON(http.MethodPost, "/wx_payment/subscription_renewal", router.AuthUser, nil, server.SetSubscriptionRenewal),
+		router.JSON(http.MethodGet, "/wx_payment/order_history", router.AuthAdmin, orderHistoryRules, server.OrderHistory),
+		router.JSON(http.MethodPost, "/wx_payment/refund", router.AuthAdmin, createRefundRules, server.CreateRefund),
+		router.JSON(http.MethodGet, "/wx_payment/refund_query", router.AuthAdmin, refundQueryRules, server.RefundQuery),
+		router.JSON(http.MethodPost, "/wx_payment/coupon", router.AuthAdmin, saveCouponRules, server.SaveCoupon),
+		router.JSON(http.MethodGet, "/wx_payment/coupon", router.AuthAdmin, couponRules, server.GetCoupon),
+		router.JSON(http.MethodGet, "/wx_payment/bill_mismatches", router.AuthAdmin, billMismatchesRules, server.BillMismatches),
+		router.JSON(http.MethodPost, "/wx_payment/reconcile_bill", router.AuthAdmin, billMismatchesRules, server.ReconcileBill),
+		router.Raw(http.MethodGet, "/wx_payment/cert_health", router.AuthNone, server.CertHealth),
+		router.JSON(http.MethodGet, "/wx_payment/cert_status", router.AuthAdmin, nil, server.CertStatus),
+		router.JSON(http.MethodPost, "/wx_payment/cert_refresh", router.AuthAdmin, nil, server.CertRefresh),
+		router.JSON(http.MethodGet, "/wx_payment/outbox_dead_letters", router.AuthAdmin, outboxDeadLettersRules, server.OutboxDeadLetters),
+		router.JSON(http.MethodPost, "/wx_payment/outbox_replay", router.AuthAdmin, outboxReplayRules, server.OutboxReplay),
+		router.JSON(http.MethodGet, "/wx_payment/rejected_credits", router.AuthAdmin, rejectedCreditsRules, server.RejectedCredits),
+	}
+}
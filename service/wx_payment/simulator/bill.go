@@ -0,0 +1,95 @@
+package simulator
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var tradeBillHeader = []string{
+	"交易时间", "公众账号ID", "商户号", "特约商户号", "设备号", "微信订单号", "商户订单号", "用户标识", "交易类型", "交易状态",
+	"付款银行", "货币种类", "应结订单金额", "代金券金额", "微信退款单号", "商户退款单号", "退款金额", "充值券退款金额", "退款类型",
+	"退款状态", "商品名称", "商户数据包", "手续费", "费率", "订单金额", "申请退款金额", "费率备注",
+}
+
+// tradeBill builds the SUCCESS bill of the orders paid on bill_date and
+// answers where to download it.
+func (s *Simulator) tradeBill(w http.ResponseWriter, r *http.Request) {
+	billDate := r.URL.Query().Get("bill_date")
+	day, err := time.ParseInLocation("2006-01-02", billDate, location)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "bill_date "+billDate)
+		return
+	}
+	if !day.AddDate(0, 0, 1).Before(time.Now()) {
+		s.writeError(w, http.StatusBadRequest, "NO_STATEMENT_EXIST", "bill of "+billDate+" is not ready")
+		return
+	}
+
+	s.mu.Lock()
+	var paid []*Transaction
+	for _, tx := range s.transactions {
+		if len(tx.TransactionID) != 0 && !tx.SuccessTime.Before(day) && tx.SuccessTime.Before(day.AddDate(0, 0, 1)) {
+			paid = append(paid, tx)
+		}
+	}
+	sort.Slice(paid, func(i, j int) bool { return paid[i].SuccessTime.Before(paid[j].SuccessTime) })
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(tradeBillHeader)
+	var total int64
+	for _, tx := range paid {
+		amount := yuan(tx.Total)
+		writer.Write(billRow(
+			tx.SuccessTime.In(location).Format("2006-01-02 15:04:05"), s.AppID, s.MchID, "0", "", tx.TransactionID, tx.OutTradeNo,
+			tx.OpenID, tx.TradeType, StateSuccess, "OTHERS", "CNY", amount, "0.00", "0", "0", "0.00", "0.00", "", "",
+			tx.Description, tx.Attach, "0.00000", "0.60%", amount, "0.00", "",
+		))
+		total += tx.Total
+	}
+	writer.Write([]string{"总交易单数", "应结订单总金额", "退款总金额", "充值券退款总金额", "手续费总金额", "订单总金额", "申请退款总金额"})
+	writer.Write(billRow(fmt.Sprint(len(paid)), yuan(total), "0.00", "0.00", "0.00000", yuan(total), "0.00"))
+	writer.Flush()
+	token := randomHex(16)
+	s.bills[token] = buf.Bytes()
+	s.mu.Unlock()
+
+	sum := sha1.Sum(buf.Bytes())
+	s.writeJSON(w, http.StatusOK, map[string]string{
+		"hash_type":    "SHA1",
+		"hash_value":   hex.EncodeToString(sum[:]),
+		"download_url": "https://" + apiHost + "/v3/billdownload/file?token=" + token,
+	})
+}
+
+// downloadBill serves a bill built by tradeBill, unsigned like wechat does.
+func (s *Simulator) downloadBill(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, ok := s.bills[r.URL.Query().Get("token")]
+	s.mu.Unlock()
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "RESOURCE_NOT_EXISTS", "bill not exist")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(content)
+}
+
+// billRow prefixes values with a backquote, as wechat does to keep
+// spreadsheets from reading them as numbers.
+func billRow(values ...string) []string {
+	row := make([]string, len(values))
+	for i, v := range values {
+		row[i] = "`" + v
+	}
+	return row
+}
+
+func yuan(fen int64) string {
+	return fmt.Sprintf("%d.%02d", fen/100, fen%100)
+}
@@ -0,0 +1,42 @@
+package simulator
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"time"
+)
+
+// certificates lists the platform certificate encrypted with the apiv3 key,
+// so that the certificate download of wx_payment can be tested by leaving
+// out wx_payment.WithPlatformCertificates.
+func (s *Simulator) certificates(w http.ResponseWriter, r *http.Request) {
+	block, err := aes.NewCipher([]byte(s.APIv3Key))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "SYSTEM_ERROR", err.Error())
+		return
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "SYSTEM_ERROR", err.Error())
+		return
+	}
+	nonce := randomHex(6)
+	plaintext := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.PlatformCertificate.Raw})
+	ciphertext := aead.Seal(nil, []byte(nonce), plaintext, []byte("certificate"))
+	s.writeJSON(w, http.StatusOK, map[string]any{
+		"data": []map[string]any{{
+			"serial_no":      s.PlatformSerialNo,
+			"effective_time": s.PlatformCertificate.NotBefore.In(location).Format(time.RFC3339),
+			"expire_time":    s.PlatformCertificate.NotAfter.In(location).Format(time.RFC3339),
+			"encrypt_certificate": map[string]string{
+				"algorithm":       "AEAD_AES_256_GCM",
+				"nonce":           nonce,
+				"associated_data": "certificate",
+				"ciphertext":      base64.StdEncoding.EncodeToString(ciphertext),
+			},
+		}},
+	})
+}
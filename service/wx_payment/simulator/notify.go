@@ -0,0 +1,74 @@
+package simulator
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// SendNotify encrypts content with the apiv3 key, signs it with the platform
+// key and posts it to url the way wechat does. It fails unless the notify is
+// acknowledged with 2xx. Tests may call it directly to send notifies that
+// wechat would not, e.g. duplicates.
+func (s *Simulator) SendNotify(url string, eventType string, originalType string, summary string, content any) error {
+	plaintext, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher([]byte(s.APIv3Key))
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	nonce := randomHex(6)
+	ciphertext := aead.Seal(nil, []byte(nonce), plaintext, []byte(originalType))
+	body, err := json.Marshal(map[string]any{
+		"id":            randomHex(16),
+		"create_time":   time.Now().In(location).Format(time.RFC3339),
+		"event_type":    eventType,
+		"resource_type": "encrypt-resource",
+		"summary":       summary,
+		"resource": map[string]string{
+			"algorithm":       "AEAD_AES_256_GCM",
+			"ciphertext":      base64.StdEncoding.EncodeToString(ciphertext),
+			"associated_data": originalType,
+			"nonce":           nonce,
+			"original_type":   originalType,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	target, err := s.notifyUrl(url)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := s.sign(req.Header, body); err != nil {
+		return err
+	}
+	resp, err := s.notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("notify %s %s answered %d: %s", eventType, target, resp.StatusCode, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	RefundProcessing = "PROCESSING"
+	RefundSuccess    = "SUCCESS"
+	RefundClosed     = "CLOSED"
+	RefundAbnormal   = "ABNORMAL"
+)
+
+// Refund stays PROCESSING until CompleteRefund settles it.
+type Refund struct {
+	OutRefundNo   string
+	RefundID      string
+	OutTradeNo    string
+	TransactionID string
+	Reason        string
+	NotifyUrl     string
+	Amount        int64
+	Total         int64
+	Status        string
+	CreateTime    time.Time
+	SuccessTime   time.Time
+}
+
+type refundRequest struct {
+	TransactionId string `json:"transaction_id"`
+	OutTradeNo    string `json:"out_trade_no"`
+	OutRefundNo   string `json:"out_refund_no"`
+	Reason        string `json:"reason"`
+	NotifyUrl     string `json:"notify_url"`
+	Amount        struct {
+		Refund   int64  `json:"refund"`
+		Total    int64  `json:"total"`
+		Currency string `json:"currency"`
+	} `json:"amount"`
+}
+
+func (s *Simulator) createRefund(w http.ResponseWriter, r *http.Request) {
+	var req refundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", err.Error())
+		return
+	}
+	if len(req.OutRefundNo) == 0 {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "out_refund_no is required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if refund, ok := s.refunds[req.OutRefundNo]; ok {
+		s.writeJSON(w, http.StatusOK, s.refundContent(refund))
+		return
+	}
+	var tx *Transaction
+	for _, t := range s.transactions {
+		if (len(req.OutTradeNo) != 0 && t.OutTradeNo == req.OutTradeNo) ||
+			(len(req.TransactionId) != 0 && t.TransactionID == req.TransactionId) {
+			tx = t
+			break
+		}
+	}
+	if tx == nil {
+		s.writeError(w, http.StatusNotFound, "RESOURCE_NOT_EXISTS", "order not exist")
+		return
+	}
+	if tx.TradeState != StateSuccess && tx.TradeState != StateRefund {
+		s.writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "order not paid, trade state "+tx.TradeState)
+		return
+	}
+	if req.Amount.Total != tx.Total {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", fmt.Sprintf("amount.total %d does not match order %d", req.Amount.Total, tx.Total))
+		return
+	}
+	if req.Amount.Refund <= 0 || req.Amount.Refund > tx.Total-s.refundedLocked(tx.OutTradeNo) {
+		s.writeError(w, http.StatusForbidden, "NOT_ENOUGH", "refund amount exceeds what is left of the order")
+		return
+	}
+	refund := &Refund{
+		OutRefundNo:   req.OutRefundNo,
+		RefundID:      s.nextID("50000"),
+		OutTradeNo:    tx.OutTradeNo,
+		TransactionID: tx.TransactionID,
+		Reason:        req.Reason,
+		NotifyUrl:     req.NotifyUrl,
+		Amount:        req.Amount.Refund,
+		Total:         tx.Total,
+		Status:        RefundProcessing,
+		CreateTime:    time.Now(),
+	}
+	s.refunds[refund.OutRefundNo] = refund
+	s.writeJSON(w, http.StatusOK, s.refundContent(refund))
+}
+
+func (s *Simulator) queryRefund(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	refund, ok := s.refunds[r.PathValue("out_refund_no")]
+	var content map[string]any
+	if ok {
+		content = s.refundContent(refund)
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "RESOURCE_NOT_EXISTS", "refund not exist")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, content)
+}
+
+// CompleteRefund settles a processing refund with status SUCCESS, CLOSED or
+// ABNORMAL and sends the refund notify if the refund asked for one.
+func (s *Simulator) CompleteRefund(outRefundNo string, status string) error {
+	if status != RefundSuccess && status != RefundClosed && status != RefundAbnormal {
+		return fmt.Errorf("unexpected refund status %s", status)
+	}
+	s.mu.Lock()
+	refund, ok := s.refunds[outRefundNo]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("refund %s not exist", outRefundNo)
+	}
+	if refund.Status != RefundProcessing {
+		current := refund.Status
+		s.mu.Unlock()
+		return fmt.Errorf("refund %s already %s", outRefundNo, current)
+	}
+	refund.Status = status
+	if status == RefundSuccess {
+		refund.SuccessTime = time.Now()
+		s.transactions[refund.OutTradeNo].TradeState = StateRefund
+	}
+	content := s.refundContent(refund)
+	content["mchid"] = s.MchID
+	content["refund_status"] = status
+	notifyUrl := refund.NotifyUrl
+	s.mu.Unlock()
+	if len(notifyUrl) == 0 {
+		return nil
+	}
+	return s.SendNotify(notifyUrl, "REFUND."+status, "refund", "退款"+status, content)
+}
+
+// Refund returns a copy of the refund.
+func (s *Simulator) Refund(outRefundNo string) (Refund, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refund, ok := s.refunds[outRefundNo]
+	if !ok {
+		return Refund{}, false
+	}
+	return *refund, true
+}
+
+// refundedLocked sums the refunds of an order that have not been closed.
+func (s *Simulator) refundedLocked(outTradeNo string) int64 {
+	var refunded int64
+	for _, refund := range s.refunds {
+		if refund.OutTradeNo == outTradeNo && (refund.Status == RefundProcessing || refund.Status == RefundSuccess) {
+			refunded += refund.Amount
+		}
+	}
+	return refunded
+}
+
+// refundContent is the refund as returned by create and query.
+func (s *Simulator) refundContent(refund *Refund) map[string]any {
+	content := map[string]any{
+		"refund_id":             refund.RefundID,
+		"out_refund_no":         refund.OutRefundNo,
+		"transaction_id":        refund.TransactionID,
+		"out_trade_no":          refund.OutTradeNo,
+		"channel":               "ORIGINAL",
+		"user_received_account": "支付用户零钱",
+		"create_time":           refund.CreateTime.In(location).Format(time.RFC3339),
+		"status":                refund.Status,
+		"funds_account":         "AVAILABLE",
+		"amount": map[string]any{
+			"total":             refund.Total,
+			"refund":            refund.Amount,
+			"payer_total":       refund.Total,
+			"payer_refund":      refund.Amount,
+			"settlement_total":  refund.Total,
+			"settlement_refund": refund.Amount,
+			"discount_refund":   0,
+			"currency":          "CNY",
+		},
+	}
+	if !refund.SuccessTime.IsZero() {
+		content["success_time"] = refund.SuccessTime.In(location).Format(time.RFC3339)
+	}
+	return content
+}
@@ -0,0 +1,283 @@
+// Package simulator is a local stand-in for the wechat pay v3 apis used by
+// wx_payment, so that payment flows can be tested without network or a real
+// merchant key. It signs its responses and notifies with a generated
+// platform certificate and checks that requests are signed with a generated
+// merchant key.
+package simulator
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/wx_payment"
+	"github.com/wechatpay-apiv3/wechatpay-go/utils"
+)
+
+const (
+	apiHost    = "api.mch.weixin.qq.com"
+	authSchema = "WECHATPAY2-SHA256-RSA2048"
+)
+
+// wechat pay uses China standard time
+var location = time.FixedZone("CST", 8*3600)
+
+// Config has to match the wx_payment config the services are started with.
+// NotifyBaseUrl replaces scheme and host of the notify urls sent with
+// prepay and refund requests, so that notifies reach a local gateway.
+type Config struct {
+	AppID         string
+	MchID         string
+	APIv3Key      string
+	NotifyBaseUrl string
+}
+
+type Simulator struct {
+	Config
+	Server              *httptest.Server
+	MerchantKey         *rsa.PrivateKey
+	PlatformKey         *rsa.PrivateKey
+	PlatformCertificate *x509.Certificate
+	PlatformSerialNo    string
+
+	notifyClient *http.Client
+	mu           sync.Mutex
+	seq          int64
+	transactions map[string]*Transaction
+	refunds      map[string]*Refund
+	bills        map[string][]byte
+}
+
+// New generates the keys and starts the simulator, Close stops it.
+func New(config Config) (*Simulator, error) {
+	if len(config.APIv3Key) != 32 {
+		return nil, errors.New("apiv3 key must have 32 bytes")
+	}
+	merchantKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	platformKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := selfSignedCertificate(platformKey)
+	if err != nil {
+		return nil, err
+	}
+	s := &Simulator{
+		Config:              config,
+		MerchantKey:         merchantKey,
+		PlatformKey:         platformKey,
+		PlatformCertificate: certificate,
+		PlatformSerialNo:    utils.GetCertificateSerialNumber(*certificate),
+		notifyClient:        &http.Client{Timeout: 10 * time.Second},
+		transactions:        make(map[string]*Transaction),
+		refunds:             make(map[string]*Refund),
+		bills:               make(map[string][]byte),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v3/pay/transactions/jsapi", s.authorized(s.prepay(TradeJsapi)))
+	mux.HandleFunc("POST /v3/pay/transactions/native", s.authorized(s.prepay(TradeNative)))
+	mux.HandleFunc("POST /v3/pay/transactions/h5", s.authorized(s.prepay(TradeH5)))
+	mux.HandleFunc("GET /v3/pay/transactions/out-trade-no/{out_trade_no}", s.authorized(s.queryOrder))
+	mux.HandleFunc("POST /v3/pay/transactions/out-trade-no/{out_trade_no}/close", s.authorized(s.closeOrder))
+	mux.HandleFunc("POST /v3/refund/domestic/refunds", s.authorized(s.createRefund))
+	mux.HandleFunc("GET /v3/refund/domestic/refunds/{out_refund_no}", s.authorized(s.queryRefund))
+	mux.HandleFunc("GET /v3/bill/tradebill", s.authorized(s.tradeBill))
+	mux.HandleFunc("GET /v3/billdownload/file", s.authorized(s.downloadBill))
+	mux.HandleFunc("GET /v3/certificates", s.authorized(s.certificates))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		s.writeError(w, http.StatusNotFound, "NOT_FOUND", "simulator does not serve "+r.Method+" "+r.URL.Path)
+	})
+	s.Server = httptest.NewServer(mux)
+	return s, nil
+}
+
+func (s *Simulator) Close() {
+	s.Server.Close()
+}
+
+// Client sends requests for api.mch.weixin.qq.com to the simulator.
+func (s *Simulator) Client() *http.Client {
+	target, _ := url.Parse(s.Server.URL)
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &rewriteTransport{target: target, base: http.DefaultTransport},
+	}
+}
+
+// Options wires WxPaymentServiceInitialize to the simulator, the notify
+// service verifies with the same certificates.
+func (s *Simulator) Options() []wx_payment.Option {
+	return []wx_payment.Option{
+		wx_payment.WithHTTPClient(s.Client()),
+		wx_payment.WithMerchantKey(s.MerchantKey),
+		wx_payment.WithPlatformCertificates(s.PlatformCertificate),
+	}
+}
+
+type rewriteTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+}
+
+func (t *rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host != apiHost {
+		return t.base.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	r.Host = t.target.Host
+	return t.base.RoundTrip(r)
+}
+
+func selfSignedCertificate(key *rsa.PrivateKey) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "Tenpay.com Root CA simulator"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// authorized rejects requests that are not signed with the merchant key.
+func (s *Simulator) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err := s.verifyAuthorization(r, body); err != nil {
+			s.writeError(w, http.StatusUnauthorized, "SIGN_ERROR", err.Error())
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Simulator) verifyAuthorization(r *http.Request, body []byte) error {
+	authorization := r.Header.Get("Authorization")
+	params, ok := strings.CutPrefix(authorization, authSchema+" ")
+	if !ok {
+		return fmt.Errorf("unexpected authorization %q", authorization)
+	}
+	values := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(param, "=")
+		values[strings.TrimSpace(key)] = strings.Trim(value, `"`)
+	}
+	if values["mchid"] != s.MchID {
+		return fmt.Errorf("unexpected mchid %q", values["mchid"])
+	}
+	timestamp, err := strconv.ParseInt(values["timestamp"], 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)).Abs() > 5*time.Minute {
+		return fmt.Errorf("timestamp %q expired", values["timestamp"])
+	}
+	signature, err := base64.StdEncoding.DecodeString(values["signature"])
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), values["timestamp"], values["nonce_str"], body)
+	hashed := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(&s.MerchantKey.PublicKey, crypto.SHA256, hashed[:], signature); err != nil {
+		return errors.New("signature does not match the merchant key")
+	}
+	return nil
+}
+
+// sign adds the headers wechat signs responses and notifies with.
+func (s *Simulator) sign(header http.Header, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := randomHex(16)
+	signature, err := utils.SignSHA256WithRSA(timestamp+"\n"+nonce+"\n"+string(body)+"\n", s.PlatformKey)
+	if err != nil {
+		return err
+	}
+	header.Set("Wechatpay-Timestamp", timestamp)
+	header.Set("Wechatpay-Nonce", nonce)
+	header.Set("Wechatpay-Signature", signature)
+	header.Set("Wechatpay-Serial", s.PlatformSerialNo)
+	header.Set("Wechatpay-Signature-Type", authSchema)
+	header.Set("Request-Id", randomHex(16))
+	return nil
+}
+
+func (s *Simulator) writeJSON(w http.ResponseWriter, status int, v any) {
+	var body []byte
+	if v != nil {
+		body, _ = json.Marshal(v)
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err := s.sign(w.Header(), body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (s *Simulator) writeError(w http.ResponseWriter, status int, code string, message string) {
+	s.writeJSON(w, status, map[string]string{"code": code, "message": message})
+}
+
+// notifyUrl is where a notify for rawUrl is delivered.
+func (s *Simulator) notifyUrl(rawUrl string) (string, error) {
+	if len(s.NotifyBaseUrl) == 0 {
+		return rawUrl, nil
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	base, err := url.Parse(s.NotifyBaseUrl)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme, u.Host = base.Scheme, base.Host
+	return u.String(), nil
+}
+
+// nextID returns prefix followed by a number unique within the simulator.
+func (s *Simulator) nextID(prefix string) string {
+	s.seq++
+	return fmt.Sprintf("%s%s%010d", prefix, time.Now().In(location).Format("20060102"), s.seq)
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return strings.ToUpper(hex.EncodeToString(buf))
+}
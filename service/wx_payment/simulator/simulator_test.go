@@ -0,0 +1,193 @@
+package simulator
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pkusunjy/grpc-gateway/internal/testutil"
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/pkusunjy/grpc-gateway/service/wx_payment"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	testAppID    = "wxd678efh567hg6787"
+	testMchID    = "1230000109"
+	testAPIv3Key = "0123456789abcdef0123456789abcdef"
+	testOpenID   = "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"
+
+	editOrderStatusPath = "/utility-project/ysOrder/editOrderStatus"
+	saveCustomerPath    = "/utility-project/ysCustomer/save"
+)
+
+// writeConfig writes the config files of the payment services to a
+// temporary directory.
+func writeConfig(t *testing.T, endpoint string) wx_payment.ConfigFiles {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"wx_payment.yaml": fmt.Sprintf("wx_appid: %s\nwx_mchid: %s\nwx_mch_apiv3: %s\nwx_secret: secret\nwx_serial_no: MERCHANTSERIAL\n",
+			testAppID, testMchID, testAPIv3Key),
+		"data_platform.yaml": "endpoint: " + endpoint + "\n",
+		"products.yaml":      "products:\n  - order_type: 1\n    name: monthly\n    description: monthly\n    price: 2990\n    duration_days: 31\n",
+		"entitlement.yaml":   "policies: []\n",
+		"subscription.yaml":  "remind_days: 3\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return wx_payment.ConfigFiles{
+		Payment:      filepath.Join(dir, "wx_payment.yaml"),
+		DataPlatform: filepath.Join(dir, "data_platform.yaml"),
+		Products:     filepath.Join(dir, "products.yaml"),
+		Entitlement:  filepath.Join(dir, "entitlement.yaml"),
+		Subscription: filepath.Join(dir, "subscription.yaml"),
+	}
+}
+
+func TestPaymentFlow(t *testing.T) {
+	db := testutil.DB(t)
+	platform := testutil.NewDataPlatform(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// the gateway serves the notifies the simulator sends
+	var notify *wx_payment.NotifyServiceImpl
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		switch r.URL.Path {
+		case "/wx_payment_notify/jsapi_notify_url":
+			notify.NotifyWxPayment(&ctx, w, r)
+		case "/wx_payment_notify/refund_notify_url":
+			notify.NotifyWxRefund(&ctx, w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(gateway.Close)
+	sim, err := New(Config{AppID: testAppID, MchID: testMchID, APIv3Key: testAPIv3Key, NotifyBaseUrl: gateway.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Close)
+
+	opts := append(sim.Options(),
+		wx_payment.WithConfigFiles(writeConfig(t, strings.TrimPrefix(platform.URL, "http://"))),
+		wx_payment.WithDB(db),
+		wx_payment.WithRedis(redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})),
+	)
+	payment, err := wx_payment.WxPaymentServiceInitialize(&ctx, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notify, err = wx_payment.NotifyServiceInitialize(&ctx, payment); err != nil {
+		t.Fatal(err)
+	}
+
+	// prepay
+	userCtx := common.ContextWithCaller(ctx, common.Caller{OpenID: testOpenID, IP: "127.0.0.1"})
+	prepay, err := payment.NativePrepay(userCtx, &wx_payment.PrepayRequest{OrderType: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prepay.CodeUrl) == 0 || prepay.Amount != 2990 {
+		t.Fatalf("prepay %+v", prepay)
+	}
+
+	// pay, the notify credits the order and the outbox upgrades the user
+	if err := sim.Pay(prepay.OutTradeNo); err != nil {
+		t.Fatal(err)
+	}
+	history, err := payment.OrderHistory(ctx, &wx_payment.OrderHistoryRequest{OutTradeNo: prepay.OutTradeNo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Order.State != wx_payment.OrderPaid {
+		t.Fatalf("order after payment %+v", history.Order)
+	}
+	platform.WaitFor(t, editOrderStatusPath, prepay.OutTradeNo)
+	platform.WaitFor(t, saveCustomerPath, `"memberType":"1"`)
+
+	// refund, the notify settles it and the membership ends
+	refund, err := payment.CreateRefund(ctx, &wx_payment.CreateRefundRequest{OutTradeNo: prepay.OutTradeNo, Reason: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.Order.State != wx_payment.OrderRefunding {
+		t.Fatalf("order during refund %+v", refund.Order)
+	}
+	if err := sim.CompleteRefund(refund.Refund.OutRefundNo, RefundSuccess); err != nil {
+		t.Fatal(err)
+	}
+	history, err = payment.OrderHistory(ctx, &wx_payment.OrderHistoryRequest{OutTradeNo: prepay.OutTradeNo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Order.State != wx_payment.OrderRefunded {
+		t.Fatalf("order after refund %+v", history.Order)
+	}
+	platform.WaitFor(t, saveCustomerPath, `"memberType":"0"`)
+}
+
+func TestCertificatesInPublicKeyMode(t *testing.T) {
+	db := testutil.DB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	sim, err := New(Config{AppID: testAppID, MchID: testMchID, APIv3Key: testAPIv3Key, NotifyBaseUrl: "http://127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Close)
+
+	// the merchant switched to the public key, wechat still lists certificates
+	files := writeConfig(t, "127.0.0.1:1")
+	publicKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&publicKey.PublicKey)
+	publicKeyPath := filepath.Join(t.TempDir(), "pub_key.pem")
+	if err := os.WriteFile(publicKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, _ := os.ReadFile(files.Payment)
+	config = append(config, fmt.Sprintf("wx_public_key_id: PUB_KEY_ID_TEST\nwx_public_key_path: %s\n", publicKeyPath)...)
+	if err := os.WriteFile(files.Payment, config, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	payment, err := wx_payment.WxPaymentServiceInitialize(&ctx, nil,
+		wx_payment.WithHTTPClient(sim.Client()),
+		wx_payment.WithMerchantKey(sim.MerchantKey),
+		wx_payment.WithConfigFiles(files),
+		wx_payment.WithDB(db),
+		wx_payment.WithRedis(redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := payment.Certs.Health()
+	if health.Mode != "public_key" || len(health.Certificates) != 1 || health.Certificates[0].SerialNo != sim.PlatformSerialNo {
+		t.Fatalf("health in public key mode %+v", health)
+	}
+
+	// the public health check tells nothing but the state
+	w := httptest.NewRecorder()
+	payment.CertHealth(w, httptest.NewRequest(http.MethodGet, "/wx_payment/cert_health", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"healthy":true}` {
+		t.Fatalf("cert health %d %s", w.Code, w.Body)
+	}
+}
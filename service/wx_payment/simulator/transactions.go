@@ -0,0 +1,256 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	TradeJsapi  = "JSAPI"
+	TradeNative = "NATIVE"
+	TradeH5     = "MWEB"
+
+	StateNotPay     = "NOTPAY"
+	StateSuccess    = "SUCCESS"
+	StateClosed     = "CLOSED"
+	StateRefund     = "REFUND"
+	StateUserPaying = "USERPAYING"
+	StatePayError   = "PAYERROR"
+	StateRevoked    = "REVOKED"
+)
+
+// Transaction is an order as the simulator sees it.
+type Transaction struct {
+	TradeType     string
+	OutTradeNo    string
+	TransactionID string
+	PrepayID      string
+	OpenID        string
+	Description   string
+	Attach        string
+	NotifyUrl     string
+	Total         int64
+	TradeState    string
+	CreateTime    time.Time
+	SuccessTime   time.Time
+}
+
+type prepayRequest struct {
+	Appid       string `json:"appid"`
+	Mchid       string `json:"mchid"`
+	Description string `json:"description"`
+	OutTradeNo  string `json:"out_trade_no"`
+	Attach      string `json:"attach"`
+	NotifyUrl   string `json:"notify_url"`
+	Amount      struct {
+		Total int64 `json:"total"`
+	} `json:"amount"`
+	Payer *struct {
+		Openid string `json:"openid"`
+	} `json:"payer"`
+	SceneInfo *struct {
+		PayerClientIp string `json:"payer_client_ip"`
+	} `json:"scene_info"`
+}
+
+func (s *Simulator) prepay(tradeType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req prepayRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", err.Error())
+			return
+		}
+		switch {
+		case req.Appid != s.AppID:
+			s.writeError(w, http.StatusBadRequest, "APPID_MCHID_NOT_MATCH", "appid "+req.Appid)
+			return
+		case req.Mchid != s.MchID:
+			s.writeError(w, http.StatusBadRequest, "APPID_MCHID_NOT_MATCH", "mchid "+req.Mchid)
+			return
+		case len(req.OutTradeNo) == 0 || len(req.Description) == 0 || len(req.NotifyUrl) == 0:
+			s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "out_trade_no, description and notify_url are required")
+			return
+		case req.Amount.Total <= 0:
+			s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "amount.total must be positive")
+			return
+		case tradeType == TradeJsapi && (req.Payer == nil || len(req.Payer.Openid) == 0):
+			s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "payer.openid is required")
+			return
+		case tradeType == TradeH5 && (req.SceneInfo == nil || len(req.SceneInfo.PayerClientIp) == 0):
+			s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "scene_info.payer_client_ip is required")
+			return
+		}
+
+		s.mu.Lock()
+		tx, ok := s.transactions[req.OutTradeNo]
+		if ok && (tx.TradeType != tradeType || tx.Total != req.Amount.Total) {
+			s.mu.Unlock()
+			s.writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "out_trade_no already used with other parameters")
+			return
+		}
+		if ok && tx.TradeState != StateNotPay {
+			state := tx.TradeState
+			s.mu.Unlock()
+			code := "ORDERPAID"
+			if state == StateClosed {
+				code = "ORDER_CLOSED"
+			}
+			s.writeError(w, http.StatusBadRequest, code, "trade state "+state)
+			return
+		}
+		if !ok {
+			tx = &Transaction{
+				TradeType:   tradeType,
+				OutTradeNo:  req.OutTradeNo,
+				PrepayID:    s.nextID("wx"),
+				Description: req.Description,
+				Attach:      req.Attach,
+				NotifyUrl:   req.NotifyUrl,
+				Total:       req.Amount.Total,
+				TradeState:  StateNotPay,
+				CreateTime:  time.Now(),
+			}
+			if req.Payer != nil {
+				tx.OpenID = req.Payer.Openid
+			}
+			s.transactions[req.OutTradeNo] = tx
+		}
+		prepayID := tx.PrepayID
+		s.mu.Unlock()
+
+		switch tradeType {
+		case TradeNative:
+			s.writeJSON(w, http.StatusOK, map[string]string{"code_url": "weixin://wxpay/bizpayurl?pr=" + prepayID})
+		case TradeH5:
+			s.writeJSON(w, http.StatusOK, map[string]string{"h5_url": "https://wx.tenpay.com/cgi-bin/mmpayweb-bin/checkmweb?prepay_id=" + prepayID})
+		default:
+			s.writeJSON(w, http.StatusOK, map[string]string{"prepay_id": prepayID})
+		}
+	}
+}
+
+func (s *Simulator) queryOrder(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("mchid") != s.MchID {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "mchid "+r.URL.Query().Get("mchid"))
+		return
+	}
+	s.mu.Lock()
+	tx, ok := s.transactions[r.PathValue("out_trade_no")]
+	var content map[string]any
+	if ok {
+		content = s.transactionContent(tx)
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "ORDER_NOT_EXIST", "order not exist")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, content)
+}
+
+func (s *Simulator) closeOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mchid string `json:"mchid"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Mchid != s.MchID {
+		s.writeError(w, http.StatusBadRequest, "PARAM_ERROR", "mchid "+req.Mchid)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, ok := s.transactions[r.PathValue("out_trade_no")]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "ORDER_NOT_EXIST", "order not exist")
+		return
+	}
+	switch tx.TradeState {
+	case StateSuccess, StateRefund:
+		s.writeError(w, http.StatusBadRequest, "ORDERPAID", "order paid")
+		return
+	case StateNotPay, StateUserPaying, StatePayError:
+		tx.TradeState = StateClosed
+	}
+	s.writeJSON(w, http.StatusNoContent, nil)
+}
+
+// Pay completes a prepaid order as if the user paid it and sends the
+// payment notify, it fails if the notify is not acknowledged.
+func (s *Simulator) Pay(outTradeNo string) error {
+	s.mu.Lock()
+	tx, ok := s.transactions[outTradeNo]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("order %s not prepaid", outTradeNo)
+	}
+	if tx.TradeState != StateNotPay && tx.TradeState != StateUserPaying {
+		state := tx.TradeState
+		s.mu.Unlock()
+		return fmt.Errorf("order %s cannot be paid in state %s", outTradeNo, state)
+	}
+	tx.TradeState = StateSuccess
+	tx.TransactionID = s.nextID("42000")
+	tx.SuccessTime = time.Now()
+	if len(tx.OpenID) == 0 {
+		tx.OpenID = "o" + randomHex(14)
+	}
+	content := s.transactionContent(tx)
+	notifyUrl := tx.NotifyUrl
+	s.mu.Unlock()
+	return s.SendNotify(notifyUrl, "TRANSACTION.SUCCESS", "transaction", "支付成功", content)
+}
+
+// SetTradeState changes the state of an order without notifying, e.g. to
+// leave a paid order for reconcile to find.
+func (s *Simulator) SetTradeState(outTradeNo string, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, ok := s.transactions[outTradeNo]
+	if !ok {
+		return fmt.Errorf("order %s not prepaid", outTradeNo)
+	}
+	tx.TradeState = state
+	if state == StateSuccess && len(tx.TransactionID) == 0 {
+		tx.TransactionID = s.nextID("42000")
+		tx.SuccessTime = time.Now()
+	}
+	return nil
+}
+
+// Transaction returns a copy of the order.
+func (s *Simulator) Transaction(outTradeNo string) (Transaction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, ok := s.transactions[outTradeNo]
+	if !ok {
+		return Transaction{}, false
+	}
+	return *tx, true
+}
+
+// transactionContent is the order as returned by query and payment notifies.
+func (s *Simulator) transactionContent(tx *Transaction) map[string]any {
+	content := map[string]any{
+		"appid":            s.AppID,
+		"mchid":            s.MchID,
+		"out_trade_no":     tx.OutTradeNo,
+		"trade_type":       tx.TradeType,
+		"trade_state":      tx.TradeState,
+		"trade_state_desc": tx.TradeState,
+		"attach":           tx.Attach,
+		"amount": map[string]any{
+			"total":          tx.Total,
+			"currency":       "CNY",
+			"payer_currency": "CNY",
+		},
+	}
+	if len(tx.TransactionID) != 0 {
+		content["transaction_id"] = tx.TransactionID
+		content["bank_type"] = "OTHERS"
+		content["success_time"] = tx.SuccessTime.In(location).Format(time.RFC3339)
+		content["payer"] = map[string]string{"openid": tx.OpenID}
+		content["amount"].(map[string]any)["payer_total"] = tx.Total
+	}
+	return content
+}
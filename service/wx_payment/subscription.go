@@ -0,0 +1,470 @@
+package wx_payment
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/pkusunjy/grpc-gateway/service/platform"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/status"
+)
+
+type SubscriptionStatus string
+
+const (
+	SubscriptionActive SubscriptionStatus = "active"
+	// the period ended without a renewal
+	SubscriptionLapsed SubscriptionStatus = "lapsed"
+	// the orders paying the period were refunded
+	SubscriptionCancelled SubscriptionStatus = "cancelled"
+)
+
+type RenewalState string
+
+const (
+	RenewalNone     RenewalState = "none"
+	RenewalReminded RenewalState = "reminded"
+	// the user does not want renewal reminders
+	RenewalOff RenewalState = "off"
+
+	subscriptionBatchSize = 100
+)
+
+var ErrSubscriptionNotFound = errors.New("subscription not found")
+
+// Subscription is the membership of a user. Every paid membership order
+// renews it: the period is extended from its current end if it is still
+// running, otherwise a new period starts. Times are unix seconds.
+type Subscription struct {
+	OpenID             string             `json:"openid"`
+	Plan               int32              `json:"plan"`
+	Status             SubscriptionStatus `json:"status"`
+	RenewalState       RenewalState       `json:"renewal_state"`
+	StartedAt          int64              `json:"started_at"`
+	CurrentPeriodStart int64              `json:"current_period_start"`
+	CurrentPeriodEnd   int64              `json:"current_period_end"`
+	LastOutTradeNo     string             `json:"last_out_trade_no"`
+	RemindedAt         int64              `json:"reminded_at,omitempty"`
+	CreatedAt          int64              `json:"created_at"`
+	UpdatedAt          int64              `json:"updated_at"`
+}
+
+var subscriptionTables = []string{
+	`CREATE TABLE IF NOT EXISTS gateway_subscription (
+		openid VARCHAR(64) NOT NULL PRIMARY KEY,
+		plan INT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		renewal_state VARCHAR(16) NOT NULL,
+		started_at BIGINT NOT NULL,
+		current_period_start BIGINT NOT NULL,
+		current_period_end BIGINT NOT NULL,
+		last_out_trade_no VARCHAR(64) NOT NULL,
+		reminded_at BIGINT NOT NULL DEFAULT 0,
+		created_at BIGINT NOT NULL,
+		updated_at BIGINT NOT NULL,
+		KEY idx_status_period_end (status, current_period_end)
+	)`,
+}
+
+type SubscriptionStore struct {
+	db *sql.DB
+}
+
+func NewSubscriptionStore(ctx context.Context, db *sql.DB) (*SubscriptionStore, error) {
+	for _, ddl := range subscriptionTables {
+		if _, err := db.ExecContext(ctx, ddl); err != nil {
+			grpclog.Errorf("create subscription table failed error: %v", err)
+			return nil, err
+		}
+	}
+	return &SubscriptionStore{db: db}, nil
+}
+
+func (s *SubscriptionStore) Get(ctx context.Context, openid string) (*Subscription, error) {
+	return scanSubscription(s.db.QueryRowContext(ctx, selectSubscription+" WHERE openid = ?;", openid))
+}
+
+// RenewTx extends the subscription of the order's user by days inside tx,
+// creating it on the first order. A first period starts from validUntil if
+// the user is a member until then.
+func (s *SubscriptionStore) RenewTx(ctx context.Context, tx *sql.Tx, order *Order, days int32, validUntil int64) (*Subscription, error) {
+	now := time.Now().Unix()
+	period := int64(days) * 86400
+	sub, err := scanSubscription(tx.QueryRowContext(ctx, selectSubscription+" WHERE openid = ? FOR UPDATE;", order.OpenID))
+	if errors.Is(err, ErrSubscriptionNotFound) {
+		sub = &Subscription{
+			OpenID:             order.OpenID,
+			Plan:               order.OrderType,
+			Status:             SubscriptionActive,
+			RenewalState:       RenewalNone,
+			StartedAt:          now,
+			CurrentPeriodStart: now,
+			CurrentPeriodEnd:   max(now, validUntil) + period,
+			LastOutTradeNo:     order.OutTradeNo,
+			CreatedAt:          now,
+			UpdatedAt:          now,
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO gateway_subscription (openid, plan, status, renewal_state, started_at, current_period_start, current_period_end,
+			last_out_trade_no, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+			sub.OpenID, sub.Plan, sub.Status, sub.RenewalState, sub.StartedAt, sub.CurrentPeriodStart, sub.CurrentPeriodEnd,
+			sub.LastOutTradeNo, sub.CreatedAt, sub.UpdatedAt)
+		if err != nil {
+			grpclog.Errorf("insert subscription of %v failed error: %v", order.OpenID, err)
+			return nil, err
+		}
+		return sub, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sub.Status == SubscriptionActive && sub.CurrentPeriodEnd > now {
+		sub.CurrentPeriodEnd += period
+	} else {
+		sub.CurrentPeriodStart = now
+		sub.CurrentPeriodEnd = now + period
+	}
+	sub.Plan = order.OrderType
+	sub.Status = SubscriptionActive
+	if sub.RenewalState != RenewalOff {
+		sub.RenewalState = RenewalNone
+	}
+	sub.RemindedAt = 0
+	sub.LastOutTradeNo = order.OutTradeNo
+	sub.UpdatedAt = now
+	return sub, s.updateTx(ctx, tx, sub)
+}
+
+// RevokeTx takes the days paid by a refunded order off the subscription, it
+// returns ErrSubscriptionNotFound for users who never had one.
+func (s *SubscriptionStore) RevokeTx(ctx context.Context, tx *sql.Tx, order *Order, days int32) (*Subscription, error) {
+	sub, err := scanSubscription(tx.QueryRowContext(ctx, selectSubscription+" WHERE openid = ? FOR UPDATE;", order.OpenID))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	sub.CurrentPeriodEnd -= int64(days) * 86400
+	if sub.CurrentPeriodEnd <= now {
+		sub.CurrentPeriodEnd = now
+		sub.Status = SubscriptionCancelled
+	}
+	sub.UpdatedAt = now
+	return sub, s.updateTx(ctx, tx, sub)
+}
+
+// SetRenewal turns renewal reminders of a user on or off. Turning them back
+// on does not remind a period twice.
+func (s *SubscriptionStore) SetRenewal(ctx context.Context, openid string, on bool) (*Subscription, error) {
+	now := time.Now().Unix()
+	var err error
+	if on {
+		_, err = s.db.ExecContext(ctx,
+			"UPDATE gateway_subscription SET renewal_state = CASE WHEN reminded_at = 0 THEN ? ELSE ? END, updated_at = ? WHERE openid = ? AND renewal_state = ?;",
+			RenewalNone, RenewalReminded, now, openid, RenewalOff)
+	} else {
+		_, err = s.db.ExecContext(ctx,
+			"UPDATE gateway_subscription SET renewal_state = ?, updated_at = ? WHERE openid = ?;",
+			RenewalOff, now, openid)
+	}
+	if err != nil {
+		grpclog.Errorf("update subscription renewal of %v failed error: %v", openid, err)
+		return nil, err
+	}
+	return s.Get(ctx, openid)
+}
+
+// ListDue returns active subscriptions ending before endsBefore that have not
+// been reminded of this period.
+func (s *SubscriptionStore) ListDue(ctx context.Context, endsBefore int64, limit int) ([]Subscription, error) {
+	return s.list(ctx, selectSubscription+" WHERE status = ? AND renewal_state = ? AND current_period_end < ? ORDER BY current_period_end LIMIT ?;",
+		SubscriptionActive, RenewalNone, endsBefore, limit)
+}
+
+// ClaimReminder marks the period reminded, it returns false when another
+// node did so first or the period changed meanwhile.
+func (s *SubscriptionStore) ClaimReminder(ctx context.Context, sub *Subscription) (bool, error) {
+	now := time.Now().Unix()
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE gateway_subscription SET renewal_state = ?, reminded_at = ?, updated_at = ? WHERE openid = ? AND renewal_state = ? AND current_period_end = ?;",
+		RenewalReminded, now, now, sub.OpenID, RenewalNone, sub.CurrentPeriodEnd)
+	if err != nil {
+		grpclog.Errorf("claim reminder of %v failed error: %v", sub.OpenID, err)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// UnclaimReminder lets the next run retry a reminder that could not be sent.
+func (s *SubscriptionStore) UnclaimReminder(ctx context.Context, sub *Subscription) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE gateway_subscription SET renewal_state = ?, reminded_at = 0 WHERE openid = ? AND renewal_state = ? AND current_period_end = ?;",
+		RenewalNone, sub.OpenID, RenewalReminded, sub.CurrentPeriodEnd)
+	if err != nil {
+		grpclog.Errorf("unclaim reminder of %v failed error: %v", sub.OpenID, err)
+	}
+	return err
+}
+
+// Lapse marks active subscriptions whose period ended before now as lapsed.
+func (s *SubscriptionStore) Lapse(ctx context.Context, now int64) (int64, error) {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE gateway_subscription SET status = ?, updated_at = ? WHERE status = ? AND current_period_end <= ?;",
+		SubscriptionLapsed, now, SubscriptionActive, now)
+	if err != nil {
+		grpclog.Errorf("lapse subscriptions failed error: %v", err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SubscriptionStore) updateTx(ctx context.Context, tx *sql.Tx, sub *Subscription) error {
+	_, err := tx.ExecContext(ctx,
+		`UPDATE gateway_subscription SET plan = ?, status = ?, renewal_state = ?, current_period_start = ?, current_period_end = ?,
+		last_out_trade_no = ?, reminded_at = ?, updated_at = ? WHERE openid = ?;`,
+		sub.Plan, sub.Status, sub.RenewalState, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.LastOutTradeNo, sub.RemindedAt,
+		sub.UpdatedAt, sub.OpenID)
+	if err != nil {
+		grpclog.Errorf("update subscription of %v failed error: %v", sub.OpenID, err)
+	}
+	return err
+}
+
+func (s *SubscriptionStore) list(ctx context.Context, query string, args ...any) ([]Subscription, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		grpclog.Errorf("query subscriptions failed error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []Subscription
+	for rows.Next() {
+		var sub Subscription
+		if err := rows.Scan(sub.fields()...); err != nil {
+			grpclog.Errorf("rows scan failed error: %v", err)
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+const selectSubscription = `SELECT openid, plan, status, renewal_state, started_at, current_period_start, current_period_end,
+	last_out_trade_no, reminded_at, created_at, updated_at FROM gateway_subscription`
+
+func (sub *Subscription) fields() []any {
+	return []any{&sub.OpenID, &sub.Plan, &sub.Status, &sub.RenewalState, &sub.StartedAt, &sub.CurrentPeriodStart,
+		&sub.CurrentPeriodEnd, &sub.LastOutTradeNo, &sub.RemindedAt, &sub.CreatedAt, &sub.UpdatedAt}
+}
+
+func scanSubscription(row *sql.Row) (*Subscription, error) {
+	var sub Subscription
+	err := row.Scan(sub.fields()...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSubscriptionNotFound
+	}
+	if err != nil {
+		grpclog.Errorf("scan subscription failed error: %v", err)
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// legacyValidUntil tells when the membership bought by the owner of
+// outTradeNo before subscriptions existed ends, only the data platform
+// knows. It is asked before the transaction renewing the subscription, so
+// that no lock is held across the http call, and is 0 for users that have a
+// subscription already.
+func (server WxPaymentServiceImpl) legacyValidUntil(ctx context.Context, outTradeNo string) int64 {
+	order, err := server.Orders.Get(ctx, outTradeNo)
+	if err != nil {
+		return 0
+	}
+	if product, ok := server.Catalog.Lookup(order.OrderType); !ok || product.DurationDays <= 0 {
+		return 0
+	}
+	if _, err := server.Subscriptions.Get(ctx, order.OpenID); !errors.Is(err, ErrSubscriptionNotFound) {
+		return 0
+	}
+	return server.memberValidUntil(order.OpenID)
+}
+
+// renewSubscriptionTx extends the membership paid by order and tells the
+// data platform the new end of the period. A new subscription starts after
+// validUntil, see legacyValidUntil. Orders of products without a duration
+// are not memberships.
+func (server WxPaymentServiceImpl) renewSubscriptionTx(ctx context.Context, tx *sql.Tx, order *Order, validUntil int64) error {
+	product, ok := server.Catalog.Lookup(order.OrderType)
+	if !ok || product.DurationDays <= 0 {
+		return nil
+	}
+	sub, err := server.Subscriptions.RenewTx(ctx, tx, order, product.DurationDays, validUntil)
+	if err != nil {
+		return err
+	}
+	grpclog.Infof("subscription of %v renewed by order %v until %v", sub.OpenID, order.OutTradeNo, sub.CurrentPeriodEnd)
+	return server.Outbox.EnqueueTx(ctx, tx, sub.OpenID, saveCustomerPath, memberParam(sub))
+}
+
+// revokeSubscriptionTx shortens the membership by the period of a refunded
+// order. Users without a subscription, or whose subscription ends with it,
+// are no members anymore: the data platform goes by the end of the
+// membership, so it is moved to now.
+func (server WxPaymentServiceImpl) revokeSubscriptionTx(ctx context.Context, tx *sql.Tx, order *Order) error {
+	var sub *Subscription
+	product, ok := server.Catalog.Lookup(order.OrderType)
+	if ok && product.DurationDays > 0 {
+		var err error
+		sub, err = server.Subscriptions.RevokeTx(ctx, tx, order, product.DurationDays)
+		if err != nil && !errors.Is(err, ErrSubscriptionNotFound) {
+			return err
+		}
+	}
+	if sub == nil || sub.Status != SubscriptionActive {
+		return server.Outbox.EnqueueTx(ctx, tx, order.OpenID, saveCustomerPath, CustomerParam{
+			MemberType: "0",
+			UserName:   order.OpenID,
+			ValidTime:  time.Now().In(billLocation).Format(datetimeLayout),
+		})
+	}
+	return server.Outbox.EnqueueTx(ctx, tx, sub.OpenID, saveCustomerPath, memberParam(sub))
+}
+
+// useTimeAndValidTimeResp is the subset of ysCustomer/queryUseTimeAndValidTime
+// that tells when a membership ends.
+type useTimeAndValidTimeResp struct {
+	Code int `json:"code"`
+	Data *struct {
+		ValidTime any `json:"validTime"`
+	} `json:"data"`
+}
+
+// memberValidUntil asks the data platform when the membership of openid
+// ends, 0 if it cannot tell.
+func (server WxPaymentServiceImpl) memberValidUntil(openid string) int64 {
+	queryUrl := fmt.Sprintf("http://%s/utility-project/ysCustomer/queryUseTimeAndValidTime?username=%s",
+		server.DataPlatformEndpoint, url.QueryEscape(openid))
+	respBody, err := platform.DoHttpGet(queryUrl)
+	if err != nil {
+		grpclog.Errorf("query valid time failed url:%v err:%v", queryUrl, err)
+		return 0
+	}
+	var resp useTimeAndValidTimeResp
+	if err := json.Unmarshal(respBody, &resp); err != nil || resp.Code != platform.CodeOK || resp.Data == nil {
+		grpclog.Errorf("unmarshal valid time failed body:%v err:%v", string(respBody), err)
+		return 0
+	}
+	var ts int64
+	switch t := resp.Data.ValidTime.(type) {
+	case float64:
+		ts = int64(t)
+	case string:
+		if n, err := strconv.ParseInt(t, 10, 64); err == nil {
+			ts = n
+		} else if parsed, err := time.ParseInLocation(datetimeLayout, t, billLocation); err == nil {
+			return parsed.Unix()
+		}
+	}
+	// milliseconds
+	if ts > 1e12 {
+		ts /= 1000
+	}
+	return ts
+}
+
+func memberParam(sub *Subscription) CustomerParam {
+	return CustomerParam{
+		MemberType: "1",
+		UserName:   sub.OpenID,
+		ValidTime:  time.Unix(sub.CurrentPeriodEnd, 0).In(billLocation).Format(datetimeLayout),
+	}
+}
+
+// RunSubscriptions reminds users of renewals and lapses ended subscriptions,
+// until ctx is done.
+func (server WxPaymentServiceImpl) RunSubscriptions(ctx context.Context) {
+	t := time.NewTicker(*subscriptionInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		now := time.Now()
+		if n, err := server.Subscriptions.Lapse(ctx, now.Unix()); err == nil && n > 0 {
+			grpclog.Infof("%v subscriptions lapsed", n)
+		}
+		server.remindRenewals(ctx, now)
+	}
+}
+
+func (server WxPaymentServiceImpl) remindRenewals(ctx context.Context, now time.Time) {
+	if !server.Reminder.Enabled() {
+		return
+	}
+	due, err := server.Subscriptions.ListDue(ctx, now.Add(server.Reminder.Ahead()).Unix(), subscriptionBatchSize)
+	if err != nil {
+		return
+	}
+	for _, sub := range due {
+		claimed, err := server.Subscriptions.ClaimReminder(ctx, &sub)
+		if err != nil || !claimed {
+			continue
+		}
+		product, _ := server.Catalog.Lookup(sub.Plan)
+		err = server.Reminder.Send(ctx, &sub, product)
+		switch {
+		case err == nil:
+			grpclog.Infof("renewal reminder sent to %v period_end:%v", sub.OpenID, sub.CurrentPeriodEnd)
+		case isReminderRefused(err):
+			// the user has not accepted the template, retrying will not help
+			grpclog.Warningf("renewal reminder to %v refused: %v", sub.OpenID, err)
+		default:
+			grpclog.Errorf("renewal reminder to %v failed error:%v", sub.OpenID, err)
+			server.Subscriptions.UnclaimReminder(ctx, &sub)
+		}
+	}
+}
+
+type SubscriptionRequest struct{}
+
+type SubscriptionResponse struct {
+	Subscription *Subscription `json:"subscription"`
+}
+
+// GetSubscription answers the subscription of the caller.
+func (server WxPaymentServiceImpl) GetSubscription(ctx context.Context, req *SubscriptionRequest) (*SubscriptionResponse, error) {
+	sub, err := server.Subscriptions.Get(ctx, common.CallerFromContext(ctx).OpenID)
+	if errors.Is(err, ErrSubscriptionNotFound) {
+		return nil, status.Errorf(codes.NotFound, "no subscription")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &SubscriptionResponse{Subscription: sub}, nil
+}
+
+type SubscriptionRenewalRequest struct {
+	Reminds bool `json:"reminds"`
+}
+
+// SetSubscriptionRenewal turns renewal reminders of the caller on or off.
+func (server WxPaymentServiceImpl) SetSubscriptionRenewal(ctx context.Context, req *SubscriptionRenewalRequest) (*SubscriptionResponse, error) {
+	sub, err := server.Subscriptions.SetRenewal(ctx, common.CallerFromContext(ctx).OpenID, req.Reminds)
+	if errors.Is(err, ErrSubscriptionNotFound) {
+		return nil, status.Errorf(codes.NotFound, "no subscription")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &SubscriptionResponse{Subscription: sub}, nil
+}
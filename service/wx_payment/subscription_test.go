@@ -0,0 +1,64 @@
+package wx_payment
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSubscriptionOfCaller(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	createTestOrder(t, server, "T1", "oUser", 1)
+	if _, _, err := server.creditPayment(ctx, &paymentCredit{TransactionID: "W1", OutTradeNo: "T1", Amount: 2990, Source: "notify"}); err != nil {
+		t.Fatal(err)
+	}
+
+	other := common.ContextWithCaller(ctx, common.Caller{OpenID: "oOther"})
+	if _, err := server.GetSubscription(other, &SubscriptionRequest{}); status.Code(err) != codes.NotFound {
+		t.Fatalf("subscription of another user = %v", err)
+	}
+	if _, err := server.SetSubscriptionRenewal(other, &SubscriptionRenewalRequest{Reminds: false}); status.Code(err) != codes.NotFound {
+		t.Fatalf("renewal of another user = %v", err)
+	}
+
+	user := common.ContextWithCaller(ctx, common.Caller{OpenID: "oUser"})
+	resp, err := server.SetSubscriptionRenewal(user, &SubscriptionRenewalRequest{Reminds: false})
+	if err != nil || resp.Subscription.OpenID != "oUser" || resp.Subscription.RenewalState != RenewalOff {
+		t.Fatalf("renewal of the caller = %+v %v", resp, err)
+	}
+	if resp, err = server.GetSubscription(user, &SubscriptionRequest{}); err != nil || resp.Subscription.LastOutTradeNo != "T1" {
+		t.Fatalf("subscription of the caller = %+v %v", resp, err)
+	}
+}
+
+func TestRenewAfterLegacyMembership(t *testing.T) {
+	server, platform := newTestPayment(t)
+	ctx := context.Background()
+	legacy := time.Now().Add(10 * 24 * time.Hour).Unix()
+	platform.SetValidTime("oUser", strconv.FormatInt(legacy*1000, 10))
+	createTestOrder(t, server, "T1", "oUser", 1)
+	createTestOrder(t, server, "T2", "oUser", 1)
+
+	if _, _, err := server.creditPayment(ctx, &paymentCredit{TransactionID: "W1", OutTradeNo: "T1", Amount: 2990, Source: "notify"}); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := server.Subscriptions.Get(ctx, "oUser")
+	if err != nil || sub.CurrentPeriodEnd != legacy+31*24*3600 {
+		t.Fatalf("subscription after the legacy membership %+v %v", sub, err)
+	}
+
+	// renewals extend the subscription, the data platform is not asked again
+	platform.SetValidTime("oUser", "0")
+	if _, _, err := server.creditPayment(ctx, &paymentCredit{TransactionID: "W2", OutTradeNo: "T2", Amount: 2990, Source: "notify"}); err != nil {
+		t.Fatal(err)
+	}
+	if sub, err = server.Subscriptions.Get(ctx, "oUser"); err != nil || sub.CurrentPeriodEnd != legacy+62*24*3600 {
+		t.Fatalf("renewed subscription %+v %v", sub, err)
+	}
+}
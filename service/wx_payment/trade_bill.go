@@ -0,0 +1,325 @@
+package wx_payment
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/grpclog"
+)
+
+const (
+	tradeBillUrl      = "https://api.mch.weixin.qq.com/v3/bill/tradebill"
+	tradeBillLockKey  = "wx_payment:trade_bill:"
+	billDateLayout    = "2006-01-02"
+	billSummaryPrefix = "总交易单数"
+
+	// header names of the trade bill columns that are reconciled
+	billColTransactionID = "微信订单号"
+	billColOutTradeNo    = "商户订单号"
+	billColTradeState    = "交易状态"
+	billColTotal         = "订单金额"
+
+	MismatchMissingLocal     = "missing_local"
+	MismatchMissingInBill    = "missing_in_bill"
+	MismatchNotPaidLocal     = "not_paid_local"
+	MismatchAmount           = "amount"
+	MismatchTransactionID    = "transaction_id"
+	billMismatchDetailMaxLen = 255
+)
+
+// wechat bills use China standard time
+var billLocation = time.FixedZone("CST", 8*3600)
+
+type tradeBillResponse struct {
+	DownloadUrl string `json:"download_url"`
+	HashType    string `json:"hash_type"`
+	HashValue   string `json:"hash_value"`
+}
+
+type tradeBillRow struct {
+	TransactionID string
+	OutTradeNo    string
+	TradeState    string
+	Amount        int64
+}
+
+// BillMismatch is a difference between the trade bill of a day and the
+// local orders.
+type BillMismatch struct {
+	BillDate      string `json:"bill_date"`
+	Kind          string `json:"kind"`
+	OutTradeNo    string `json:"out_trade_no"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	Detail        string `json:"detail,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+}
+
+var billTables = []string{
+	`CREATE TABLE IF NOT EXISTS gateway_bill_mismatch (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		bill_date VARCHAR(10) NOT NULL,
+		kind VARCHAR(32) NOT NULL,
+		out_trade_no VARCHAR(64) NOT NULL DEFAULT '',
+		transaction_id VARCHAR(64) NOT NULL DEFAULT '',
+		detail VARCHAR(255) NOT NULL DEFAULT '',
+		created_at BIGINT NOT NULL,
+		KEY idx_bill_date (bill_date)
+	)`,
+}
+
+type BillStore struct {
+	db *sql.DB
+}
+
+func NewBillStore(ctx context.Context, db *sql.DB) (*BillStore, error) {
+	for _, ddl := range billTables {
+		if _, err := db.ExecContext(ctx, ddl); err != nil {
+			grpclog.Errorf("create bill table failed error: %v", err)
+			return nil, err
+		}
+	}
+	return &BillStore{db: db}, nil
+}
+
+// Replace stores the mismatches of billDate, dropping those of an earlier run.
+func (s *BillStore) Replace(ctx context.Context, billDate string, mismatches []BillMismatch) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM gateway_bill_mismatch WHERE bill_date = ?;", billDate); err != nil {
+		grpclog.Errorf("delete bill mismatches %v failed error: %v", billDate, err)
+		return err
+	}
+	now := time.Now().Unix()
+	for _, m := range mismatches {
+		detail := m.Detail
+		if runes := []rune(detail); len(runes) > billMismatchDetailMaxLen {
+			detail = string(runes[:billMismatchDetailMaxLen])
+		}
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO gateway_bill_mismatch (bill_date, kind, out_trade_no, transaction_id, detail, created_at) VALUES (?, ?, ?, ?, ?, ?);",
+			billDate, m.Kind, m.OutTradeNo, m.TransactionID, detail, now)
+		if err != nil {
+			grpclog.Errorf("insert bill mismatch %+v failed error: %v", m, err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *BillStore) List(ctx context.Context, billDate string) ([]BillMismatch, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT bill_date, kind, out_trade_no, transaction_id, detail, created_at FROM gateway_bill_mismatch WHERE bill_date = ? ORDER BY id;",
+		billDate)
+	if err != nil {
+		grpclog.Errorf("query bill mismatches %v failed error: %v", billDate, err)
+		return nil, err
+	}
+	defer rows.Close()
+	var mismatches []BillMismatch
+	for rows.Next() {
+		var m BillMismatch
+		if err := rows.Scan(&m.BillDate, &m.Kind, &m.OutTradeNo, &m.TransactionID, &m.Detail, &m.CreatedAt); err != nil {
+			grpclog.Errorf("rows scan failed error: %v", err)
+			return nil, err
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, rows.Err()
+}
+
+// reconcileTradeBill checks the trade bill of the day before now once it is
+// available. A redis lock keeps several gateways from running it twice.
+func (server WxPaymentServiceImpl) reconcileTradeBill(ctx context.Context, now time.Time) {
+	now = now.In(billLocation)
+	if now.Hour() < *tradeBillHour {
+		return
+	}
+	billDate := now.AddDate(0, 0, -1).Format(billDateLayout)
+	lockKey := tradeBillLockKey + billDate
+	locked, err := server.RedisClient.SetNX(ctx, lockKey, now.Unix(), 48*time.Hour).Result()
+	if err != nil || !locked {
+		return
+	}
+	mismatches, err := server.ReconcileTradeBill(ctx, billDate)
+	if err != nil {
+		grpclog.Errorf("reconcile trade bill %v failed error:%v", billDate, err)
+		// try again on the next tick
+		server.RedisClient.Del(ctx, lockKey)
+		return
+	}
+	grpclog.Infof("reconcile trade bill %v found %v mismatches", billDate, len(mismatches))
+}
+
+// ReconcileTradeBill compares the successful transactions in the trade bill
+// of billDate with the orders paid that day and stores the differences.
+func (server WxPaymentServiceImpl) ReconcileTradeBill(ctx context.Context, billDate string) ([]BillMismatch, error) {
+	day, err := time.ParseInLocation(billDateLayout, billDate, billLocation)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := server.downloadTradeBill(ctx, billDate)
+	if err != nil {
+		return nil, err
+	}
+	var mismatches []BillMismatch
+	report := func(kind string, outTradeNo, transactionID string, format string, args ...any) {
+		m := BillMismatch{
+			BillDate:      billDate,
+			Kind:          kind,
+			OutTradeNo:    outTradeNo,
+			TransactionID: transactionID,
+			Detail:        fmt.Sprintf(format, args...),
+		}
+		grpclog.Errorf("trade bill %v mismatch %v out_trade_no:%v transaction_id:%v %v", billDate, kind, outTradeNo, transactionID, m.Detail)
+		mismatches = append(mismatches, m)
+	}
+	inBill := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		inBill[row.OutTradeNo] = true
+		order, err := server.Orders.Get(ctx, row.OutTradeNo)
+		if errors.Is(err, ErrOrderNotFound) {
+			report(MismatchMissingLocal, row.OutTradeNo, row.TransactionID, "amount %d", row.Amount)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case order.State != OrderPaid && order.State != OrderRefunding && order.State != OrderRefunded:
+			report(MismatchNotPaidLocal, row.OutTradeNo, row.TransactionID, "local state %s", order.State)
+		case order.Amount != row.Amount:
+			report(MismatchAmount, row.OutTradeNo, row.TransactionID, "local %d bill %d", order.Amount, row.Amount)
+		case order.TransactionID != row.TransactionID:
+			report(MismatchTransactionID, row.OutTradeNo, row.TransactionID, "local %s", order.TransactionID)
+		}
+	}
+	paid, err := server.Orders.ListPaid(ctx, day.Unix(), day.AddDate(0, 0, 1).Unix())
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range paid {
+		if !inBill[order.OutTradeNo] {
+			report(MismatchMissingInBill, order.OutTradeNo, order.TransactionID, "local state %s amount %d", order.State, order.Amount)
+		}
+	}
+	if err := server.Bills.Replace(ctx, billDate, mismatches); err != nil {
+		return nil, err
+	}
+	return mismatches, nil
+}
+
+// downloadTradeBill fetches the successful transactions of billDate. The
+// download itself is not signed by wechat, so it goes through BillClient and
+// is checked against the hash given in the bill response.
+func (server WxPaymentServiceImpl) downloadTradeBill(ctx context.Context, billDate string) ([]tradeBillRow, error) {
+	query := url.Values{}
+	query.Set("bill_date", billDate)
+	query.Set("bill_type", "SUCCESS")
+	result, err := server.WxClient.Get(ctx, tradeBillUrl+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer result.Response.Body.Close()
+	var bill tradeBillResponse
+	if err := json.NewDecoder(result.Response.Body).Decode(&bill); err != nil {
+		return nil, err
+	}
+	download, err := server.BillClient.Get(ctx, bill.DownloadUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer download.Response.Body.Close()
+	content, err := io.ReadAll(download.Response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(bill.HashType, "SHA1") {
+		sum := sha1.Sum(content)
+		if hex.EncodeToString(sum[:]) != strings.ToLower(bill.HashValue) {
+			return nil, fmt.Errorf("trade bill %s hash mismatch", billDate)
+		}
+	}
+	return parseTradeBill(content)
+}
+
+// parseTradeBill reads the csv trade bill, where every value is prefixed with
+// a backtick and the transactions are followed by a summary. Columns are
+// found by their header since they differ between bill types.
+func parseTradeBill(content []byte) ([]tradeBillRow, error) {
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(content), "\ufeff")))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("empty trade bill")
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[billValue(name)] = i
+	}
+	index := make(map[string]int)
+	for _, name := range []string{billColTransactionID, billColOutTradeNo, billColTradeState, billColTotal} {
+		i, ok := columns[name]
+		if !ok {
+			return nil, fmt.Errorf("trade bill has no column %s", name)
+		}
+		index[name] = i
+	}
+	var rows []tradeBillRow
+	for i, record := range records[1:] {
+		if len(record) > 0 && strings.HasPrefix(billValue(record[0]), billSummaryPrefix) {
+			break
+		}
+		value := func(name string) string {
+			if index[name] >= len(record) {
+				return ""
+			}
+			return billValue(record[index[name]])
+		}
+		amount, err := yuanToFen(value(billColTotal))
+		if err != nil {
+			return nil, fmt.Errorf("trade bill line %d: %w", i+2, err)
+		}
+		rows = append(rows, tradeBillRow{
+			TransactionID: value(billColTransactionID),
+			OutTradeNo:    value(billColOutTradeNo),
+			TradeState:    value(billColTradeState),
+			Amount:        amount,
+		})
+	}
+	return rows, nil
+}
+
+func billValue(v string) string {
+	return strings.TrimPrefix(strings.TrimSpace(v), "`")
+}
+
+// yuanToFen converts an amount such as "12.30" without going through floats.
+func yuanToFen(v string) (int64, error) {
+	yuan, cents, _ := strings.Cut(v, ".")
+	if len(cents) > 2 {
+		return 0, fmt.Errorf("invalid amount %q", v)
+	}
+	cents += strings.Repeat("0", 2-len(cents))
+	n, err := strconv.ParseInt(yuan+cents, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", v)
+	}
+	return n, nil
+}
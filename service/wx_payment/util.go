@@ -14,6 +14,8 @@ type CustomerParam struct {
 	Nickname    string `json:"nickName,omitempty"`
 	PhoneNumber string `json:"phoneNumber,omitempty"`
 	UserName    string `json:"username,omitempty"`
+	// end of the membership, "2006-01-02 15:04:05" in China standard time
+	ValidTime string `json:"validTime,omitempty"`
 }
 
 type OrderParam struct {
@@ -43,3 +45,17 @@ func GenRandomStr() (*string, error) {
 	res := ss.String()
 	return &res, nil
 }
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func int64Value(n *int64) int64 {
+	if n == nil {
+		return 0
+	}
+	return *n
+}
@@ -3,18 +3,24 @@ package wx_payment
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/pkusunjy/grpc-gateway/service/common"
 	"github.com/pkusunjy/grpc-gateway/service/platform"
 	"github.com/pkusunjy/openai-server-proto/wx_payment"
 	"github.com/redis/go-redis/v9"
 	"github.com/wechatpay-apiv3/wechatpay-go/core"
-	"github.com/wechatpay-apiv3/wechatpay-go/core/option"
 	"github.com/wechatpay-apiv3/wechatpay-go/services/payments/jsapi"
-	"github.com/wechatpay-apiv3/wechatpay-go/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"gopkg.in/yaml.v3"
 )
 
@@ -24,60 +30,141 @@ type WxPaymentServiceImpl struct {
 	WxMchID              string `yaml:"wx_mchid"`
 	WxMchAPIv3Key        string `yaml:"wx_mch_apiv3"`
 	WxSecret             string `yaml:"wx_secret"`
-	WxSerialNo           string `yaml:"wx_serial_no"`
 	RedisClient          *redis.Client
+	Certs                *CertManager
 	WxClient             *core.Client
+	BillClient           *core.Client
 	Platform             *platform.PlatformService
+	Orders               *OrderStore
+	Outbox               *Outbox
+	Refunds              *RefundStore
+	Notifies             *NotifyStore
+	Bills                *BillStore
+	Catalog              *Catalog
+	Coupons              *CouponStore
+	Policies             []EntitlementPolicy
+	Subscriptions        *SubscriptionStore
+	Reminder             *RenewalReminder
 	wx_payment.UnimplementedWxPaymentServiceServer
 }
 
-func WxPaymentServiceInitialize(ctx *context.Context, platform *platform.PlatformService) (*WxPaymentServiceImpl, error) {
+// WxPaymentServiceInitialize loads the payment config and connects to
+// wechat, opts are for tests running against the simulator. Errors are
+// returned for the caller to give up on.
+func WxPaymentServiceInitialize(ctx *context.Context, platform *platform.PlatformService, opts ...Option) (*WxPaymentServiceImpl, error) {
+	o := newOptions(opts)
 	// load keys
-	content, err := os.ReadFile(*authFile)
+	content, err := os.ReadFile(o.files.Payment)
 	if err != nil {
-		grpclog.Fatal(err)
+		grpclog.Errorf("read payment config failed error: %v", err)
 		return nil, err
 	}
 	server := WxPaymentServiceImpl{}
 	err = yaml.Unmarshal(content, &server)
 	if err != nil {
-		grpclog.Fatal(err)
+		grpclog.Errorf("unmarshal payment config failed error: %v", err)
 		return nil, err
 	}
-	// init wx client
-	mchPrivateKey, err := utils.LoadPrivateKeyWithPath(*apiClientKeyPath)
+	// init wx client, both clients sign and verify through Certs
+	server.Certs, err = NewCertManager(*ctx, server.WxMchID, server.WxMchAPIv3Key, o)
 	if err != nil {
-		grpclog.Fatal("load merchant private key error: ", err)
+		grpclog.Errorf("new wechat pay cert manager error: %v", err)
 		return nil, err
 	}
-	wxClient, err := core.NewClient(
-		*ctx,
-		option.WithWechatPayAutoAuthCipher(server.WxMchID, server.WxSerialNo, mchPrivateKey, server.WxMchAPIv3Key),
-	)
+	wxClient, err := core.NewClient(*ctx, server.Certs.clientOptions()...)
+	if err != nil {
+		grpclog.Errorf("new wechat pay client error: %v", err)
+		return nil, err
+	}
+	// bill downloads are not signed by wechat
+	billClient, err := core.NewClient(*ctx, server.Certs.billClientOptions()...)
 	if err != nil {
-		grpclog.Fatal("new wechat pay client error: ", err)
+		grpclog.Errorf("new wechat pay bill client error: %v", err)
 		return nil, err
 	}
 	// load data_platform file
-	content, err = os.ReadFile(*dataPlatformFile)
+	content, err = os.ReadFile(o.files.DataPlatform)
 	if err != nil {
-		grpclog.Fatal(err)
+		grpclog.Errorf("read data platform config failed error: %v", err)
 		return nil, err
 	}
 	err = yaml.Unmarshal(content, &server)
 	if err != nil {
-		grpclog.Fatal(err)
+		grpclog.Errorf("unmarshal data platform config failed error: %v", err)
 		return nil, err
 	}
 	// init redis client
-	server.RedisClient = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
+	server.RedisClient = o.redisClient
+	if server.RedisClient == nil {
+		server.RedisClient = redis.NewClient(&redis.Options{
+			Addr:     "localhost:6379",
+			Password: "",
+			DB:       0,
+		})
+	}
+
+	db := o.db
+	if db == nil {
+		db = platform.DB()
+	}
+	server.Orders, err = NewOrderStore(*ctx, db)
+	if err != nil {
+		grpclog.Errorf("new order store error: %v", err)
+		return nil, err
+	}
+	server.Outbox, err = NewOutbox(*ctx, db, server.DataPlatformEndpoint)
+	if err != nil {
+		grpclog.Errorf("new outbox error: %v", err)
+		return nil, err
+	}
+	server.Refunds, err = NewRefundStore(*ctx, db)
+	if err != nil {
+		grpclog.Errorf("new refund store error: %v", err)
+		return nil, err
+	}
+	server.Notifies, err = NewNotifyStore(*ctx, db)
+	if err != nil {
+		grpclog.Errorf("new notify store error: %v", err)
+		return nil, err
+	}
+	server.Bills, err = NewBillStore(*ctx, db)
+	if err != nil {
+		grpclog.Errorf("new bill store error: %v", err)
+		return nil, err
+	}
+	server.Coupons, err = NewCouponStore(*ctx, db, server.Orders)
+	if err != nil {
+		grpclog.Errorf("new coupon store error: %v", err)
+		return nil, err
+	}
+	server.Policies, err = LoadEntitlementPolicies(o.files.Entitlement, platform, server.Orders)
+	if err != nil {
+		grpclog.Errorf("load entitlement policies error: %v", err)
+		return nil, err
+	}
+	server.Catalog, err = NewCatalog(*ctx, o.files.Products, server.DataPlatformEndpoint)
+	if err != nil {
+		grpclog.Errorf("new product catalog error: %v", err)
+		return nil, err
+	}
+	server.Subscriptions, err = NewSubscriptionStore(*ctx, db)
+	if err != nil {
+		grpclog.Errorf("new subscription store error: %v", err)
+		return nil, err
+	}
+	server.Reminder, err = NewRenewalReminder(o.files.Subscription, server.WxAppID, server.WxSecret, server.RedisClient)
+	if err != nil {
+		grpclog.Errorf("new renewal reminder error: %v", err)
+		return nil, err
+	}
 
 	server.WxClient = wxClient
+	server.BillClient = billClient
 	server.Platform = platform
+	go server.Outbox.Run(*ctx)
+	go server.Certs.Run(*ctx)
+	go server.RunReconcile(*ctx)
+	go server.RunSubscriptions(*ctx)
 	return &server, nil
 }
 
@@ -85,7 +172,94 @@ func (server WxPaymentServiceImpl) Jsapi(ctx context.Context, req *wx_payment.Js
 	reqJson, _ := json.Marshal(req)
 	grpclog.Infof("jsapi received request: %v", string(reqJson))
 
-	openid := req.GetOpenid()
+	// the body openid is what older clients send, only the caller is believed
+	openid := common.CallerFromContext(ctx).OpenID
+	if len(openid) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "session token required")
+	}
+	if len(req.GetOpenid()) != 0 && req.GetOpenid() != openid {
+		grpclog.Warningf("jsapi body openid:%v does not match caller:%v", req.GetOpenid(), openid)
+		return nil, status.Error(codes.PermissionDenied, "openid does not match the caller")
+	}
+	debug_str := fmt.Sprintf("[frontend_debug] openid:%v ", openid)
+	placed, err := server.placeOrder(ctx, ChannelJsapi, openid, req.DataPlatformOrderType, int64(req.GetAmount()), couponCode(ctx))
+	if err != nil {
+		grpclog.Errorf("%v place order failed error:%v", debug_str, err)
+		return nil, err
+	}
+	order := placed.Order
+
+	resp := wx_payment.JsApiResponse{}
+	// Granted orders need no payment, so no notify will be called.
+	// The client tells them apart by the Grpc-Metadata-Granted-By header and the empty JsApiResponse.
+	if placed.GrantedBy != nil {
+		grpc.SetHeader(ctx, metadata.Pairs(grantedByMetadataKey, placed.GrantedBy.Name(), chargedAmountMetadataKey, "0"))
+		return &resp, nil
+	}
+
+	// Create prepay_id
+	svc := jsapi.JsapiApiService{Client: server.WxClient}
+	prepayResp, _, err := svc.PrepayWithRequestPayment(ctx,
+		jsapi.PrepayRequest{
+			Appid:       &server.WxAppID,
+			Mchid:       &server.WxMchID,
+			Description: core.String(placed.Product.Description),
+			OutTradeNo:  core.String(order.OutTradeNo),
+			Attach:      core.String(jsapiAttach),
+			NotifyUrl:   core.String(*notifyUrl),
+			Amount: &jsapi.Amount{
+				Total: core.Int64(order.Amount),
+			},
+			Payer: &jsapi.Payer{
+				Openid: core.String(openid),
+			},
+		},
+	)
+	if err != nil {
+		grpclog.Errorf("%v call PrepayWithRequestPayment failed error:%v", debug_str, err)
+		server.prepayFailed(ctx, order.OutTradeNo, err)
+		return nil, err
+	} else {
+		grpclog.Infof("%v call PrepayWithRequestPayment success", debug_str)
+	}
+	server.prepaidOrder(ctx, order.OutTradeNo, "prepay_id="+*prepayResp.PrepayId)
+	resp = wx_payment.JsApiResponse{
+		Timestamp: *prepayResp.TimeStamp,
+		NonceStr:  *prepayResp.NonceStr,
+		Package:   "prepay_id=" + *prepayResp.PrepayId,
+		SignType:  *prepayResp.SignType,
+		PaySign:   *prepayResp.PaySign,
+	}
+	respJson, _ := json.Marshal(&resp)
+	grpclog.Infof("%v PrepayWithRequestPayment return response: %v", debug_str, string(respJson))
+	grpc.SetHeader(ctx, metadata.Pairs(chargedAmountMetadataKey, strconv.FormatInt(order.Amount, 10)))
+
+	return &resp, nil
+}
+
+// placedOrder is an order stored locally and at the data platform. It still
+// has to be paid through its channel unless GrantedBy is set.
+type placedOrder struct {
+	Order     *Order
+	Product   Product
+	GrantedBy EntitlementPolicy
+}
+
+// placeOrder does what every payment channel needs before prepay: it prices
+// the order from the catalog and the coupon, stores it, tells the data
+// platform about it and grants it if an entitlement policy says so.
+func (server WxPaymentServiceImpl) placeOrder(ctx context.Context, channel string, openid string, orderType int32, clientAmount int64, code string) (*placedOrder, error) {
+	debug_str := fmt.Sprintf("[frontend_debug] openid:%v channel:%v ", openid, channel)
+	if len(openid) == 0 {
+		grpclog.Errorf("%v request params invalid, received empty openid", debug_str)
+		return nil, status.Errorf(codes.InvalidArgument, "openid required")
+	}
+	// Only catalog products can be bought, createOrder decides what they cost
+	product, ok := server.Catalog.Lookup(orderType)
+	if !ok {
+		grpclog.Errorf("%v unknown order type:%v", debug_str, orderType)
+		return nil, status.Errorf(codes.InvalidArgument, "unknown order type %d", orderType)
+	}
 
 	// Add user to db
 	// From integration test results, it seems that no additional check is needed
@@ -94,7 +268,6 @@ func (server WxPaymentServiceImpl) Jsapi(ctx context.Context, req *wx_payment.Js
 		MemberType: "0",
 		UserName:   openid,
 	})
-	debug_str := fmt.Sprintf("[frontend_debug] openid:%v ", openid)
 	saveCustomerUrl := fmt.Sprintf("http://%s/utility-project/ysCustomer/save", server.DataPlatformEndpoint)
 	saveCustomerRespBody, err := platform.DoHttpPost(saveCustomerUrl, saveCustomerReqBody)
 	if err != nil {
@@ -109,10 +282,23 @@ func (server WxPaymentServiceImpl) Jsapi(ctx context.Context, req *wx_payment.Js
 		return nil, err
 	}
 
+	// Price the order and keep it locally before telling the data platform
+	order := &Order{
+		OutTradeNo: *outTradeNo,
+		OpenID:     openid,
+		OrderType:  orderType,
+		Channel:    channel,
+	}
+	err = server.createOrder(ctx, order, &product, code, clientAmount)
+	if err != nil {
+		grpclog.Errorf("%v create order failed out_trade_no:%v error:%v", debug_str, *outTradeNo, err)
+		return nil, err
+	}
+
 	// Create an order to db
 	ysOrderSaveReqBody, _ := json.Marshal(OrderParam{
 		OrderCode: *outTradeNo,
-		OrderType: req.DataPlatformOrderType,
+		OrderType: orderType,
 		UserName:  openid,
 	})
 	ysOrderSaveUrl := fmt.Sprintf("http://%s/utility-project/ysOrder/save", server.DataPlatformEndpoint)
@@ -122,97 +308,358 @@ func (server WxPaymentServiceImpl) Jsapi(ctx context.Context, req *wx_payment.Js
 	}
 	grpclog.Infof("%v save order received response:%v", debug_str, string(ysOrderSaveRespBody))
 
-	resp := wx_payment.JsApiResponse{}
-	// If openid is in whitelist, he/she doesn't need to pay, so no notify will be called.
-	// But he/she has access to functions that need payment.
-	// This is a new attribute for users, therefore a new column should be added into the MySQL user-related table.
-	// All user-related getter/setter interfaces should be added with extra logic to deal with these "special" users, if needed.
-	// It sucks.
-	if req.DataPlatformOrderType == 3 {
-		// isMember := server.RedisClient.SIsMember(ctx, "mikiai_whitelist_user", openid)
-		// if isMember == nil {
-		// 	grpclog.Errorf("error exec smembers cmd")
-		// 	return &resp, nil
-		// }
-		dbQueryData := platform.WhitelistUserData{OpenID: &openid}
-		dbQueryRes, err := server.Platform.WhitelistMySqlQuery(&ctx, &dbQueryData)
+	placed := &placedOrder{Order: order, Product: product}
+	if policy := server.grantingPolicy(ctx, order); policy != nil {
+		granted, err := server.grantOrder(ctx, *outTradeNo, policy)
 		if err != nil {
-			grpclog.Errorf("%v whitelist query openid: %v fail err:%v", debug_str, dbQueryData.OpenID, err)
-			return &resp, nil
+			grpclog.Errorf("%v order %v grant failed error:%v", debug_str, *outTradeNo, err)
+			return nil, err
 		}
-		if len(dbQueryRes) > 0 {
-			now_unix := time.Now().Unix()
-			is_free_user := true
-			if dbQueryRes[0].Status != nil {
-				is_status_valid := (*dbQueryRes[0].Status == 1)
-				if is_status_valid {
-					grpclog.Infof("%v status check pass", debug_str)
-				}
-				is_free_user = is_free_user && is_status_valid
-			}
-			if dbQueryRes[0].AddedTime != nil && dbQueryRes[0].ExpirationTime != nil {
-				is_time_valid := (*dbQueryRes[0].AddedTime < uint64(now_unix) && uint64(now_unix) < *dbQueryRes[0].ExpirationTime)
-				if is_time_valid {
-					grpclog.Infof("%v time check pass", debug_str)
-				}
-				is_free_user = is_free_user && is_time_valid
-			}
-			if is_free_user {
-				grpclog.Infof("%v is in whitelist, order_type=3", debug_str)
-				// Edit order db
-				editOrderReqBody, _ := json.Marshal(OrderParam{
-					OrderCode: *outTradeNo,
-				})
-				editOrderUrl := fmt.Sprintf("http://%s/utility-project/ysOrder/editOrderStatus", server.DataPlatformEndpoint)
-				editOrderRespBody, err := platform.DoHttpPost(editOrderUrl, editOrderReqBody)
-				if err != nil {
-					grpclog.Errorf("%v Error HttpPost, url:%v, reqBody:%v, error:%v", debug_str, editOrderUrl, string(editOrderReqBody), err)
-				}
-				grpclog.Infof("%v edit order received response:%v", debug_str, string(editOrderRespBody))
-				// Whitelist users don't need to create payment, so return an empty JsApiResponse
-				return &resp, nil
-			}
+		if granted {
+			grpclog.Infof("%v order %v granted by policy %v", debug_str, *outTradeNo, policy.Name())
+			placed.GrantedBy = policy
+		} else {
+			// taken by a concurrent order, this one is paid for
+			grpclog.Infof("%v order %v no grant of policy %v left", debug_str, *outTradeNo, policy.Name())
 		}
 	}
+	return placed, nil
+}
 
-	// Create prepay_id
-	amount := req.GetAmount()
-	if len(openid) == 0 || amount == 0 {
-		grpclog.Errorf("%v request params invalid, received openid:%v amount:%v", debug_str, openid, amount)
-		return nil, fmt.Errorf("openid: %s amount:%d", openid, amount)
+func (server WxPaymentServiceImpl) prepaidOrder(ctx context.Context, outTradeNo string, reason string) {
+	_, err := server.Orders.Transition(ctx, outTradeNo, OrderPrepaid, OrderChange{Reason: reason})
+	if err != nil {
+		grpclog.Errorf("order %v transition to prepaid failed error:%v", outTradeNo, err)
 	}
-	svc := jsapi.JsapiApiService{Client: server.WxClient}
-	prepayResp, _, err := svc.PrepayWithRequestPayment(ctx,
-		jsapi.PrepayRequest{
-			Appid:       &server.WxAppID,
-			Mchid:       &server.WxMchID,
-			Description: core.String(jsapiDescription),
-			OutTradeNo:  core.String(*outTradeNo),
-			Attach:      core.String(jsapiAttach),
-			NotifyUrl:   core.String(*notifyUrl),
-			Amount: &jsapi.Amount{
-				Total: core.Int64(int64(amount)),
-			},
-			Payer: &jsapi.Payer{
-				Openid: core.String(openid),
-			},
-		},
-	)
+}
+
+// prepayFailed fails the order when wechat refused its prepay. Other errors,
+// timeouts among them, leave it created: wechat may have taken the order, so
+// the reconcile job asks wechat about it once it expires.
+func (server WxPaymentServiceImpl) prepayFailed(ctx context.Context, outTradeNo string, err error) {
+	var apiErr *core.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode/100 != 4 {
+		return
+	}
+	_, err = server.Orders.Transition(ctx, outTradeNo, OrderFailed, OrderChange{Reason: err.Error()})
+	if err != nil {
+		grpclog.Errorf("order %v transition to failed error:%v", outTradeNo, err)
+	}
+}
+
+// createOrder prices order from product and the coupon code if any, holding
+// the coupon in the same transaction that stores the order. The amount the
+// client sent must be zero or one of the prices it may have been shown.
+func (server WxPaymentServiceImpl) createOrder(ctx context.Context, order *Order, product *Product, code string, clientAmount int64) error {
+	price := product.PriceAt(time.Now())
+	tx, err := server.Orders.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var discount int64
+	if len(code) != 0 {
+		discount, err = server.Coupons.HoldTx(ctx, tx, code, order.OpenID, product.OrderType, price, order.OutTradeNo)
+		if err != nil {
+			return err
+		}
+	}
+	order.Amount = price - discount
+	if clientAmount != 0 && clientAmount != product.Price && clientAmount != price && clientAmount != order.Amount {
+		grpclog.Errorf("order %v amount mismatch order type:%v amount:%v price:%v charged:%v",
+			order.OutTradeNo, product.OrderType, clientAmount, price, order.Amount)
+		return status.Errorf(codes.InvalidArgument, "amount %d does not match price %d of order type %d", clientAmount, order.Amount, product.OrderType)
+	}
+	if err := server.Orders.CreateTx(ctx, tx, order); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// grantOrder marks an order paid by policy without a payment and queues the
+// data platform update in the same transaction. It returns false, leaving
+// the order to be paid, when policy has no grant left for it.
+func (server WxPaymentServiceImpl) grantOrder(ctx context.Context, outTradeNo string, policy EntitlementPolicy) (bool, error) {
+	validUntil := server.legacyValidUntil(ctx, outTradeNo)
+	tx, err := server.Orders.BeginTx(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	order, err := server.Orders.LockTx(ctx, tx, outTradeNo)
+	if err != nil {
+		return false, err
+	}
+	if claiming, ok := policy.(claimingPolicy); ok {
+		claimed, err := claiming.ClaimTx(ctx, tx, order)
+		if err != nil || !claimed {
+			return false, err
+		}
+	}
+	// nothing is paid, so a coupon sent along is not used up
+	if err := server.Coupons.ReleaseTx(ctx, tx, outTradeNo); err != nil {
+		return false, err
+	}
+	order, err = server.Orders.TransitionTx(ctx, tx, outTradeNo, OrderPaid, OrderChange{Reason: grantReason(policy)})
+	if err != nil {
+		return false, err
+	}
+	if err := server.Outbox.EnqueueOrderPaidTx(ctx, tx, order); err != nil {
+		return false, err
+	}
+	if err := server.renewSubscriptionTx(ctx, tx, order, validUntil); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	server.Outbox.Kick()
+	return true, nil
+}
+
+// paymentCredit is a successful wechat transaction to be applied to its order.
+type paymentCredit struct {
+	TransactionID string
+	OutTradeNo    string
+	Amount        int64
+	Source        string
+	// unix seconds, zero when wechat did not tell
+	SuccessTime int64
+}
+
+// parseSuccessTime reads the rfc3339 success_time of a wechat transaction.
+func parseSuccessTime(successTime *string) int64 {
+	t, err := time.Parse(time.RFC3339, stringValue(successTime))
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// creditPayment marks the order of a successful transaction paid and queues
+// the data platform update, all in one transaction. Each transaction is
+// credited once no matter whether the notify or the reconcile job sees it
+// first. Transactions that cannot be credited are kept as rejected credits
+// to be refunded. It returns a notify result with its reason, errors are
+// worth a retry.
+func (server WxPaymentServiceImpl) creditPayment(ctx context.Context, credit *paymentCredit) (string, string, error) {
+	validUntil := server.legacyValidUntil(ctx, credit.OutTradeNo)
+	tx, err := server.Orders.BeginTx(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+	fresh, err := server.Notifies.MarkProcessedTx(ctx, tx, credit.TransactionID, credit.OutTradeNo)
+	if err != nil {
+		return "", "", err
+	}
+	if !fresh {
+		return notifyResultDuplicate, "", nil
+	}
+	var reason string
+	order, err := server.Orders.LockTx(ctx, tx, credit.OutTradeNo)
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		// nothing tells what the money was meant to buy
+		reason = "order not found"
+	case err != nil:
+		return "", "", err
+	case order.Amount != credit.Amount:
+		reason = fmt.Sprintf("amount mismatch order:%d %s:%d", order.Amount, credit.Source, credit.Amount)
+	case order.State == OrderPaid:
+		// a second transaction paying the same order
+		reason = fmt.Sprintf("order already paid by transaction_id:%s", order.TransactionID)
+	default:
+		successTime := credit.SuccessTime
+		if successTime == 0 {
+			grpclog.Warningf("%v %v without success_time", credit.Source, credit.OutTradeNo)
+			successTime = time.Now().Unix()
+		}
+		order, err = server.Orders.TransitionTx(ctx, tx, credit.OutTradeNo, OrderPaid, OrderChange{
+			Reason:        credit.Source,
+			TransactionID: credit.TransactionID,
+			SuccessTime:   successTime,
+		})
+		if errors.Is(err, ErrInvalidTransition) {
+			reason = err.Error()
+		} else if err != nil {
+			return "", "", err
+		}
+	}
+	if len(reason) != 0 {
+		grpclog.Errorf("%v %v transaction_id:%v amount:%v rejected: %v",
+			credit.Source, credit.OutTradeNo, credit.TransactionID, credit.Amount, reason)
+		if err := server.Notifies.RejectTx(ctx, tx, credit, reason); err != nil {
+			return "", "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return "", "", err
+		}
+		return notifyResultRejected, reason, nil
+	}
+	// edit backend order table, delivered by the outbox worker
+	if err := server.Outbox.EnqueueOrderPaidTx(ctx, tx, order); err != nil {
+		return "", "", err
+	}
+	// queued after the order status under the same key, so that the period
+	// sent last wins
+	if err := server.renewSubscriptionTx(ctx, tx, order, validUntil); err != nil {
+		return "", "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", "", err
+	}
+	server.Outbox.Kick()
+	return notifyResultProcessed, "", nil
+}
+
+type RejectedCreditsRequest struct {
+	Limit int `json:"limit,omitempty"`
+}
+
+type RejectedCreditsResponse struct {
+	Credits []RejectedCredit `json:"credits"`
+}
+
+// RejectedCredits lists the transactions paid but not credited, which are
+// to be refunded.
+func (server WxPaymentServiceImpl) RejectedCredits(ctx context.Context, req *RejectedCreditsRequest) (*RejectedCreditsResponse, error) {
+	limit := req.Limit
+	if limit == 0 {
+		limit = 100
+	}
+	credits, err := server.Notifies.Rejected(ctx, limit)
 	if err != nil {
-		grpclog.Error("%v call PrepayWithRequestPayment failed error:", debug_str, err)
 		return nil, err
-	} else {
-		grpclog.Info("%v call PrepayWithRequestPayment success", debug_str)
 	}
-	resp = wx_payment.JsApiResponse{
-		Timestamp: *prepayResp.TimeStamp,
-		NonceStr:  *prepayResp.NonceStr,
-		Package:   "prepay_id=" + *prepayResp.PrepayId,
-		SignType:  *prepayResp.SignType,
-		PaySign:   *prepayResp.PaySign,
+	return &RejectedCreditsResponse{Credits: credits}, nil
+}
+
+type OrderHistoryRequest struct {
+	OutTradeNo string `json:"out_trade_no,omitempty"`
+}
+
+type OrderHistoryResponse struct {
+	Order   *Order       `json:"order"`
+	History []OrderEvent `json:"history"`
+}
+
+func (server WxPaymentServiceImpl) OrderHistory(ctx context.Context, req *OrderHistoryRequest) (*OrderHistoryResponse, error) {
+	order, err := server.Orders.Get(ctx, req.OutTradeNo)
+	if errors.Is(err, ErrOrderNotFound) {
+		return nil, common.NewHTTPError(http.StatusNotFound, "order %s not found", req.OutTradeNo)
 	}
-	respJson, _ := json.Marshal(&resp)
-	grpclog.Infof("%v PrepayWithRequestPayment return response: %v", debug_str, string(respJson))
+	if err != nil {
+		return nil, err
+	}
+	history, err := server.Orders.History(ctx, req.OutTradeNo)
+	if err != nil {
+		return nil, err
+	}
+	return &OrderHistoryResponse{Order: order, History: history}, nil
+}
 
-	return &resp, nil
+type OutboxDeadLettersRequest struct {
+	Limit int `json:"limit,omitempty"`
+}
+
+type OutboxDeadLettersResponse struct {
+	Messages []OutboxMessage `json:"messages"`
+}
+
+func (server WxPaymentServiceImpl) OutboxDeadLetters(ctx context.Context, req *OutboxDeadLettersRequest) (*OutboxDeadLettersResponse, error) {
+	limit := req.Limit
+	if limit == 0 {
+		limit = 100
+	}
+	messages, err := server.Outbox.DeadLetters(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxDeadLettersResponse{Messages: messages}, nil
+}
+
+type OutboxReplayRequest struct {
+	ID int64 `json:"id"`
+}
+
+type OutboxReplayResponse struct {
+	Replayed int64 `json:"replayed"`
+}
+
+func (server WxPaymentServiceImpl) OutboxReplay(ctx context.Context, req *OutboxReplayRequest) (*OutboxReplayResponse, error) {
+	replayed, err := server.Outbox.Replay(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if replayed == 0 {
+		return nil, common.NewHTTPError(http.StatusNotFound, "dead letter %d not found", req.ID)
+	}
+	return &OutboxReplayResponse{Replayed: replayed}, nil
+}
+
+type BillMismatchesRequest struct {
+	BillDate string `json:"bill_date,omitempty"`
+}
+
+type BillMismatchesResponse struct {
+	Mismatches []BillMismatch `json:"mismatches"`
+}
+
+func (server WxPaymentServiceImpl) BillMismatches(ctx context.Context, req *BillMismatchesRequest) (*BillMismatchesResponse, error) {
+	mismatches, err := server.Bills.List(ctx, req.BillDate)
+	if err != nil {
+		return nil, err
+	}
+	return &BillMismatchesResponse{Mismatches: mismatches}, nil
+}
+
+// ReconcileBill reruns the trade bill reconciliation of a day on demand.
+func (server WxPaymentServiceImpl) ReconcileBill(ctx context.Context, req *BillMismatchesRequest) (*BillMismatchesResponse, error) {
+	mismatches, err := server.ReconcileTradeBill(ctx, req.BillDate)
+	if err != nil {
+		return nil, common.NewHTTPError(http.StatusBadGateway, "reconcile trade bill failed: %v", err)
+	}
+	return &BillMismatchesResponse{Mismatches: mismatches}, nil
+}
+
+type ProductsRequest struct{}
+
+type ProductsResponse struct {
+	Products []Product `json:"products"`
+}
+
+// Products lists the catalog with the prices charged right now.
+func (server WxPaymentServiceImpl) Products(ctx context.Context, req *ProductsRequest) (*ProductsResponse, error) {
+	now := time.Now()
+	products := server.Catalog.List()
+	for i := range products {
+		products[i].Price = products[i].PriceAt(now)
+	}
+	return &ProductsResponse{Products: products}, nil
+}
+
+func (server WxPaymentServiceImpl) SaveCoupon(ctx context.Context, req *Coupon) (*Coupon, error) {
+	if req.EndsAt <= req.StartsAt {
+		return nil, common.NewHTTPError(http.StatusBadRequest, "ends_at must be after starts_at")
+	}
+	if req.Kind == CouponPercent && req.Value >= 100 {
+		return nil, common.NewHTTPError(http.StatusBadRequest, "percent coupons take less than 100 percent off")
+	}
+	if err := server.Coupons.Save(ctx, req); err != nil {
+		return nil, err
+	}
+	return server.Coupons.Get(ctx, req.Code)
+}
+
+type CouponRequest struct {
+	Code string `json:"code,omitempty"`
+}
+
+func (server WxPaymentServiceImpl) GetCoupon(ctx context.Context, req *CouponRequest) (*Coupon, error) {
+	coupon, err := server.Coupons.Get(ctx, req.Code)
+	if errors.Is(err, ErrCouponNotFound) {
+		return nil, common.NewHTTPError(http.StatusNotFound, "coupon %s not found", req.Code)
+	}
+	return coupon, err
 }
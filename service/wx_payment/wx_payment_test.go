@@ -0,0 +1,155 @@
+package wx_payment
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pkusunjy/grpc-gateway/service/common"
+	"github.com/pkusunjy/openai-server-proto/wx_payment"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreditPayment(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	createTestOrder(t, server, "T1", "oUser", 1)
+
+	credit := &paymentCredit{TransactionID: "W1", OutTradeNo: "T1", Amount: 2990, Source: "notify"}
+	result, reason, err := server.creditPayment(ctx, credit)
+	if err != nil || result != notifyResultProcessed {
+		t.Fatalf("credit = %v %v %v", result, reason, err)
+	}
+	order, _ := server.Orders.Get(ctx, "T1")
+	if order.State != OrderPaid || order.TransactionID != "W1" || order.PaidAt == 0 {
+		t.Fatalf("order after credit %+v", order)
+	}
+	if paths := pendingOutbox(t, server); !slices.Equal(paths, []string{editOrderStatusPath, saveCustomerPath}) {
+		t.Fatalf("outbox %v", paths)
+	}
+	sub, err := server.Subscriptions.Get(ctx, "oUser")
+	if err != nil || sub.LastOutTradeNo != "T1" {
+		t.Fatalf("subscription %+v %v", sub, err)
+	}
+
+	// the reconcile job seeing the same transaction does nothing
+	result, _, err = server.creditPayment(ctx, &paymentCredit{TransactionID: "W1", OutTradeNo: "T1", Amount: 2990, Source: "reconcile"})
+	if err != nil || result != notifyResultDuplicate {
+		t.Fatalf("second credit = %v %v", result, err)
+	}
+	if paths := pendingOutbox(t, server); len(paths) != 2 {
+		t.Fatalf("outbox after duplicate %v", paths)
+	}
+}
+
+func TestCreditPaymentRejected(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	createTestOrder(t, server, "T1", "oUser", 1)
+	createTestOrder(t, server, "T2", "oUser", 1)
+	createTestOrder(t, server, "T3", "oUser", 1)
+	if _, _, err := server.creditPayment(ctx, &paymentCredit{TransactionID: "W2", OutTradeNo: "T2", Amount: 2990, Source: "notify"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Orders.Transition(ctx, "T3", OrderClosed, OrderChange{Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	credits := []*paymentCredit{
+		{TransactionID: "W1", OutTradeNo: "T1", Amount: 1, Source: "notify"},
+		{TransactionID: "W9", OutTradeNo: "T9", Amount: 2990, Source: "notify"},
+		{TransactionID: "W2b", OutTradeNo: "T2", Amount: 2990, Source: "notify"},
+		{TransactionID: "W3", OutTradeNo: "T3", Amount: 2990, Source: "reconcile"},
+	}
+	for _, credit := range credits {
+		result, reason, err := server.creditPayment(ctx, credit)
+		if err != nil || result != notifyResultRejected || len(reason) == 0 {
+			t.Fatalf("credit %+v = %v %q %v", credit, result, reason, err)
+		}
+		// kept processed, so a retried notify is not rejected twice
+		result, _, err = server.creditPayment(ctx, credit)
+		if err != nil || result != notifyResultDuplicate {
+			t.Fatalf("credit %+v again = %v %v", credit, result, err)
+		}
+	}
+	if order, _ := server.Orders.Get(ctx, "T1"); order.State != OrderCreated {
+		t.Fatalf("underpaid order %v", order.State)
+	}
+	if order, _ := server.Orders.Get(ctx, "T2"); order.TransactionID != "W2" {
+		t.Fatalf("order paid twice now has transaction %v", order.TransactionID)
+	}
+
+	rejected, err := server.Notifies.Rejected(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, c := range rejected {
+		ids = append(ids, c.TransactionID)
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"W1", "W2b", "W3", "W9"}) {
+		t.Fatalf("rejected credits %+v", rejected)
+	}
+}
+
+func TestCreateOrderAmount(t *testing.T) {
+	server, _ := newTestPayment(t)
+	ctx := context.Background()
+	now := time.Now()
+	product := testProducts[1]
+	product.Promotions = []Promotion{{Price: 1990, start: now.Add(-time.Hour), end: now.Add(time.Hour)}}
+
+	cases := []struct {
+		name   string
+		amount int64
+		ok     bool
+	}{
+		{"none sent", 0, true},
+		{"list price", 2990, true},
+		{"current price", 1990, true},
+		{"tampered", 1, false},
+		{"negative", -1990, false},
+	}
+	for i, c := range cases {
+		order := &Order{OutTradeNo: fmt.Sprintf("T%d", i), OpenID: "oUser", OrderType: 1, Channel: ChannelJsapi}
+		err := server.createOrder(ctx, order, &product, "", c.amount)
+		if !c.ok {
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("%s: amount %d got %v", c.name, c.amount, err)
+			}
+			if _, err := server.Orders.Get(ctx, order.OutTradeNo); err == nil {
+				t.Errorf("%s: rejected order was stored", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: amount %d got %v", c.name, c.amount, err)
+			continue
+		}
+		// the server charges the current price whatever was sent
+		if stored, err := server.Orders.Get(ctx, order.OutTradeNo); err != nil || stored.Amount != 1990 {
+			t.Errorf("%s: stored %+v %v", c.name, stored, err)
+		}
+	}
+}
+
+func TestJsapiCaller(t *testing.T) {
+	server, _ := newTestPayment(t)
+	as := func(openid string) context.Context {
+		return common.ContextWithCaller(context.Background(), common.Caller{OpenID: openid})
+	}
+	req := &wx_payment.JsApiRequest{Openid: "oVictim", DataPlatformOrderType: 1}
+	if _, err := server.Jsapi(context.Background(), req); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("jsapi without caller = %v", err)
+	}
+	if _, err := server.Jsapi(as("oUser"), req); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("jsapi for another openid = %v", err)
+	}
+	if orders, err := server.Orders.list(context.Background(), selectOrder+";"); err != nil || len(orders) != 0 {
+		t.Fatalf("orders placed %v %v", orders, err)
+	}
+}